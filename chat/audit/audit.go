@@ -0,0 +1,201 @@
+// Package audit implements a tamper-evident, append-only event log. Each
+// entry is one JSON line carrying the hash of the entry before it, so
+// editing, dropping or reordering lines breaks the chain.
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Event kinds written by the server.
+const (
+	KindRegister   = "register"
+	KindDisconnect = "disconnect"
+	KindJoin       = "join"
+	KindLeave      = "leave"
+	KindDirect     = "dm"   // metadata only, never the body
+	KindFile       = "file" // file name and size, never the contents
+)
+
+// genesis is the Prev of the first entry in a log.
+var genesis = hex.EncodeToString(make([]byte, sha256.Size))
+
+type Event struct {
+	Seq    uint64    `json:"seq"`
+	Time   time.Time `json:"time"`
+	Kind   string    `json:"kind"`
+	User   string    `json:"user"`
+	Room   string    `json:"room,omitempty"`
+	To     string    `json:"to,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+	Prev   string    `json:"prev"`
+	Hash   string    `json:"hash"`
+}
+
+// hash covers every field but Hash itself, chained onto Prev.
+func (e Event) hash() (string, error) {
+	e.Hash = ""
+	body, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(append([]byte(e.Prev), body...))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Log appends events to a file. It is safe for concurrent use.
+type Log struct {
+	mutex sync.Mutex
+	file  *os.File
+	seq   uint64
+	prev  string
+}
+
+// Open opens (or creates) the log at path and verifies the existing chain
+// so new entries continue from its tip.
+func Open(path string) (*Log, error) {
+	l := &Log{prev: genesis}
+	if f, err := os.Open(path); err == nil {
+		err = Scan(f, func(e Event) error {
+			l.seq, l.prev = e.Seq, e.Hash
+			return nil
+		})
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("existing audit log %s: %w", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	l.file = file
+	return l, nil
+}
+
+// Append fills in the sequence number and chain hashes and writes e.
+func (l *Log) Append(e Event) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	e.Seq = l.seq + 1
+	e.Prev = l.prev
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	h, err := e.hash()
+	if err != nil {
+		return err
+	}
+	e.Hash = h
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	l.seq, l.prev = e.Seq, e.Hash
+	return nil
+}
+
+func (l *Log) Close() error {
+	return l.file.Close()
+}
+
+// Scan reads a log, checking the chain as it goes, and calls fn for each
+// entry. It stops at the first broken link.
+func Scan(r io.Reader, fn func(Event) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	prev, seq := genesis, uint64(0)
+	for line := 1; scanner.Scan(); line++ {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if e.Seq != seq+1 {
+			return fmt.Errorf("line %d: sequence %d follows %d", line, e.Seq, seq)
+		}
+		if e.Prev != prev {
+			return fmt.Errorf("line %d: chain broken (prev hash does not match entry %d)", line, seq)
+		}
+		h, err := e.hash()
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if h != e.Hash {
+			return fmt.Errorf("line %d: entry %d was modified (hash mismatch)", line, e.Seq)
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+		prev, seq = e.Hash, e.Seq
+	}
+	return scanner.Err()
+}
+
+// Verify checks the chain in r and returns its last entry and how many
+// there are. Entries cut off the end leave an intact chain, so if tip is
+// set, the entry with that hash (the tip an earlier Verify returned) must
+// still be there.
+func Verify(r io.Reader, tip string) (last Event, n int, err error) {
+	seen := tip == ""
+	err = Scan(r, func(e Event) error {
+		last, n = e, n+1
+		seen = seen || e.Hash == tip
+		return nil
+	})
+	if err == nil && !seen {
+		err = fmt.Errorf("truncated: no entry has the tip hash %s", tip)
+	}
+	return last, n, err
+}
+
+// Filter selects entries for Query. Zero fields match everything.
+type Filter struct {
+	User  string // matches User or To
+	Room  string
+	Since time.Time
+	Until time.Time
+}
+
+func (f Filter) match(e Event) bool {
+	if f.User != "" && e.User != f.User && e.To != f.User {
+		return false
+	}
+	if f.Room != "" && e.Room != f.Room {
+		return false
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && e.Time.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+// Query verifies the chain and returns the entries matching f.
+func Query(r io.Reader, f Filter) ([]Event, error) {
+	var out []Event
+	err := Scan(r, func(e Event) error {
+		if f.match(e) {
+			out = append(out, e)
+		}
+		return nil
+	})
+	return out, err
+}
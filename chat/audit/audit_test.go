@@ -0,0 +1,127 @@
+package audit
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testLog writes a few events to a new log and returns its lines.
+func testLog(t *testing.T) []string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []Event{
+		{Kind: KindRegister, User: "alice"},
+		{Kind: KindJoin, User: "alice", Room: "lobby"},
+		{Kind: KindDirect, User: "alice", To: "bob"},
+		{Kind: KindDisconnect, User: "alice"},
+	} {
+		if err := l.Append(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.SplitAfter(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func verify(lines []string, tip string) (Event, int, error) {
+	return Verify(strings.NewReader(strings.Join(lines, "")), tip)
+}
+
+func TestCleanLogVerifies(t *testing.T) {
+	lines := testLog(t)
+	last, n, err := verify(lines, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 || last.Seq != 4 || last.Kind != KindDisconnect {
+		t.Fatalf("%d entries ending with %+v", n, last)
+	}
+	if _, _, err := verify(lines, last.Hash); err != nil {
+		t.Fatalf("with its own tip: %v", err)
+	}
+}
+
+func TestLogContinuesAfterReopening(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	for i := 0; i < 2; i++ {
+		l, err := Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Append(Event{Kind: KindRegister, User: "alice"}); err != nil {
+			t.Fatal(err)
+		}
+		l.Close()
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, n, err := Verify(f, ""); err != nil || n != 2 {
+		t.Fatalf("%d entries: %v", n, err)
+	}
+}
+
+func TestTamperingIsDetected(t *testing.T) {
+	lines := testLog(t)
+	last, _, _ := verify(lines, "")
+
+	swap := func(i, j int) []string {
+		out := append([]string(nil), lines...)
+		out[i], out[j] = out[j], out[i]
+		return out
+	}
+	for _, tc := range []struct {
+		what  string
+		lines []string
+		tip   string
+	}{
+		{"an edited entry", append([]string{strings.Replace(lines[0], `"alice"`, `"mallory"`, 1)}, lines[1:]...), ""},
+		{"reordered entries", swap(1, 2), ""},
+		{"the first entry dropped", lines[1:], ""},
+		{"an entry dropped from the middle", append(append([]string(nil), lines[:1]...), lines[2:]...), ""},
+		{"a torn last line", append(append([]string(nil), lines[:3]...), lines[3][:len(lines[3])/2]), ""},
+		{"the last entry dropped", lines[:3], last.Hash},
+	} {
+		if _, _, err := verify(tc.lines, tc.tip); err == nil {
+			t.Errorf("%s went unnoticed", tc.what)
+		}
+	}
+}
+
+func TestOpenRefusesATamperedLog(t *testing.T) {
+	lines := testLog(t)
+	path := filepath.Join(t.TempDir(), "audit.log")
+	lines[1], lines[2] = lines[2], lines[1]
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "")), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path); err == nil {
+		t.Fatal("opened a log with a broken chain to append to")
+	}
+}
+
+func TestQuery(t *testing.T) {
+	lines := testLog(t)
+	got, err := Query(bytes.NewReader([]byte(strings.Join(lines, ""))), Filter{User: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Kind != KindDirect {
+		t.Fatalf("bob's events: %+v, want alice's DM to bob", got)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"chat/audit"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: auditctl verify [-tip hash] <file>")
+	fmt.Fprintln(os.Stderr, "       auditctl query [-user name] [-room name] [-since time] [-until time] <file>")
+	fmt.Fprintln(os.Stderr, "times are RFC 3339, e.g. 2024-05-01T09:00:00Z")
+	os.Exit(2)
+}
+
+func parseTime(s string) time.Time {
+	if s == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		log.Fatalln("bad time:", err)
+	}
+	return t
+}
+
+func main() {
+	if len(os.Args) < 3 {
+		usage()
+	}
+
+	switch os.Args[1] {
+	case "verify":
+		fs := flag.NewFlagSet("verify", flag.ExitOnError)
+		tip := fs.String("tip", "", "fail unless the entry with this hash, the tip of an earlier verify, is still there")
+		_ = fs.Parse(os.Args[2:])
+		if fs.NArg() < 1 {
+			usage()
+		}
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer f.Close()
+		last, n, err := audit.Verify(f, *tip)
+		if err != nil {
+			log.Fatalln("verification FAILED:", err)
+		}
+		fmt.Printf("OK: %d entries, chain intact, tip %s\n", n, last.Hash)
+
+	case "query":
+		fs := flag.NewFlagSet("query", flag.ExitOnError)
+		user := fs.String("user", "", "only events by or to this user")
+		room := fs.String("room", "", "only events in this room")
+		since := fs.String("since", "", "only events at or after this time")
+		until := fs.String("until", "", "only events at or before this time")
+		_ = fs.Parse(os.Args[2:])
+		if fs.NArg() < 1 {
+			usage()
+		}
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer f.Close()
+		events, err := audit.Query(f, audit.Filter{
+			User: *user, Room: *room, Since: parseTime(*since), Until: parseTime(*until),
+		})
+		for _, e := range events {
+			fmt.Printf("%6d %s %-10s %-16s", e.Seq, e.Time.Format(time.RFC3339), e.Kind, e.User)
+			if e.Room != "" {
+				fmt.Printf(" room=%s", e.Room)
+			}
+			if e.To != "" {
+				fmt.Printf(" to=%s", e.To)
+			}
+			if e.Detail != "" {
+				fmt.Printf(" %s", e.Detail)
+			}
+			fmt.Println()
+		}
+		if err != nil {
+			log.Fatalln("verification FAILED:", err)
+		}
+
+	default:
+		usage()
+	}
+}
@@ -1,13 +1,26 @@
 package main
 
 import (
-	"bufio"
 	"chat/messages"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
+)
+
+// localUser is who we registered as, for highlighting mentions.
+var localUser string
+
+const (
+	highlightOn  = "\033[1;33m" // bold yellow
+	highlightOff = "\033[0m"
+	bell         = "\a"
 )
 
 func receiveMessage(msgHandler *messages.MessageHandler) {
@@ -20,21 +33,238 @@ func receiveMessage(msgHandler *messages.MessageHandler) {
 		switch m := w.Msg.(type) {
 		case *messages.Wrapper_ServerNotice:
 			if room := m.ServerNotice.GetRoom(); room != "" {
-				fmt.Fprintf(os.Stderr, "\r\033[K[room:%s] * %s\n", room, m.ServerNotice.GetText())
+				ui.printf("[room:%s] * %s\n", room, m.ServerNotice.GetText())
 			} else {
-				fmt.Fprintf(os.Stderr, "\r\033[K* %s\n", m.ServerNotice.GetText())
+				ui.printf("* %s\n", m.ServerNotice.GetText())
 			}
+		case *messages.Wrapper_Typing:
+			ui.startTyping(m.Typing.GetUsername())
+			continue
+		case *messages.Wrapper_FileOffer:
+			files.offered(m.FileOffer)
+		case *messages.Wrapper_FileAccept:
+			files.accepted(m.FileAccept, msgHandler)
+			continue
+		case *messages.Wrapper_FileChunk:
+			files.chunk(m.FileChunk, msgHandler)
+			continue
+		case *messages.Wrapper_FileComplete:
+			files.completed(m.FileComplete)
 		case *messages.Wrapper_RoomChat:
-			rc := m.RoomChat
-			fmt.Fprintf(os.Stderr, "\r\033[K[room:%s] <%s> %s\n",
-				rc.GetRoom(), rc.GetUsername(), rc.GetMessageBody())
+			ui.stopTyping(m.RoomChat.GetUsername())
+			seen.add(m.RoomChat)
+			printRoomChat(m.RoomChat)
+		case *messages.Wrapper_EditMessage:
+			e := m.EditMessage
+			if rc := seen.edit(e.GetMessageId(), e.GetMessageBody()); rc != nil {
+				printRoomChat(rc)
+			} else {
+				printRoomChat(&messages.RoomChat{
+					Username: e.GetUsername(), Room: e.GetRoom(), MessageId: e.GetMessageId(),
+					MessageBody: e.GetMessageBody(), Edited: true,
+				})
+			}
+		case *messages.Wrapper_MentionNotice:
+			mn := m.MentionNotice
+			if seen.get(mn.GetMessageId()) != nil {
+				continue // already shown (and highlighted) as a room message
+			}
+			ui.printf("%s[mention in %s] #%d <%s> %s%s%s\n",
+				highlightOn, mn.GetRoom(), mn.GetMessageId(), mn.GetFrom(), mn.GetMessageBody(), highlightOff, bell)
+		case *messages.Wrapper_Reaction:
+			r := m.Reaction
+			if rc := seen.react(r.GetMessageId(), r.GetEmoji(), r.GetCount()); rc != nil {
+				printRoomChat(rc)
+			} else {
+				ui.printf("[room:%s] #%d %s %d (%s)\n",
+					r.GetRoom(), r.GetMessageId(), r.GetEmoji(), r.GetCount(), r.GetUsername())
+			}
+		case *messages.Wrapper_SearchResults:
+			showSearchResults(m.SearchResults)
+		case *messages.Wrapper_CommandList:
+			showCommandList(m.CommandList)
+		case *messages.Wrapper_ThreadView:
+			tv := m.ThreadView
+			ui.printf("--- thread #%d in %s ---\n", tv.GetThreadId(), tv.GetRoom())
+			for _, rc := range tv.GetMessages() {
+				printRoomChat(rc)
+			}
+			ui.printf("--- end of thread #%d ---\n", tv.GetThreadId())
+		case *messages.Wrapper_DeleteMessage:
+			d := m.DeleteMessage
+			seen.remove(d.GetMessageId())
+			if d.GetUsername() == "" {
+				ui.printf("[room:%s] #%d expired\n", d.GetRoom(), d.GetMessageId())
+				break
+			}
+			ui.printf("[room:%s] #%d deleted by %s\n",
+				d.GetRoom(), d.GetMessageId(), d.GetUsername())
 		case *messages.Wrapper_DirectChat:
 			dc := m.DirectChat
-			fmt.Fprintf(os.Stderr, "\r\033[K[dm %s→%s] %s\n",
-				dc.GetFrom(), dc.GetTo(), dc.GetMessageBody())
+			ui.stopTyping(dc.GetFrom())
+			text := "(unencrypted) " + dc.GetMessageBody()
+			if len(dc.GetCiphertext()) > 0 {
+				body, trusted, err := keys.decrypt(dc)
+				switch {
+				case err != nil:
+					text = fmt.Sprintf("(could not decrypt: %s)", err)
+				case !trusted:
+					text = "(UNTRUSTED KEY) " + body
+				default:
+					text = body
+				}
+			}
+			dms.heard(dc.GetFrom(), dc.GetRetention())
+			ttl := time.Duration(dc.GetTtlSeconds()) * time.Second
+			dms.add(dc.GetFrom(), fmt.Sprintf("[dm %s→%s] %s", dc.GetFrom(), dc.GetTo(), text), time.Now(), ttl)
+			if ttl > 0 {
+				// /history forgets it, but the screen is out of our hands
+				text += fmt.Sprintf(" (disappears in %s)", messages.FormatDays(ttl))
+				from := dc.GetFrom()
+				time.AfterFunc(ttl, func() {
+					ui.printf("[dm %s→%s] a message from %s has expired: please don't keep a copy\n", from, localUser, from)
+					ui.prompt()
+				})
+			}
+			ui.printf("[dm %s→%s] %s\n", dc.GetFrom(), dc.GetTo(), text)
+		case *messages.Wrapper_PublishKey:
+			keys.keyArrived(m.PublishKey, localUser, msgHandler)
+			continue
+		}
+		ui.prompt()
+	}
+}
+
+// typingInterval is how often we remind the others we're still typing.
+const typingInterval = 3 * time.Second
+
+// typingNotifier turns keystrokes into Typing indicators, at most one per
+// typingInterval for the same room or user.
+type typingNotifier struct {
+	msgHandler *messages.MessageHandler
+	target     string
+	last       time.Time
+}
+
+// keyPressed is called with the input line as it was before the key.
+// Commands don't count as typing, except the ones that carry a message.
+func (tn *typingNotifier) keyPressed(line, currentRoom string) {
+	var t messages.Typing
+	if rest, ok := strings.CutPrefix(line, "/dm "); ok {
+		to, _, found := strings.Cut(strings.TrimLeft(rest, " "), " ")
+		if !found || to == "" {
+			return // still typing the recipient's name
 		}
-		fmt.Fprint(os.Stderr, "message> ")
+		t.To = to
+	} else if line == "" || (strings.HasPrefix(line, "/") && !strings.HasPrefix(line, "/reply ")) {
+		return // might be the start of a command
+	} else if currentRoom != "" {
+		t.Room = currentRoom
+	} else {
+		return
 	}
+
+	target := t.Room + "\x00" + t.To
+	if target == tn.target && time.Since(tn.last) < typingInterval {
+		return
+	}
+	tn.target, tn.last = target, time.Now()
+	_ = tn.msgHandler.Send(&messages.Wrapper{Msg: &messages.Wrapper_Typing{Typing: &t}})
+}
+
+func printRoomChat(rc *messages.RoomChat) {
+	ui.printf("%s\n", formatRoomChat(rc))
+}
+
+func formatRoomChat(rc *messages.RoomChat) string {
+	reply, suffix := "", ""
+	if rc.GetReplyTo() != 0 {
+		reply = fmt.Sprintf(" ↳#%d", rc.GetReplyTo())
+	}
+	if rc.GetEdited() {
+		suffix += " (edited)"
+	}
+	if len(rc.GetReactions()) > 0 {
+		emojis := make([]string, 0, len(rc.GetReactions()))
+		for e := range rc.GetReactions() {
+			emojis = append(emojis, e)
+		}
+		slices.Sort(emojis)
+		suffix += "  "
+		for _, e := range emojis {
+			suffix += fmt.Sprintf(" %s %d", e, rc.GetReactions()[e])
+		}
+	}
+	if at := rc.GetExpiresAt(); at > 0 {
+		suffix += " (disappears at " + time.Unix(at, 0).Format("15:04:05") + ")"
+	}
+	if n := rc.GetReplyCount(); n > 0 {
+		suffix += fmt.Sprintf(" [%d replies: /thread %d]", n, rc.GetMessageId())
+	}
+	line := fmt.Sprintf("[room:%s] #%d%s <%s> %s%s",
+		rc.GetRoom(), rc.GetMessageId(), reply, rc.GetUsername(), rc.GetMessageBody(), suffix)
+	if rc.GetUsername() != localUser && messages.Mentions(rc.GetMessageBody(), localUser) {
+		line = highlightOn + line + highlightOff
+		if !rc.GetEdited() && len(rc.GetReactions()) == 0 {
+			line += bell // ring once, not on every re-render
+		}
+	}
+	return line
+}
+
+func reply(parent uint64, room, body string, ttl uint32, msgHandler *messages.MessageHandler) {
+	_ = msgHandler.Send(&messages.Wrapper{
+		Msg: &messages.Wrapper_RoomChat{
+			RoomChat: &messages.RoomChat{Room: room, MessageBody: body, ReplyTo: parent, TtlSeconds: ttl},
+		},
+	})
+}
+
+func react(id uint64, room, emoji string, remove bool, msgHandler *messages.MessageHandler) {
+	_ = msgHandler.Send(&messages.Wrapper{
+		Msg: &messages.Wrapper_Reaction{
+			Reaction: &messages.Reaction{Room: room, MessageId: id, Emoji: emoji, Remove: remove},
+		},
+	})
+}
+
+// showThread asks the server for a thread; the ThreadView arrives in receiveMessage.
+func showThread(id uint64, room string, msgHandler *messages.MessageHandler) {
+	_ = msgHandler.Send(&messages.Wrapper{
+		Msg: &messages.Wrapper_ThreadRequest{
+			ThreadRequest: &messages.ThreadRequest{Room: room, ThreadId: id},
+		},
+	})
+}
+
+// messageRoom is the room message id was posted in, if we've seen it,
+// otherwise the current room.
+func messageRoom(id uint64, currentRoom string) string {
+	if rc := seen.get(id); rc != nil {
+		return rc.GetRoom()
+	}
+	return currentRoom
+}
+
+func editMessage(id uint64, room, body string, msgHandler *messages.MessageHandler) {
+	_ = msgHandler.Send(&messages.Wrapper{
+		Msg: &messages.Wrapper_EditMessage{
+			EditMessage: &messages.EditMessage{Room: room, MessageId: id, MessageBody: body},
+		},
+	})
+}
+
+func deleteMessage(id uint64, room string, msgHandler *messages.MessageHandler) {
+	_ = msgHandler.Send(&messages.Wrapper{
+		Msg: &messages.Wrapper_DeleteMessage{
+			DeleteMessage: &messages.DeleteMessage{Room: room, MessageId: id},
+		},
+	})
+}
+
+// parseID reads a message ID as shown in the scrollback, with or without the '#'.
+func parseID(s string) (uint64, error) {
+	return strconv.ParseUint(strings.TrimPrefix(s, "#"), 10, 64)
 }
 
 func joinRoom(user string, currentRoom string, room string, msgHandler *messages.MessageHandler) string {
@@ -51,8 +281,8 @@ func joinRoom(user string, currentRoom string, room string, msgHandler *messages
 
 func leaveRoom(user string, currentRoom string, msgHandler *messages.MessageHandler) string {
 	if currentRoom == "" {
-		fmt.Fprintln(os.Stderr, "You haven't joined a room")
-		fmt.Fprint(os.Stderr, "message> ")
+		ui.println("You haven't joined a room")
+		ui.prompt()
 		return currentRoom
 	}
 	_ = msgHandler.Send(&messages.Wrapper{
@@ -63,14 +293,51 @@ func leaveRoom(user string, currentRoom string, msgHandler *messages.MessageHand
 	return ""
 }
 
-func directmessage(from string, to string, body string, msgHandler *messages.MessageHandler) {
-	_ = msgHandler.Send(&messages.Wrapper{
-		Msg: &messages.Wrapper_DirectChat{
-			DirectChat: &messages.DirectChat{
-				From: from, To: to, MessageBody: body,
+// clientFeatures lists the optional protocol features this client can enable.
+var clientFeatures = []string{messages.FeatureCompression, messages.FeatureHistory}
+
+// v1Refusal is how a server from before Hello (protocol version 1) answers
+// one: it takes it for a Registration without a username.
+const v1Refusal = "You must register with a non-empty username"
+
+// handshake sends our Hello and waits for the server's Welcome, which lists
+// the features enabled for this connection and the server's limits.
+func handshake(msgHandler *messages.MessageHandler) (*messages.Welcome, error) {
+	// A server turning us away may hang up before reading the Hello, so a
+	// send error only matters if there's no notice explaining it
+	sendErr := msgHandler.Send(&messages.Wrapper{
+		Msg: &messages.Wrapper_Hello{
+			Hello: &messages.Hello{
+				ProtocolVersion: messages.ProtocolVersion,
+				Features:        clientFeatures,
+				ClientName:      "go-chat client",
 			},
 		},
 	})
+
+	w, err := msgHandler.Receive()
+	if err != nil {
+		if sendErr != nil {
+			return nil, sendErr
+		}
+		return nil, err
+	}
+	switch m := w.Msg.(type) {
+	case *messages.Wrapper_Welcome:
+		// The server picks a version we offered, so never a newer one
+		if v := m.Welcome.GetProtocolVersion(); v < messages.MinProtocolVersion || v > messages.ProtocolVersion {
+			return nil, fmt.Errorf("server chose protocol version %d, we speak %d to %d",
+				v, messages.MinProtocolVersion, messages.ProtocolVersion)
+		}
+		return m.Welcome, nil
+	case *messages.Wrapper_ServerNotice:
+		if m.ServerNotice.GetText() == v1Refusal {
+			return nil, errors.New("server is too old: it speaks protocol version 1, and this client needs 2 or later")
+		}
+		return nil, errors.New(m.ServerNotice.GetText())
+	default:
+		return nil, fmt.Errorf("unexpected %T before Welcome", m)
+	}
 }
 
 func main() {
@@ -78,9 +345,19 @@ func main() {
 		log.Fatalln("usage: client <username> <host:port>")
 	}
 	user := os.Args[1]
+	localUser = user
 	host := os.Args[2]
 	fmt.Println("Hello,", user)
 
+	var err error
+	if keys, err = loadKeyring(host, user); err != nil {
+		log.Fatalln("cannot load keys:", err)
+	}
+	if dms, err = loadDMHistory(keys.dir, host, user); err != nil {
+		log.Fatalln("cannot load DM retention:", err)
+	}
+	go dms.runCompactor(time.Second)
+
 	conn, err := net.Dial("tcp", host)
 	if err != nil {
 		log.Fatalln(err)
@@ -89,6 +366,16 @@ func main() {
 
 	msgHandler := messages.NewMessageHandler(conn)
 
+	welcome, err := handshake(msgHandler)
+	if err != nil {
+		log.Fatalln("handshake failed:", err)
+	}
+	files.maxSize = welcome.GetLimits().GetMaxFileSize()
+	keys.home = welcome.GetServerName()
+	if slices.Contains(welcome.GetFeatures(), messages.FeatureCompression) {
+		msgHandler.SetCompression(true)
+	}
+
 	// Register
 	reg := messages.Registration{Username: user}
 	if err := msgHandler.Send(&messages.Wrapper{
@@ -96,16 +383,32 @@ func main() {
 	}); err != nil {
 		log.Fatalln("registration failed:", err)
 	}
+	_ = msgHandler.Send(&messages.Wrapper{
+		Msg: &messages.Wrapper_PublishKey{PublishKey: &messages.PublishKey{PublicKey: keys.publicKey()}},
+	})
+
+	ui = newConsole()
+	defer ui.close()
+	log.SetOutput(ui)
 
 	go receiveMessage(msgHandler)
 
 	currentRoom := "" // user must /join before sending
-	scanner := bufio.NewScanner(os.Stdin)
-	fmt.Fprint(os.Stderr, "message> ")
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
+	var ttl uint32    // self-destruct timer for what we send, in seconds; /ttl sets it
+	typing := &typingNotifier{msgHandler: msgHandler}
+	ui.onKey = func(line string) { typing.keyPressed(line, currentRoom) }
+	ui.prompt()
+	for {
+		line, err := ui.readLine()
+		if err != nil {
+			if err != io.EOF {
+				log.Println("stdin:", err)
+			}
+			break
+		}
+		line = strings.TrimSpace(line)
 		if line == "" {
-			fmt.Fprint(os.Stderr, "message> ")
+			ui.prompt()
 			continue
 		}
 
@@ -115,8 +418,8 @@ func main() {
 			switch cmd {
 			case "/join":
 				if len(fields) < 2 {
-					fmt.Fprintln(os.Stderr, "usage: /join <room>")
-					fmt.Fprint(os.Stderr, "message> ")
+					ui.println("usage: /join <room>")
+					ui.prompt()
 					continue
 				}
 				room := fields[1]
@@ -127,37 +430,239 @@ func main() {
 
 			case "/dm":
 				if len(fields) < 3 {
-					fmt.Fprintln(os.Stderr, "usage: /dm <user> <message>")
-					fmt.Fprint(os.Stderr, "message> ")
+					ui.println("usage: /dm <user> <message>")
+					ui.prompt()
 					continue
 				}
 				to := fields[1]
 				body := strings.TrimSpace(line[len(cmd)+1+len(to)+1:])
-				directmessage(user, to, body, msgHandler)
+				keys.sendDM(to, body, ttl, msgHandler)
+
+			case "/ttl":
+				if len(fields) != 2 {
+					ui.println("usage: /ttl <duration|off>")
+					ui.prompt()
+					continue
+				}
+				if strings.ToLower(fields[1]) == "off" {
+					ttl = 0
+					ui.println("* messages you send no longer self-destruct")
+					break
+				}
+				d, err := messages.ParseDays(fields[1])
+				if err != nil || d < time.Second {
+					ui.println("bad duration:", fields[1])
+					break
+				}
+				ttl = uint32(d / time.Second)
+				ui.printf("* messages you send now self-destruct after %s\n", messages.FormatDays(d))
+
+			case "/retention":
+				if len(fields) > 1 && strings.HasPrefix(fields[1], "@") {
+					peer := strings.TrimPrefix(fields[1], "@")
+					if len(fields) == 2 {
+						dms.explain(peer)
+						break
+					}
+					p, err := messages.ParseDMRetention(fields[2:])
+					if err != nil {
+						ui.println(err)
+						break
+					}
+					dms.set(peer, p)
+					break
+				}
+				if currentRoom == "" {
+					ui.println("Join a room first: /join <room>")
+					break
+				}
+				rr := &messages.RoomRetention{}
+				if len(fields) > 1 {
+					if rr, err = messages.ParseRetention(fields[1:]); err != nil {
+						ui.println(err)
+						break
+					}
+				}
+				rr.Room = currentRoom
+				_ = msgHandler.Send(&messages.Wrapper{Msg: &messages.Wrapper_RoomRetention{RoomRetention: rr}})
+
+			case "/search":
+				q, err := parseSearch(fields[1:], time.Now())
+				if err != nil {
+					ui.println(err)
+					ui.println("usage: /search [in:<room>] [from:<user>] [since:<2h|2006-01-02>] [until:...] <words>")
+					ui.prompt()
+					continue
+				}
+				_ = msgHandler.Send(&messages.Wrapper{Msg: &messages.Wrapper_Search{Search: q}})
+
+			case "/history":
+				if len(fields) != 2 {
+					ui.println("usage: /history <user>")
+					ui.prompt()
+					continue
+				}
+				dms.show(fields[1])
+
+			case "/fingerprint":
+				name := ""
+				if len(fields) > 1 {
+					name = fields[1]
+				}
+				keys.showFingerprint(name)
+
+			case "/trust":
+				if len(fields) < 2 {
+					ui.println("usage: /trust <user>")
+					ui.prompt()
+					continue
+				}
+				if err := keys.trust(fields[1], user, msgHandler); err != nil {
+					ui.println(err)
+				}
+
+			case "/plaintext":
+				if len(fields) < 2 {
+					ui.println("usage: /plaintext <user>")
+					ui.prompt()
+					continue
+				}
+				if err := keys.sendPlain(fields[1], user, msgHandler); err != nil {
+					ui.println(err)
+				}
+
+			case "/edit":
+				if len(fields) < 3 {
+					ui.println("usage: /edit <id> <new text>")
+					ui.prompt()
+					continue
+				}
+				id, err := parseID(fields[1])
+				if err != nil {
+					ui.println("bad message id:", fields[1])
+					ui.prompt()
+					continue
+				}
+				body := strings.TrimSpace(line[len(cmd)+1+len(fields[1])+1:])
+				editMessage(id, messageRoom(id, currentRoom), body, msgHandler)
+
+			case "/reply":
+				if len(fields) < 3 {
+					ui.println("usage: /reply <id> <text>")
+					ui.prompt()
+					continue
+				}
+				id, err := parseID(fields[1])
+				if err != nil {
+					ui.println("bad message id:", fields[1])
+					ui.prompt()
+					continue
+				}
+				body := strings.TrimSpace(line[len(cmd)+1+len(fields[1])+1:])
+				reply(id, messageRoom(id, currentRoom), body, ttl, msgHandler)
+
+			case "/thread":
+				if len(fields) < 2 {
+					ui.println("usage: /thread <id>")
+					ui.prompt()
+					continue
+				}
+				id, err := parseID(fields[1])
+				if err != nil {
+					ui.println("bad message id:", fields[1])
+					ui.prompt()
+					continue
+				}
+				// a reply's thread is its root's, if we know it
+				if rc := seen.get(id); rc != nil && rc.GetThreadId() != 0 {
+					id = rc.GetThreadId()
+				}
+				showThread(id, messageRoom(id, currentRoom), msgHandler)
+
+			case "/react", "/unreact":
+				if len(fields) != 3 {
+					ui.printf("usage: %s <id> <emoji>\n", cmd)
+					ui.prompt()
+					continue
+				}
+				id, err := parseID(fields[1])
+				if err != nil {
+					ui.println("bad message id:", fields[1])
+					ui.prompt()
+					continue
+				}
+				react(id, messageRoom(id, currentRoom), fields[2], cmd == "/unreact", msgHandler)
+
+			case "/delete":
+				if len(fields) < 2 {
+					ui.println("usage: /delete <id>")
+					ui.prompt()
+					continue
+				}
+				id, err := parseID(fields[1])
+				if err != nil {
+					ui.println("bad message id:", fields[1])
+					ui.prompt()
+					continue
+				}
+				deleteMessage(id, messageRoom(id, currentRoom), msgHandler)
+
+			case "/send":
+				if len(fields) < 3 {
+					ui.println("usage: /send <user|#room> <path>")
+					ui.prompt()
+					continue
+				}
+				path := strings.TrimSpace(strings.TrimPrefix(line[len(cmd):], " "+fields[1]))
+				if err := sendFile(fields[1], currentRoom, path, msgHandler); err != nil {
+					ui.println("cannot send:", err)
+				}
+
+			case "/get":
+				if len(fields) < 2 {
+					ui.println("usage: /get <file id> [path]")
+					ui.prompt()
+					continue
+				}
+				id, err := parseID(fields[1])
+				if err != nil {
+					ui.println("bad file id:", fields[1])
+					ui.prompt()
+					continue
+				}
+				path := strings.TrimSpace(strings.TrimPrefix(line[len(cmd):], " "+fields[1]))
+				if err := getFile(id, path, msgHandler); err != nil {
+					ui.println("cannot download:", err)
+				}
+
+			case "/help":
+				showHelp()
+				_ = msgHandler.Send(&messages.Wrapper{Msg: &messages.Wrapper_Command{Command: &messages.Command{}}})
 
 			default:
-				fmt.Fprintln(os.Stderr, "commands: /join /leave /dm")
+				// the server's, if it has one by that name
+				_ = msgHandler.Send(&messages.Wrapper{
+					Msg: &messages.Wrapper_Command{
+						Command: &messages.Command{Name: cmd[1:], Args: fields[1:], Room: currentRoom},
+					},
+				})
 			}
 		} else {
 			// plain message -> current room
 			if currentRoom == "" {
-				fmt.Fprintln(os.Stderr, "Join a room first: /join <room>")
-				fmt.Fprint(os.Stderr, "message> ")
+				ui.println("Join a room first: /join <room>")
+				ui.prompt()
 				continue
 			}
 			_ = msgHandler.Send(&messages.Wrapper{
 				Msg: &messages.Wrapper_RoomChat{
 					RoomChat: &messages.RoomChat{
-						Username: user, Room: currentRoom, MessageBody: line,
+						Username: user, Room: currentRoom, MessageBody: line, TtlSeconds: ttl,
 					},
 				},
 			})
 		}
 
-		fmt.Fprint(os.Stderr, "\r\033[K")
-		fmt.Fprint(os.Stderr, "message> ")
-	}
-	if err := scanner.Err(); err != nil {
-		log.Println("stdin:", err)
+		ui.prompt()
 	}
 }
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"chat/messages"
+	"net"
+	"strings"
+	"testing"
+)
+
+// handshakeWith runs the client's handshake against a server that answers
+// the Hello with reply, and returns the outcome.
+func handshakeWith(t *testing.T, reply *messages.Wrapper) (*messages.Welcome, error) {
+	t.Helper()
+	ours, theirs := net.Pipe()
+	client, server := messages.NewMessageHandler(ours), messages.NewMessageHandler(theirs)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	go func() {
+		if _, err := server.Receive(); err == nil {
+			_ = server.Send(reply)
+		}
+	}()
+	return handshake(client)
+}
+
+func welcome(version uint32) *messages.Wrapper {
+	return &messages.Wrapper{Msg: &messages.Wrapper_Welcome{Welcome: &messages.Welcome{ProtocolVersion: version}}}
+}
+
+func TestHandshake(t *testing.T) {
+	if _, err := handshakeWith(t, welcome(messages.ProtocolVersion)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandshakeRefusesVersionsWeDontSpeak(t *testing.T) {
+	for _, v := range []uint32{messages.MinProtocolVersion - 1, messages.ProtocolVersion + 1} {
+		if _, err := handshakeWith(t, welcome(v)); err == nil {
+			t.Errorf("accepted a Welcome for version %d", v)
+		}
+	}
+}
+
+// TestHandshakeWithV1Server has the server take our Hello for a nameless
+// Registration, as one from before Hello does.
+func TestHandshakeWithV1Server(t *testing.T) {
+	_, err := handshakeWith(t, &messages.Wrapper{Msg: &messages.Wrapper_ServerNotice{
+		ServerNotice: &messages.ServerNotice{Text: "You must register with a non-empty username"},
+	}})
+	if err == nil || !strings.Contains(err.Error(), "too old") {
+		t.Fatalf("got %v, want the server called too old", err)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"golang.org/x/term"
+)
+
+const (
+	promptText = "message> "
+	// typingShownFor is how long a "typing…" indicator lasts without a refresh.
+	typingShownFor = 5 * time.Second
+)
+
+// console is the user's terminal. On a real terminal it runs a line editor,
+// so incoming messages don't trash half-typed input and we see keystrokes
+// (for typing indicators). Otherwise it falls back to plain line-by-line
+// stdin/stderr, which is what scripts piping into the client get.
+type console struct {
+	term    *term.Terminal // nil when stdin isn't a terminal
+	restore func()
+	scanner *bufio.Scanner
+
+	// onKey, if set, is called from readLine for every printable key with
+	// the line as it was before the key.
+	onKey func(line string)
+
+	mutex  sync.Mutex
+	typing map[string]time.Time // username -> when their indicator expires
+}
+
+var ui *console
+
+func newConsole() *console {
+	c := &console{typing: make(map[string]time.Time)}
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		c.scanner = bufio.NewScanner(os.Stdin)
+		return c
+	}
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		c.scanner = bufio.NewScanner(os.Stdin)
+		return c
+	}
+	c.restore = func() { _ = term.Restore(fd, state) }
+	c.term = term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stderr}, promptText)
+	c.term.AutoCompleteCallback = func(line string, pos int, key rune) (string, int, bool) {
+		if c.onKey != nil && unicode.IsPrint(key) {
+			c.onKey(line)
+		}
+		return "", 0, false
+	}
+	go c.expireTyping()
+	return c
+}
+
+// close puts the terminal back the way we found it.
+func (c *console) close() {
+	if c.restore != nil {
+		c.restore()
+	}
+}
+
+func (c *console) readLine() (string, error) {
+	if c.term != nil {
+		return c.term.ReadLine()
+	}
+	if c.scanner.Scan() {
+		return c.scanner.Text(), nil
+	}
+	if err := c.scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", io.EOF
+}
+
+// Write lets the console stand in for os.Stderr (e.g. as the log output).
+func (c *console) Write(p []byte) (int, error) {
+	if c.term != nil {
+		return c.term.Write(p)
+	}
+	return os.Stderr.Write(p)
+}
+
+// printf prints a line above the prompt.
+func (c *console) printf(format string, args ...any) {
+	if c.term != nil {
+		fmt.Fprintf(c.term, format, args...)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "\r\033[K"+format, args...)
+}
+
+func (c *console) println(args ...any) {
+	fmt.Fprintln(c, args...)
+}
+
+// prompt redraws the prompt. The line editor keeps its own, so this only
+// matters in plain mode.
+func (c *console) prompt() {
+	if c.term == nil {
+		fmt.Fprint(os.Stderr, "\r\033[K"+promptText)
+	}
+}
+
+// startTyping shows that username is typing, until it expires or they send something.
+func (c *console) startTyping(username string) {
+	c.mutex.Lock()
+	_, already := c.typing[username]
+	c.typing[username] = time.Now().Add(typingShownFor)
+	c.mutex.Unlock()
+
+	if c.term != nil {
+		c.refreshPrompt()
+	} else if !already {
+		c.printf("* %s is typing…\n", username)
+		c.prompt()
+	}
+}
+
+func (c *console) stopTyping(username string) {
+	c.mutex.Lock()
+	_, was := c.typing[username]
+	delete(c.typing, username)
+	c.mutex.Unlock()
+	if was && c.term != nil {
+		c.refreshPrompt()
+	}
+}
+
+// refreshPrompt puts whoever is typing in front of the prompt.
+func (c *console) refreshPrompt() {
+	c.mutex.Lock()
+	names := make([]string, 0, len(c.typing))
+	for name := range c.typing {
+		names = append(names, name)
+	}
+	c.mutex.Unlock()
+	slices.Sort(names)
+
+	switch len(names) {
+	case 0:
+		c.term.SetPrompt(promptText)
+	case 1:
+		c.term.SetPrompt(fmt.Sprintf("[%s is typing…] %s", names[0], promptText))
+	default:
+		c.term.SetPrompt(fmt.Sprintf("[%s are typing…] %s", strings.Join(names, ", "), promptText))
+	}
+	// SetPrompt only takes effect on the next redraw; writing nothing forces one
+	_, _ = c.term.Write(nil)
+}
+
+// expireTyping drops indicators nobody has refreshed.
+func (c *console) expireTyping() {
+	for range time.Tick(time.Second) {
+		now := time.Now()
+		expired := false
+		c.mutex.Lock()
+		for name, until := range c.typing {
+			if now.After(until) {
+				delete(c.typing, name)
+				expired = true
+			}
+		}
+		c.mutex.Unlock()
+		if expired {
+			c.refreshPrompt()
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"chat/messages"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// dmLimit is how many messages the client keeps per DM conversation when
+// neither side has asked for fewer.
+const dmLimit = 1000
+
+// dmHistory keeps this session's direct messages per conversation, for
+// /history. The server keeps no DMs, so this is what DM retention governs:
+// each side sets its own with /retention @user and sends it along with every
+// DM, and both ends keep their copies to the stricter of the two. A
+// compactor drops what falls outside that, and what self-destructs.
+type dmHistory struct {
+	server, user string
+	path         string // where our settings are saved; "" if they can't be
+
+	mutex  sync.Mutex
+	ours   map[string]*messages.DMRetention // peer -> what we set
+	theirs map[string]*messages.DMRetention // peer -> what their last DM said
+	convs  map[string][]dmLine              // peer -> kept messages, oldest first
+}
+
+type dmLine struct {
+	at      time.Time
+	expires time.Time // zero if it doesn't self-destruct
+	text    string
+}
+
+var dms *dmHistory
+
+// loadDMHistory reads user's saved DM retention settings for server from
+// dir, which may be "" if there's nowhere to keep them.
+func loadDMHistory(dir, server, user string) (*dmHistory, error) {
+	h := &dmHistory{
+		server: server,
+		user:   user,
+		ours:   make(map[string]*messages.DMRetention),
+		theirs: make(map[string]*messages.DMRetention),
+		convs:  make(map[string][]dmLine),
+	}
+	if dir == "" {
+		return h, nil
+	}
+	h.path = filepath.Join(dir, "dm_retention")
+	f, err := os.Open(h.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return h, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	// one "server user peer settings..." per line; later lines win
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[0] != server || fields[1] != user {
+			continue
+		}
+		p, err := messages.ParseDMRetention(fields[3:])
+		if err != nil {
+			continue
+		}
+		if proto.Size(p) == 0 {
+			delete(h.ours, fields[2])
+		} else {
+			h.ours[fields[2]] = p
+		}
+	}
+	return h, scanner.Err()
+}
+
+// set changes our retention for the conversation with peer, saves it and
+// applies it to what's already kept.
+func (h *dmHistory) set(peer string, p *messages.DMRetention) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if proto.Size(p) == 0 {
+		delete(h.ours, peer) // back to no limit: nothing to send
+	} else {
+		h.ours[peer] = p
+	}
+	h.compactConv(peer, time.Now())
+	ui.printf("* you now keep DMs with %s %s\n", peer, describeDMRetention(p))
+	if h.path == "" {
+		return
+	}
+	f, err := os.OpenFile(h.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		ui.println("cannot save retention:", err)
+		return
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "%s %s %s %s\n", h.server, h.user, peer, strings.Join(messages.RetentionWords(p), " "))
+}
+
+// own is what we send with a DM to peer: our setting, or nil for none.
+func (h *dmHistory) own(peer string) *messages.DMRetention {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.ours[peer]
+}
+
+// heard records the retention peer sent with a DM, saying so when it changes.
+func (h *dmHistory) heard(peer string, p *messages.DMRetention) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if proto.Size(p) == 0 {
+		p = nil // no limit, however it was sent
+	}
+	if proto.Equal(h.theirs[peer], p) {
+		return
+	}
+	if p == nil {
+		delete(h.theirs, peer)
+	} else {
+		h.theirs[peer] = p
+	}
+	ui.printf("* %s keeps DMs with you %s, so you keep them %s\n",
+		peer, describeDMRetention(p), describeDMRetention(h.effective(peer)))
+	h.compactConv(peer, time.Now())
+}
+
+// explain says how the conversation with peer is kept, and why.
+func (h *dmHistory) explain(peer string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	ui.printf("* DMs with %s are kept %s (you: %s; %s: %s)\n", peer, describeDMRetention(h.effective(peer)),
+		strings.Join(messages.RetentionWords(h.ours[peer]), " "), peer, strings.Join(messages.RetentionWords(h.theirs[peer]), " "))
+}
+
+// ttl caps ttl at the conversation's age limit, if it has one.
+func (h *dmHistory) ttl(peer string, ttl time.Duration) time.Duration {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if age := time.Duration(h.effective(peer).GetMaxAgeSeconds()) * time.Second; age > 0 && (ttl == 0 || ttl > age) {
+		return age
+	}
+	return ttl
+}
+
+// effective is the stricter of our retention and peer's. The caller holds
+// the mutex.
+func (h *dmHistory) effective(peer string) *messages.DMRetention {
+	return stricterDM(h.ours[peer], h.theirs[peer])
+}
+
+// stricterDM combines two policies, keeping the tighter limit of each kind.
+func stricterDM(a, b *messages.DMRetention) *messages.DMRetention {
+	p := &messages.DMRetention{Ephemeral: a.GetEphemeral() || b.GetEphemeral()}
+	p.Keep = tighter(a.GetKeep(), b.GetKeep())
+	p.MaxAgeSeconds = tighter(a.GetMaxAgeSeconds(), b.GetMaxAgeSeconds())
+	return p
+}
+
+// tighter is the smaller of two limits, where zero means none.
+func tighter[T uint32 | int64](a, b T) T {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+func describeDMRetention(p *messages.DMRetention) string {
+	switch {
+	case p.GetEphemeral():
+		return "not at all (ephemeral)"
+	case p.GetKeep() == 0 && p.GetMaxAgeSeconds() == 0:
+		return "with no limit"
+	}
+	var parts []string
+	if p.GetKeep() > 0 {
+		parts = append(parts, fmt.Sprintf("the newest %d", p.GetKeep()))
+	}
+	if p.GetMaxAgeSeconds() > 0 {
+		parts = append(parts, "for up to "+messages.FormatDays(time.Duration(p.GetMaxAgeSeconds())*time.Second))
+	}
+	return strings.Join(parts, " ")
+}
+
+// add keeps a DM with peer, as far as the conversation's retention allows.
+func (h *dmHistory) add(peer, text string, at time.Time, ttl time.Duration) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.effective(peer).GetEphemeral() {
+		return
+	}
+	line := dmLine{at: at, text: text}
+	if ttl > 0 {
+		line.expires = at.Add(ttl)
+	}
+	h.convs[peer] = append(h.convs[peer], line)
+	h.compactConv(peer, at)
+}
+
+// compact enforces every conversation's retention as of now.
+func (h *dmHistory) compact(now time.Time) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for peer := range h.convs {
+		h.compactConv(peer, now)
+	}
+}
+
+// compactConv enforces the retention of the conversation with peer. The
+// caller holds the mutex.
+func (h *dmHistory) compactConv(peer string, now time.Time) {
+	p := h.effective(peer)
+	if p.GetEphemeral() {
+		delete(h.convs, peer)
+		return
+	}
+	var cutoff time.Time
+	if age := p.GetMaxAgeSeconds(); age > 0 {
+		cutoff = now.Add(-time.Duration(age) * time.Second)
+	}
+	kept := h.convs[peer][:0]
+	for _, line := range h.convs[peer] {
+		if line.at.Before(cutoff) || (!line.expires.IsZero() && !now.Before(line.expires)) {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	keep := dmLimit
+	if n := int(p.GetKeep()); n > 0 && n < keep {
+		keep = n
+	}
+	if len(kept) > keep {
+		kept = kept[len(kept)-keep:]
+	}
+	if len(kept) == 0 {
+		delete(h.convs, peer)
+		return
+	}
+	h.convs[peer] = kept
+}
+
+// show prints what's kept of the conversation with peer.
+func (h *dmHistory) show(peer string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	ui.printf("--- DMs with %s, kept %s ---\n", peer, describeDMRetention(h.effective(peer)))
+	for _, line := range h.convs[peer] {
+		ui.printf("%s %s\n", line.at.Format("2006-01-02 15:04"), line.text)
+	}
+	ui.printf("--- end of DMs with %s ---\n", peer)
+}
+
+// runCompactor compacts every interval.
+func (h *dmHistory) runCompactor(every time.Duration) {
+	for now := range time.Tick(every) {
+		h.compact(now)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"chat/messages"
+	"testing"
+	"time"
+)
+
+func testDMHistory(t *testing.T, dir string) *dmHistory {
+	t.Helper()
+	if ui == nil {
+		ui = &console{typing: make(map[string]time.Time)}
+	}
+	h, err := loadDMHistory(dir, "test", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func (h *dmHistory) kept(peer string) int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return len(h.convs[peer])
+}
+
+func TestStricterDM(t *testing.T) {
+	got := stricterDM(&messages.DMRetention{Keep: 10}, &messages.DMRetention{Keep: 50, MaxAgeSeconds: 60})
+	if got.GetKeep() != 10 || got.GetMaxAgeSeconds() != 60 || got.GetEphemeral() {
+		t.Errorf("got %v, want keep=10 age=60s", got)
+	}
+	if !stricterDM(nil, &messages.DMRetention{Ephemeral: true}).GetEphemeral() {
+		t.Error("one side's ephemeral didn't win")
+	}
+	if got := stricterDM(nil, nil); got.GetKeep() != 0 || got.GetMaxAgeSeconds() != 0 {
+		t.Errorf("no settings gave %v", got)
+	}
+}
+
+func TestDMHistoryKeepsNewest(t *testing.T) {
+	h := testDMHistory(t, "")
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		h.add("bob", "hi", now, 0)
+	}
+	h.set("bob", &messages.DMRetention{Keep: 3})
+	if n := h.kept("bob"); n != 3 {
+		t.Fatalf("kept %d, want 3", n)
+	}
+	h.add("bob", "hi", now, 0)
+	if n := h.kept("bob"); n != 3 {
+		t.Fatalf("kept %d after another, want 3", n)
+	}
+}
+
+func TestDMHistoryCompacts(t *testing.T) {
+	h := testDMHistory(t, "")
+	now := time.Now()
+	h.heard("bob", &messages.DMRetention{MaxAgeSeconds: 3600}) // bob's setting binds us too
+	h.add("bob", "old", now, 0)
+	h.add("bob", "self-destructs", now.Add(time.Minute), time.Minute)
+	h.add("bob", "new", now.Add(30*time.Minute), 0)
+
+	h.compact(now.Add(2 * time.Minute))
+	if n := h.kept("bob"); n != 2 {
+		t.Fatalf("kept %d after the TTL ran out, want 2", n)
+	}
+	h.compact(now.Add(time.Hour + time.Second))
+	if n := h.kept("bob"); n != 1 {
+		t.Fatalf("kept %d past the age limit, want 1", n)
+	}
+}
+
+func TestEphemeralDMsArentKept(t *testing.T) {
+	h := testDMHistory(t, "")
+	h.add("bob", "before", time.Now(), 0)
+	h.heard("bob", &messages.DMRetention{Ephemeral: true})
+	if n := h.kept("bob"); n != 0 {
+		t.Fatalf("kept %d after bob went ephemeral", n)
+	}
+	h.add("bob", "after", time.Now(), 0)
+	if n := h.kept("bob"); n != 0 {
+		t.Fatalf("kept %d in an ephemeral conversation", n)
+	}
+	// our own choice can't loosen theirs
+	h.set("bob", &messages.DMRetention{Keep: 100})
+	h.add("bob", "still", time.Now(), 0)
+	if n := h.kept("bob"); n != 0 {
+		t.Fatalf("kept %d: our setting overrode bob's ephemeral", n)
+	}
+}
+
+func TestDMRetentionIsSaved(t *testing.T) {
+	dir := t.TempDir()
+	h := testDMHistory(t, dir)
+	h.set("bob", &messages.DMRetention{Keep: 5, MaxAgeSeconds: 7 * 24 * 3600})
+	h.set("carol", &messages.DMRetention{Ephemeral: true})
+	h.set("carol", &messages.DMRetention{}) // back to the default
+
+	h = testDMHistory(t, dir)
+	if p := h.own("bob"); p.GetKeep() != 5 || p.GetMaxAgeSeconds() != 7*24*3600 {
+		t.Errorf("bob's setting came back as %v", p)
+	}
+	if p := h.own("carol"); p != nil {
+		t.Errorf("carol's setting came back as %v, want none", p)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"chat/messages"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keyring holds our X25519 identity and the keys we trust for other users.
+// Trust is on first use: the first key we see for a user is remembered in
+// ~/.gochat/known_keys, and a different one later is flagged until /trust.
+//
+// Every DM looks the recipient's key up again first, since it changes
+// whenever they reconnect from somewhere else; messages wait in pending
+// until the answer comes back.
+type keyring struct {
+	server  string // known keys are per server, since usernames are
+	home    string // the server's federation name, if it has one
+	dir     string // "" if nothing can be saved
+	private *ecdh.PrivateKey
+
+	mutex   sync.Mutex
+	known   map[string][]byte      // username -> trusted key
+	changed map[string][]byte      // username -> new key waiting for /trust
+	pending map[string][]pendingDM // username -> DMs waiting for their key
+}
+
+type pendingDM struct {
+	body string
+	ttl  uint32 // seconds, 0 = no self-destruct
+}
+
+var keys *keyring
+
+// loadKeyring reads (or creates) user's identity key and the known keys for
+// server. If ~/.gochat isn't usable it carries on with a throwaway identity.
+func loadKeyring(server, user string) (*keyring, error) {
+	k := &keyring{
+		server:  server,
+		known:   make(map[string][]byte),
+		changed: make(map[string][]byte),
+		pending: make(map[string][]pendingDM),
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		k.dir = filepath.Join(home, ".gochat")
+	}
+	if k.dir == "" || os.MkdirAll(k.dir, 0o700) != nil {
+		k.dir = ""
+		private, err := ecdh.X25519().GenerateKey(rand.Reader)
+		k.private = private
+		return k, err
+	}
+
+	identity := filepath.Join(k.dir, "identity-"+url.PathEscape(user))
+	if raw, err := os.ReadFile(identity); err == nil {
+		seed, err := hex.DecodeString(strings.TrimSpace(string(raw)))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", identity, err)
+		}
+		if k.private, err = ecdh.X25519().NewPrivateKey(seed); err != nil {
+			return nil, fmt.Errorf("%s: %w", identity, err)
+		}
+	} else if errors.Is(err, os.ErrNotExist) {
+		if k.private, err = ecdh.X25519().GenerateKey(rand.Reader); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(identity, []byte(hex.EncodeToString(k.private.Bytes())+"\n"), 0o600); err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, err
+	}
+
+	f, err := os.Open(filepath.Join(k.dir, "known_keys"))
+	if errors.Is(err, os.ErrNotExist) {
+		return k, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	// one "server username hexkey" per line; later lines win
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || fields[0] != server {
+			continue
+		}
+		if key, err := hex.DecodeString(fields[2]); err == nil {
+			k.known[fields[1]] = key
+		}
+	}
+	return k, scanner.Err()
+}
+
+func (k *keyring) publicKey() []byte {
+	return k.private.PublicKey().Bytes()
+}
+
+// fingerprint is a short, comparable form of a public key.
+func fingerprint(key []byte) string {
+	sum := sha256.Sum256(key)
+	h := hex.EncodeToString(sum[:16])
+	groups := make([]string, 0, len(h)/4)
+	for i := 0; i < len(h); i += 4 {
+		groups = append(groups, h[i:i+4])
+	}
+	return strings.Join(groups, " ")
+}
+
+// remember trusts key for username from now on. The caller holds the mutex.
+func (k *keyring) remember(username string, key []byte) {
+	k.known[username] = key
+	delete(k.changed, username)
+	if k.dir == "" {
+		return
+	}
+	f, err := os.OpenFile(filepath.Join(k.dir, "known_keys"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		ui.println("cannot save key:", err)
+		return
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "%s %s %s\n", k.server, username, hex.EncodeToString(key))
+}
+
+// verify checks key against what we trust for username, trusting it if
+// it's the first we've seen. It returns false if the key has changed.
+// The caller holds the mutex.
+func (k *keyring) verify(username string, key []byte) bool {
+	old, ok := k.known[username]
+	switch {
+	case !ok:
+		k.remember(username, key)
+		ui.printf("* trusting %s's key on first use, fingerprint %s\n", username, fingerprint(key))
+		return true
+	case bytes.Equal(old, key):
+		return true
+	}
+	if !bytes.Equal(k.changed[username], key) {
+		k.changed[username] = key
+		ui.printf("%s* WARNING: %s's key has changed!\n*   was %s\n*   now %s\n"+
+			"* Check the new fingerprint with them, then /trust %s%s\n",
+			highlightOn, username, fingerprint(old), fingerprint(key), username, highlightOff)
+	}
+	return false
+}
+
+// trust accepts username's changed key and sends anything that was held back.
+func (k *keyring) trust(username, from string, msgHandler *messages.MessageHandler) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	key := k.changed[username]
+	if key == nil {
+		return fmt.Errorf("no changed key for %s", username)
+	}
+	k.remember(username, key)
+	ui.printf("* now trusting %s's key %s\n", username, fingerprint(key))
+	k.flush(username, from, key, msgHandler)
+	return nil
+}
+
+// sendPlain sends the DMs held for username unencrypted, once the user has
+// decided that's acceptable.
+func (k *keyring) sendPlain(username, from string, msgHandler *messages.MessageHandler) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if len(k.pending[username]) == 0 {
+		return fmt.Errorf("no messages held for %s", username)
+	}
+	ui.printf("* sending %d message(s) to %s in plaintext\n", len(k.pending[username]), username)
+	k.flush(username, from, nil, msgHandler)
+	return nil
+}
+
+// sendDM queues body for to and asks the server for their current key.
+func (k *keyring) sendDM(to, body string, ttl uint32, msgHandler *messages.MessageHandler) {
+	k.mutex.Lock()
+	k.pending[to] = append(k.pending[to], pendingDM{body: body, ttl: ttl})
+	k.mutex.Unlock()
+	_ = msgHandler.Send(&messages.Wrapper{
+		Msg: &messages.Wrapper_KeyRequest{KeyRequest: &messages.KeyRequest{Username: to}},
+	})
+}
+
+// keyArrived sends whatever was waiting on pk's user: encrypted if they
+// have a key we trust, in plaintext (with a warning) if they have none and
+// never had one. If we already trust a key for them, the server saying
+// there's none could be it stripping the encryption, so the messages wait
+// for /plaintext.
+func (k *keyring) keyArrived(pk *messages.PublishKey, from string, msgHandler *messages.MessageHandler) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	to := pk.GetUsername()
+	if len(k.pending[to]) == 0 {
+		return
+	}
+	key := pk.GetPublicKey()
+	if len(key) == 0 {
+		if _, ok := k.known[to]; ok {
+			ui.printf("%s* WARNING: the server says %s has no encryption key, but you know one for them.\n"+
+				"* %d message(s) held: /plaintext %s sends them unencrypted anyway%s\n",
+				highlightOn, to, len(k.pending[to]), to, highlightOff)
+			return
+		}
+		ui.printf("* %s has no encryption key (offline, or an older client): sending in plaintext\n", to)
+	} else if !k.verify(to, key) {
+		ui.printf("* %d message(s) to %s held until you /trust them\n", len(k.pending[to]), to)
+		return
+	}
+	k.flush(to, from, key, msgHandler)
+}
+
+// flush sends the pending DMs for to. The caller holds the mutex.
+func (k *keyring) flush(to, from string, key []byte, msgHandler *messages.MessageHandler) {
+	for _, dm := range k.pending[to] {
+		dc := &messages.DirectChat{From: from, To: to, MessageBody: dm.body}
+		if len(key) > 0 {
+			var err error
+			if dc, err = k.encrypt(from, to, key, dm.body); err != nil {
+				ui.printf("* cannot encrypt to %s: %s\n", to, err)
+				continue
+			}
+		}
+		ttl := dms.ttl(to, time.Duration(dm.ttl)*time.Second)
+		dc.TtlSeconds = uint32(ttl / time.Second)
+		dc.Retention = dms.own(to)
+		if msgHandler.Send(&messages.Wrapper{Msg: &messages.Wrapper_DirectChat{DirectChat: dc}}) == nil {
+			dms.add(to, fmt.Sprintf("[dm %s→%s] %s", from, to, dm.body), time.Now(), ttl)
+		}
+	}
+	delete(k.pending, to)
+}
+
+// sessionKey derives the AES key for messages between a sender and a
+// recipient key. Both ends get the same one: the sender from its private
+// key and the recipient's public key, the recipient the other way round.
+func (k *keyring) sessionKey(peer, senderKey, recipientKey []byte) (cipher.AEAD, error) {
+	pub, err := ecdh.X25519().NewPublicKey(peer)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := k.private.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	h.Write([]byte("go-chat dm v1"))
+	h.Write(shared)
+	h.Write(senderKey)
+	h.Write(recipientKey)
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// dmHeader is authenticated with every encrypted DM, so the server can't
+// pass a message off as being from or to someone else. Across federated
+// servers each end sees the other's name as user@server, so both sign the
+// names in that form.
+func (k *keyring) dmHeader(from, to string) []byte {
+	return []byte(k.qualify(from) + "\x00" + k.qualify(to))
+}
+
+func (k *keyring) qualify(username string) string {
+	if k.home == "" || strings.Contains(username, "@") {
+		return username
+	}
+	return username + "@" + k.home
+}
+
+func (k *keyring) encrypt(from, to string, peer []byte, body string) (*messages.DirectChat, error) {
+	aead, err := k.sessionKey(peer, k.publicKey(), peer)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &messages.DirectChat{
+		From: from, To: to,
+		Ciphertext: aead.Seal(nil, nonce, []byte(body), k.dmHeader(from, to)),
+		Nonce:      nonce,
+		SenderKey:  k.publicKey(),
+	}, nil
+}
+
+// decrypt opens an encrypted DM. trusted is false if the sender's key isn't
+// the one we know for them.
+func (k *keyring) decrypt(dc *messages.DirectChat) (body string, trusted bool, err error) {
+	k.mutex.Lock()
+	trusted = k.verify(dc.GetFrom(), dc.GetSenderKey())
+	k.mutex.Unlock()
+
+	aead, err := k.sessionKey(dc.GetSenderKey(), dc.GetSenderKey(), k.publicKey())
+	if err != nil {
+		return "", trusted, err
+	}
+	if len(dc.GetNonce()) != aead.NonceSize() {
+		return "", trusted, errors.New("bad nonce")
+	}
+	plain, err := aead.Open(nil, dc.GetNonce(), dc.GetCiphertext(), k.dmHeader(dc.GetFrom(), dc.GetTo()))
+	if err != nil {
+		return "", trusted, err
+	}
+	return string(plain), trusted, nil
+}
+
+// showFingerprint prints our own fingerprint, or the one we trust for username.
+func (k *keyring) showFingerprint(username string) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if username == "" {
+		ui.printf("* your key: %s\n", fingerprint(k.publicKey()))
+		return
+	}
+	key, ok := k.known[username]
+	if !ok {
+		ui.printf("* no key known for %s yet: DM them first\n", username)
+		return
+	}
+	ui.printf("* %s's key: %s\n", username, fingerprint(key))
+	if changed := k.changed[username]; changed != nil {
+		ui.printf("*   but they now present %s (/trust %s to accept)\n", fingerprint(changed), username)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"chat/messages"
+	"crypto/ecdh"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeServer is the other end of the client's connection: it records what
+// the client sends.
+func fakeServer(t *testing.T) (*messages.MessageHandler, <-chan *messages.Wrapper) {
+	t.Helper()
+	if ui == nil {
+		ui = &console{typing: make(map[string]time.Time)}
+	}
+	dms, _ = loadDMHistory("", "test", "alice")
+	ours, theirs := net.Pipe()
+	client, server := messages.NewMessageHandler(ours), messages.NewMessageHandler(theirs)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	sent := make(chan *messages.Wrapper, 16)
+	go func() {
+		for {
+			w, err := server.Receive()
+			if err != nil {
+				return
+			}
+			sent <- w
+		}
+	}()
+	return client, sent
+}
+
+func testKeyring(t *testing.T) *keyring {
+	t.Helper()
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &keyring{
+		private: private,
+		known:   make(map[string][]byte),
+		changed: make(map[string][]byte),
+		pending: make(map[string][]pendingDM),
+	}
+}
+
+// nextDM skips key requests and returns the next DM the client sent.
+func nextDM(t *testing.T, sent <-chan *messages.Wrapper, d time.Duration) *messages.DirectChat {
+	t.Helper()
+	timeout := time.After(d)
+	for {
+		select {
+		case w := <-sent:
+			if dc := w.GetDirectChat(); dc != nil {
+				return dc
+			}
+		case <-timeout:
+			return nil
+		}
+	}
+}
+
+func TestDMToUserWithoutKeyGoesInPlaintext(t *testing.T) {
+	mh, sent := fakeServer(t)
+	k := testKeyring(t)
+	k.sendDM("bob", "hi", 0, mh)
+	k.keyArrived(&messages.PublishKey{Username: "bob"}, "alice", mh)
+	dc := nextDM(t, sent, time.Second)
+	if dc == nil || dc.GetMessageBody() != "hi" || len(dc.GetCiphertext()) != 0 {
+		t.Fatalf("sent %v, want hi in plaintext", dc)
+	}
+}
+
+func TestDMIsEncryptedToTrustedKey(t *testing.T) {
+	mh, sent := fakeServer(t)
+	k := testKeyring(t)
+	bob := testKeyring(t)
+	k.sendDM("bob", "hi", 0, mh)
+	k.keyArrived(&messages.PublishKey{Username: "bob", PublicKey: bob.publicKey()}, "alice", mh)
+	dc := nextDM(t, sent, time.Second)
+	if dc == nil || dc.GetMessageBody() != "" || len(dc.GetCiphertext()) == 0 {
+		t.Fatalf("sent %v, want ciphertext only", dc)
+	}
+	if body, _, err := bob.decrypt(dc); err != nil || body != "hi" {
+		t.Fatalf("bob decrypted %q, %v", body, err)
+	}
+}
+
+func TestServerCannotStripEncryption(t *testing.T) {
+	mh, sent := fakeServer(t)
+	k := testKeyring(t)
+	bob := testKeyring(t)
+	k.known["bob"] = bob.publicKey()
+
+	// the server answers that bob has no key, though we know one
+	k.sendDM("bob", "secret", 0, mh)
+	k.keyArrived(&messages.PublishKey{Username: "bob"}, "alice", mh)
+	if dc := nextDM(t, sent, 100*time.Millisecond); dc != nil {
+		t.Fatalf("sent %v without the user agreeing to plaintext", dc)
+	}
+
+	if err := k.sendPlain("bob", "alice", mh); err != nil {
+		t.Fatal(err)
+	}
+	dc := nextDM(t, sent, time.Second)
+	if dc == nil || dc.GetMessageBody() != "secret" {
+		t.Fatalf("sent %v after /plaintext, want the held message", dc)
+	}
+	if err := k.sendPlain("bob", "alice", mh); err == nil {
+		t.Error("/plaintext with nothing held didn't complain")
+	}
+}
+
+func TestDMCarriesOurRetention(t *testing.T) {
+	mh, sent := fakeServer(t)
+	k := testKeyring(t)
+	dms.set("bob", &messages.DMRetention{Keep: 10, MaxAgeSeconds: 3600})
+	k.sendDM("bob", "hi", 7200, mh)
+	k.keyArrived(&messages.PublishKey{Username: "bob"}, "alice", mh)
+	dc := nextDM(t, sent, time.Second)
+	if dc.GetRetention().GetKeep() != 10 || dc.GetRetention().GetMaxAgeSeconds() != 3600 {
+		t.Errorf("sent retention %v, want ours", dc.GetRetention())
+	}
+	if dc.GetTtlSeconds() != 3600 {
+		t.Errorf("TTL %d, want it capped at the hour we keep DMs for", dc.GetTtlSeconds())
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import "chat/messages"
+
+// localCommands are the commands the client handles itself, for /help.
+// Anything else starting with "/" goes to the server to run.
+var localCommands = []struct{ usage, help string }{
+	{"/join <room>", "join a room and talk there"},
+	{"/leave", "leave the room you're talking in"},
+	{"/dm <user> <message>", "send someone a message, encrypted if they have a key"},
+	{"/reply <id> <text>", "answer a message in its thread"},
+	{"/thread <id>", "show a message's thread"},
+	{"/edit <id> <new text>", "change a message you sent"},
+	{"/delete <id>", "delete a message you sent"},
+	{"/react <id> <emoji>", "react to a message (/unreact to take it back)"},
+	{"/send <user|#room> <path>", "offer someone a file"},
+	{"/get <file id> [path]", "download a file you were offered"},
+	{"/search [filters] <words>", "search history; filters are in:<room> from:<user> since:<2h> until:..."},
+	{"/ttl <duration|off>", "have what you send self-destruct"},
+	{"/retention [policy]", "show or set how long the room keeps history"},
+	{"/retention @<user> [policy]", "show or set how long DMs with someone are kept"},
+	{"/history <user>", "show the DMs with someone that are still kept"},
+	{"/fingerprint [user]", "show a key's fingerprint"},
+	{"/trust <user>", "trust someone's current key"},
+	{"/plaintext <user>", "send DMs held for someone unencrypted"},
+	{"/help", "this list"},
+}
+
+// showHelp lists the client's commands. The server's follow when its
+// CommandList arrives.
+func showHelp() {
+	ui.println("commands:")
+	for _, lc := range localCommands {
+		ui.printf("  %-28s %s\n", lc.usage, lc.help)
+	}
+}
+
+func showCommandList(list *messages.CommandList) {
+	if len(list.GetCommands()) == 0 {
+		return
+	}
+	ui.println("server commands:")
+	for _, spec := range list.GetCommands() {
+		ui.printf("  %-28s %s\n", messages.CommandUsage(spec), spec.GetHelp())
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"chat/messages"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseSearch turns /search arguments into a Search. Filters look like
+// in:room, from:user, since:2h and until:2006-01-02; everything else is
+// the text to look for.
+func parseSearch(args []string, now time.Time) (*messages.Search, error) {
+	q := &messages.Search{}
+	var words []string
+	for _, arg := range args {
+		key, value, ok := strings.Cut(arg, ":")
+		if !ok || value == "" {
+			words = append(words, arg)
+			continue
+		}
+		key = strings.ToLower(key)
+		switch key {
+		case "in":
+			q.Room = strings.TrimPrefix(value, "#")
+		case "from":
+			q.From = value
+		case "since", "until":
+			t, err := parseWhen(value, now)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", arg, err)
+			}
+			if key == "since" {
+				q.Since = t.Unix()
+			} else {
+				q.Until = t.Unix()
+			}
+		default:
+			words = append(words, arg) // e.g. a URL
+		}
+	}
+	q.Query = strings.Join(words, " ")
+	if q.Query == "" && q.From == "" {
+		return nil, errors.New("nothing to search for")
+	}
+	return q, nil
+}
+
+// parseWhen reads a time as either how long ago ("90m", "2h", "3d") or a
+// date ("2006-01-02", local time).
+func parseWhen(s string, now time.Time) (time.Time, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil {
+			return now.AddDate(0, 0, -n), nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Time{}, errors.New("want a duration like 2h or 3d, or a date like 2006-01-02")
+}
+
+func showSearchResults(sr *messages.SearchResults) {
+	if len(sr.GetMessages()) == 0 {
+		ui.printf("* no messages match %q\n", sr.GetQuery())
+		return
+	}
+	ui.printf("--- %d results for %q, newest first ---\n", len(sr.GetMessages()), sr.GetQuery())
+	for _, rc := range sr.GetMessages() {
+		seen.add(rc)
+		when := time.Unix(rc.GetSentAt(), 0).Format("2006-01-02 15:04")
+		ui.printf("%s %s\n", when, strings.TrimSuffix(formatRoomChat(rc), bell))
+	}
+	if sr.GetTruncated() {
+		ui.println("--- more matched: narrow it down with in:, from:, since: or more words ---")
+	} else {
+		ui.println("--- end of results ---")
+	}
+}
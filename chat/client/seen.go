@@ -0,0 +1,77 @@
+package main
+
+import (
+	"chat/messages"
+	"sync"
+)
+
+// seenLimit is how many room messages the client remembers.
+const seenLimit = 1000
+
+// seenMessages remembers recent room messages by ID, so an edit can be
+// re-rendered with its original author and /edit knows which room a message
+// belongs to. Shared by the input loop and receiveMessage.
+type seenMessages struct {
+	mutex sync.Mutex
+	byID  map[uint64]*messages.RoomChat
+	order []uint64 // oldest first
+}
+
+var seen = &seenMessages{byID: make(map[uint64]*messages.RoomChat)}
+
+func (s *seenMessages) add(rc *messages.RoomChat) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.byID[rc.GetMessageId()]; !ok {
+		s.order = append(s.order, rc.GetMessageId())
+	}
+	s.byID[rc.GetMessageId()] = rc
+	if len(s.order) > seenLimit {
+		delete(s.byID, s.order[0])
+		s.order = s.order[1:]
+	}
+}
+
+func (s *seenMessages) get(id uint64) *messages.RoomChat {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.byID[id]
+}
+
+// edit updates a remembered message, returning it (or nil if unknown).
+func (s *seenMessages) edit(id uint64, body string) *messages.RoomChat {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	rc := s.byID[id]
+	if rc != nil {
+		rc.MessageBody = body
+		rc.Edited = true
+	}
+	return rc
+}
+
+func (s *seenMessages) remove(id uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.byID, id)
+}
+
+// react records an emoji's new count on a remembered message, returning it
+// (or nil if unknown).
+func (s *seenMessages) react(id uint64, emoji string, count uint32) *messages.RoomChat {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	rc := s.byID[id]
+	if rc == nil {
+		return nil
+	}
+	if count == 0 {
+		delete(rc.Reactions, emoji)
+	} else {
+		if rc.Reactions == nil {
+			rc.Reactions = make(map[string]uint32)
+		}
+		rc.Reactions[emoji] = count
+	}
+	return rc
+}
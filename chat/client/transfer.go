@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"chat/messages"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// transfers tracks our file transfers: at most one upload (the server takes
+// one at a time per user) and any number of downloads. Shared by the input
+// loop and receiveMessage.
+type transfers struct {
+	mutex     sync.Mutex
+	maxSize   uint64 // from the server's Welcome; 0 if it takes no files
+	upload    *upload
+	offers    map[uint64]*messages.FileOffer // files offered to us, by ID
+	downloads map[uint64]*download
+}
+
+type upload struct {
+	id   uint64 // 0 until the server accepts the offer
+	name string
+	data []byte
+}
+
+type download struct {
+	offer    *messages.FileOffer
+	path     string
+	file     *os.File
+	sum      hash.Hash
+	received uint64
+}
+
+var files = &transfers{
+	offers:    make(map[uint64]*messages.FileOffer),
+	downloads: make(map[uint64]*download),
+}
+
+// humanSize formats n bytes for people.
+func humanSize(n uint64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%d bytes", n)
+	}
+}
+
+// sendFile offers the file at path to a user, or to a room when target is
+// "#room" or the room we're in. The upload itself happens as the server asks
+// for chunks.
+func sendFile(target, currentRoom, path string, msgHandler *messages.MessageHandler) error {
+	files.mutex.Lock()
+	defer files.mutex.Unlock()
+	if files.upload != nil {
+		return errors.New("wait for the current upload to finish")
+	}
+	if files.maxSize == 0 {
+		return errors.New("this server doesn't take files")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if uint64(info.Size()) > files.maxSize {
+		return fmt.Errorf("%s is too large: the server takes up to %s", path, humanSize(files.maxSize))
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return fmt.Errorf("%s is empty", path)
+	}
+
+	sum := sha256.Sum256(data)
+	offer := &messages.FileOffer{Name: filepath.Base(path), Size: uint64(len(data)), Sha256: sum[:]}
+	if room, ok := strings.CutPrefix(target, "#"); ok {
+		offer.Room = room
+	} else if target == currentRoom {
+		offer.Room = target
+	} else {
+		offer.To = target
+	}
+	files.upload = &upload{name: offer.Name, data: data}
+	if err := msgHandler.Send(&messages.Wrapper{Msg: &messages.Wrapper_FileOffer{FileOffer: offer}}); err != nil {
+		files.upload = nil
+		return err
+	}
+	ui.printf("* uploading %s (%s)…\n", offer.Name, humanSize(offer.Size))
+	return nil
+}
+
+// accepted answers the server asking for the chunk of our upload at an offset.
+func (t *transfers) accepted(fa *messages.FileAccept, msgHandler *messages.MessageHandler) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	up := t.upload
+	if up == nil {
+		return
+	}
+	if up.id == 0 {
+		up.id = fa.GetFileId() // the first request tells us the ID
+	}
+	if fa.GetFileId() != up.id || fa.GetOffset() >= uint64(len(up.data)) {
+		return
+	}
+	end := min(fa.GetOffset()+messages.FileChunkSize, uint64(len(up.data)))
+	_ = msgHandler.Send(&messages.Wrapper{
+		Msg: &messages.Wrapper_FileChunk{
+			FileChunk: &messages.FileChunk{FileId: up.id, Offset: fa.GetOffset(), Data: up.data[fa.GetOffset():end]},
+		},
+	})
+}
+
+// offered remembers a file someone sent us so /get can find it.
+func (t *transfers) offered(fo *messages.FileOffer) {
+	t.mutex.Lock()
+	t.offers[fo.GetFileId()] = fo
+	t.mutex.Unlock()
+
+	prefix := ""
+	if fo.GetRoom() != "" {
+		prefix = "[room:" + fo.GetRoom() + "] "
+	}
+	ui.printf("%s* %s sent a file: %s (%s). Download it with /get %d\n",
+		prefix, fo.GetFrom(), fo.GetName(), humanSize(fo.GetSize()), fo.GetFileId())
+}
+
+// getFile starts downloading file id into path (by default its own name in
+// the current directory). Existing files are never overwritten.
+func getFile(id uint64, path string, msgHandler *messages.MessageHandler) error {
+	files.mutex.Lock()
+	defer files.mutex.Unlock()
+	offer := files.offers[id]
+	if offer == nil {
+		return fmt.Errorf("no file #%d has been offered to you", id)
+	}
+	if files.downloads[id] != nil {
+		return fmt.Errorf("already downloading #%d", id)
+	}
+	if path == "" {
+		path = filepath.Base(offer.GetName())
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	files.downloads[id] = &download{offer: offer, path: path, file: f, sum: sha256.New()}
+	if err := msgHandler.Send(&messages.Wrapper{
+		Msg: &messages.Wrapper_FileAccept{FileAccept: &messages.FileAccept{FileId: id}},
+	}); err != nil {
+		files.fail(id, err)
+		return err
+	}
+	ui.printf("* downloading %s to %s…\n", offer.GetName(), path)
+	return nil
+}
+
+// chunk writes a piece of a download and asks for the next one.
+func (t *transfers) chunk(ch *messages.FileChunk, msgHandler *messages.MessageHandler) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	d := t.downloads[ch.GetFileId()]
+	if d == nil || ch.GetOffset() != d.received {
+		return
+	}
+	if _, err := d.file.Write(ch.GetData()); err != nil {
+		t.fail(ch.GetFileId(), err)
+		return
+	}
+	d.sum.Write(ch.GetData())
+	d.received += uint64(len(ch.GetData()))
+	if d.received < d.offer.GetSize() {
+		_ = msgHandler.Send(&messages.Wrapper{
+			Msg: &messages.Wrapper_FileAccept{FileAccept: &messages.FileAccept{FileId: ch.GetFileId(), Offset: d.received}},
+		})
+	}
+}
+
+// completed handles the end of a transfer, ours or theirs, successful or not.
+func (t *transfers) completed(fc *messages.FileComplete) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if up := t.upload; up != nil && (fc.GetFileId() == 0 || fc.GetFileId() == up.id) {
+		t.upload = nil
+		if fc.GetError() != "" {
+			ui.printf("* upload of %s failed: %s\n", up.name, fc.GetError())
+		} else {
+			ui.printf("* sent %s (file #%d)\n", up.name, up.id)
+		}
+		return
+	}
+
+	id := fc.GetFileId()
+	d := t.downloads[id]
+	if d == nil {
+		return
+	}
+	switch {
+	case fc.GetError() != "":
+		t.fail(id, errors.New(fc.GetError()))
+	case d.received != d.offer.GetSize():
+		t.fail(id, fmt.Errorf("got %d of %d bytes", d.received, d.offer.GetSize()))
+	case !bytes.Equal(d.sum.Sum(nil), fc.GetSha256()) || !bytes.Equal(fc.GetSha256(), d.offer.GetSha256()):
+		t.fail(id, errors.New("checksum mismatch"))
+	default:
+		delete(t.downloads, id)
+		if err := d.file.Close(); err != nil {
+			ui.printf("* download of %s failed: %s\n", d.offer.GetName(), err)
+			return
+		}
+		ui.printf("* saved %s (%s, sha256 verified)\n", d.path, humanSize(d.received))
+	}
+}
+
+// fail abandons download id and removes what we'd written of it. The caller
+// holds the mutex.
+func (t *transfers) fail(id uint64, err error) {
+	d := t.downloads[id]
+	if d == nil {
+		return
+	}
+	delete(t.downloads, id)
+	d.file.Close()
+	os.Remove(d.path)
+	ui.printf("* download of %s failed: %s\n", d.offer.GetName(), err)
+}
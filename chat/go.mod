@@ -2,4 +2,9 @@ module chat
 
 go 1.23.1
 
-require google.golang.org/protobuf v1.36.9
+require (
+	golang.org/x/term v0.27.0
+	google.golang.org/protobuf v1.36.9
+)
+
+require golang.org/x/sys v0.28.0 // indirect
@@ -21,6 +21,262 @@ const (
 	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
 )
 
+type ClusterEvent_Kind int32
+
+const (
+	ClusterEvent_ROOM    ClusterEvent_Kind = 0 // deliver payload to room's members, applying it to history first
+	ClusterEvent_DIRECT  ClusterEvent_Kind = 1 // deliver payload to username, if they're on this node
+	ClusterEvent_ALL     ClusterEvent_Kind = 2 // deliver payload to everyone
+	ClusterEvent_JOIN    ClusterEvent_Kind = 3 // username joined room
+	ClusterEvent_LEAVE   ClusterEvent_Kind = 4 // username left room
+	ClusterEvent_ONLINE  ClusterEvent_Kind = 5 // username registered on node (sent by the hub)
+	ClusterEvent_OFFLINE ClusterEvent_Kind = 6 // username is gone, from every room (sent by the hub)
+	ClusterEvent_KEY     ClusterEvent_Kind = 7 // username published public_key
+	ClusterEvent_RESET   ClusterEvent_Kind = 8 // the link to the hub was (re)made: forget everything remote
+)
+
+// Enum value maps for ClusterEvent_Kind.
+var (
+	ClusterEvent_Kind_name = map[int32]string{
+		0: "ROOM",
+		1: "DIRECT",
+		2: "ALL",
+		3: "JOIN",
+		4: "LEAVE",
+		5: "ONLINE",
+		6: "OFFLINE",
+		7: "KEY",
+		8: "RESET",
+	}
+	ClusterEvent_Kind_value = map[string]int32{
+		"ROOM":    0,
+		"DIRECT":  1,
+		"ALL":     2,
+		"JOIN":    3,
+		"LEAVE":   4,
+		"ONLINE":  5,
+		"OFFLINE": 6,
+		"KEY":     7,
+		"RESET":   8,
+	}
+)
+
+func (x ClusterEvent_Kind) Enum() *ClusterEvent_Kind {
+	p := new(ClusterEvent_Kind)
+	*p = x
+	return p
+}
+
+func (x ClusterEvent_Kind) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (ClusterEvent_Kind) Descriptor() protoreflect.EnumDescriptor {
+	return file_chat_proto_enumTypes[0].Descriptor()
+}
+
+func (ClusterEvent_Kind) Type() protoreflect.EnumType {
+	return &file_chat_proto_enumTypes[0]
+}
+
+func (x ClusterEvent_Kind) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use ClusterEvent_Kind.Descriptor instead.
+func (ClusterEvent_Kind) EnumDescriptor() ([]byte, []int) {
+	return file_chat_proto_rawDescGZIP(), []int{33, 0}
+}
+
+// Protocol negotiation: the first frame a client sends, answered with Welcome
+type Hello struct {
+	state           protoimpl.MessageState `protogen:"open.v1"`
+	ProtocolVersion uint32                 `protobuf:"varint,1,opt,name=protocol_version,json=protocolVersion,proto3" json:"protocol_version,omitempty"`
+	Features        []string               `protobuf:"bytes,2,rep,name=features,proto3" json:"features,omitempty"` // features the client supports
+	ClientName      string                 `protobuf:"bytes,3,opt,name=client_name,json=clientName,proto3" json:"client_name,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *Hello) Reset() {
+	*x = Hello{}
+	mi := &file_chat_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Hello) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Hello) ProtoMessage() {}
+
+func (x *Hello) ProtoReflect() protoreflect.Message {
+	mi := &file_chat_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Hello.ProtoReflect.Descriptor instead.
+func (*Hello) Descriptor() ([]byte, []int) {
+	return file_chat_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Hello) GetProtocolVersion() uint32 {
+	if x != nil {
+		return x.ProtocolVersion
+	}
+	return 0
+}
+
+func (x *Hello) GetFeatures() []string {
+	if x != nil {
+		return x.Features
+	}
+	return nil
+}
+
+func (x *Hello) GetClientName() string {
+	if x != nil {
+		return x.ClientName
+	}
+	return ""
+}
+
+type ServerLimits struct {
+	state             protoimpl.MessageState `protogen:"open.v1"`
+	MaxFrameSize      uint64                 `protobuf:"varint,1,opt,name=max_frame_size,json=maxFrameSize,proto3" json:"max_frame_size,omitempty"` // largest payload the server will read
+	MaxUsernameLength uint32                 `protobuf:"varint,2,opt,name=max_username_length,json=maxUsernameLength,proto3" json:"max_username_length,omitempty"`
+	MaxFileSize       uint64                 `protobuf:"varint,3,opt,name=max_file_size,json=maxFileSize,proto3" json:"max_file_size,omitempty"` // largest upload the server accepts, 0 if it takes none
+	unknownFields     protoimpl.UnknownFields
+	sizeCache         protoimpl.SizeCache
+}
+
+func (x *ServerLimits) Reset() {
+	*x = ServerLimits{}
+	mi := &file_chat_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ServerLimits) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ServerLimits) ProtoMessage() {}
+
+func (x *ServerLimits) ProtoReflect() protoreflect.Message {
+	mi := &file_chat_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ServerLimits.ProtoReflect.Descriptor instead.
+func (*ServerLimits) Descriptor() ([]byte, []int) {
+	return file_chat_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *ServerLimits) GetMaxFrameSize() uint64 {
+	if x != nil {
+		return x.MaxFrameSize
+	}
+	return 0
+}
+
+func (x *ServerLimits) GetMaxUsernameLength() uint32 {
+	if x != nil {
+		return x.MaxUsernameLength
+	}
+	return 0
+}
+
+func (x *ServerLimits) GetMaxFileSize() uint64 {
+	if x != nil {
+		return x.MaxFileSize
+	}
+	return 0
+}
+
+type Welcome struct {
+	state           protoimpl.MessageState `protogen:"open.v1"`
+	ProtocolVersion uint32                 `protobuf:"varint,1,opt,name=protocol_version,json=protocolVersion,proto3" json:"protocol_version,omitempty"` // version both sides will speak
+	Features        []string               `protobuf:"bytes,2,rep,name=features,proto3" json:"features,omitempty"`                                       // features enabled for this connection
+	Limits          *ServerLimits          `protobuf:"bytes,3,opt,name=limits,proto3" json:"limits,omitempty"`
+	ServerName      string                 `protobuf:"bytes,4,opt,name=server_name,json=serverName,proto3" json:"server_name,omitempty"` // how federated servers address this one, empty if it isn't federated
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *Welcome) Reset() {
+	*x = Welcome{}
+	mi := &file_chat_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Welcome) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Welcome) ProtoMessage() {}
+
+func (x *Welcome) ProtoReflect() protoreflect.Message {
+	mi := &file_chat_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Welcome.ProtoReflect.Descriptor instead.
+func (*Welcome) Descriptor() ([]byte, []int) {
+	return file_chat_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Welcome) GetProtocolVersion() uint32 {
+	if x != nil {
+		return x.ProtocolVersion
+	}
+	return 0
+}
+
+func (x *Welcome) GetFeatures() []string {
+	if x != nil {
+		return x.Features
+	}
+	return nil
+}
+
+func (x *Welcome) GetLimits() *ServerLimits {
+	if x != nil {
+		return x.Limits
+	}
+	return nil
+}
+
+func (x *Welcome) GetServerName() string {
+	if x != nil {
+		return x.ServerName
+	}
+	return ""
+}
+
 // Register a username
 type Registration struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
@@ -31,7 +287,7 @@ type Registration struct {
 
 func (x *Registration) Reset() {
 	*x = Registration{}
-	mi := &file_chat_proto_msgTypes[0]
+	mi := &file_chat_proto_msgTypes[3]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -43,7 +299,7 @@ func (x *Registration) String() string {
 func (*Registration) ProtoMessage() {}
 
 func (x *Registration) ProtoReflect() protoreflect.Message {
-	mi := &file_chat_proto_msgTypes[0]
+	mi := &file_chat_proto_msgTypes[3]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -56,7 +312,7 @@ func (x *Registration) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use Registration.ProtoReflect.Descriptor instead.
 func (*Registration) Descriptor() ([]byte, []int) {
-	return file_chat_proto_rawDescGZIP(), []int{0}
+	return file_chat_proto_rawDescGZIP(), []int{3}
 }
 
 func (x *Registration) GetUsername() string {
@@ -77,7 +333,7 @@ type ServerNotice struct {
 
 func (x *ServerNotice) Reset() {
 	*x = ServerNotice{}
-	mi := &file_chat_proto_msgTypes[1]
+	mi := &file_chat_proto_msgTypes[4]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -89,7 +345,7 @@ func (x *ServerNotice) String() string {
 func (*ServerNotice) ProtoMessage() {}
 
 func (x *ServerNotice) ProtoReflect() protoreflect.Message {
-	mi := &file_chat_proto_msgTypes[1]
+	mi := &file_chat_proto_msgTypes[4]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -102,7 +358,7 @@ func (x *ServerNotice) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use ServerNotice.ProtoReflect.Descriptor instead.
 func (*ServerNotice) Descriptor() ([]byte, []int) {
-	return file_chat_proto_rawDescGZIP(), []int{1}
+	return file_chat_proto_rawDescGZIP(), []int{4}
 }
 
 func (x *ServerNotice) GetText() string {
@@ -130,7 +386,7 @@ type RoomJoin struct {
 
 func (x *RoomJoin) Reset() {
 	*x = RoomJoin{}
-	mi := &file_chat_proto_msgTypes[2]
+	mi := &file_chat_proto_msgTypes[5]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -142,7 +398,7 @@ func (x *RoomJoin) String() string {
 func (*RoomJoin) ProtoMessage() {}
 
 func (x *RoomJoin) ProtoReflect() protoreflect.Message {
-	mi := &file_chat_proto_msgTypes[2]
+	mi := &file_chat_proto_msgTypes[5]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -155,7 +411,7 @@ func (x *RoomJoin) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use RoomJoin.ProtoReflect.Descriptor instead.
 func (*RoomJoin) Descriptor() ([]byte, []int) {
-	return file_chat_proto_rawDescGZIP(), []int{2}
+	return file_chat_proto_rawDescGZIP(), []int{5}
 }
 
 func (x *RoomJoin) GetUsername() string {
@@ -182,7 +438,7 @@ type RoomLeave struct {
 
 func (x *RoomLeave) Reset() {
 	*x = RoomLeave{}
-	mi := &file_chat_proto_msgTypes[3]
+	mi := &file_chat_proto_msgTypes[6]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -194,7 +450,7 @@ func (x *RoomLeave) String() string {
 func (*RoomLeave) ProtoMessage() {}
 
 func (x *RoomLeave) ProtoReflect() protoreflect.Message {
-	mi := &file_chat_proto_msgTypes[3]
+	mi := &file_chat_proto_msgTypes[6]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -207,7 +463,7 @@ func (x *RoomLeave) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use RoomLeave.ProtoReflect.Descriptor instead.
 func (*RoomLeave) Descriptor() ([]byte, []int) {
-	return file_chat_proto_rawDescGZIP(), []int{3}
+	return file_chat_proto_rawDescGZIP(), []int{6}
 }
 
 func (x *RoomLeave) GetUsername() string {
@@ -229,13 +485,22 @@ type RoomChat struct {
 	Username      string                 `protobuf:"bytes,1,opt,name=username,proto3" json:"username,omitempty"` // server will overwrite with authenticated user
 	Room          string                 `protobuf:"bytes,2,opt,name=room,proto3" json:"room,omitempty"`
 	MessageBody   string                 `protobuf:"bytes,3,opt,name=message_body,json=messageBody,proto3" json:"message_body,omitempty"`
+	MessageId     uint64                 `protobuf:"varint,4,opt,name=message_id,json=messageId,proto3" json:"message_id,omitempty"`                                                          // assigned by the server
+	Edited        bool                   `protobuf:"varint,5,opt,name=edited,proto3" json:"edited,omitempty"`                                                                                 // set by the server once the sender edits it
+	ReplyTo       uint64                 `protobuf:"varint,6,opt,name=reply_to,json=replyTo,proto3" json:"reply_to,omitempty"`                                                                // message this replies to, 0 = not a reply
+	ThreadId      uint64                 `protobuf:"varint,7,opt,name=thread_id,json=threadId,proto3" json:"thread_id,omitempty"`                                                             // root message of the thread, set by the server
+	ReplyCount    uint32                 `protobuf:"varint,8,opt,name=reply_count,json=replyCount,proto3" json:"reply_count,omitempty"`                                                       // replies to this message's thread, set by the server
+	Reactions     map[string]uint32      `protobuf:"bytes,9,rep,name=reactions,proto3" json:"reactions,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"varint,2,opt,name=value"` // emoji -> count, set by the server
+	SentAt        int64                  `protobuf:"varint,10,opt,name=sent_at,json=sentAt,proto3" json:"sent_at,omitempty"`                                                                  // unix seconds, set by the server
+	TtlSeconds    uint32                 `protobuf:"varint,11,opt,name=ttl_seconds,json=ttlSeconds,proto3" json:"ttl_seconds,omitempty"`                                                      // self-destruct this long after sending, 0 = never
+	ExpiresAt     int64                  `protobuf:"varint,12,opt,name=expires_at,json=expiresAt,proto3" json:"expires_at,omitempty"`                                                         // unix seconds, set by the server from ttl_seconds
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
 func (x *RoomChat) Reset() {
 	*x = RoomChat{}
-	mi := &file_chat_proto_msgTypes[4]
+	mi := &file_chat_proto_msgTypes[7]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -247,7 +512,7 @@ func (x *RoomChat) String() string {
 func (*RoomChat) ProtoMessage() {}
 
 func (x *RoomChat) ProtoReflect() protoreflect.Message {
-	mi := &file_chat_proto_msgTypes[4]
+	mi := &file_chat_proto_msgTypes[7]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -260,7 +525,7 @@ func (x *RoomChat) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use RoomChat.ProtoReflect.Descriptor instead.
 func (*RoomChat) Descriptor() ([]byte, []int) {
-	return file_chat_proto_rawDescGZIP(), []int{4}
+	return file_chat_proto_rawDescGZIP(), []int{7}
 }
 
 func (x *RoomChat) GetUsername() string {
@@ -284,97 +549,98 @@ func (x *RoomChat) GetMessageBody() string {
 	return ""
 }
 
-// Direct message
-type DirectChat struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	From          string                 `protobuf:"bytes,1,opt,name=from,proto3" json:"from,omitempty"` // server will overwrite
-	To            string                 `protobuf:"bytes,2,opt,name=to,proto3" json:"to,omitempty"`
-	MessageBody   string                 `protobuf:"bytes,3,opt,name=message_body,json=messageBody,proto3" json:"message_body,omitempty"`
-	unknownFields protoimpl.UnknownFields
-	sizeCache     protoimpl.SizeCache
+func (x *RoomChat) GetMessageId() uint64 {
+	if x != nil {
+		return x.MessageId
+	}
+	return 0
 }
 
-func (x *DirectChat) Reset() {
-	*x = DirectChat{}
-	mi := &file_chat_proto_msgTypes[5]
-	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
-	ms.StoreMessageInfo(mi)
+func (x *RoomChat) GetEdited() bool {
+	if x != nil {
+		return x.Edited
+	}
+	return false
 }
 
-func (x *DirectChat) String() string {
-	return protoimpl.X.MessageStringOf(x)
+func (x *RoomChat) GetReplyTo() uint64 {
+	if x != nil {
+		return x.ReplyTo
+	}
+	return 0
 }
 
-func (*DirectChat) ProtoMessage() {}
+func (x *RoomChat) GetThreadId() uint64 {
+	if x != nil {
+		return x.ThreadId
+	}
+	return 0
+}
 
-func (x *DirectChat) ProtoReflect() protoreflect.Message {
-	mi := &file_chat_proto_msgTypes[5]
+func (x *RoomChat) GetReplyCount() uint32 {
 	if x != nil {
-		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
-		if ms.LoadMessageInfo() == nil {
-			ms.StoreMessageInfo(mi)
-		}
-		return ms
+		return x.ReplyCount
 	}
-	return mi.MessageOf(x)
+	return 0
 }
 
-// Deprecated: Use DirectChat.ProtoReflect.Descriptor instead.
-func (*DirectChat) Descriptor() ([]byte, []int) {
-	return file_chat_proto_rawDescGZIP(), []int{5}
+func (x *RoomChat) GetReactions() map[string]uint32 {
+	if x != nil {
+		return x.Reactions
+	}
+	return nil
 }
 
-func (x *DirectChat) GetFrom() string {
+func (x *RoomChat) GetSentAt() int64 {
 	if x != nil {
-		return x.From
+		return x.SentAt
 	}
-	return ""
+	return 0
 }
 
-func (x *DirectChat) GetTo() string {
+func (x *RoomChat) GetTtlSeconds() uint32 {
 	if x != nil {
-		return x.To
+		return x.TtlSeconds
 	}
-	return ""
+	return 0
 }
 
-func (x *DirectChat) GetMessageBody() string {
+func (x *RoomChat) GetExpiresAt() int64 {
 	if x != nil {
-		return x.MessageBody
+		return x.ExpiresAt
 	}
-	return ""
+	return 0
 }
 
-type Wrapper struct {
-	state protoimpl.MessageState `protogen:"open.v1"`
-	// Types that are valid to be assigned to Msg:
-	//
-	//	*Wrapper_RegistrationMessage
-	//	*Wrapper_ServerNotice
-	//	*Wrapper_RoomJoin
-	//	*Wrapper_RoomLeave
-	//	*Wrapper_RoomChat
-	//	*Wrapper_DirectChat
-	Msg           isWrapper_Msg `protobuf_oneof:"msg"`
+// RoomRetention asks for (or, with update, sets) how much history the server
+// keeps for a room. Only the room's operator may change it. Zero keep and
+// max_age_seconds mean the server's default.
+type RoomRetention struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Room          string                 `protobuf:"bytes,1,opt,name=room,proto3" json:"room,omitempty"`
+	Keep          uint32                 `protobuf:"varint,2,opt,name=keep,proto3" json:"keep,omitempty"`                                          // newest messages kept
+	MaxAgeSeconds int64                  `protobuf:"varint,3,opt,name=max_age_seconds,json=maxAgeSeconds,proto3" json:"max_age_seconds,omitempty"` // older messages are dropped
+	Ephemeral     bool                   `protobuf:"varint,4,opt,name=ephemeral,proto3" json:"ephemeral,omitempty"`                                // store nothing
+	Update        bool                   `protobuf:"varint,5,opt,name=update,proto3" json:"update,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
-func (x *Wrapper) Reset() {
-	*x = Wrapper{}
-	mi := &file_chat_proto_msgTypes[6]
+func (x *RoomRetention) Reset() {
+	*x = RoomRetention{}
+	mi := &file_chat_proto_msgTypes[8]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
 
-func (x *Wrapper) String() string {
+func (x *RoomRetention) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*Wrapper) ProtoMessage() {}
+func (*RoomRetention) ProtoMessage() {}
 
-func (x *Wrapper) ProtoReflect() protoreflect.Message {
-	mi := &file_chat_proto_msgTypes[6]
+func (x *RoomRetention) ProtoReflect() protoreflect.Message {
+	mi := &file_chat_proto_msgTypes[8]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -385,41 +651,1959 @@ func (x *Wrapper) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use Wrapper.ProtoReflect.Descriptor instead.
-func (*Wrapper) Descriptor() ([]byte, []int) {
-	return file_chat_proto_rawDescGZIP(), []int{6}
+// Deprecated: Use RoomRetention.ProtoReflect.Descriptor instead.
+func (*RoomRetention) Descriptor() ([]byte, []int) {
+	return file_chat_proto_rawDescGZIP(), []int{8}
 }
 
-func (x *Wrapper) GetMsg() isWrapper_Msg {
+func (x *RoomRetention) GetRoom() string {
 	if x != nil {
-		return x.Msg
+		return x.Room
 	}
-	return nil
+	return ""
 }
 
-func (x *Wrapper) GetRegistrationMessage() *Registration {
+func (x *RoomRetention) GetKeep() uint32 {
 	if x != nil {
-		if x, ok := x.Msg.(*Wrapper_RegistrationMessage); ok {
-			return x.RegistrationMessage
-		}
+		return x.Keep
 	}
-	return nil
+	return 0
 }
 
-func (x *Wrapper) GetServerNotice() *ServerNotice {
+func (x *RoomRetention) GetMaxAgeSeconds() int64 {
 	if x != nil {
-		if x, ok := x.Msg.(*Wrapper_ServerNotice); ok {
-			return x.ServerNotice
-		}
+		return x.MaxAgeSeconds
 	}
-	return nil
+	return 0
 }
 
-func (x *Wrapper) GetRoomJoin() *RoomJoin {
+func (x *RoomRetention) GetEphemeral() bool {
 	if x != nil {
-		if x, ok := x.Msg.(*Wrapper_RoomJoin); ok {
-			return x.RoomJoin
-		}
+		return x.Ephemeral
+	}
+	return false
+}
+
+func (x *RoomRetention) GetUpdate() bool {
+	if x != nil {
+		return x.Update
+	}
+	return false
+}
+
+// Add or remove an emoji reaction. The server relays it with the new count.
+type Reaction struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Username      string                 `protobuf:"bytes,1,opt,name=username,proto3" json:"username,omitempty"` // server will overwrite
+	Room          string                 `protobuf:"bytes,2,opt,name=room,proto3" json:"room,omitempty"`
+	MessageId     uint64                 `protobuf:"varint,3,opt,name=message_id,json=messageId,proto3" json:"message_id,omitempty"`
+	Emoji         string                 `protobuf:"bytes,4,opt,name=emoji,proto3" json:"emoji,omitempty"`
+	Remove        bool                   `protobuf:"varint,5,opt,name=remove,proto3" json:"remove,omitempty"`
+	Count         uint32                 `protobuf:"varint,6,opt,name=count,proto3" json:"count,omitempty"` // how many users now have this reaction, set by the server
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Reaction) Reset() {
+	*x = Reaction{}
+	mi := &file_chat_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Reaction) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Reaction) ProtoMessage() {}
+
+func (x *Reaction) ProtoReflect() protoreflect.Message {
+	mi := &file_chat_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Reaction.ProtoReflect.Descriptor instead.
+func (*Reaction) Descriptor() ([]byte, []int) {
+	return file_chat_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *Reaction) GetUsername() string {
+	if x != nil {
+		return x.Username
+	}
+	return ""
+}
+
+func (x *Reaction) GetRoom() string {
+	if x != nil {
+		return x.Room
+	}
+	return ""
+}
+
+func (x *Reaction) GetMessageId() uint64 {
+	if x != nil {
+		return x.MessageId
+	}
+	return 0
+}
+
+func (x *Reaction) GetEmoji() string {
+	if x != nil {
+		return x.Emoji
+	}
+	return ""
+}
+
+func (x *Reaction) GetRemove() bool {
+	if x != nil {
+		return x.Remove
+	}
+	return false
+}
+
+func (x *Reaction) GetCount() uint32 {
+	if x != nil {
+		return x.Count
+	}
+	return 0
+}
+
+// Ask for one thread on its own; answered with a ThreadView
+type ThreadRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Room          string                 `protobuf:"bytes,1,opt,name=room,proto3" json:"room,omitempty"`
+	ThreadId      uint64                 `protobuf:"varint,2,opt,name=thread_id,json=threadId,proto3" json:"thread_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ThreadRequest) Reset() {
+	*x = ThreadRequest{}
+	mi := &file_chat_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ThreadRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ThreadRequest) ProtoMessage() {}
+
+func (x *ThreadRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_chat_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ThreadRequest.ProtoReflect.Descriptor instead.
+func (*ThreadRequest) Descriptor() ([]byte, []int) {
+	return file_chat_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *ThreadRequest) GetRoom() string {
+	if x != nil {
+		return x.Room
+	}
+	return ""
+}
+
+func (x *ThreadRequest) GetThreadId() uint64 {
+	if x != nil {
+		return x.ThreadId
+	}
+	return 0
+}
+
+type ThreadView struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Room          string                 `protobuf:"bytes,1,opt,name=room,proto3" json:"room,omitempty"`
+	ThreadId      uint64                 `protobuf:"varint,2,opt,name=thread_id,json=threadId,proto3" json:"thread_id,omitempty"`
+	Messages      []*RoomChat            `protobuf:"bytes,3,rep,name=messages,proto3" json:"messages,omitempty"` // root first, then replies oldest first
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ThreadView) Reset() {
+	*x = ThreadView{}
+	mi := &file_chat_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ThreadView) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ThreadView) ProtoMessage() {}
+
+func (x *ThreadView) ProtoReflect() protoreflect.Message {
+	mi := &file_chat_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ThreadView.ProtoReflect.Descriptor instead.
+func (*ThreadView) Descriptor() ([]byte, []int) {
+	return file_chat_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *ThreadView) GetRoom() string {
+	if x != nil {
+		return x.Room
+	}
+	return ""
+}
+
+func (x *ThreadView) GetThreadId() uint64 {
+	if x != nil {
+		return x.ThreadId
+	}
+	return 0
+}
+
+func (x *ThreadView) GetMessages() []*RoomChat {
+	if x != nil {
+		return x.Messages
+	}
+	return nil
+}
+
+// Search looks through the stored history of the rooms the sender is in.
+// Every word of the query has to match; the filters are optional.
+type Search struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Query         string                 `protobuf:"bytes,1,opt,name=query,proto3" json:"query,omitempty"`
+	Room          string                 `protobuf:"bytes,2,opt,name=room,proto3" json:"room,omitempty"`    // only this room
+	From          string                 `protobuf:"bytes,3,opt,name=from,proto3" json:"from,omitempty"`    // only messages from this user
+	Since         int64                  `protobuf:"varint,4,opt,name=since,proto3" json:"since,omitempty"` // unix seconds, inclusive
+	Until         int64                  `protobuf:"varint,5,opt,name=until,proto3" json:"until,omitempty"` // unix seconds, exclusive
+	Limit         uint32                 `protobuf:"varint,6,opt,name=limit,proto3" json:"limit,omitempty"` // 0 = the server's default
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Search) Reset() {
+	*x = Search{}
+	mi := &file_chat_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Search) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Search) ProtoMessage() {}
+
+func (x *Search) ProtoReflect() protoreflect.Message {
+	mi := &file_chat_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Search.ProtoReflect.Descriptor instead.
+func (*Search) Descriptor() ([]byte, []int) {
+	return file_chat_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *Search) GetQuery() string {
+	if x != nil {
+		return x.Query
+	}
+	return ""
+}
+
+func (x *Search) GetRoom() string {
+	if x != nil {
+		return x.Room
+	}
+	return ""
+}
+
+func (x *Search) GetFrom() string {
+	if x != nil {
+		return x.From
+	}
+	return ""
+}
+
+func (x *Search) GetSince() int64 {
+	if x != nil {
+		return x.Since
+	}
+	return 0
+}
+
+func (x *Search) GetUntil() int64 {
+	if x != nil {
+		return x.Until
+	}
+	return 0
+}
+
+func (x *Search) GetLimit() uint32 {
+	if x != nil {
+		return x.Limit
+	}
+	return 0
+}
+
+type SearchResults struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Query         string                 `protobuf:"bytes,1,opt,name=query,proto3" json:"query,omitempty"`
+	Messages      []*RoomChat            `protobuf:"bytes,2,rep,name=messages,proto3" json:"messages,omitempty"`    // newest first
+	Truncated     bool                   `protobuf:"varint,3,opt,name=truncated,proto3" json:"truncated,omitempty"` // there were more than the limit
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SearchResults) Reset() {
+	*x = SearchResults{}
+	mi := &file_chat_proto_msgTypes[13]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SearchResults) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SearchResults) ProtoMessage() {}
+
+func (x *SearchResults) ProtoReflect() protoreflect.Message {
+	mi := &file_chat_proto_msgTypes[13]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SearchResults.ProtoReflect.Descriptor instead.
+func (*SearchResults) Descriptor() ([]byte, []int) {
+	return file_chat_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *SearchResults) GetQuery() string {
+	if x != nil {
+		return x.Query
+	}
+	return ""
+}
+
+func (x *SearchResults) GetMessages() []*RoomChat {
+	if x != nil {
+		return x.Messages
+	}
+	return nil
+}
+
+func (x *SearchResults) GetTruncated() bool {
+	if x != nil {
+		return x.Truncated
+	}
+	return false
+}
+
+// Change or remove an earlier RoomChat. Only its sender or the room operator may.
+type EditMessage struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Username      string                 `protobuf:"bytes,1,opt,name=username,proto3" json:"username,omitempty"` // server will overwrite
+	Room          string                 `protobuf:"bytes,2,opt,name=room,proto3" json:"room,omitempty"`
+	MessageId     uint64                 `protobuf:"varint,3,opt,name=message_id,json=messageId,proto3" json:"message_id,omitempty"`
+	MessageBody   string                 `protobuf:"bytes,4,opt,name=message_body,json=messageBody,proto3" json:"message_body,omitempty"` // replacement text
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *EditMessage) Reset() {
+	*x = EditMessage{}
+	mi := &file_chat_proto_msgTypes[14]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *EditMessage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*EditMessage) ProtoMessage() {}
+
+func (x *EditMessage) ProtoReflect() protoreflect.Message {
+	mi := &file_chat_proto_msgTypes[14]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use EditMessage.ProtoReflect.Descriptor instead.
+func (*EditMessage) Descriptor() ([]byte, []int) {
+	return file_chat_proto_rawDescGZIP(), []int{14}
+}
+
+func (x *EditMessage) GetUsername() string {
+	if x != nil {
+		return x.Username
+	}
+	return ""
+}
+
+func (x *EditMessage) GetRoom() string {
+	if x != nil {
+		return x.Room
+	}
+	return ""
+}
+
+func (x *EditMessage) GetMessageId() uint64 {
+	if x != nil {
+		return x.MessageId
+	}
+	return 0
+}
+
+func (x *EditMessage) GetMessageBody() string {
+	if x != nil {
+		return x.MessageBody
+	}
+	return ""
+}
+
+type DeleteMessage struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Username      string                 `protobuf:"bytes,1,opt,name=username,proto3" json:"username,omitempty"` // server will overwrite
+	Room          string                 `protobuf:"bytes,2,opt,name=room,proto3" json:"room,omitempty"`
+	MessageId     uint64                 `protobuf:"varint,3,opt,name=message_id,json=messageId,proto3" json:"message_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DeleteMessage) Reset() {
+	*x = DeleteMessage{}
+	mi := &file_chat_proto_msgTypes[15]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DeleteMessage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeleteMessage) ProtoMessage() {}
+
+func (x *DeleteMessage) ProtoReflect() protoreflect.Message {
+	mi := &file_chat_proto_msgTypes[15]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeleteMessage.ProtoReflect.Descriptor instead.
+func (*DeleteMessage) Descriptor() ([]byte, []int) {
+	return file_chat_proto_rawDescGZIP(), []int{15}
+}
+
+func (x *DeleteMessage) GetUsername() string {
+	if x != nil {
+		return x.Username
+	}
+	return ""
+}
+
+func (x *DeleteMessage) GetRoom() string {
+	if x != nil {
+		return x.Room
+	}
+	return ""
+}
+
+func (x *DeleteMessage) GetMessageId() uint64 {
+	if x != nil {
+		return x.MessageId
+	}
+	return 0
+}
+
+// Sent to a user named with @username in a RoomChat, even outside that room
+type MentionNotice struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Room          string                 `protobuf:"bytes,1,opt,name=room,proto3" json:"room,omitempty"`
+	From          string                 `protobuf:"bytes,2,opt,name=from,proto3" json:"from,omitempty"`
+	MessageId     uint64                 `protobuf:"varint,3,opt,name=message_id,json=messageId,proto3" json:"message_id,omitempty"`
+	MessageBody   string                 `protobuf:"bytes,4,opt,name=message_body,json=messageBody,proto3" json:"message_body,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *MentionNotice) Reset() {
+	*x = MentionNotice{}
+	mi := &file_chat_proto_msgTypes[16]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *MentionNotice) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MentionNotice) ProtoMessage() {}
+
+func (x *MentionNotice) ProtoReflect() protoreflect.Message {
+	mi := &file_chat_proto_msgTypes[16]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MentionNotice.ProtoReflect.Descriptor instead.
+func (*MentionNotice) Descriptor() ([]byte, []int) {
+	return file_chat_proto_rawDescGZIP(), []int{16}
+}
+
+func (x *MentionNotice) GetRoom() string {
+	if x != nil {
+		return x.Room
+	}
+	return ""
+}
+
+func (x *MentionNotice) GetFrom() string {
+	if x != nil {
+		return x.From
+	}
+	return ""
+}
+
+func (x *MentionNotice) GetMessageId() uint64 {
+	if x != nil {
+		return x.MessageId
+	}
+	return 0
+}
+
+func (x *MentionNotice) GetMessageBody() string {
+	if x != nil {
+		return x.MessageBody
+	}
+	return ""
+}
+
+// File transfer. The sender offers a file (without an ID) to a user or room.
+// The server answers with the file's ID and pulls it up chunk by chunk with
+// FileAccept; once it has all of it and the checksum matches it confirms
+// with a FileComplete and passes the FileOffer (now with the ID) on.
+// Recipients download the same way: a FileAccept asks for the chunk at an
+// offset, and a FileComplete follows the last one. Keeping one chunk in
+// flight at a time lets chat frames interleave with the transfer.
+type FileOffer struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	FileId        uint64                 `protobuf:"varint,1,opt,name=file_id,json=fileId,proto3" json:"file_id,omitempty"` // set by the server
+	From          string                 `protobuf:"bytes,2,opt,name=from,proto3" json:"from,omitempty"`                    // server will overwrite
+	To            string                 `protobuf:"bytes,3,opt,name=to,proto3" json:"to,omitempty"`                        // a user, or
+	Room          string                 `protobuf:"bytes,4,opt,name=room,proto3" json:"room,omitempty"`                    // a room
+	Name          string                 `protobuf:"bytes,5,opt,name=name,proto3" json:"name,omitempty"`
+	Size          uint64                 `protobuf:"varint,6,opt,name=size,proto3" json:"size,omitempty"`
+	Sha256        []byte                 `protobuf:"bytes,7,opt,name=sha256,proto3" json:"sha256,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *FileOffer) Reset() {
+	*x = FileOffer{}
+	mi := &file_chat_proto_msgTypes[17]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *FileOffer) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FileOffer) ProtoMessage() {}
+
+func (x *FileOffer) ProtoReflect() protoreflect.Message {
+	mi := &file_chat_proto_msgTypes[17]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FileOffer.ProtoReflect.Descriptor instead.
+func (*FileOffer) Descriptor() ([]byte, []int) {
+	return file_chat_proto_rawDescGZIP(), []int{17}
+}
+
+func (x *FileOffer) GetFileId() uint64 {
+	if x != nil {
+		return x.FileId
+	}
+	return 0
+}
+
+func (x *FileOffer) GetFrom() string {
+	if x != nil {
+		return x.From
+	}
+	return ""
+}
+
+func (x *FileOffer) GetTo() string {
+	if x != nil {
+		return x.To
+	}
+	return ""
+}
+
+func (x *FileOffer) GetRoom() string {
+	if x != nil {
+		return x.Room
+	}
+	return ""
+}
+
+func (x *FileOffer) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *FileOffer) GetSize() uint64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+func (x *FileOffer) GetSha256() []byte {
+	if x != nil {
+		return x.Sha256
+	}
+	return nil
+}
+
+type FileAccept struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	FileId        uint64                 `protobuf:"varint,1,opt,name=file_id,json=fileId,proto3" json:"file_id,omitempty"`
+	Offset        uint64                 `protobuf:"varint,2,opt,name=offset,proto3" json:"offset,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *FileAccept) Reset() {
+	*x = FileAccept{}
+	mi := &file_chat_proto_msgTypes[18]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *FileAccept) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FileAccept) ProtoMessage() {}
+
+func (x *FileAccept) ProtoReflect() protoreflect.Message {
+	mi := &file_chat_proto_msgTypes[18]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FileAccept.ProtoReflect.Descriptor instead.
+func (*FileAccept) Descriptor() ([]byte, []int) {
+	return file_chat_proto_rawDescGZIP(), []int{18}
+}
+
+func (x *FileAccept) GetFileId() uint64 {
+	if x != nil {
+		return x.FileId
+	}
+	return 0
+}
+
+func (x *FileAccept) GetOffset() uint64 {
+	if x != nil {
+		return x.Offset
+	}
+	return 0
+}
+
+type FileChunk struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	FileId        uint64                 `protobuf:"varint,1,opt,name=file_id,json=fileId,proto3" json:"file_id,omitempty"`
+	Offset        uint64                 `protobuf:"varint,2,opt,name=offset,proto3" json:"offset,omitempty"`
+	Data          []byte                 `protobuf:"bytes,3,opt,name=data,proto3" json:"data,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *FileChunk) Reset() {
+	*x = FileChunk{}
+	mi := &file_chat_proto_msgTypes[19]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *FileChunk) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FileChunk) ProtoMessage() {}
+
+func (x *FileChunk) ProtoReflect() protoreflect.Message {
+	mi := &file_chat_proto_msgTypes[19]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FileChunk.ProtoReflect.Descriptor instead.
+func (*FileChunk) Descriptor() ([]byte, []int) {
+	return file_chat_proto_rawDescGZIP(), []int{19}
+}
+
+func (x *FileChunk) GetFileId() uint64 {
+	if x != nil {
+		return x.FileId
+	}
+	return 0
+}
+
+func (x *FileChunk) GetOffset() uint64 {
+	if x != nil {
+		return x.Offset
+	}
+	return 0
+}
+
+func (x *FileChunk) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+type FileComplete struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	FileId        uint64                 `protobuf:"varint,1,opt,name=file_id,json=fileId,proto3" json:"file_id,omitempty"` // 0 if the offer itself was refused
+	Sha256        []byte                 `protobuf:"bytes,2,opt,name=sha256,proto3" json:"sha256,omitempty"`
+	Error         string                 `protobuf:"bytes,3,opt,name=error,proto3" json:"error,omitempty"` // set if the transfer failed
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *FileComplete) Reset() {
+	*x = FileComplete{}
+	mi := &file_chat_proto_msgTypes[20]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *FileComplete) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FileComplete) ProtoMessage() {}
+
+func (x *FileComplete) ProtoReflect() protoreflect.Message {
+	mi := &file_chat_proto_msgTypes[20]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FileComplete.ProtoReflect.Descriptor instead.
+func (*FileComplete) Descriptor() ([]byte, []int) {
+	return file_chat_proto_rawDescGZIP(), []int{20}
+}
+
+func (x *FileComplete) GetFileId() uint64 {
+	if x != nil {
+		return x.FileId
+	}
+	return 0
+}
+
+func (x *FileComplete) GetSha256() []byte {
+	if x != nil {
+		return x.Sha256
+	}
+	return nil
+}
+
+func (x *FileComplete) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+// PublishKey puts a user's X25519 public key in the server's key directory,
+// which lasts as long as their connection. The server sends one back (with
+// an empty key if the user has none) in answer to a KeyRequest.
+type PublishKey struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Username      string                 `protobuf:"bytes,1,opt,name=username,proto3" json:"username,omitempty"` // server will overwrite
+	PublicKey     []byte                 `protobuf:"bytes,2,opt,name=public_key,json=publicKey,proto3" json:"public_key,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PublishKey) Reset() {
+	*x = PublishKey{}
+	mi := &file_chat_proto_msgTypes[21]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PublishKey) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PublishKey) ProtoMessage() {}
+
+func (x *PublishKey) ProtoReflect() protoreflect.Message {
+	mi := &file_chat_proto_msgTypes[21]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PublishKey.ProtoReflect.Descriptor instead.
+func (*PublishKey) Descriptor() ([]byte, []int) {
+	return file_chat_proto_rawDescGZIP(), []int{21}
+}
+
+func (x *PublishKey) GetUsername() string {
+	if x != nil {
+		return x.Username
+	}
+	return ""
+}
+
+func (x *PublishKey) GetPublicKey() []byte {
+	if x != nil {
+		return x.PublicKey
+	}
+	return nil
+}
+
+type KeyRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Username      string                 `protobuf:"bytes,1,opt,name=username,proto3" json:"username,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *KeyRequest) Reset() {
+	*x = KeyRequest{}
+	mi := &file_chat_proto_msgTypes[22]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *KeyRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*KeyRequest) ProtoMessage() {}
+
+func (x *KeyRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_chat_proto_msgTypes[22]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use KeyRequest.ProtoReflect.Descriptor instead.
+func (*KeyRequest) Descriptor() ([]byte, []int) {
+	return file_chat_proto_rawDescGZIP(), []int{22}
+}
+
+func (x *KeyRequest) GetUsername() string {
+	if x != nil {
+		return x.Username
+	}
+	return ""
+}
+
+// Direct message: either a plaintext message_body or, end-to-end encrypted,
+// a ciphertext: AES-256-GCM under a key derived from X25519 between
+// sender_key and the recipient's published key. The server only ever sees
+// the ciphertext.
+type DirectChat struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	From          string                 `protobuf:"bytes,1,opt,name=from,proto3" json:"from,omitempty"` // server will overwrite
+	To            string                 `protobuf:"bytes,2,opt,name=to,proto3" json:"to,omitempty"`
+	MessageBody   string                 `protobuf:"bytes,3,opt,name=message_body,json=messageBody,proto3" json:"message_body,omitempty"`
+	Ciphertext    []byte                 `protobuf:"bytes,4,opt,name=ciphertext,proto3" json:"ciphertext,omitempty"`
+	Nonce         []byte                 `protobuf:"bytes,5,opt,name=nonce,proto3" json:"nonce,omitempty"`
+	SenderKey     []byte                 `protobuf:"bytes,6,opt,name=sender_key,json=senderKey,proto3" json:"sender_key,omitempty"`     // the sender's public key, so the recipient can check it
+	TtlSeconds    uint32                 `protobuf:"varint,7,opt,name=ttl_seconds,json=ttlSeconds,proto3" json:"ttl_seconds,omitempty"` // the recipient's client forgets it after this long
+	Retention     *DMRetention           `protobuf:"bytes,8,opt,name=retention,proto3" json:"retention,omitempty"`                      // the sender's retention for this conversation
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DirectChat) Reset() {
+	*x = DirectChat{}
+	mi := &file_chat_proto_msgTypes[23]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DirectChat) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DirectChat) ProtoMessage() {}
+
+func (x *DirectChat) ProtoReflect() protoreflect.Message {
+	mi := &file_chat_proto_msgTypes[23]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DirectChat.ProtoReflect.Descriptor instead.
+func (*DirectChat) Descriptor() ([]byte, []int) {
+	return file_chat_proto_rawDescGZIP(), []int{23}
+}
+
+func (x *DirectChat) GetFrom() string {
+	if x != nil {
+		return x.From
+	}
+	return ""
+}
+
+func (x *DirectChat) GetTo() string {
+	if x != nil {
+		return x.To
+	}
+	return ""
+}
+
+func (x *DirectChat) GetMessageBody() string {
+	if x != nil {
+		return x.MessageBody
+	}
+	return ""
+}
+
+func (x *DirectChat) GetCiphertext() []byte {
+	if x != nil {
+		return x.Ciphertext
+	}
+	return nil
+}
+
+func (x *DirectChat) GetNonce() []byte {
+	if x != nil {
+		return x.Nonce
+	}
+	return nil
+}
+
+func (x *DirectChat) GetSenderKey() []byte {
+	if x != nil {
+		return x.SenderKey
+	}
+	return nil
+}
+
+func (x *DirectChat) GetTtlSeconds() uint32 {
+	if x != nil {
+		return x.TtlSeconds
+	}
+	return 0
+}
+
+func (x *DirectChat) GetRetention() *DMRetention {
+	if x != nil {
+		return x.Retention
+	}
+	return nil
+}
+
+// DMRetention is how long one side of a DM conversation keeps it: the
+// newest keep messages, for up to max_age_seconds, or not at all. The server
+// keeps no DMs, so this is for the clients: each sends its own with every
+// DM, and both ends keep their copies to the stricter of the two.
+type DMRetention struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Keep          uint32                 `protobuf:"varint,1,opt,name=keep,proto3" json:"keep,omitempty"`
+	MaxAgeSeconds int64                  `protobuf:"varint,2,opt,name=max_age_seconds,json=maxAgeSeconds,proto3" json:"max_age_seconds,omitempty"`
+	Ephemeral     bool                   `protobuf:"varint,3,opt,name=ephemeral,proto3" json:"ephemeral,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DMRetention) Reset() {
+	*x = DMRetention{}
+	mi := &file_chat_proto_msgTypes[24]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DMRetention) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DMRetention) ProtoMessage() {}
+
+func (x *DMRetention) ProtoReflect() protoreflect.Message {
+	mi := &file_chat_proto_msgTypes[24]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DMRetention.ProtoReflect.Descriptor instead.
+func (*DMRetention) Descriptor() ([]byte, []int) {
+	return file_chat_proto_rawDescGZIP(), []int{24}
+}
+
+func (x *DMRetention) GetKeep() uint32 {
+	if x != nil {
+		return x.Keep
+	}
+	return 0
+}
+
+func (x *DMRetention) GetMaxAgeSeconds() int64 {
+	if x != nil {
+		return x.MaxAgeSeconds
+	}
+	return 0
+}
+
+func (x *DMRetention) GetEphemeral() bool {
+	if x != nil {
+		return x.Ephemeral
+	}
+	return false
+}
+
+// Says a user is typing in a room (or to one user, when "to" is set).
+// Clients send it every few seconds while typing; it is relayed, never stored.
+type Typing struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Username      string                 `protobuf:"bytes,1,opt,name=username,proto3" json:"username,omitempty"` // server will overwrite
+	Room          string                 `protobuf:"bytes,2,opt,name=room,proto3" json:"room,omitempty"`
+	To            string                 `protobuf:"bytes,3,opt,name=to,proto3" json:"to,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Typing) Reset() {
+	*x = Typing{}
+	mi := &file_chat_proto_msgTypes[25]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Typing) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Typing) ProtoMessage() {}
+
+func (x *Typing) ProtoReflect() protoreflect.Message {
+	mi := &file_chat_proto_msgTypes[25]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Typing.ProtoReflect.Descriptor instead.
+func (*Typing) Descriptor() ([]byte, []int) {
+	return file_chat_proto_rawDescGZIP(), []int{25}
+}
+
+func (x *Typing) GetUsername() string {
+	if x != nil {
+		return x.Username
+	}
+	return ""
+}
+
+func (x *Typing) GetRoom() string {
+	if x != nil {
+		return x.Room
+	}
+	return ""
+}
+
+func (x *Typing) GetTo() string {
+	if x != nil {
+		return x.To
+	}
+	return ""
+}
+
+// Command runs a slash command on the server: whatever the client doesn't
+// handle itself. An empty name asks for a CommandList instead. Results come
+// back as notices.
+type Command struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"` // without the slash
+	Args          []string               `protobuf:"bytes,2,rep,name=args,proto3" json:"args,omitempty"` // the rest of the line, split on spaces
+	Room          string                 `protobuf:"bytes,3,opt,name=room,proto3" json:"room,omitempty"` // the client's current room, if any
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Command) Reset() {
+	*x = Command{}
+	mi := &file_chat_proto_msgTypes[26]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Command) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Command) ProtoMessage() {}
+
+func (x *Command) ProtoReflect() protoreflect.Message {
+	mi := &file_chat_proto_msgTypes[26]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Command.ProtoReflect.Descriptor instead.
+func (*Command) Descriptor() ([]byte, []int) {
+	return file_chat_proto_rawDescGZIP(), []int{26}
+}
+
+func (x *Command) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Command) GetArgs() []string {
+	if x != nil {
+		return x.Args
+	}
+	return nil
+}
+
+func (x *Command) GetRoom() string {
+	if x != nil {
+		return x.Room
+	}
+	return ""
+}
+
+// CommandList is every command the server runs, for /help.
+type CommandList struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Commands      []*CommandSpec         `protobuf:"bytes,1,rep,name=commands,proto3" json:"commands,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CommandList) Reset() {
+	*x = CommandList{}
+	mi := &file_chat_proto_msgTypes[27]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CommandList) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CommandList) ProtoMessage() {}
+
+func (x *CommandList) ProtoReflect() protoreflect.Message {
+	mi := &file_chat_proto_msgTypes[27]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CommandList.ProtoReflect.Descriptor instead.
+func (*CommandList) Descriptor() ([]byte, []int) {
+	return file_chat_proto_rawDescGZIP(), []int{27}
+}
+
+func (x *CommandList) GetCommands() []*CommandSpec {
+	if x != nil {
+		return x.Commands
+	}
+	return nil
+}
+
+type CommandSpec struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Help          string                 `protobuf:"bytes,2,opt,name=help,proto3" json:"help,omitempty"`
+	Args          []*CommandArg          `protobuf:"bytes,3,rep,name=args,proto3" json:"args,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CommandSpec) Reset() {
+	*x = CommandSpec{}
+	mi := &file_chat_proto_msgTypes[28]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CommandSpec) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CommandSpec) ProtoMessage() {}
+
+func (x *CommandSpec) ProtoReflect() protoreflect.Message {
+	mi := &file_chat_proto_msgTypes[28]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CommandSpec.ProtoReflect.Descriptor instead.
+func (*CommandSpec) Descriptor() ([]byte, []int) {
+	return file_chat_proto_rawDescGZIP(), []int{28}
+}
+
+func (x *CommandSpec) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *CommandSpec) GetHelp() string {
+	if x != nil {
+		return x.Help
+	}
+	return ""
+}
+
+func (x *CommandSpec) GetArgs() []*CommandArg {
+	if x != nil {
+		return x.Args
+	}
+	return nil
+}
+
+type CommandArg struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Optional      bool                   `protobuf:"varint,2,opt,name=optional,proto3" json:"optional,omitempty"`
+	Rest          bool                   `protobuf:"varint,3,opt,name=rest,proto3" json:"rest,omitempty"` // takes everything after it, spaces and all
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CommandArg) Reset() {
+	*x = CommandArg{}
+	mi := &file_chat_proto_msgTypes[29]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CommandArg) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CommandArg) ProtoMessage() {}
+
+func (x *CommandArg) ProtoReflect() protoreflect.Message {
+	mi := &file_chat_proto_msgTypes[29]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CommandArg.ProtoReflect.Descriptor instead.
+func (*CommandArg) Descriptor() ([]byte, []int) {
+	return file_chat_proto_rawDescGZIP(), []int{29}
+}
+
+func (x *CommandArg) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *CommandArg) GetOptional() bool {
+	if x != nil {
+		return x.Optional
+	}
+	return false
+}
+
+func (x *CommandArg) GetRest() bool {
+	if x != nil {
+		return x.Rest
+	}
+	return false
+}
+
+// Cluster: frames between server nodes, never sent to clients. Nodes link
+// to a hub node over the same framing clients use. As with FedHello, the
+// node and the hub swap nonces, the hub's reply carrying its proof, and
+// then the node sends its own; the hub's last ClusterHello accepts it.
+// Proofs are HMAC-SHA256 under the cluster's secret, over both nonces.
+type ClusterHello struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Node          uint32                 `protobuf:"varint,1,opt,name=node,proto3" json:"node,omitempty"` // the sender's node ID, 1-255
+	Nonce         []byte                 `protobuf:"bytes,3,opt,name=nonce,proto3" json:"nonce,omitempty"`
+	Proof         []byte                 `protobuf:"bytes,4,opt,name=proof,proto3" json:"proof,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ClusterHello) Reset() {
+	*x = ClusterHello{}
+	mi := &file_chat_proto_msgTypes[30]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ClusterHello) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ClusterHello) ProtoMessage() {}
+
+func (x *ClusterHello) ProtoReflect() protoreflect.Message {
+	mi := &file_chat_proto_msgTypes[30]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ClusterHello.ProtoReflect.Descriptor instead.
+func (*ClusterHello) Descriptor() ([]byte, []int) {
+	return file_chat_proto_rawDescGZIP(), []int{30}
+}
+
+func (x *ClusterHello) GetNode() uint32 {
+	if x != nil {
+		return x.Node
+	}
+	return 0
+}
+
+func (x *ClusterHello) GetNonce() []byte {
+	if x != nil {
+		return x.Nonce
+	}
+	return nil
+}
+
+func (x *ClusterHello) GetProof() []byte {
+	if x != nil {
+		return x.Proof
+	}
+	return nil
+}
+
+// ClusterClaim asks the hub for a username cluster-wide, or gives it back
+// with release. Only claims are answered, with a ClusterClaimResult.
+type ClusterClaim struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Seq           uint64                 `protobuf:"varint,1,opt,name=seq,proto3" json:"seq,omitempty"`
+	Username      string                 `protobuf:"bytes,2,opt,name=username,proto3" json:"username,omitempty"`
+	Release       bool                   `protobuf:"varint,3,opt,name=release,proto3" json:"release,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ClusterClaim) Reset() {
+	*x = ClusterClaim{}
+	mi := &file_chat_proto_msgTypes[31]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ClusterClaim) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ClusterClaim) ProtoMessage() {}
+
+func (x *ClusterClaim) ProtoReflect() protoreflect.Message {
+	mi := &file_chat_proto_msgTypes[31]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ClusterClaim.ProtoReflect.Descriptor instead.
+func (*ClusterClaim) Descriptor() ([]byte, []int) {
+	return file_chat_proto_rawDescGZIP(), []int{31}
+}
+
+func (x *ClusterClaim) GetSeq() uint64 {
+	if x != nil {
+		return x.Seq
+	}
+	return 0
+}
+
+func (x *ClusterClaim) GetUsername() string {
+	if x != nil {
+		return x.Username
+	}
+	return ""
+}
+
+func (x *ClusterClaim) GetRelease() bool {
+	if x != nil {
+		return x.Release
+	}
+	return false
+}
+
+type ClusterClaimResult struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Seq           uint64                 `protobuf:"varint,1,opt,name=seq,proto3" json:"seq,omitempty"`
+	Error         string                 `protobuf:"bytes,2,opt,name=error,proto3" json:"error,omitempty"`                                    // empty if the name is now the claimer's
+	AlreadyYours  bool                   `protobuf:"varint,3,opt,name=already_yours,json=alreadyYours,proto3" json:"already_yours,omitempty"` // set with error when the claimer already held it
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ClusterClaimResult) Reset() {
+	*x = ClusterClaimResult{}
+	mi := &file_chat_proto_msgTypes[32]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ClusterClaimResult) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ClusterClaimResult) ProtoMessage() {}
+
+func (x *ClusterClaimResult) ProtoReflect() protoreflect.Message {
+	mi := &file_chat_proto_msgTypes[32]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ClusterClaimResult.ProtoReflect.Descriptor instead.
+func (*ClusterClaimResult) Descriptor() ([]byte, []int) {
+	return file_chat_proto_rawDescGZIP(), []int{32}
+}
+
+func (x *ClusterClaimResult) GetSeq() uint64 {
+	if x != nil {
+		return x.Seq
+	}
+	return 0
+}
+
+func (x *ClusterClaimResult) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+func (x *ClusterClaimResult) GetAlreadyYours() bool {
+	if x != nil {
+		return x.AlreadyYours
+	}
+	return false
+}
+
+// ClusterEvent is something one node tells every other node.
+type ClusterEvent struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Kind          ClusterEvent_Kind      `protobuf:"varint,1,opt,name=kind,proto3,enum=ClusterEvent_Kind" json:"kind,omitempty"`
+	Node          uint32                 `protobuf:"varint,2,opt,name=node,proto3" json:"node,omitempty"` // where it happened
+	Room          string                 `protobuf:"bytes,3,opt,name=room,proto3" json:"room,omitempty"`
+	Username      string                 `protobuf:"bytes,4,opt,name=username,proto3" json:"username,omitempty"`
+	Payload       *Wrapper               `protobuf:"bytes,5,opt,name=payload,proto3" json:"payload,omitempty"`
+	PublicKey     []byte                 `protobuf:"bytes,6,opt,name=public_key,json=publicKey,proto3" json:"public_key,omitempty"`
+	Operator      string                 `protobuf:"bytes,7,opt,name=operator,proto3" json:"operator,omitempty"` // on JOIN: the room's operator, on the node it came from
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ClusterEvent) Reset() {
+	*x = ClusterEvent{}
+	mi := &file_chat_proto_msgTypes[33]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ClusterEvent) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ClusterEvent) ProtoMessage() {}
+
+func (x *ClusterEvent) ProtoReflect() protoreflect.Message {
+	mi := &file_chat_proto_msgTypes[33]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ClusterEvent.ProtoReflect.Descriptor instead.
+func (*ClusterEvent) Descriptor() ([]byte, []int) {
+	return file_chat_proto_rawDescGZIP(), []int{33}
+}
+
+func (x *ClusterEvent) GetKind() ClusterEvent_Kind {
+	if x != nil {
+		return x.Kind
+	}
+	return ClusterEvent_ROOM
+}
+
+func (x *ClusterEvent) GetNode() uint32 {
+	if x != nil {
+		return x.Node
+	}
+	return 0
+}
+
+func (x *ClusterEvent) GetRoom() string {
+	if x != nil {
+		return x.Room
+	}
+	return ""
+}
+
+func (x *ClusterEvent) GetUsername() string {
+	if x != nil {
+		return x.Username
+	}
+	return ""
+}
+
+func (x *ClusterEvent) GetPayload() *Wrapper {
+	if x != nil {
+		return x.Payload
+	}
+	return nil
+}
+
+func (x *ClusterEvent) GetPublicKey() []byte {
+	if x != nil {
+		return x.PublicKey
+	}
+	return nil
+}
+
+func (x *ClusterEvent) GetOperator() string {
+	if x != nil {
+		return x.Operator
+	}
+	return ""
+}
+
+// Federation: frames between independent servers, never sent to clients.
+// A link starts with a FedHello each way, then a second one from the
+// dialer carrying its proof. Proofs are HMAC-SHA256 under the secret the
+// two servers share, over both nonces.
+type FedHello struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Server        string                 `protobuf:"bytes,1,opt,name=server,proto3" json:"server,omitempty"` // the sender's server name
+	Nonce         []byte                 `protobuf:"bytes,2,opt,name=nonce,proto3" json:"nonce,omitempty"`
+	Proof         []byte                 `protobuf:"bytes,3,opt,name=proof,proto3" json:"proof,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *FedHello) Reset() {
+	*x = FedHello{}
+	mi := &file_chat_proto_msgTypes[34]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *FedHello) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FedHello) ProtoMessage() {}
+
+func (x *FedHello) ProtoReflect() protoreflect.Message {
+	mi := &file_chat_proto_msgTypes[34]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FedHello.ProtoReflect.Descriptor instead.
+func (*FedHello) Descriptor() ([]byte, []int) {
+	return file_chat_proto_rawDescGZIP(), []int{34}
+}
+
+func (x *FedHello) GetServer() string {
+	if x != nil {
+		return x.Server
+	}
+	return ""
+}
+
+func (x *FedHello) GetNonce() []byte {
+	if x != nil {
+		return x.Nonce
+	}
+	return nil
+}
+
+func (x *FedHello) GetProof() []byte {
+	if x != nil {
+		return x.Proof
+	}
+	return nil
+}
+
+// FedFrame carries a frame from one of the sending server's users, to be
+// acted on by their proxy on the receiving server, or with deliver, a frame
+// that proxy was sent, for the receiving server's user. Names in payload
+// are always as the receiving server sees them.
+type FedFrame struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	User          string                 `protobuf:"bytes,1,opt,name=user,proto3" json:"user,omitempty"` // a local user of whichever server isn't the proxy's
+	Payload       *Wrapper               `protobuf:"bytes,2,opt,name=payload,proto3" json:"payload,omitempty"`
+	Features      []string               `protobuf:"bytes,3,rep,name=features,proto3" json:"features,omitempty"` // what the user's connection negotiated
+	Bye           bool                   `protobuf:"varint,4,opt,name=bye,proto3" json:"bye,omitempty"`          // the user's session (or with deliver, their proxy) is gone
+	Deliver       bool                   `protobuf:"varint,5,opt,name=deliver,proto3" json:"deliver,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *FedFrame) Reset() {
+	*x = FedFrame{}
+	mi := &file_chat_proto_msgTypes[35]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *FedFrame) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FedFrame) ProtoMessage() {}
+
+func (x *FedFrame) ProtoReflect() protoreflect.Message {
+	mi := &file_chat_proto_msgTypes[35]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FedFrame.ProtoReflect.Descriptor instead.
+func (*FedFrame) Descriptor() ([]byte, []int) {
+	return file_chat_proto_rawDescGZIP(), []int{35}
+}
+
+func (x *FedFrame) GetUser() string {
+	if x != nil {
+		return x.User
+	}
+	return ""
+}
+
+func (x *FedFrame) GetPayload() *Wrapper {
+	if x != nil {
+		return x.Payload
+	}
+	return nil
+}
+
+func (x *FedFrame) GetFeatures() []string {
+	if x != nil {
+		return x.Features
+	}
+	return nil
+}
+
+func (x *FedFrame) GetBye() bool {
+	if x != nil {
+		return x.Bye
+	}
+	return false
+}
+
+func (x *FedFrame) GetDeliver() bool {
+	if x != nil {
+		return x.Deliver
+	}
+	return false
+}
+
+type Wrapper struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Types that are valid to be assigned to Msg:
+	//
+	//	*Wrapper_RegistrationMessage
+	//	*Wrapper_ServerNotice
+	//	*Wrapper_Hello
+	//	*Wrapper_Welcome
+	//	*Wrapper_RoomJoin
+	//	*Wrapper_RoomLeave
+	//	*Wrapper_RoomChat
+	//	*Wrapper_EditMessage
+	//	*Wrapper_DeleteMessage
+	//	*Wrapper_ThreadRequest
+	//	*Wrapper_ThreadView
+	//	*Wrapper_Reaction
+	//	*Wrapper_MentionNotice
+	//	*Wrapper_Typing
+	//	*Wrapper_DirectChat
+	//	*Wrapper_FileOffer
+	//	*Wrapper_FileAccept
+	//	*Wrapper_FileChunk
+	//	*Wrapper_FileComplete
+	//	*Wrapper_PublishKey
+	//	*Wrapper_KeyRequest
+	//	*Wrapper_Search
+	//	*Wrapper_SearchResults
+	//	*Wrapper_RoomRetention
+	//	*Wrapper_Command
+	//	*Wrapper_CommandList
+	//	*Wrapper_ClusterHello
+	//	*Wrapper_ClusterClaim
+	//	*Wrapper_ClusterClaimResult
+	//	*Wrapper_ClusterEvent
+	//	*Wrapper_FedHello
+	//	*Wrapper_FedFrame
+	Msg           isWrapper_Msg `protobuf_oneof:"msg"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Wrapper) Reset() {
+	*x = Wrapper{}
+	mi := &file_chat_proto_msgTypes[36]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Wrapper) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Wrapper) ProtoMessage() {}
+
+func (x *Wrapper) ProtoReflect() protoreflect.Message {
+	mi := &file_chat_proto_msgTypes[36]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Wrapper.ProtoReflect.Descriptor instead.
+func (*Wrapper) Descriptor() ([]byte, []int) {
+	return file_chat_proto_rawDescGZIP(), []int{36}
+}
+
+func (x *Wrapper) GetMsg() isWrapper_Msg {
+	if x != nil {
+		return x.Msg
+	}
+	return nil
+}
+
+func (x *Wrapper) GetRegistrationMessage() *Registration {
+	if x != nil {
+		if x, ok := x.Msg.(*Wrapper_RegistrationMessage); ok {
+			return x.RegistrationMessage
+		}
+	}
+	return nil
+}
+
+func (x *Wrapper) GetServerNotice() *ServerNotice {
+	if x != nil {
+		if x, ok := x.Msg.(*Wrapper_ServerNotice); ok {
+			return x.ServerNotice
+		}
+	}
+	return nil
+}
+
+func (x *Wrapper) GetHello() *Hello {
+	if x != nil {
+		if x, ok := x.Msg.(*Wrapper_Hello); ok {
+			return x.Hello
+		}
+	}
+	return nil
+}
+
+func (x *Wrapper) GetWelcome() *Welcome {
+	if x != nil {
+		if x, ok := x.Msg.(*Wrapper_Welcome); ok {
+			return x.Welcome
+		}
+	}
+	return nil
+}
+
+func (x *Wrapper) GetRoomJoin() *RoomJoin {
+	if x != nil {
+		if x, ok := x.Msg.(*Wrapper_RoomJoin); ok {
+			return x.RoomJoin
+		}
 	}
 	return nil
 }
@@ -442,6 +2626,69 @@ func (x *Wrapper) GetRoomChat() *RoomChat {
 	return nil
 }
 
+func (x *Wrapper) GetEditMessage() *EditMessage {
+	if x != nil {
+		if x, ok := x.Msg.(*Wrapper_EditMessage); ok {
+			return x.EditMessage
+		}
+	}
+	return nil
+}
+
+func (x *Wrapper) GetDeleteMessage() *DeleteMessage {
+	if x != nil {
+		if x, ok := x.Msg.(*Wrapper_DeleteMessage); ok {
+			return x.DeleteMessage
+		}
+	}
+	return nil
+}
+
+func (x *Wrapper) GetThreadRequest() *ThreadRequest {
+	if x != nil {
+		if x, ok := x.Msg.(*Wrapper_ThreadRequest); ok {
+			return x.ThreadRequest
+		}
+	}
+	return nil
+}
+
+func (x *Wrapper) GetThreadView() *ThreadView {
+	if x != nil {
+		if x, ok := x.Msg.(*Wrapper_ThreadView); ok {
+			return x.ThreadView
+		}
+	}
+	return nil
+}
+
+func (x *Wrapper) GetReaction() *Reaction {
+	if x != nil {
+		if x, ok := x.Msg.(*Wrapper_Reaction); ok {
+			return x.Reaction
+		}
+	}
+	return nil
+}
+
+func (x *Wrapper) GetMentionNotice() *MentionNotice {
+	if x != nil {
+		if x, ok := x.Msg.(*Wrapper_MentionNotice); ok {
+			return x.MentionNotice
+		}
+	}
+	return nil
+}
+
+func (x *Wrapper) GetTyping() *Typing {
+	if x != nil {
+		if x, ok := x.Msg.(*Wrapper_Typing); ok {
+			return x.Typing
+		}
+	}
+	return nil
+}
+
 func (x *Wrapper) GetDirectChat() *DirectChat {
 	if x != nil {
 		if x, ok := x.Msg.(*Wrapper_DirectChat); ok {
@@ -451,6 +2698,159 @@ func (x *Wrapper) GetDirectChat() *DirectChat {
 	return nil
 }
 
+func (x *Wrapper) GetFileOffer() *FileOffer {
+	if x != nil {
+		if x, ok := x.Msg.(*Wrapper_FileOffer); ok {
+			return x.FileOffer
+		}
+	}
+	return nil
+}
+
+func (x *Wrapper) GetFileAccept() *FileAccept {
+	if x != nil {
+		if x, ok := x.Msg.(*Wrapper_FileAccept); ok {
+			return x.FileAccept
+		}
+	}
+	return nil
+}
+
+func (x *Wrapper) GetFileChunk() *FileChunk {
+	if x != nil {
+		if x, ok := x.Msg.(*Wrapper_FileChunk); ok {
+			return x.FileChunk
+		}
+	}
+	return nil
+}
+
+func (x *Wrapper) GetFileComplete() *FileComplete {
+	if x != nil {
+		if x, ok := x.Msg.(*Wrapper_FileComplete); ok {
+			return x.FileComplete
+		}
+	}
+	return nil
+}
+
+func (x *Wrapper) GetPublishKey() *PublishKey {
+	if x != nil {
+		if x, ok := x.Msg.(*Wrapper_PublishKey); ok {
+			return x.PublishKey
+		}
+	}
+	return nil
+}
+
+func (x *Wrapper) GetKeyRequest() *KeyRequest {
+	if x != nil {
+		if x, ok := x.Msg.(*Wrapper_KeyRequest); ok {
+			return x.KeyRequest
+		}
+	}
+	return nil
+}
+
+func (x *Wrapper) GetSearch() *Search {
+	if x != nil {
+		if x, ok := x.Msg.(*Wrapper_Search); ok {
+			return x.Search
+		}
+	}
+	return nil
+}
+
+func (x *Wrapper) GetSearchResults() *SearchResults {
+	if x != nil {
+		if x, ok := x.Msg.(*Wrapper_SearchResults); ok {
+			return x.SearchResults
+		}
+	}
+	return nil
+}
+
+func (x *Wrapper) GetRoomRetention() *RoomRetention {
+	if x != nil {
+		if x, ok := x.Msg.(*Wrapper_RoomRetention); ok {
+			return x.RoomRetention
+		}
+	}
+	return nil
+}
+
+func (x *Wrapper) GetCommand() *Command {
+	if x != nil {
+		if x, ok := x.Msg.(*Wrapper_Command); ok {
+			return x.Command
+		}
+	}
+	return nil
+}
+
+func (x *Wrapper) GetCommandList() *CommandList {
+	if x != nil {
+		if x, ok := x.Msg.(*Wrapper_CommandList); ok {
+			return x.CommandList
+		}
+	}
+	return nil
+}
+
+func (x *Wrapper) GetClusterHello() *ClusterHello {
+	if x != nil {
+		if x, ok := x.Msg.(*Wrapper_ClusterHello); ok {
+			return x.ClusterHello
+		}
+	}
+	return nil
+}
+
+func (x *Wrapper) GetClusterClaim() *ClusterClaim {
+	if x != nil {
+		if x, ok := x.Msg.(*Wrapper_ClusterClaim); ok {
+			return x.ClusterClaim
+		}
+	}
+	return nil
+}
+
+func (x *Wrapper) GetClusterClaimResult() *ClusterClaimResult {
+	if x != nil {
+		if x, ok := x.Msg.(*Wrapper_ClusterClaimResult); ok {
+			return x.ClusterClaimResult
+		}
+	}
+	return nil
+}
+
+func (x *Wrapper) GetClusterEvent() *ClusterEvent {
+	if x != nil {
+		if x, ok := x.Msg.(*Wrapper_ClusterEvent); ok {
+			return x.ClusterEvent
+		}
+	}
+	return nil
+}
+
+func (x *Wrapper) GetFedHello() *FedHello {
+	if x != nil {
+		if x, ok := x.Msg.(*Wrapper_FedHello); ok {
+			return x.FedHello
+		}
+	}
+	return nil
+}
+
+func (x *Wrapper) GetFedFrame() *FedFrame {
+	if x != nil {
+		if x, ok := x.Msg.(*Wrapper_FedFrame); ok {
+			return x.FedFrame
+		}
+	}
+	return nil
+}
+
 type isWrapper_Msg interface {
 	isWrapper_Msg()
 }
@@ -463,6 +2863,14 @@ type Wrapper_ServerNotice struct {
 	ServerNotice *ServerNotice `protobuf:"bytes,3,opt,name=server_notice,json=serverNotice,proto3,oneof"`
 }
 
+type Wrapper_Hello struct {
+	Hello *Hello `protobuf:"bytes,4,opt,name=hello,proto3,oneof"`
+}
+
+type Wrapper_Welcome struct {
+	Welcome *Welcome `protobuf:"bytes,5,opt,name=welcome,proto3,oneof"`
+}
+
 type Wrapper_RoomJoin struct {
 	RoomJoin *RoomJoin `protobuf:"bytes,10,opt,name=room_join,json=roomJoin,proto3,oneof"`
 }
@@ -475,28 +2883,191 @@ type Wrapper_RoomChat struct {
 	RoomChat *RoomChat `protobuf:"bytes,12,opt,name=room_chat,json=roomChat,proto3,oneof"`
 }
 
+type Wrapper_EditMessage struct {
+	EditMessage *EditMessage `protobuf:"bytes,13,opt,name=edit_message,json=editMessage,proto3,oneof"`
+}
+
+type Wrapper_DeleteMessage struct {
+	DeleteMessage *DeleteMessage `protobuf:"bytes,14,opt,name=delete_message,json=deleteMessage,proto3,oneof"`
+}
+
+type Wrapper_ThreadRequest struct {
+	ThreadRequest *ThreadRequest `protobuf:"bytes,15,opt,name=thread_request,json=threadRequest,proto3,oneof"`
+}
+
+type Wrapper_ThreadView struct {
+	ThreadView *ThreadView `protobuf:"bytes,16,opt,name=thread_view,json=threadView,proto3,oneof"`
+}
+
+type Wrapper_Reaction struct {
+	Reaction *Reaction `protobuf:"bytes,17,opt,name=reaction,proto3,oneof"`
+}
+
+type Wrapper_MentionNotice struct {
+	MentionNotice *MentionNotice `protobuf:"bytes,18,opt,name=mention_notice,json=mentionNotice,proto3,oneof"`
+}
+
+type Wrapper_Typing struct {
+	Typing *Typing `protobuf:"bytes,19,opt,name=typing,proto3,oneof"`
+}
+
 type Wrapper_DirectChat struct {
 	DirectChat *DirectChat `protobuf:"bytes,20,opt,name=direct_chat,json=directChat,proto3,oneof"`
 }
 
+type Wrapper_FileOffer struct {
+	FileOffer *FileOffer `protobuf:"bytes,21,opt,name=file_offer,json=fileOffer,proto3,oneof"`
+}
+
+type Wrapper_FileAccept struct {
+	FileAccept *FileAccept `protobuf:"bytes,22,opt,name=file_accept,json=fileAccept,proto3,oneof"`
+}
+
+type Wrapper_FileChunk struct {
+	FileChunk *FileChunk `protobuf:"bytes,23,opt,name=file_chunk,json=fileChunk,proto3,oneof"`
+}
+
+type Wrapper_FileComplete struct {
+	FileComplete *FileComplete `protobuf:"bytes,24,opt,name=file_complete,json=fileComplete,proto3,oneof"`
+}
+
+type Wrapper_PublishKey struct {
+	PublishKey *PublishKey `protobuf:"bytes,25,opt,name=publish_key,json=publishKey,proto3,oneof"`
+}
+
+type Wrapper_KeyRequest struct {
+	KeyRequest *KeyRequest `protobuf:"bytes,26,opt,name=key_request,json=keyRequest,proto3,oneof"`
+}
+
+type Wrapper_Search struct {
+	Search *Search `protobuf:"bytes,27,opt,name=search,proto3,oneof"`
+}
+
+type Wrapper_SearchResults struct {
+	SearchResults *SearchResults `protobuf:"bytes,28,opt,name=search_results,json=searchResults,proto3,oneof"`
+}
+
+type Wrapper_RoomRetention struct {
+	RoomRetention *RoomRetention `protobuf:"bytes,29,opt,name=room_retention,json=roomRetention,proto3,oneof"`
+}
+
+type Wrapper_Command struct {
+	Command *Command `protobuf:"bytes,30,opt,name=command,proto3,oneof"`
+}
+
+type Wrapper_CommandList struct {
+	CommandList *CommandList `protobuf:"bytes,31,opt,name=command_list,json=commandList,proto3,oneof"`
+}
+
+type Wrapper_ClusterHello struct {
+	ClusterHello *ClusterHello `protobuf:"bytes,40,opt,name=cluster_hello,json=clusterHello,proto3,oneof"`
+}
+
+type Wrapper_ClusterClaim struct {
+	ClusterClaim *ClusterClaim `protobuf:"bytes,41,opt,name=cluster_claim,json=clusterClaim,proto3,oneof"`
+}
+
+type Wrapper_ClusterClaimResult struct {
+	ClusterClaimResult *ClusterClaimResult `protobuf:"bytes,42,opt,name=cluster_claim_result,json=clusterClaimResult,proto3,oneof"`
+}
+
+type Wrapper_ClusterEvent struct {
+	ClusterEvent *ClusterEvent `protobuf:"bytes,43,opt,name=cluster_event,json=clusterEvent,proto3,oneof"`
+}
+
+type Wrapper_FedHello struct {
+	FedHello *FedHello `protobuf:"bytes,44,opt,name=fed_hello,json=fedHello,proto3,oneof"`
+}
+
+type Wrapper_FedFrame struct {
+	FedFrame *FedFrame `protobuf:"bytes,45,opt,name=fed_frame,json=fedFrame,proto3,oneof"`
+}
+
 func (*Wrapper_RegistrationMessage) isWrapper_Msg() {}
 
 func (*Wrapper_ServerNotice) isWrapper_Msg() {}
 
+func (*Wrapper_Hello) isWrapper_Msg() {}
+
+func (*Wrapper_Welcome) isWrapper_Msg() {}
+
 func (*Wrapper_RoomJoin) isWrapper_Msg() {}
 
 func (*Wrapper_RoomLeave) isWrapper_Msg() {}
 
 func (*Wrapper_RoomChat) isWrapper_Msg() {}
 
+func (*Wrapper_EditMessage) isWrapper_Msg() {}
+
+func (*Wrapper_DeleteMessage) isWrapper_Msg() {}
+
+func (*Wrapper_ThreadRequest) isWrapper_Msg() {}
+
+func (*Wrapper_ThreadView) isWrapper_Msg() {}
+
+func (*Wrapper_Reaction) isWrapper_Msg() {}
+
+func (*Wrapper_MentionNotice) isWrapper_Msg() {}
+
+func (*Wrapper_Typing) isWrapper_Msg() {}
+
 func (*Wrapper_DirectChat) isWrapper_Msg() {}
 
+func (*Wrapper_FileOffer) isWrapper_Msg() {}
+
+func (*Wrapper_FileAccept) isWrapper_Msg() {}
+
+func (*Wrapper_FileChunk) isWrapper_Msg() {}
+
+func (*Wrapper_FileComplete) isWrapper_Msg() {}
+
+func (*Wrapper_PublishKey) isWrapper_Msg() {}
+
+func (*Wrapper_KeyRequest) isWrapper_Msg() {}
+
+func (*Wrapper_Search) isWrapper_Msg() {}
+
+func (*Wrapper_SearchResults) isWrapper_Msg() {}
+
+func (*Wrapper_RoomRetention) isWrapper_Msg() {}
+
+func (*Wrapper_Command) isWrapper_Msg() {}
+
+func (*Wrapper_CommandList) isWrapper_Msg() {}
+
+func (*Wrapper_ClusterHello) isWrapper_Msg() {}
+
+func (*Wrapper_ClusterClaim) isWrapper_Msg() {}
+
+func (*Wrapper_ClusterClaimResult) isWrapper_Msg() {}
+
+func (*Wrapper_ClusterEvent) isWrapper_Msg() {}
+
+func (*Wrapper_FedHello) isWrapper_Msg() {}
+
+func (*Wrapper_FedFrame) isWrapper_Msg() {}
+
 var File_chat_proto protoreflect.FileDescriptor
 
 const file_chat_proto_rawDesc = "" +
 	"\n" +
 	"\n" +
-	"chat.proto\"*\n" +
+	"chat.proto\"o\n" +
+	"\x05Hello\x12)\n" +
+	"\x10protocol_version\x18\x01 \x01(\rR\x0fprotocolVersion\x12\x1a\n" +
+	"\bfeatures\x18\x02 \x03(\tR\bfeatures\x12\x1f\n" +
+	"\vclient_name\x18\x03 \x01(\tR\n" +
+	"clientName\"\x88\x01\n" +
+	"\fServerLimits\x12$\n" +
+	"\x0emax_frame_size\x18\x01 \x01(\x04R\fmaxFrameSize\x12.\n" +
+	"\x13max_username_length\x18\x02 \x01(\rR\x11maxUsernameLength\x12\"\n" +
+	"\rmax_file_size\x18\x03 \x01(\x04R\vmaxFileSize\"\x98\x01\n" +
+	"\aWelcome\x12)\n" +
+	"\x10protocol_version\x18\x01 \x01(\rR\x0fprotocolVersion\x12\x1a\n" +
+	"\bfeatures\x18\x02 \x03(\tR\bfeatures\x12%\n" +
+	"\x06limits\x18\x03 \x01(\v2\r.ServerLimitsR\x06limits\x12\x1f\n" +
+	"\vserver_name\x18\x04 \x01(\tR\n" +
+	"serverName\"*\n" +
 	"\fRegistration\x12\x1a\n" +
 	"\busername\x18\x01 \x01(\tR\busername\"6\n" +
 	"\fServerNotice\x12\x12\n" +
@@ -507,27 +3078,231 @@ const file_chat_proto_rawDesc = "" +
 	"\x04room\x18\x02 \x01(\tR\x04room\";\n" +
 	"\tRoomLeave\x12\x1a\n" +
 	"\busername\x18\x01 \x01(\tR\busername\x12\x12\n" +
-	"\x04room\x18\x02 \x01(\tR\x04room\"]\n" +
+	"\x04room\x18\x02 \x01(\tR\x04room\"\xbc\x03\n" +
 	"\bRoomChat\x12\x1a\n" +
 	"\busername\x18\x01 \x01(\tR\busername\x12\x12\n" +
 	"\x04room\x18\x02 \x01(\tR\x04room\x12!\n" +
-	"\fmessage_body\x18\x03 \x01(\tR\vmessageBody\"S\n" +
+	"\fmessage_body\x18\x03 \x01(\tR\vmessageBody\x12\x1d\n" +
+	"\n" +
+	"message_id\x18\x04 \x01(\x04R\tmessageId\x12\x16\n" +
+	"\x06edited\x18\x05 \x01(\bR\x06edited\x12\x19\n" +
+	"\breply_to\x18\x06 \x01(\x04R\areplyTo\x12\x1b\n" +
+	"\tthread_id\x18\a \x01(\x04R\bthreadId\x12\x1f\n" +
+	"\vreply_count\x18\b \x01(\rR\n" +
+	"replyCount\x126\n" +
+	"\treactions\x18\t \x03(\v2\x18.RoomChat.ReactionsEntryR\treactions\x12\x17\n" +
+	"\asent_at\x18\n" +
+	" \x01(\x03R\x06sentAt\x12\x1f\n" +
+	"\vttl_seconds\x18\v \x01(\rR\n" +
+	"ttlSeconds\x12\x1d\n" +
+	"\n" +
+	"expires_at\x18\f \x01(\x03R\texpiresAt\x1a<\n" +
+	"\x0eReactionsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\rR\x05value:\x028\x01\"\x95\x01\n" +
+	"\rRoomRetention\x12\x12\n" +
+	"\x04room\x18\x01 \x01(\tR\x04room\x12\x12\n" +
+	"\x04keep\x18\x02 \x01(\rR\x04keep\x12&\n" +
+	"\x0fmax_age_seconds\x18\x03 \x01(\x03R\rmaxAgeSeconds\x12\x1c\n" +
+	"\tephemeral\x18\x04 \x01(\bR\tephemeral\x12\x16\n" +
+	"\x06update\x18\x05 \x01(\bR\x06update\"\x9d\x01\n" +
+	"\bReaction\x12\x1a\n" +
+	"\busername\x18\x01 \x01(\tR\busername\x12\x12\n" +
+	"\x04room\x18\x02 \x01(\tR\x04room\x12\x1d\n" +
+	"\n" +
+	"message_id\x18\x03 \x01(\x04R\tmessageId\x12\x14\n" +
+	"\x05emoji\x18\x04 \x01(\tR\x05emoji\x12\x16\n" +
+	"\x06remove\x18\x05 \x01(\bR\x06remove\x12\x14\n" +
+	"\x05count\x18\x06 \x01(\rR\x05count\"@\n" +
+	"\rThreadRequest\x12\x12\n" +
+	"\x04room\x18\x01 \x01(\tR\x04room\x12\x1b\n" +
+	"\tthread_id\x18\x02 \x01(\x04R\bthreadId\"d\n" +
+	"\n" +
+	"ThreadView\x12\x12\n" +
+	"\x04room\x18\x01 \x01(\tR\x04room\x12\x1b\n" +
+	"\tthread_id\x18\x02 \x01(\x04R\bthreadId\x12%\n" +
+	"\bmessages\x18\x03 \x03(\v2\t.RoomChatR\bmessages\"\x88\x01\n" +
+	"\x06Search\x12\x14\n" +
+	"\x05query\x18\x01 \x01(\tR\x05query\x12\x12\n" +
+	"\x04room\x18\x02 \x01(\tR\x04room\x12\x12\n" +
+	"\x04from\x18\x03 \x01(\tR\x04from\x12\x14\n" +
+	"\x05since\x18\x04 \x01(\x03R\x05since\x12\x14\n" +
+	"\x05until\x18\x05 \x01(\x03R\x05until\x12\x14\n" +
+	"\x05limit\x18\x06 \x01(\rR\x05limit\"j\n" +
+	"\rSearchResults\x12\x14\n" +
+	"\x05query\x18\x01 \x01(\tR\x05query\x12%\n" +
+	"\bmessages\x18\x02 \x03(\v2\t.RoomChatR\bmessages\x12\x1c\n" +
+	"\ttruncated\x18\x03 \x01(\bR\ttruncated\"\x7f\n" +
+	"\vEditMessage\x12\x1a\n" +
+	"\busername\x18\x01 \x01(\tR\busername\x12\x12\n" +
+	"\x04room\x18\x02 \x01(\tR\x04room\x12\x1d\n" +
+	"\n" +
+	"message_id\x18\x03 \x01(\x04R\tmessageId\x12!\n" +
+	"\fmessage_body\x18\x04 \x01(\tR\vmessageBody\"^\n" +
+	"\rDeleteMessage\x12\x1a\n" +
+	"\busername\x18\x01 \x01(\tR\busername\x12\x12\n" +
+	"\x04room\x18\x02 \x01(\tR\x04room\x12\x1d\n" +
+	"\n" +
+	"message_id\x18\x03 \x01(\x04R\tmessageId\"y\n" +
+	"\rMentionNotice\x12\x12\n" +
+	"\x04room\x18\x01 \x01(\tR\x04room\x12\x12\n" +
+	"\x04from\x18\x02 \x01(\tR\x04from\x12\x1d\n" +
+	"\n" +
+	"message_id\x18\x03 \x01(\x04R\tmessageId\x12!\n" +
+	"\fmessage_body\x18\x04 \x01(\tR\vmessageBody\"\x9c\x01\n" +
+	"\tFileOffer\x12\x17\n" +
+	"\afile_id\x18\x01 \x01(\x04R\x06fileId\x12\x12\n" +
+	"\x04from\x18\x02 \x01(\tR\x04from\x12\x0e\n" +
+	"\x02to\x18\x03 \x01(\tR\x02to\x12\x12\n" +
+	"\x04room\x18\x04 \x01(\tR\x04room\x12\x12\n" +
+	"\x04name\x18\x05 \x01(\tR\x04name\x12\x12\n" +
+	"\x04size\x18\x06 \x01(\x04R\x04size\x12\x16\n" +
+	"\x06sha256\x18\a \x01(\fR\x06sha256\"=\n" +
+	"\n" +
+	"FileAccept\x12\x17\n" +
+	"\afile_id\x18\x01 \x01(\x04R\x06fileId\x12\x16\n" +
+	"\x06offset\x18\x02 \x01(\x04R\x06offset\"P\n" +
+	"\tFileChunk\x12\x17\n" +
+	"\afile_id\x18\x01 \x01(\x04R\x06fileId\x12\x16\n" +
+	"\x06offset\x18\x02 \x01(\x04R\x06offset\x12\x12\n" +
+	"\x04data\x18\x03 \x01(\fR\x04data\"U\n" +
+	"\fFileComplete\x12\x17\n" +
+	"\afile_id\x18\x01 \x01(\x04R\x06fileId\x12\x16\n" +
+	"\x06sha256\x18\x02 \x01(\fR\x06sha256\x12\x14\n" +
+	"\x05error\x18\x03 \x01(\tR\x05error\"G\n" +
+	"\n" +
+	"PublishKey\x12\x1a\n" +
+	"\busername\x18\x01 \x01(\tR\busername\x12\x1d\n" +
+	"\n" +
+	"public_key\x18\x02 \x01(\fR\tpublicKey\"(\n" +
+	"\n" +
+	"KeyRequest\x12\x1a\n" +
+	"\busername\x18\x01 \x01(\tR\busername\"\xf5\x01\n" +
 	"\n" +
 	"DirectChat\x12\x12\n" +
 	"\x04from\x18\x01 \x01(\tR\x04from\x12\x0e\n" +
 	"\x02to\x18\x02 \x01(\tR\x02to\x12!\n" +
-	"\fmessage_body\x18\x03 \x01(\tR\vmessageBody\"\xbb\x02\n" +
+	"\fmessage_body\x18\x03 \x01(\tR\vmessageBody\x12\x1e\n" +
+	"\n" +
+	"ciphertext\x18\x04 \x01(\fR\n" +
+	"ciphertext\x12\x14\n" +
+	"\x05nonce\x18\x05 \x01(\fR\x05nonce\x12\x1d\n" +
+	"\n" +
+	"sender_key\x18\x06 \x01(\fR\tsenderKey\x12\x1f\n" +
+	"\vttl_seconds\x18\a \x01(\rR\n" +
+	"ttlSeconds\x12*\n" +
+	"\tretention\x18\b \x01(\v2\f.DMRetentionR\tretention\"g\n" +
+	"\vDMRetention\x12\x12\n" +
+	"\x04keep\x18\x01 \x01(\rR\x04keep\x12&\n" +
+	"\x0fmax_age_seconds\x18\x02 \x01(\x03R\rmaxAgeSeconds\x12\x1c\n" +
+	"\tephemeral\x18\x03 \x01(\bR\tephemeral\"H\n" +
+	"\x06Typing\x12\x1a\n" +
+	"\busername\x18\x01 \x01(\tR\busername\x12\x12\n" +
+	"\x04room\x18\x02 \x01(\tR\x04room\x12\x0e\n" +
+	"\x02to\x18\x03 \x01(\tR\x02to\"E\n" +
+	"\aCommand\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x12\n" +
+	"\x04args\x18\x02 \x03(\tR\x04args\x12\x12\n" +
+	"\x04room\x18\x03 \x01(\tR\x04room\"7\n" +
+	"\vCommandList\x12(\n" +
+	"\bcommands\x18\x01 \x03(\v2\f.CommandSpecR\bcommands\"V\n" +
+	"\vCommandSpec\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x12\n" +
+	"\x04help\x18\x02 \x01(\tR\x04help\x12\x1f\n" +
+	"\x04args\x18\x03 \x03(\v2\v.CommandArgR\x04args\"P\n" +
+	"\n" +
+	"CommandArg\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x1a\n" +
+	"\boptional\x18\x02 \x01(\bR\boptional\x12\x12\n" +
+	"\x04rest\x18\x03 \x01(\bR\x04rest\"T\n" +
+	"\fClusterHello\x12\x12\n" +
+	"\x04node\x18\x01 \x01(\rR\x04node\x12\x14\n" +
+	"\x05nonce\x18\x03 \x01(\fR\x05nonce\x12\x14\n" +
+	"\x05proof\x18\x04 \x01(\fR\x05proofJ\x04\b\x02\x10\x03\"V\n" +
+	"\fClusterClaim\x12\x10\n" +
+	"\x03seq\x18\x01 \x01(\x04R\x03seq\x12\x1a\n" +
+	"\busername\x18\x02 \x01(\tR\busername\x12\x18\n" +
+	"\arelease\x18\x03 \x01(\bR\arelease\"a\n" +
+	"\x12ClusterClaimResult\x12\x10\n" +
+	"\x03seq\x18\x01 \x01(\x04R\x03seq\x12\x14\n" +
+	"\x05error\x18\x02 \x01(\tR\x05error\x12#\n" +
+	"\ralready_yours\x18\x03 \x01(\bR\falreadyYours\"\xc2\x02\n" +
+	"\fClusterEvent\x12&\n" +
+	"\x04kind\x18\x01 \x01(\x0e2\x12.ClusterEvent.KindR\x04kind\x12\x12\n" +
+	"\x04node\x18\x02 \x01(\rR\x04node\x12\x12\n" +
+	"\x04room\x18\x03 \x01(\tR\x04room\x12\x1a\n" +
+	"\busername\x18\x04 \x01(\tR\busername\x12\"\n" +
+	"\apayload\x18\x05 \x01(\v2\b.WrapperR\apayload\x12\x1d\n" +
+	"\n" +
+	"public_key\x18\x06 \x01(\fR\tpublicKey\x12\x1a\n" +
+	"\boperator\x18\a \x01(\tR\boperator\"g\n" +
+	"\x04Kind\x12\b\n" +
+	"\x04ROOM\x10\x00\x12\n" +
+	"\n" +
+	"\x06DIRECT\x10\x01\x12\a\n" +
+	"\x03ALL\x10\x02\x12\b\n" +
+	"\x04JOIN\x10\x03\x12\t\n" +
+	"\x05LEAVE\x10\x04\x12\n" +
+	"\n" +
+	"\x06ONLINE\x10\x05\x12\v\n" +
+	"\aOFFLINE\x10\x06\x12\a\n" +
+	"\x03KEY\x10\a\x12\t\n" +
+	"\x05RESET\x10\b\"N\n" +
+	"\bFedHello\x12\x16\n" +
+	"\x06server\x18\x01 \x01(\tR\x06server\x12\x14\n" +
+	"\x05nonce\x18\x02 \x01(\fR\x05nonce\x12\x14\n" +
+	"\x05proof\x18\x03 \x01(\fR\x05proof\"\x8a\x01\n" +
+	"\bFedFrame\x12\x12\n" +
+	"\x04user\x18\x01 \x01(\tR\x04user\x12\"\n" +
+	"\apayload\x18\x02 \x01(\v2\b.WrapperR\apayload\x12\x1a\n" +
+	"\bfeatures\x18\x03 \x03(\tR\bfeatures\x12\x10\n" +
+	"\x03bye\x18\x04 \x01(\bR\x03bye\x12\x18\n" +
+	"\adeliver\x18\x05 \x01(\bR\adeliver\"\xa8\f\n" +
 	"\aWrapper\x12B\n" +
 	"\x14registration_message\x18\x01 \x01(\v2\r.RegistrationH\x00R\x13registrationMessage\x124\n" +
-	"\rserver_notice\x18\x03 \x01(\v2\r.ServerNoticeH\x00R\fserverNotice\x12(\n" +
+	"\rserver_notice\x18\x03 \x01(\v2\r.ServerNoticeH\x00R\fserverNotice\x12\x1e\n" +
+	"\x05hello\x18\x04 \x01(\v2\x06.HelloH\x00R\x05hello\x12$\n" +
+	"\awelcome\x18\x05 \x01(\v2\b.WelcomeH\x00R\awelcome\x12(\n" +
 	"\troom_join\x18\n" +
 	" \x01(\v2\t.RoomJoinH\x00R\broomJoin\x12+\n" +
 	"\n" +
 	"room_leave\x18\v \x01(\v2\n" +
 	".RoomLeaveH\x00R\troomLeave\x12(\n" +
-	"\troom_chat\x18\f \x01(\v2\t.RoomChatH\x00R\broomChat\x12.\n" +
+	"\troom_chat\x18\f \x01(\v2\t.RoomChatH\x00R\broomChat\x121\n" +
+	"\fedit_message\x18\r \x01(\v2\f.EditMessageH\x00R\veditMessage\x127\n" +
+	"\x0edelete_message\x18\x0e \x01(\v2\x0e.DeleteMessageH\x00R\rdeleteMessage\x127\n" +
+	"\x0ethread_request\x18\x0f \x01(\v2\x0e.ThreadRequestH\x00R\rthreadRequest\x12.\n" +
+	"\vthread_view\x18\x10 \x01(\v2\v.ThreadViewH\x00R\n" +
+	"threadView\x12'\n" +
+	"\breaction\x18\x11 \x01(\v2\t.ReactionH\x00R\breaction\x127\n" +
+	"\x0emention_notice\x18\x12 \x01(\v2\x0e.MentionNoticeH\x00R\rmentionNotice\x12!\n" +
+	"\x06typing\x18\x13 \x01(\v2\a.TypingH\x00R\x06typing\x12.\n" +
 	"\vdirect_chat\x18\x14 \x01(\v2\v.DirectChatH\x00R\n" +
-	"directChatB\x05\n" +
+	"directChat\x12+\n" +
+	"\n" +
+	"file_offer\x18\x15 \x01(\v2\n" +
+	".FileOfferH\x00R\tfileOffer\x12.\n" +
+	"\vfile_accept\x18\x16 \x01(\v2\v.FileAcceptH\x00R\n" +
+	"fileAccept\x12+\n" +
+	"\n" +
+	"file_chunk\x18\x17 \x01(\v2\n" +
+	".FileChunkH\x00R\tfileChunk\x124\n" +
+	"\rfile_complete\x18\x18 \x01(\v2\r.FileCompleteH\x00R\ffileComplete\x12.\n" +
+	"\vpublish_key\x18\x19 \x01(\v2\v.PublishKeyH\x00R\n" +
+	"publishKey\x12.\n" +
+	"\vkey_request\x18\x1a \x01(\v2\v.KeyRequestH\x00R\n" +
+	"keyRequest\x12!\n" +
+	"\x06search\x18\x1b \x01(\v2\a.SearchH\x00R\x06search\x127\n" +
+	"\x0esearch_results\x18\x1c \x01(\v2\x0e.SearchResultsH\x00R\rsearchResults\x127\n" +
+	"\x0eroom_retention\x18\x1d \x01(\v2\x0e.RoomRetentionH\x00R\rroomRetention\x12$\n" +
+	"\acommand\x18\x1e \x01(\v2\b.CommandH\x00R\acommand\x121\n" +
+	"\fcommand_list\x18\x1f \x01(\v2\f.CommandListH\x00R\vcommandList\x124\n" +
+	"\rcluster_hello\x18( \x01(\v2\r.ClusterHelloH\x00R\fclusterHello\x124\n" +
+	"\rcluster_claim\x18) \x01(\v2\r.ClusterClaimH\x00R\fclusterClaim\x12G\n" +
+	"\x14cluster_claim_result\x18* \x01(\v2\x13.ClusterClaimResultH\x00R\x12clusterClaimResult\x124\n" +
+	"\rcluster_event\x18+ \x01(\v2\r.ClusterEventH\x00R\fclusterEvent\x12(\n" +
+	"\tfed_hello\x18, \x01(\v2\t.FedHelloH\x00R\bfedHello\x12(\n" +
+	"\tfed_frame\x18- \x01(\v2\t.FedFrameH\x00R\bfedFrameB\x05\n" +
 	"\x03msgB\fZ\n" +
 	"./messagesb\x06proto3"
 
@@ -543,28 +3318,97 @@ func file_chat_proto_rawDescGZIP() []byte {
 	return file_chat_proto_rawDescData
 }
 
-var file_chat_proto_msgTypes = make([]protoimpl.MessageInfo, 7)
+var file_chat_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_chat_proto_msgTypes = make([]protoimpl.MessageInfo, 38)
 var file_chat_proto_goTypes = []any{
-	(*Registration)(nil), // 0: Registration
-	(*ServerNotice)(nil), // 1: ServerNotice
-	(*RoomJoin)(nil),     // 2: RoomJoin
-	(*RoomLeave)(nil),    // 3: RoomLeave
-	(*RoomChat)(nil),     // 4: RoomChat
-	(*DirectChat)(nil),   // 5: DirectChat
-	(*Wrapper)(nil),      // 6: Wrapper
+	(ClusterEvent_Kind)(0),     // 0: ClusterEvent.Kind
+	(*Hello)(nil),              // 1: Hello
+	(*ServerLimits)(nil),       // 2: ServerLimits
+	(*Welcome)(nil),            // 3: Welcome
+	(*Registration)(nil),       // 4: Registration
+	(*ServerNotice)(nil),       // 5: ServerNotice
+	(*RoomJoin)(nil),           // 6: RoomJoin
+	(*RoomLeave)(nil),          // 7: RoomLeave
+	(*RoomChat)(nil),           // 8: RoomChat
+	(*RoomRetention)(nil),      // 9: RoomRetention
+	(*Reaction)(nil),           // 10: Reaction
+	(*ThreadRequest)(nil),      // 11: ThreadRequest
+	(*ThreadView)(nil),         // 12: ThreadView
+	(*Search)(nil),             // 13: Search
+	(*SearchResults)(nil),      // 14: SearchResults
+	(*EditMessage)(nil),        // 15: EditMessage
+	(*DeleteMessage)(nil),      // 16: DeleteMessage
+	(*MentionNotice)(nil),      // 17: MentionNotice
+	(*FileOffer)(nil),          // 18: FileOffer
+	(*FileAccept)(nil),         // 19: FileAccept
+	(*FileChunk)(nil),          // 20: FileChunk
+	(*FileComplete)(nil),       // 21: FileComplete
+	(*PublishKey)(nil),         // 22: PublishKey
+	(*KeyRequest)(nil),         // 23: KeyRequest
+	(*DirectChat)(nil),         // 24: DirectChat
+	(*DMRetention)(nil),        // 25: DMRetention
+	(*Typing)(nil),             // 26: Typing
+	(*Command)(nil),            // 27: Command
+	(*CommandList)(nil),        // 28: CommandList
+	(*CommandSpec)(nil),        // 29: CommandSpec
+	(*CommandArg)(nil),         // 30: CommandArg
+	(*ClusterHello)(nil),       // 31: ClusterHello
+	(*ClusterClaim)(nil),       // 32: ClusterClaim
+	(*ClusterClaimResult)(nil), // 33: ClusterClaimResult
+	(*ClusterEvent)(nil),       // 34: ClusterEvent
+	(*FedHello)(nil),           // 35: FedHello
+	(*FedFrame)(nil),           // 36: FedFrame
+	(*Wrapper)(nil),            // 37: Wrapper
+	nil,                        // 38: RoomChat.ReactionsEntry
 }
 var file_chat_proto_depIdxs = []int32{
-	0, // 0: Wrapper.registration_message:type_name -> Registration
-	1, // 1: Wrapper.server_notice:type_name -> ServerNotice
-	2, // 2: Wrapper.room_join:type_name -> RoomJoin
-	3, // 3: Wrapper.room_leave:type_name -> RoomLeave
-	4, // 4: Wrapper.room_chat:type_name -> RoomChat
-	5, // 5: Wrapper.direct_chat:type_name -> DirectChat
-	6, // [6:6] is the sub-list for method output_type
-	6, // [6:6] is the sub-list for method input_type
-	6, // [6:6] is the sub-list for extension type_name
-	6, // [6:6] is the sub-list for extension extendee
-	0, // [0:6] is the sub-list for field type_name
+	2,  // 0: Welcome.limits:type_name -> ServerLimits
+	38, // 1: RoomChat.reactions:type_name -> RoomChat.ReactionsEntry
+	8,  // 2: ThreadView.messages:type_name -> RoomChat
+	8,  // 3: SearchResults.messages:type_name -> RoomChat
+	25, // 4: DirectChat.retention:type_name -> DMRetention
+	29, // 5: CommandList.commands:type_name -> CommandSpec
+	30, // 6: CommandSpec.args:type_name -> CommandArg
+	0,  // 7: ClusterEvent.kind:type_name -> ClusterEvent.Kind
+	37, // 8: ClusterEvent.payload:type_name -> Wrapper
+	37, // 9: FedFrame.payload:type_name -> Wrapper
+	4,  // 10: Wrapper.registration_message:type_name -> Registration
+	5,  // 11: Wrapper.server_notice:type_name -> ServerNotice
+	1,  // 12: Wrapper.hello:type_name -> Hello
+	3,  // 13: Wrapper.welcome:type_name -> Welcome
+	6,  // 14: Wrapper.room_join:type_name -> RoomJoin
+	7,  // 15: Wrapper.room_leave:type_name -> RoomLeave
+	8,  // 16: Wrapper.room_chat:type_name -> RoomChat
+	15, // 17: Wrapper.edit_message:type_name -> EditMessage
+	16, // 18: Wrapper.delete_message:type_name -> DeleteMessage
+	11, // 19: Wrapper.thread_request:type_name -> ThreadRequest
+	12, // 20: Wrapper.thread_view:type_name -> ThreadView
+	10, // 21: Wrapper.reaction:type_name -> Reaction
+	17, // 22: Wrapper.mention_notice:type_name -> MentionNotice
+	26, // 23: Wrapper.typing:type_name -> Typing
+	24, // 24: Wrapper.direct_chat:type_name -> DirectChat
+	18, // 25: Wrapper.file_offer:type_name -> FileOffer
+	19, // 26: Wrapper.file_accept:type_name -> FileAccept
+	20, // 27: Wrapper.file_chunk:type_name -> FileChunk
+	21, // 28: Wrapper.file_complete:type_name -> FileComplete
+	22, // 29: Wrapper.publish_key:type_name -> PublishKey
+	23, // 30: Wrapper.key_request:type_name -> KeyRequest
+	13, // 31: Wrapper.search:type_name -> Search
+	14, // 32: Wrapper.search_results:type_name -> SearchResults
+	9,  // 33: Wrapper.room_retention:type_name -> RoomRetention
+	27, // 34: Wrapper.command:type_name -> Command
+	28, // 35: Wrapper.command_list:type_name -> CommandList
+	31, // 36: Wrapper.cluster_hello:type_name -> ClusterHello
+	32, // 37: Wrapper.cluster_claim:type_name -> ClusterClaim
+	33, // 38: Wrapper.cluster_claim_result:type_name -> ClusterClaimResult
+	34, // 39: Wrapper.cluster_event:type_name -> ClusterEvent
+	35, // 40: Wrapper.fed_hello:type_name -> FedHello
+	36, // 41: Wrapper.fed_frame:type_name -> FedFrame
+	42, // [42:42] is the sub-list for method output_type
+	42, // [42:42] is the sub-list for method input_type
+	42, // [42:42] is the sub-list for extension type_name
+	42, // [42:42] is the sub-list for extension extendee
+	0,  // [0:42] is the sub-list for field type_name
 }
 
 func init() { file_chat_proto_init() }
@@ -572,26 +3416,53 @@ func file_chat_proto_init() {
 	if File_chat_proto != nil {
 		return
 	}
-	file_chat_proto_msgTypes[6].OneofWrappers = []any{
+	file_chat_proto_msgTypes[36].OneofWrappers = []any{
 		(*Wrapper_RegistrationMessage)(nil),
 		(*Wrapper_ServerNotice)(nil),
+		(*Wrapper_Hello)(nil),
+		(*Wrapper_Welcome)(nil),
 		(*Wrapper_RoomJoin)(nil),
 		(*Wrapper_RoomLeave)(nil),
 		(*Wrapper_RoomChat)(nil),
+		(*Wrapper_EditMessage)(nil),
+		(*Wrapper_DeleteMessage)(nil),
+		(*Wrapper_ThreadRequest)(nil),
+		(*Wrapper_ThreadView)(nil),
+		(*Wrapper_Reaction)(nil),
+		(*Wrapper_MentionNotice)(nil),
+		(*Wrapper_Typing)(nil),
 		(*Wrapper_DirectChat)(nil),
+		(*Wrapper_FileOffer)(nil),
+		(*Wrapper_FileAccept)(nil),
+		(*Wrapper_FileChunk)(nil),
+		(*Wrapper_FileComplete)(nil),
+		(*Wrapper_PublishKey)(nil),
+		(*Wrapper_KeyRequest)(nil),
+		(*Wrapper_Search)(nil),
+		(*Wrapper_SearchResults)(nil),
+		(*Wrapper_RoomRetention)(nil),
+		(*Wrapper_Command)(nil),
+		(*Wrapper_CommandList)(nil),
+		(*Wrapper_ClusterHello)(nil),
+		(*Wrapper_ClusterClaim)(nil),
+		(*Wrapper_ClusterClaimResult)(nil),
+		(*Wrapper_ClusterEvent)(nil),
+		(*Wrapper_FedHello)(nil),
+		(*Wrapper_FedFrame)(nil),
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_chat_proto_rawDesc), len(file_chat_proto_rawDesc)),
-			NumEnums:      0,
-			NumMessages:   7,
+			NumEnums:      1,
+			NumMessages:   38,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
 		GoTypes:           file_chat_proto_goTypes,
 		DependencyIndexes: file_chat_proto_depIdxs,
+		EnumInfos:         file_chat_proto_enumTypes,
 		MessageInfos:      file_chat_proto_msgTypes,
 	}.Build()
 	File_chat_proto = out.File
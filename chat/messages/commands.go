@@ -0,0 +1,21 @@
+package messages
+
+import "strings"
+
+// CommandUsage formats how to call a command, e.g. "/kick <user> [reason...]".
+func CommandUsage(spec *CommandSpec) string {
+	var b strings.Builder
+	b.WriteString("/" + spec.GetName())
+	for _, arg := range spec.GetArgs() {
+		name := arg.GetName()
+		if arg.GetRest() {
+			name += "..."
+		}
+		if arg.GetOptional() {
+			b.WriteString(" [" + name + "]")
+		} else {
+			b.WriteString(" <" + name + ">")
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,30 @@
+package messages
+
+import (
+	"slices"
+	"strings"
+)
+
+// ParseMentions returns the distinct usernames written as @username in body,
+// in order of first appearance. Trailing punctuation is not part of a name.
+func ParseMentions(body string) []string {
+	var names []string
+	for _, word := range strings.Fields(body) {
+		if !strings.HasPrefix(word, "@") {
+			continue
+		}
+		name := strings.TrimRight(word[1:], ".,:;!?)'\"")
+		if name == "" || len(name) > MaxUsernameLength {
+			continue
+		}
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Mentions reports whether body mentions username.
+func Mentions(body, username string) bool {
+	return slices.Contains(ParseMentions(body), username)
+}
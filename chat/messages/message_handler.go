@@ -1,17 +1,43 @@
 package messages
 
 import (
+	"bytes"
+	"compress/flate"
+	"context"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"google.golang.org/protobuf/proto"
 )
 
+const (
+	// frameCompressed is set in the length prefix when the payload is
+	// flate-compressed. Real lengths never come near the top bit.
+	frameCompressed = uint64(1) << 63
+	// CompressThreshold is the smallest payload worth compressing; anything
+	// shorter goes out raw even when compression is on.
+	CompressThreshold = 512
+)
+
 type MessageHandler struct {
 	conn      net.Conn
 	sendMutex sync.Mutex
+	compress  atomic.Bool
+	logger    atomic.Pointer[slog.Logger]
+}
+
+var flateWriters = sync.Pool{
+	New: func() any {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
 }
 
 func (m *MessageHandler) Handle(conn net.Conn) {}
@@ -48,17 +74,78 @@ func (m *MessageHandler) writeN(buf []byte) error {
 	return nil
 }
 
+// SetLogger makes the handler trace every frame's type and size (never its
+// contents) at debug level.
+func (m *MessageHandler) SetLogger(logger *slog.Logger) {
+	m.logger.Store(logger)
+}
+
+func (m *MessageHandler) traceFrame(msg string, w *Wrapper, size int, compressed bool) {
+	logger := m.logger.Load()
+	if logger == nil || !logger.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	logger.Debug(msg, "type", TypeName(w), "size", size, "compressed", compressed)
+}
+
+// SetCompression turns compression of large outgoing frames on or off, and
+// with it whether compressed frames are accepted. Both peers must have
+// negotiated FeatureCompression first.
+func (m *MessageHandler) SetCompression(enabled bool) {
+	m.compress.Store(enabled)
+}
+
+func compressPayload(payload []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompressPayload(payload []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(payload))
+	defer r.Close()
+	// Read one byte past the limit so a decompression bomb is an error, not a truncated frame
+	out, err := io.ReadAll(io.LimitReader(r, MaxFrameSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > MaxFrameSize {
+		return nil, fmt.Errorf("decompressed frame exceeds limit of %d", MaxFrameSize)
+	}
+	return out, nil
+}
+
 func (m *MessageHandler) Send(wrapper *Wrapper) error {
 	serialized, err := proto.Marshal(wrapper)
 	if err != nil {
 		return err
 	}
 
+	header := uint64(len(serialized))
+	if m.compress.Load() && len(serialized) >= CompressThreshold {
+		compressed, err := compressPayload(serialized)
+		if err != nil {
+			return err
+		}
+		if len(compressed) < len(serialized) { // Only use it if it actually helped
+			serialized = compressed
+			header = uint64(len(serialized)) | frameCompressed
+		}
+	}
+
 	m.sendMutex.Lock()
 	defer m.sendMutex.Unlock()
 
 	prefix := make([]byte, 8)
-	binary.LittleEndian.PutUint64(prefix, uint64(len(serialized)))
+	binary.LittleEndian.PutUint64(prefix, header)
 	if err := m.writeN(prefix); err != nil { // <- check error
 		return err
 	}
@@ -66,6 +153,7 @@ func (m *MessageHandler) Send(wrapper *Wrapper) error {
 		return err
 	}
 
+	m.traceFrame("frame sent", wrapper, len(serialized), header&frameCompressed != 0)
 	return nil
 }
 
@@ -75,15 +163,28 @@ func (m *MessageHandler) Receive() (*Wrapper, error) {
 		return nil, err
 	}
 
-	payloadSize := binary.LittleEndian.Uint64(prefix)
+	header := binary.LittleEndian.Uint64(prefix)
+	payloadSize := header &^ frameCompressed
 	if payloadSize == 0 { // Defensive: treat 0-size as closed/invalid
 		return nil, io.EOF
 	}
+	if payloadSize > MaxFrameSize {
+		return nil, fmt.Errorf("frame of %d bytes exceeds limit of %d", payloadSize, MaxFrameSize)
+	}
+	if header&frameCompressed != 0 && !m.compress.Load() {
+		return nil, errors.New("compressed frame, but compression wasn't negotiated")
+	}
 
 	payload := make([]byte, payloadSize)
 	if err := m.readN(payload); err != nil { // Propagate read errors
 		return nil, err
 	}
+	if header&frameCompressed != 0 {
+		var err error
+		if payload, err = decompressPayload(payload); err != nil {
+			return nil, err
+		}
+	}
 
 	wrapper := &Wrapper{}
 	if err := proto.Unmarshal(payload, wrapper); err != nil {
@@ -92,6 +193,7 @@ func (m *MessageHandler) Receive() (*Wrapper, error) {
 	if wrapper.GetMsg() == nil {
 		return nil, io.EOF
 	}
+	m.traceFrame("frame received", wrapper, int(payloadSize), header&frameCompressed != 0)
 	return wrapper, nil
 }
 
@@ -112,6 +214,20 @@ func MarshalFrame(w *Wrapper) ([]byte, error) {
 	return frame, nil
 }
 
+// SetReadDeadline bounds how long Receive waits. The zero time clears it.
+func (m *MessageHandler) SetReadDeadline(t time.Time) error {
+	return m.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline bounds how long Send waits. The zero time clears it.
+func (m *MessageHandler) SetWriteDeadline(t time.Time) error {
+	return m.conn.SetWriteDeadline(t)
+}
+
+func (m *MessageHandler) RemoteAddr() net.Addr {
+	return m.conn.RemoteAddr()
+}
+
 func (m *MessageHandler) Close() {
 	m.conn.Close()
 }
@@ -0,0 +1,97 @@
+package messages
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// pipe returns two handlers talking to each other over a net.Pipe.
+func pipe(t testing.TB) (a, b *MessageHandler) {
+	t.Helper()
+	ca, cb := net.Pipe()
+	a, b = NewMessageHandler(ca), NewMessageHandler(cb)
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return a, b
+}
+
+// chatFrame is a room message whose body is size bytes of chat-like text.
+func chatFrame(size int) *Wrapper {
+	line := "the quick brown fox jumps over the lazy dog, again and again. "
+	body := strings.Repeat(line, size/len(line)+1)[:size]
+	return &Wrapper{Msg: &Wrapper_RoomChat{RoomChat: &RoomChat{Room: "lobby", Username: "alice", MessageBody: body}}}
+}
+
+// sendAsync sends w from a on another goroutine, since net.Pipe blocks
+// until the other end reads, and reports how that went.
+func sendAsync(a *MessageHandler, w *Wrapper) <-chan error {
+	sent := make(chan error, 1)
+	go func() { sent <- a.Send(w) }()
+	return sent
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		a, b := pipe(t)
+		a.SetCompression(compress)
+		b.SetCompression(compress)
+		for _, size := range []int{10, CompressThreshold, 64 << 10} {
+			want := chatFrame(size)
+			sent := sendAsync(a, want)
+			got, err := b.Receive()
+			if err != nil {
+				t.Fatalf("compress=%v size=%d: %v", compress, size, err)
+			}
+			if err := <-sent; err != nil {
+				t.Fatalf("compress=%v size=%d: send: %v", compress, size, err)
+			}
+			if !proto.Equal(got, want) {
+				t.Errorf("compress=%v size=%d: frame changed on the way", compress, size)
+			}
+		}
+	}
+}
+
+func TestCompressedFrameNeedsNegotiation(t *testing.T) {
+	a, b := pipe(t)
+	a.SetCompression(true)         // b never agreed to it
+	sendAsync(a, chatFrame(4<<10)) // fails once b hangs up; only b matters
+	if _, err := b.Receive(); err == nil {
+		t.Fatal("a compressed frame was accepted without compression being negotiated")
+	}
+}
+
+func benchmarkThroughput(b *testing.B, size int, compress bool) {
+	tx, rx := pipe(b)
+	tx.SetCompression(compress)
+	rx.SetCompression(compress)
+	w := chatFrame(size)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < b.N; i++ {
+			if _, err := rx.Receive(); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	}()
+	b.SetBytes(int64(proto.Size(w)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := tx.Send(w); err != nil {
+			b.Fatal(err)
+		}
+	}
+	<-done
+}
+
+func BenchmarkSmallUncompressed(b *testing.B) { benchmarkThroughput(b, 100, false) }
+func BenchmarkSmallCompressed(b *testing.B)   { benchmarkThroughput(b, 100, true) }
+func BenchmarkLargeUncompressed(b *testing.B) { benchmarkThroughput(b, 16<<10, false) }
+func BenchmarkLargeCompressed(b *testing.B)   { benchmarkThroughput(b, 16<<10, true) }
@@ -0,0 +1,90 @@
+package messages
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseDays is time.ParseDuration plus a "d" suffix for whole days, which
+// is how retention periods are usually written.
+func ParseDays(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("bad number of days %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// FormatDays is the inverse of ParseDays, preferring days where they fit.
+func FormatDays(d time.Duration) string {
+	if d >= 24*time.Hour && d%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	}
+	return d.String()
+}
+
+// ParseRetention reads a retention policy from words like "keep=100",
+// "age=7d" and "ephemeral". "default" on its own goes back to the server's
+// policy. The result has update set; the caller fills in the room.
+func ParseRetention(args []string) (*RoomRetention, error) {
+	rr := &RoomRetention{Update: true}
+	for _, arg := range args {
+		key, value, _ := strings.Cut(strings.ToLower(arg), "=")
+		switch key {
+		case "keep":
+			n, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("keep wants a number of messages, not %q", value)
+			}
+			rr.Keep = uint32(n)
+		case "age":
+			d, err := ParseDays(value)
+			if err != nil {
+				return nil, fmt.Errorf("age wants a duration like 12h or 30d: %w", err)
+			}
+			rr.MaxAgeSeconds = int64(d / time.Second)
+		case "ephemeral":
+			rr.Ephemeral = true
+		case "default":
+			if len(args) > 1 {
+				return nil, fmt.Errorf("default can't be combined with anything else")
+			}
+		default:
+			return nil, fmt.Errorf("unknown retention setting %q (want keep=N, age=DURATION, ephemeral or default)", arg)
+		}
+	}
+	return rr, nil
+}
+
+// ParseDMRetention is ParseRetention for one side of a DM conversation.
+// "default" gives an empty policy, which sets no limit of its own.
+func ParseDMRetention(args []string) (*DMRetention, error) {
+	rr, err := ParseRetention(args)
+	if err != nil {
+		return nil, err
+	}
+	return &DMRetention{Keep: rr.GetKeep(), MaxAgeSeconds: rr.GetMaxAgeSeconds(), Ephemeral: rr.GetEphemeral()}, nil
+}
+
+// RetentionWords is the inverse of ParseDMRetention.
+func RetentionWords(p *DMRetention) []string {
+	if p.GetEphemeral() {
+		return []string{"ephemeral"}
+	}
+	var words []string
+	if p.GetKeep() > 0 {
+		words = append(words, fmt.Sprintf("keep=%d", p.GetKeep()))
+	}
+	if p.GetMaxAgeSeconds() > 0 {
+		words = append(words, "age="+FormatDays(time.Duration(p.GetMaxAgeSeconds())*time.Second))
+	}
+	if len(words) == 0 {
+		return []string{"default"}
+	}
+	return words
+}
@@ -0,0 +1,11 @@
+package messages
+
+// TypeName returns the name of the message carried by w, e.g. "room_chat",
+// or "none" if it's empty. Handy for logs and metrics.
+func TypeName(w *Wrapper) string {
+	m := w.ProtoReflect()
+	if fd := m.WhichOneof(m.Descriptor().Oneofs().ByName("msg")); fd != nil {
+		return string(fd.Name())
+	}
+	return "none"
+}
@@ -0,0 +1,55 @@
+package messages
+
+import (
+	"slices"
+	"strings"
+)
+
+const (
+	// ProtocolVersion is the version this build speaks. Bump it whenever
+	// framing or message semantics change.
+	ProtocolVersion uint32 = 2
+	// MinProtocolVersion is the oldest version we still accept. Version 1 is
+	// the original protocol with no Hello: the first frame is a Registration.
+	MinProtocolVersion uint32 = 1
+)
+
+// Optional features, advertised in Hello and Welcome.
+const (
+	FeatureCompression = "compression"
+	FeatureHistory     = "history"
+)
+
+const (
+	MaxFrameSize      = 1 << 20 // 1 MiB
+	MaxUsernameLength = 32
+	// FileChunkSize is the most data one FileChunk carries. It's well under
+	// MaxFrameSize so a transfer never holds up other frames for long.
+	FileChunkSize = 64 << 10
+	// nameBreakers can't be in a username or room name: each would split
+	// the name in two, or the line it's written on, for the IRC gateway.
+	nameBreakers = " \r\n\x00"
+)
+
+// ValidName reports whether name can be a username or room name.
+func ValidName(name string) bool {
+	return !strings.ContainsAny(name, nameBreakers)
+}
+
+// NegotiateVersion picks the version both peers speak, or false if the peer
+// is too old for us.
+func NegotiateVersion(peer uint32) (uint32, bool) {
+	v := min(peer, ProtocolVersion)
+	return v, v >= MinProtocolVersion
+}
+
+// NegotiateFeatures returns the features in offered that are also in supported.
+func NegotiateFeatures(offered, supported []string) []string {
+	var agreed []string
+	for _, f := range offered {
+		if slices.Contains(supported, f) {
+			agreed = append(agreed, f)
+		}
+	}
+	return agreed
+}
@@ -0,0 +1,19 @@
+package messages
+
+import "testing"
+
+func TestNegotiateVersion(t *testing.T) {
+	for _, tc := range []struct {
+		peer, want uint32
+		ok         bool
+	}{
+		{MinProtocolVersion - 1, 0, false},
+		{MinProtocolVersion, MinProtocolVersion, true},
+		{ProtocolVersion, ProtocolVersion, true},
+		{ProtocolVersion + 1, ProtocolVersion, true}, // a newer peer comes down to us
+	} {
+		if v, ok := NegotiateVersion(tc.peer); ok != tc.ok || (ok && v != tc.want) {
+			t.Errorf("NegotiateVersion(%d) = %d, %v; want %d, %v", tc.peer, v, ok, tc.want, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"chat/messages"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+)
+
+const adminHelp = `commands:
+  list                    connections with address, send queue depth and rooms
+  rooms                   rooms and member counts
+  kick <user> [reason]    force-disconnect a user
+  broadcast <text>        send a notice to every connected client
+  close <room>            remove everyone from a room
+  rename <room> <new>     rename a room, keeping its members
+  motd [reload]           show the message of the day, or re-read its file
+  retention <room> [keep=N] [age=DUR] [ephemeral|default]
+                          show or change how much history a room keeps
+  help                    this text`
+
+// serveAdmin runs the operator console on a Unix socket. Only local users
+// with access to the socket file can reach it.
+func (s *server) serveAdmin(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		listener.Close()
+		return err
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				slog.Warn("admin accept error", "err", err)
+				return
+			}
+			go s.handleAdmin(conn)
+		}
+	}()
+	return nil
+}
+
+func (s *server) handleAdmin(conn net.Conn) {
+	defer conn.Close()
+	slog.Info("admin console connected")
+
+	scanner := bufio.NewScanner(conn)
+	fmt.Fprint(conn, "admin> ")
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "quit" || line == "exit" {
+			return
+		}
+		if line != "" {
+			if err := s.runAdminCommand(conn, line); err != nil {
+				fmt.Fprintln(conn, "error:", err)
+			}
+		}
+		fmt.Fprint(conn, "admin> ")
+	}
+}
+
+func (s *server) runAdminCommand(w io.Writer, line string) error {
+	fields := strings.Fields(line)
+	cmd, args := strings.ToLower(fields[0]), fields[1:]
+	// rest is everything after the first n arguments, spacing intact
+	rest := func(n int) string {
+		s := strings.TrimSpace(line[len(fields[0]):])
+		for i := 0; i < n && s != ""; i++ {
+			s = strings.TrimSpace(strings.TrimPrefix(s, args[i]))
+		}
+		return s
+	}
+	slog.Info("admin command", "command", cmd, "args", len(args))
+
+	switch cmd {
+	case "help":
+		fmt.Fprintln(w, adminHelp)
+
+	case "list":
+		infos := s.users.list()
+		for _, info := range infos {
+			fmt.Fprintf(w, "%-20s %-22s queue=%d/%d rooms=%s\n",
+				info.username, info.addr, info.queueDepth, clientQueueSize, strings.Join(info.rooms, ","))
+		}
+		fmt.Fprintf(w, "%d connected\n", len(infos))
+
+	case "rooms":
+		stats := s.users.stats()
+		for room, n := range stats.members {
+			fmt.Fprintf(w, "%-20s %d members\n", room, n)
+		}
+		fmt.Fprintf(w, "%d rooms\n", len(stats.members))
+
+	case "kick":
+		if len(args) < 1 {
+			return errors.New("usage: kick <user> [reason]")
+		}
+		c := s.users.lookup(args[0])
+		if c == nil {
+			return fmt.Errorf("no such user %q", args[0])
+		}
+		reason := rest(1)
+		if reason == "" {
+			reason = "no reason given"
+		}
+		c.enqueue(notice("Disconnected by an operator: " + reason))
+		s.users.remove(c.conn) // flushes the notice, then closes the connection
+		fmt.Fprintln(w, "kicked", c.username)
+
+	case "broadcast":
+		text := rest(0)
+		if text == "" {
+			return errors.New("usage: broadcast <text>")
+		}
+		s.users.broadcastAll(notice(text))
+		fmt.Fprintln(w, "sent")
+
+	case "close":
+		if len(args) != 1 {
+			return errors.New("usage: close <room>")
+		}
+		if err := s.users.closeRoom(args[0]); err != nil {
+			return err
+		}
+		fmt.Fprintln(w, "closed", args[0])
+
+	case "rename":
+		if len(args) != 2 {
+			return errors.New("usage: rename <room> <new>")
+		}
+		if err := s.users.renameRoom(args[0], args[1]); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "renamed %s to %s\n", args[0], args[1])
+
+	case "retention":
+		if len(args) < 1 {
+			return errors.New("usage: retention <room> [keep=N] [age=DUR] [ephemeral|default]")
+		}
+		var set *retentionPolicy
+		if len(args) > 1 {
+			rr, err := messages.ParseRetention(args[1:])
+			if err != nil {
+				return err
+			}
+			p := retentionFromProto(rr)
+			set = &p
+		}
+		policy, err := s.users.retention(nil, args[0], set)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s %s\n", args[0], policy)
+
+	case "motd":
+		if len(args) == 1 && args[0] == "reload" {
+			if err := s.motd.load(); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintln(w, s.motd.get())
+
+	default:
+		return fmt.Errorf("unknown command %q (try help)", cmd)
+	}
+	return nil
+}
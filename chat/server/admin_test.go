@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"chat/messages"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// adminConsole is a connection to s's operator console.
+type adminConsole struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialAdmin(t *testing.T, s *server) *adminConsole {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	if err := s.serveAdmin(path); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	ac := &adminConsole{t: t, conn: conn, r: bufio.NewReader(conn)}
+	ac.prompt()
+	return ac
+}
+
+// prompt reads up to the next prompt, returning what came before it.
+func (ac *adminConsole) prompt() string {
+	ac.t.Helper()
+	var out strings.Builder
+	for !strings.HasSuffix(out.String(), "admin> ") {
+		b, err := ac.r.ReadByte()
+		if err != nil {
+			ac.t.Fatalf("admin: %v after %q", err, out.String())
+		}
+		out.WriteByte(b)
+	}
+	return strings.TrimSuffix(out.String(), "admin> ")
+}
+
+// run runs line and returns what it printed.
+func (ac *adminConsole) run(line string) string {
+	ac.t.Helper()
+	if _, err := ac.conn.Write([]byte(line + "\n")); err != nil {
+		ac.t.Fatal(err)
+	}
+	return ac.prompt()
+}
+
+func TestAdminKick(t *testing.T) {
+	s := newServer()
+	admin := dialAdmin(t, s)
+	alice := connect(t, s, "alice")
+	alice.joined("lobby")
+	bob := connect(t, s, "bob")
+	bob.joined("lobby")
+
+	if out := admin.run("kick bob  flooding the lobby"); out != "kicked bob\n" {
+		t.Errorf("kick printed %q", out)
+	}
+	bob.expectNotice("Disconnected by an operator: flooding the lobby")
+	waitFor(t, "bob to go", func() bool { return s.users.lookup("bob") == nil })
+	if names, _ := s.users.members(nil, "lobby"); slices.Contains(names, "bob") {
+		t.Errorf("bob is still in the lobby: %v", names)
+	}
+
+	if out := admin.run("kick bob"); !strings.HasPrefix(out, "error: no such user") {
+		t.Errorf("kicking bob twice printed %q", out)
+	}
+	if out := admin.run("kick"); !strings.HasPrefix(out, "error: usage") {
+		t.Errorf("kicking nobody printed %q", out)
+	}
+}
+
+func TestAdminBroadcast(t *testing.T) {
+	s := newServer()
+	admin := dialAdmin(t, s)
+	alice := connect(t, s, "alice")
+	alice.joined("lobby")
+	bob := connect(t, s, "bob") // in no room
+
+	if out := admin.run("broadcast Back in  5 minutes"); out != "sent\n" {
+		t.Errorf("broadcast printed %q", out)
+	}
+	alice.expectNotice("Back in  5 minutes")
+	bob.expectNotice("Back in  5 minutes")
+
+	if out := admin.run("broadcast"); !strings.HasPrefix(out, "error: usage") {
+		t.Errorf("an empty broadcast printed %q", out)
+	}
+}
+
+// TestAdminIsOperatorsOnly checks the console is only for whoever can open
+// its socket: nobody else can, and chat clients can't run its commands.
+func TestAdminIsOperatorsOnly(t *testing.T) {
+	s := newServer()
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	if err := s.serveAdmin(path); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Fatalf("admin socket is %v (%v), want only its owner let in", fi.Mode().Perm(), err)
+	}
+
+	alice := connect(t, s, "alice")
+	mallory := connect(t, s, "mallory")
+	mallory.command("kick", "alice")
+	mallory.expectNotice("Unknown command /kick")
+	mallory.command("broadcast", "free crypto")
+	mallory.expectNotice("Unknown command /broadcast")
+	if s.users.lookup("alice") == nil {
+		t.Fatal("mallory kicked alice")
+	}
+	alice.expectNone("mallory's broadcast", 100*time.Millisecond, func(w *messages.Wrapper) bool {
+		return strings.Contains(w.GetServerNotice().GetText(), "free crypto")
+	})
+
+	if out := dialAdmin(t, s).run("shutdown"); !strings.HasPrefix(out, `error: unknown command "shutdown"`) {
+		t.Errorf("an unknown command printed %q", out)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"chat/audit"
+	"log/slog"
+	"time"
+)
+
+// auditSink feeds registry events into an audit log. Writes happen on their
+// own goroutine so the registry never waits on the disk, but nothing is
+// dropped: if the queue fills up the registry blocks until it drains.
+type auditSink struct {
+	log    *audit.Log
+	events chan audit.Event
+}
+
+func newAuditSink(path string) (*auditSink, error) {
+	l, err := audit.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &auditSink{log: l, events: make(chan audit.Event, 4096)}
+	go s.writeLoop()
+	return s, nil
+}
+
+func (s *auditSink) writeLoop() {
+	for e := range s.events {
+		if err := s.log.Append(e); err != nil {
+			slog.Error("audit write failed", "err", err, "kind", e.Kind, "user", e.User)
+		}
+	}
+}
+
+func (s *auditSink) record(ev registryEvent) {
+	s.events <- audit.Event{Time: time.Now().UTC(), Kind: ev.kind, User: ev.user, Room: ev.room, To: ev.to, Detail: ev.detail}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"chat/messages"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The built-in plugins. In rooms they answer "!command ..."; in DMs the "!"
+// is optional.
+
+// botCommand splits what ev says into a command and the rest, or returns
+// "" if it isn't addressed to a bot.
+func botCommand(ev botEvent) (string, string) {
+	text := strings.TrimSpace(ev.text)
+	if strings.HasPrefix(text, "!") {
+		text = text[1:]
+	} else if ev.kind != botDirect {
+		return "", ""
+	}
+	cmd, rest, _ := strings.Cut(text, " ")
+	return strings.ToLower(cmd), strings.TrimSpace(rest)
+}
+
+// echoBot says back whatever follows !echo, or anything sent to it directly.
+type echoBot struct{}
+
+func (echoBot) name() string { return "echo" }
+
+func (echoBot) handle(b *bot, ev botEvent) {
+	switch ev.kind {
+	case botChat:
+		if cmd, rest := botCommand(ev); cmd == "echo" && rest != "" {
+			b.say(ev.room, rest)
+		}
+	case botDirect:
+		b.direct(ev.user, ev.text)
+	}
+}
+
+// diceBot rolls dice: !roll 2d6 (one six-sided die by default).
+type diceBot struct{}
+
+const (
+	maxDice  = 20
+	maxSides = 1000
+)
+
+func (diceBot) name() string { return "dice" }
+
+func (diceBot) handle(b *bot, ev botEvent) {
+	if cmd, rest := botCommand(ev); cmd == "roll" {
+		b.reply(ev, roll(ev.user, rest))
+	}
+}
+
+// roll rolls spec ("NdM", "dM" or "") for user and describes the result.
+func roll(user, spec string) string {
+	if spec == "" {
+		spec = "1d6"
+	}
+	n, m, ok := strings.Cut(strings.ToLower(spec), "d")
+	if n == "" {
+		n = "1"
+	}
+	dice, err1 := strconv.Atoi(n)
+	sides, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil || dice < 1 || dice > maxDice || sides < 2 || sides > maxSides {
+		return fmt.Sprintf("usage: !roll NdM, with up to %d dice of 2 to %d sides", maxDice, maxSides)
+	}
+	rolls := make([]string, dice)
+	total := 0
+	for i := range rolls {
+		r := rand.IntN(sides) + 1
+		rolls[i] = strconv.Itoa(r)
+		total += r
+	}
+	if dice == 1 {
+		return fmt.Sprintf("%s rolled %s: %d", user, spec, total)
+	}
+	return fmt.Sprintf("%s rolled %s: %s = %d", user, spec, strings.Join(rolls, " + "), total)
+}
+
+// remindBot sets reminders: !remind 10m stretch. The reminder comes back
+// where it was asked for, mentioning whoever asked.
+type remindBot struct {
+	// A reminder the bot is too busy for is given up on from its timer's
+	// goroutine, so unlike the rest of a plugin, pending needs a lock
+	mutex   sync.Mutex
+	pending map[string]int // username -> reminders not yet due
+}
+
+const (
+	maxReminder        = 7 * 24 * time.Hour
+	maxRemindersByUser = 10
+)
+
+func newRemindBot() *remindBot {
+	return &remindBot{pending: make(map[string]int)}
+}
+
+func (*remindBot) name() string { return "remind" }
+
+func (rb *remindBot) handle(b *bot, ev botEvent) {
+	cmd, rest := botCommand(ev)
+	if cmd != "remind" {
+		return
+	}
+	when, what, _ := strings.Cut(rest, " ")
+	d, err := messages.ParseDays(when)
+	what = strings.TrimSpace(what)
+	switch {
+	case err != nil || d <= 0 || what == "":
+		b.reply(ev, "usage: !remind <in, e.g. 10m or 2d> <what>")
+		return
+	case d > maxReminder:
+		b.reply(ev, "I can't remember things for longer than "+messages.FormatDays(maxReminder))
+		return
+	case !rb.add(ev.user):
+		b.reply(ev, fmt.Sprintf("%s, you already have %d reminders waiting", ev.user, maxRemindersByUser))
+		return
+	}
+
+	b.reply(ev, fmt.Sprintf("OK %s, I'll remind you in %s", ev.user, d))
+	b.after(d, func() {
+		rb.done(ev.user)
+		b.reply(ev, fmt.Sprintf("@%s reminder: %s", ev.user, what))
+	}, func() {
+		rb.done(ev.user)
+		b.c.log.Warn("reminder dropped", "user", ev.user)
+	})
+}
+
+// add counts a new reminder for user, unless they have too many waiting.
+func (rb *remindBot) add(user string) bool {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+	if rb.pending[user] >= maxRemindersByUser {
+		return false
+	}
+	rb.pending[user]++
+	return true
+}
+
+// done stops counting one of user's reminders, once it's due.
+func (rb *remindBot) done(user string) {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+	if rb.pending[user]--; rb.pending[user] <= 0 {
+		delete(rb.pending, user)
+	}
+}
+
+// greeterBot welcomes everyone who joins its rooms.
+type greeterBot struct{}
+
+func (greeterBot) name() string { return "greeter" }
+
+func (greeterBot) handle(b *bot, ev botEvent) {
+	if ev.kind == botJoin {
+		b.say(ev.room, fmt.Sprintf("Welcome to %s, %s!", ev.room, ev.user))
+	}
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"chat/audit"
+	"chat/messages"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// A cluster is several server nodes sharing usernames and rooms. Each node
+// keeps its own registry and its own copy of every room's history; they
+// stay in step by telling each other what happened over a bus.
+//
+// Usernames are claimed on the bus before a client is added, so they stay
+// unique cluster-wide. Whoever holds the names (the hub) also knows who is
+// online and in which rooms, and replays that to nodes as they link up.
+// History isn't replayed: a node only has the messages sent since it joined.
+type bus interface {
+	// claim reserves username for node, telling everyone else it's online.
+	claim(node uint32, username string) error
+	// release gives username back, taking it out of every room.
+	release(node uint32, username string)
+	// publish sends ev to every other node. It never blocks: if a node
+	// can't keep up, events to it are dropped.
+	publish(ev *messages.ClusterEvent)
+	// subscribe hands fn everything published by other nodes, in order.
+	subscribe(node uint32, fn func(*messages.ClusterEvent)) error
+}
+
+const (
+	// nodeBits is how many low bits of a message ID name the node that
+	// assigned it, so IDs stay unique across a cluster.
+	nodeBits = 8
+	maxNode  = 1<<nodeBits - 1
+	// clusterQueueSize is how many events can wait for one node.
+	clusterQueueSize = 4096
+)
+
+var (
+	errNameTaken = errors.New("username is empty or already exists")
+	// errClaimedHere means the claimer already holds the name, which only
+	// matters when a node reclaims its users after relinking.
+	errClaimedHere = errors.New("username is already claimed by this node")
+)
+
+// memBus is a bus inside one process. The hub node runs one, with its own
+// registry and every linked node subscribed; tests can run several
+// registries on one.
+type memBus struct {
+	mutex     sync.Mutex
+	names     map[string]*presence         // username -> where they are
+	rooms     map[string]map[string]uint32 // room -> username -> node
+	operators map[string]string            // room -> its operator, as first heard
+	subs      map[uint32]*memSub
+	metrics   *serverMetrics
+}
+
+// memSub is a linked node's queue. Missing a membership event would leave
+// the node wrong about a room for good, so when the queue overflows the node
+// is resynced instead: it gets a RESET and a fresh replay.
+type memSub struct {
+	queue  chan *messages.ClusterEvent
+	resync chan struct{} // signalled once per overflow
+	behind bool          // waiting for a resync; guarded by the bus mutex
+}
+
+type presence struct {
+	node uint32
+	key  []byte
+}
+
+func newMemBus(metrics *serverMetrics) *memBus {
+	return &memBus{
+		metrics:   metrics,
+		names:     make(map[string]*presence),
+		rooms:     make(map[string]map[string]uint32),
+		operators: make(map[string]string),
+		subs:      make(map[uint32]*memSub),
+	}
+}
+
+func (b *memBus) claim(node uint32, username string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if username == "" {
+		return errNameTaken
+	}
+	if p := b.names[username]; p != nil {
+		if p.node == node {
+			return errClaimedHere
+		}
+		return errNameTaken
+	}
+	b.names[username] = &presence{node: node}
+	b.deliver(&messages.ClusterEvent{Kind: messages.ClusterEvent_ONLINE, Node: node, Username: username})
+	return nil
+}
+
+func (b *memBus) release(node uint32, username string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.drop(node, username)
+}
+
+// drop forgets username if node holds it. The caller holds the mutex.
+func (b *memBus) drop(node uint32, username string) {
+	if p := b.names[username]; p == nil || p.node != node {
+		return
+	}
+	delete(b.names, username)
+	for room, members := range b.rooms {
+		delete(members, username)
+		if len(members) == 0 {
+			delete(b.rooms, room)
+			delete(b.operators, room)
+		}
+	}
+	b.deliver(&messages.ClusterEvent{Kind: messages.ClusterEvent_OFFLINE, Node: node, Username: username})
+}
+
+func (b *memBus) publish(ev *messages.ClusterEvent) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	// Keep track of presence, for nodes that link later. Only the node a
+	// user is on gets to speak for them.
+	p := b.names[ev.GetUsername()]
+	switch ev.GetKind() {
+	case messages.ClusterEvent_JOIN:
+		if p == nil || p.node != ev.GetNode() {
+			return
+		}
+		if b.rooms[ev.GetRoom()] == nil {
+			b.rooms[ev.GetRoom()] = make(map[string]uint32)
+		}
+		b.rooms[ev.GetRoom()][ev.GetUsername()] = ev.GetNode()
+		if b.operators[ev.GetRoom()] == "" {
+			b.operators[ev.GetRoom()] = ev.GetOperator()
+		}
+	case messages.ClusterEvent_LEAVE:
+		if p == nil || p.node != ev.GetNode() {
+			return
+		}
+		delete(b.rooms[ev.GetRoom()], ev.GetUsername())
+		if len(b.rooms[ev.GetRoom()]) == 0 {
+			delete(b.rooms, ev.GetRoom())
+			delete(b.operators, ev.GetRoom())
+		}
+	case messages.ClusterEvent_KEY:
+		if p == nil || p.node != ev.GetNode() {
+			return
+		}
+		p.key = ev.GetPublicKey()
+	case messages.ClusterEvent_ONLINE, messages.ClusterEvent_OFFLINE, messages.ClusterEvent_RESET:
+		return // only the bus itself says these
+	}
+	b.deliver(ev)
+}
+
+// deliver queues ev for every node but the one it came from. A node whose
+// queue is full is resynced. The caller holds the mutex.
+func (b *memBus) deliver(ev *messages.ClusterEvent) {
+	for node, sub := range b.subs {
+		if node == ev.GetNode() {
+			continue
+		}
+		select {
+		case sub.queue <- proto.Clone(ev).(*messages.ClusterEvent):
+		default:
+			b.metrics.clusterDropped.Add(1)
+			if !sub.behind {
+				sub.behind = true
+				sub.resync <- struct{}{}
+				slog.Warn("cluster queue full, resyncing node", "node", node, "kind", ev.GetKind())
+			}
+		}
+	}
+}
+
+// subscribe first replays who is online and in which rooms, so a node that
+// links late starts out knowing as much as the others.
+func (b *memBus) subscribe(node uint32, fn func(*messages.ClusterEvent)) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.subs[node] != nil {
+		return fmt.Errorf("node %d is already linked", node)
+	}
+	replay := b.replay(node)
+	sub := &memSub{queue: make(chan *messages.ClusterEvent, clusterQueueSize), resync: make(chan struct{}, 1)}
+	b.subs[node] = sub
+	go func() {
+		for {
+			for _, ev := range replay {
+				fn(ev)
+			}
+			replay = nil
+			select {
+			case ev, ok := <-sub.queue:
+				if !ok {
+					return
+				}
+				fn(ev)
+			case <-sub.resync:
+				replay = b.catchUp(node, sub)
+			}
+		}
+	}()
+	return nil
+}
+
+// catchUp starts node over after its queue overflowed: a RESET, the replay,
+// then whatever messages were still queued. Membership events still queued
+// are dropped, as the replay covers them and they may be out of date.
+func (b *memBus) catchUp(node uint32, sub *memSub) []*messages.ClusterEvent {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.subs[node] != sub {
+		return nil // detached meanwhile
+	}
+	sub.behind = false
+	var queued []*messages.ClusterEvent
+	for len(sub.queue) > 0 { // nothing else takes from it, and we hold off deliver
+		switch ev := <-sub.queue; ev.GetKind() {
+		case messages.ClusterEvent_ROOM, messages.ClusterEvent_DIRECT, messages.ClusterEvent_ALL:
+			queued = append(queued, ev)
+		}
+	}
+	replay := append([]*messages.ClusterEvent{{Kind: messages.ClusterEvent_RESET}}, b.replay(node)...)
+	return append(replay, queued...)
+}
+
+// replay is what node needs to know about everyone else: who is online,
+// their keys and their rooms. The caller holds the mutex.
+func (b *memBus) replay(node uint32) []*messages.ClusterEvent {
+	var replay []*messages.ClusterEvent
+	for name, p := range b.names {
+		if p.node == node {
+			continue
+		}
+		replay = append(replay, &messages.ClusterEvent{Kind: messages.ClusterEvent_ONLINE, Node: p.node, Username: name})
+		if p.key != nil {
+			replay = append(replay, &messages.ClusterEvent{Kind: messages.ClusterEvent_KEY, Node: p.node, Username: name, PublicKey: p.key})
+		}
+	}
+	for room, members := range b.rooms {
+		for name, at := range members {
+			if at != node {
+				replay = append(replay, &messages.ClusterEvent{Kind: messages.ClusterEvent_JOIN, Node: at, Room: room, Username: name, Operator: b.operators[room]})
+			}
+		}
+	}
+	return replay
+}
+
+// detach unsubscribes node and takes all its users offline, when its link
+// to the hub goes down.
+func (b *memBus) detach(node uint32) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if sub := b.subs[node]; sub != nil {
+		close(sub.queue)
+		delete(b.subs, node)
+	}
+	for name, p := range b.names {
+		if p.node == node {
+			b.drop(node, name)
+		}
+	}
+}
+
+// remoteUser is someone registered on another node of the cluster.
+type remoteUser struct {
+	node uint32
+	key  []byte
+}
+
+// joinCluster links r to the rest of a cluster over b as node. Call it
+// before any client is added.
+func (r *registry) joinCluster(node uint32, b bus) error {
+	r.node = node
+	r.cluster = b
+	if err := b.subscribe(node, r.applyCluster); err != nil {
+		return err
+	}
+	r.addSink(r.shareMembership)
+	return nil
+}
+
+// messageID hands out the next message ID. In a cluster the node's ID goes
+// in the low bits, so two nodes never hand out the same one.
+func (r *registry) messageID() uint64 {
+	id := r.nextID.Add(1)
+	if r.cluster == nil {
+		return id
+	}
+	return id<<nodeBits | uint64(r.node)
+}
+
+// shareMembership is a sink telling the cluster about joins and leaves on
+// this node (including those an admin causes).
+func (r *registry) shareMembership(ev registryEvent) {
+	var kind messages.ClusterEvent_Kind
+	switch ev.kind {
+	case audit.KindJoin:
+		kind = messages.ClusterEvent_JOIN
+	case audit.KindLeave:
+		kind = messages.ClusterEvent_LEAVE
+	default:
+		return
+	}
+	r.cluster.publish(&messages.ClusterEvent{Kind: kind, Node: r.node, Room: ev.room, Username: ev.user, Operator: ev.operator})
+}
+
+// publishRoom tells the other nodes about w, which has just been applied to
+// room and sent to the members here. The caller holds the room locked, so
+// the other nodes see a room's changes in the order they happened.
+func (r *registry) publishRoom(room string, w *messages.Wrapper) {
+	if r.cluster == nil {
+		return
+	}
+	r.cluster.publish(&messages.ClusterEvent{Kind: messages.ClusterEvent_ROOM, Node: r.node, Room: room, Payload: w})
+}
+
+// publishDirect sends w to username on another node, reporting whether
+// they're online anywhere else.
+func (r *registry) publishDirect(username string, w *messages.Wrapper) bool {
+	r.mutex.RLock()
+	ru := r.remoteUsers[username]
+	r.mutex.RUnlock()
+	if ru == nil {
+		return false
+	}
+	r.cluster.publish(&messages.ClusterEvent{Kind: messages.ClusterEvent_DIRECT, Node: r.node, Username: username, Payload: w})
+	return true
+}
+
+// applyCluster applies an event from another node. The bus calls it from
+// one goroutine, in order. Nothing here is published again or audited: the
+// node it happened on has done both.
+func (r *registry) applyCluster(ev *messages.ClusterEvent) {
+	name := ev.GetUsername()
+	switch ev.GetKind() {
+	case messages.ClusterEvent_RESET:
+		r.mutex.Lock()
+		clear(r.remoteUsers)
+		r.mutex.Unlock()
+		for _, rm := range r.allRooms() {
+			rm.mutex.Lock()
+			clear(rm.remote)
+			rm.mutex.Unlock()
+		}
+		r.reclaim()
+
+	case messages.ClusterEvent_ONLINE:
+		r.mutex.Lock()
+		r.remoteUsers[name] = &remoteUser{node: ev.GetNode()}
+		r.mutex.Unlock()
+
+	case messages.ClusterEvent_OFFLINE:
+		r.mutex.Lock()
+		delete(r.remoteUsers, name)
+		r.mutex.Unlock()
+		for _, rm := range r.allRooms() {
+			rm.mutex.Lock()
+			if !rm.gone {
+				delete(rm.remote, name)
+				r.dropIfIdle(rm)
+			}
+			rm.mutex.Unlock()
+		}
+
+	case messages.ClusterEvent_KEY:
+		r.mutex.Lock()
+		if ru := r.remoteUsers[name]; ru != nil {
+			ru.key = ev.GetPublicKey()
+		}
+		r.mutex.Unlock()
+
+	case messages.ClusterEvent_JOIN:
+		// whoever runs the room on the joiner's node, not the joiner
+		rm := r.openRoom(ev.GetRoom(), ev.GetOperator())
+		rm.remote[name] = ev.GetNode()
+		rm.mutex.Unlock()
+
+	case messages.ClusterEvent_LEAVE:
+		if rm := r.lockRoom(ev.GetRoom()); rm != nil {
+			delete(rm.remote, name)
+			r.dropIfIdle(rm)
+			rm.mutex.Unlock()
+		}
+
+	case messages.ClusterEvent_ROOM:
+		r.applyRoom(ev.GetRoom(), ev.GetPayload())
+
+	case messages.ClusterEvent_DIRECT:
+		if c := r.lookup(name); c != nil {
+			c.enqueue(ev.GetPayload())
+		}
+
+	case messages.ClusterEvent_ALL:
+		r.mutex.RLock()
+		for _, c := range r.byName {
+			c.enqueue(ev.GetPayload())
+		}
+		r.mutex.RUnlock()
+	}
+}
+
+// applyRoom brings this node's copy of a room up to date with something
+// that happened to it elsewhere, then shows it to the members here.
+func (r *registry) applyRoom(name string, w *messages.Wrapper) {
+	var rm *room
+	if rc := w.GetRoomChat(); rc != nil {
+		rm = r.openRoom(name, "") // a sender isn't the operator just for being first here
+	} else if rm = r.lockRoom(name); rm == nil {
+		return
+	}
+	defer rm.mutex.Unlock()
+
+	switch msg := w.Msg.(type) {
+	case *messages.Wrapper_RoomChat:
+		rc := msg.RoomChat
+		if rc.GetReplyTo() != 0 {
+			_ = rm.attachReply(rc) // the parent may predate this node joining
+		}
+		rm.store(rc)
+		r.notifyMentions(rc)
+
+	case *messages.Wrapper_EditMessage:
+		if stored := rm.history.get(msg.EditMessage.GetMessageId()); stored != nil {
+			rm.edit(stored, msg.EditMessage.GetMessageBody())
+		}
+
+	case *messages.Wrapper_DeleteMessage:
+		if stored := rm.history.get(msg.DeleteMessage.GetMessageId()); stored != nil {
+			rm.detachReply(stored)
+			rm.unstore(stored.GetMessageId())
+		}
+
+	case *messages.Wrapper_Reaction:
+		changed, count, err := rm.react(msg.Reaction.GetUsername(), msg.Reaction)
+		if err != nil || !changed {
+			return
+		}
+		msg.Reaction.Count = count
+
+	case *messages.Wrapper_RoomRetention:
+		// the policy itself; everyone is told with a separate notice
+		rm.setRetention(retentionFromProto(msg.RoomRetention))
+		return
+	}
+	rm.broadcast(w)
+}
+
+// reclaim claims the names of everyone on this node again after the link
+// to the hub was remade, and tells the cluster which rooms they're in.
+// Anyone whose name was taken elsewhere in the meantime is disconnected.
+func (r *registry) reclaim() {
+	type localUser struct {
+		c     *client
+		key   []byte
+		rooms []string
+	}
+	in := r.roomsOf()
+	operators := make(map[string]string)
+	for _, rm := range r.allRooms() {
+		rm.mutex.Lock()
+		operators[rm.name] = rm.operator
+		rm.mutex.Unlock()
+	}
+	var locals []localUser
+	r.mutex.RLock()
+	for _, c := range r.byName {
+		locals = append(locals, localUser{c: c, key: c.publicKey, rooms: in[c]})
+	}
+	r.mutex.RUnlock()
+	// Claims wait on the hub, so they can't hold up the link that answers them
+	go func() {
+		for _, lu := range locals {
+			err := r.cluster.claim(r.node, lu.c.username)
+			if errors.Is(err, errHubDown) {
+				return // down again already: the next RESET tries again
+			}
+			if err != nil && !errors.Is(err, errClaimedHere) {
+				lu.c.log.Warn("username taken elsewhere in the cluster while the hub was unreachable")
+				_ = lu.c.conn.Send(notice("Disconnected: your username was taken elsewhere while this server was cut off"))
+				lu.c.conn.Close()
+				continue
+			}
+			if lu.key != nil {
+				r.cluster.publish(&messages.ClusterEvent{Kind: messages.ClusterEvent_KEY, Node: r.node, Username: lu.c.username, PublicKey: lu.key})
+			}
+			for _, room := range lu.rooms {
+				r.cluster.publish(&messages.ClusterEvent{Kind: messages.ClusterEvent_JOIN, Node: r.node, Room: room, Username: lu.c.username, Operator: operators[room]})
+			}
+		}
+	}()
+}
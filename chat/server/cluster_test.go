@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"chat/messages"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// clustered makes n servers, nodes 1 to n, sharing one in-process bus.
+func clustered(t *testing.T, n int) (*memBus, []*server) {
+	t.Helper()
+	b := newMemBus(newServerMetrics())
+	var servers []*server
+	for node := 1; node <= n; node++ {
+		s := newServer()
+		if err := s.users.joinCluster(uint32(node), b); err != nil {
+			t.Fatal(err)
+		}
+		servers = append(servers, s)
+	}
+	return b, servers
+}
+
+// operator is who runs room on s, failing the test if s has no such room.
+func operator(t *testing.T, s *server, room string) string {
+	t.Helper()
+	rm := s.users.lockRoom(room)
+	if rm == nil {
+		t.Fatalf("no room %q", room)
+	}
+	defer rm.mutex.Unlock()
+	return rm.operator
+}
+
+func TestClusterRoom(t *testing.T) {
+	_, s := clustered(t, 2)
+	alice := connect(t, s[0], "alice")
+	bob := connect(t, s[1], "bob")
+	alice.joined("lobby")
+	bob.join("lobby")
+	alice.expectNotice("bob joined")
+
+	alice.say("lobby", "hi bob")
+	bob.expectChat("hi bob")
+	bob.dm("alice", "hi alice")
+	alice.expect("bob's DM", func(w *messages.Wrapper) bool {
+		return w.GetDirectChat().GetMessageBody() == "hi alice"
+	})
+	if names, _ := s[0].users.members(nil, "lobby"); !slices.Equal(names, []string{"alice", "bob"}) {
+		t.Errorf("node 1 has %v in the lobby", names)
+	}
+
+	bob.close()
+	waitFor(t, "bob to leave node 1's lobby", func() bool {
+		names, _ := s[0].users.members(nil, "lobby")
+		return slices.Equal(names, []string{"alice"})
+	})
+}
+
+func TestClusterNamesAreUnique(t *testing.T) {
+	_, s := clustered(t, 2)
+	connect(t, s[0], "alice")
+	dial(t, s[1], "alice").expectNotice("Registration failed")
+}
+
+func TestRemoteJoinerIsntOperator(t *testing.T) {
+	b, s := clustered(t, 1)
+	connect(t, s[0], "alice").joined("lobby")
+	connect(t, s[0], "mallory").joined("lobby")
+
+	// a node that links now hears both joins, in no particular order
+	late := newServer()
+	if err := late.users.joinCluster(2, b); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the replay", func() bool {
+		names, _ := late.users.members(nil, "lobby")
+		return len(names) == 2
+	})
+	if op := operator(t, late, "lobby"); op != "alice" {
+		t.Fatalf("node 2 has %q running the lobby, want alice", op)
+	}
+
+	// and a joiner on a node without the room doesn't take it over either
+	late.users.applyCluster(&messages.ClusterEvent{Kind: messages.ClusterEvent_JOIN, Node: 3, Room: "attic", Username: "mallory"})
+	if op := operator(t, late, "attic"); op != "" {
+		t.Fatalf("a JOIN saying nothing of the operator made %q the operator", op)
+	}
+}
+
+// TestClusterResyncsOnOverflow has a node stall until its queue overflows,
+// then checks it's told to start over rather than left missing events.
+func TestClusterResyncsOnOverflow(t *testing.T) {
+	b := newMemBus(newServerMetrics())
+	if err := b.claim(1, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	stalled := make(chan struct{})
+	var mutex sync.Mutex
+	var seen []*messages.ClusterEvent
+	if err := b.subscribe(2, func(ev *messages.ClusterEvent) {
+		<-stalled
+		mutex.Lock()
+		seen = append(seen, ev)
+		mutex.Unlock()
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	join := func(room string) {
+		b.publish(&messages.ClusterEvent{Kind: messages.ClusterEvent_JOIN, Node: 1, Room: room, Username: "alice", Operator: "alice"})
+	}
+	for i := 0; i <= clusterQueueSize; i++ {
+		join(fmt.Sprintf("room%d", i))
+	}
+	// these are lost, so only a resync can tell node 2 about them
+	b.publish(&messages.ClusterEvent{Kind: messages.ClusterEvent_LEAVE, Node: 1, Room: "room0", Username: "alice"})
+	join("late")
+	close(stalled)
+
+	// after the RESET, node 2 is told exactly where alice is now
+	var after []*messages.ClusterEvent
+	waitFor(t, "a resync", func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		for i, ev := range seen {
+			if ev.GetKind() == messages.ClusterEvent_RESET {
+				after = slices.Clone(seen[i+1:])
+				return len(after) > clusterQueueSize
+			}
+		}
+		return false
+	})
+	in := make(map[string]bool)
+	for _, ev := range after {
+		if ev.GetKind() == messages.ClusterEvent_JOIN {
+			in[ev.GetRoom()] = true
+		}
+	}
+	if in["room0"] || !in["late"] || !in[fmt.Sprintf("room%d", clusterQueueSize)] {
+		t.Fatalf("after the resync node 2 has alice in room0 %v, late %v", in["room0"], in["late"])
+	}
+}
+
+func TestDetachTakesUsersOffline(t *testing.T) {
+	b, s := clustered(t, 2)
+	connect(t, s[1], "bob").joined("lobby")
+	waitFor(t, "node 1 to hear of bob", func() bool {
+		_, node := s[0].users.whereIs("bob")
+		return node == 2
+	})
+
+	b.detach(2)
+	waitFor(t, "node 1 to forget bob", func() bool {
+		_, node := s[0].users.whereIs("bob")
+		names, _ := s[0].users.members(nil, "lobby")
+		return node == 0 && len(names) == 0
+	})
+	if err := b.claim(1, "bob"); err != nil {
+		t.Fatalf("bob's name is still held after node 2 unlinked: %v", err)
+	}
+}
+
+const testClusterSecret = "s3cret"
+
+// linkedHub serves a hub, node 1, for nodes to link to over TCP, returning
+// it and the address to link to.
+func linkedHub(t *testing.T) (*server, string) {
+	t.Helper()
+	s := newServer()
+	hub := newMemBus(s.metrics)
+	if err := s.users.joinCluster(1, hub); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go s.servePeers(ln, hub, 1, testClusterSecret)
+	return s, ln.Addr().String()
+}
+
+// linkedNode links a new server to the hub at addr as node, with secret.
+func linkedNode(t *testing.T, addr string, node uint32, secret string) (*server, *peerBus) {
+	t.Helper()
+	s := newServer()
+	b := newPeerBus(addr, node, secret, s.metrics)
+	if err := s.users.joinCluster(node, b); err != nil {
+		t.Fatal(err)
+	}
+	return s, b
+}
+
+func (b *peerBus) linked() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.out != nil
+}
+
+func TestPeerLink(t *testing.T) {
+	hub, addr := linkedHub(t)
+	node, b := linkedNode(t, addr, 2, testClusterSecret)
+	waitFor(t, "the link", b.linked)
+
+	alice := connect(t, hub, "alice")
+	bob := connect(t, node, "bob")
+	bob.dm("alice", "over the link")
+	alice.expect("bob's DM", func(w *messages.Wrapper) bool {
+		return w.GetDirectChat().GetMessageBody() == "over the link"
+	})
+}
+
+func TestPeerLinkNeedsTheSecret(t *testing.T) {
+	_, addr := linkedHub(t)
+	node, b := linkedNode(t, addr, 2, "wrong")
+	time.Sleep(100 * time.Millisecond)
+	if b.linked() {
+		t.Fatal("a node with the wrong secret linked")
+	}
+	dial(t, node, "bob").expectNotice("Registration failed")
+}
+
+// TestPeerLinkHidesTheSecret has a node link to an impostor hub, which
+// must learn nothing it could link with itself.
+func TestPeerLinkHidesTheSecret(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	linkedNode(t, ln.Addr().String(), 2, testClusterSecret)
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mh := messages.NewMessageHandler(conn)
+	defer mh.Close()
+	w, err := mh.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hello := w.GetClusterHello(); hello.GetNode() != 2 || len(hello.GetNonce()) == 0 {
+		t.Fatalf("the node opened with %v", w)
+	}
+	if raw, _ := proto.Marshal(w); bytes.Contains(raw, []byte(testClusterSecret)) {
+		t.Fatal("the node sent the secret")
+	}
+	// and without a proof of its own, the impostor hears no more
+	_ = mh.Send(clusterHello(&messages.ClusterHello{Node: 1, Nonce: newNonce(), Proof: []byte("trust me")}))
+	if _, err := mh.Receive(); err == nil {
+		t.Fatal("the node answered a hub that doesn't know the secret")
+	}
+}
+
+func TestServePeersStopsWhenClosed(t *testing.T) {
+	s := newServer()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		s.servePeers(ln, newMemBus(s.metrics), 1, testClusterSecret)
+		close(done)
+	}()
+	ln.Close()
+	select {
+	case <-done:
+	case <-time.After(testTimeout):
+		t.Fatal("servePeers kept accepting on a closed listener")
+	}
+}
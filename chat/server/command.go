@@ -0,0 +1,159 @@
+package main
+
+import (
+	"chat/messages"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// serverCommand is a slash command the server runs for clients. run gets
+// the room the client typed it in (maybe "") and its arguments, checked
+// against spec, and returns what to tell them.
+type serverCommand struct {
+	spec *messages.CommandSpec
+	run  func(c *client, room string, args []string) (string, error)
+}
+
+// commands are the server's slash commands, by name. Clients list them with
+// /help and send here any command they don't handle themselves, so a new
+// one needs no client change.
+var commands = builtinCommands()
+
+// newCommand makes a command. usage names its arguments: <x> is required,
+// [x] optional, and ... on the last one has it take the rest of the line.
+func newCommand(name, usage, help string, run func(c *client, room string, args []string) (string, error)) *serverCommand {
+	spec := &messages.CommandSpec{Name: name, Help: help}
+	for _, word := range strings.Fields(usage) {
+		arg := &messages.CommandArg{Optional: strings.HasPrefix(word, "[")}
+		arg.Name, arg.Rest = strings.CutSuffix(strings.Trim(word, "<>[]"), "...")
+		spec.Args = append(spec.Args, arg)
+	}
+	return &serverCommand{spec: spec, run: run}
+}
+
+// fitArgs checks args against spec, joining up a rest argument.
+func fitArgs(spec *messages.CommandSpec, args []string) ([]string, bool) {
+	specs := spec.GetArgs()
+	required := 0
+	for _, arg := range specs {
+		if !arg.GetOptional() {
+			required++
+		}
+	}
+	if len(args) < required {
+		return nil, false
+	}
+	if len(specs) > 0 && specs[len(specs)-1].GetRest() && len(args) > len(specs) {
+		last := len(specs) - 1
+		return append(args[:last:last], strings.Join(args[last:], " ")), true
+	}
+	return args, len(args) <= len(specs)
+}
+
+// runCommand runs what c sent, or with no name, tells c what it can run.
+func runCommand(c *client, cmd *messages.Command) {
+	name := strings.ToLower(cmd.GetName())
+	if name == "" {
+		list := &messages.CommandList{}
+		for _, sc := range commands {
+			list.Commands = append(list.Commands, sc.spec)
+		}
+		slices.SortFunc(list.Commands, func(a, b *messages.CommandSpec) int { return strings.Compare(a.GetName(), b.GetName()) })
+		c.enqueue(&messages.Wrapper{Msg: &messages.Wrapper_CommandList{CommandList: list}})
+		return
+	}
+
+	sc := commands[name]
+	if sc == nil {
+		c.enqueue(notice(fmt.Sprintf("Unknown command /%s: try /help", name)))
+		return
+	}
+	args, ok := fitArgs(sc.spec, cmd.GetArgs())
+	if !ok {
+		c.enqueue(notice("usage: " + messages.CommandUsage(sc.spec)))
+		return
+	}
+	out, err := sc.run(c, cmd.GetRoom(), args)
+	if err != nil {
+		out = fmt.Sprintf("/%s: %s", name, err)
+	}
+	c.enqueue(notice(out))
+}
+
+func builtinCommands() map[string]*serverCommand {
+	cmds := make(map[string]*serverCommand)
+	add := func(name, usage, help string, run func(c *client, room string, args []string) (string, error)) {
+		cmds[name] = newCommand(name, usage, help, run)
+	}
+
+	add("who", "[room]", "who is in a room (by default the one you're in)", func(c *client, room string, args []string) (string, error) {
+		if len(args) > 0 {
+			room = args[0]
+		}
+		if room == "" {
+			return "", errors.New("which room? /who <room>")
+		}
+		names, err := c.srv.users.members(c, room)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s (%d): %s", room, len(names), strings.Join(names, ", ")), nil
+	})
+
+	add("rooms", "", "rooms on this server and how many are in each", func(c *client, _ string, _ []string) (string, error) {
+		members := c.srv.users.stats().members
+		if len(members) == 0 {
+			return "No rooms yet: /join one to make it", nil
+		}
+		rooms := make([]string, 0, len(members))
+		for room, n := range members {
+			rooms = append(rooms, fmt.Sprintf("%s (%d)", room, n))
+		}
+		slices.Sort(rooms)
+		return "Rooms: " + strings.Join(rooms, ", "), nil
+	})
+
+	add("whois", "<user>", "whether someone is online, and which of your rooms they're in", func(c *client, _ string, args []string) (string, error) {
+		users := c.srv.users
+		name := args[0]
+		who, node := users.whereIs(name)
+		switch {
+		case who != nil:
+			var where []string
+			if who.home != "" {
+				where = append(where, "connected through "+who.home)
+			}
+			// only the rooms c could see them in anyway
+			in := users.roomsOf()
+			var shared []string
+			for _, room := range in[who] {
+				if slices.Contains(in[c], room) {
+					shared = append(shared, room)
+				}
+			}
+			if len(shared) > 0 {
+				where = append(where, "in "+strings.Join(shared, ", "))
+			}
+			if users.publicKey(name) != nil {
+				where = append(where, "takes encrypted DMs")
+			}
+			if len(where) == 0 {
+				return name + " is online", nil
+			}
+			return fmt.Sprintf("%s is online: %s", name, strings.Join(where, "; ")), nil
+		case node != 0:
+			return fmt.Sprintf("%s is online on node %d of this cluster", name, node), nil
+		}
+		return name + " isn't online here", nil
+	})
+
+	add("motd", "", "the message of the day", func(c *client, _ string, _ []string) (string, error) {
+		if text := c.srv.motd.get(); text != "" {
+			return text, nil
+		}
+		return "There's no message of the day", nil
+	})
+	return cmds
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"chat/messages"
+	"testing"
+)
+
+func (tc *testClient) command(name string, args ...string) {
+	tc.t.Helper()
+	tc.send(&messages.Wrapper{Msg: &messages.Wrapper_Command{Command: &messages.Command{Name: name, Args: args}}})
+}
+
+func TestWhoNeedsMembership(t *testing.T) {
+	s := newServer()
+	alice := connect(t, s, "alice")
+	alice.joined("secret")
+	mallory := connect(t, s, "mallory")
+
+	mallory.command("who", "secret")
+	mallory.expectNotice("/who: " + errNotMember.Error())
+	mallory.command("who", "nowhere")
+	mallory.expectNotice("/who: " + errNotMember.Error())
+
+	alice.command("who", "secret")
+	alice.expectNotice("secret (1): alice")
+}
+
+func TestWhoisOnlySharedRooms(t *testing.T) {
+	s := newServer()
+	alice := connect(t, s, "alice")
+	alice.joined("lobby")
+	alice.joined("secret")
+	bob := connect(t, s, "bob")
+	bob.joined("lobby")
+
+	bob.command("whois", "alice")
+	bob.expectNotice("alice is online: in lobby")
+	alice.command("whois", "alice")
+	alice.expectNotice("alice is online: in lobby, secret")
+
+	mallory := connect(t, s, "mallory")
+	mallory.command("whois", "alice")
+	if text := mallory.expectNotice("alice is online").GetText(); text != "alice is online" {
+		t.Errorf("mallory, in no rooms, was told %q", text)
+	}
+}
@@ -1,44 +1,144 @@
 package main
 
-import "chat/messages"
+import (
+	"chat/messages"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// transport is anything a client's frames can be written to.
+// *messages.MessageHandler is the native one; the IRC gateway provides another.
+type transport interface {
+	Send(w *messages.Wrapper) error
+	Close()
+	RemoteAddr() net.Addr
+}
+
+// readerless is a transport with no read loop of its own (a federated
+// proxy, say), so nothing notices when it's closed: whoever disconnects its
+// client has to remove it from the registry too.
+type readerless interface {
+	readerless()
+}
+
+// clientQueueSize is how many frames can wait for a slow client before we drop.
+const clientQueueSize = 128
+
+// minTypingInterval is how often a client's typing indicators are relayed at most.
+const minTypingInterval = time.Second
+
+// flushTimeout is how long removing a client waits for its queue to drain
+// before giving up on it and cutting the connection.
+const flushTimeout = 5 * time.Second
 
 type client struct {
-	msgHandler *messages.MessageHandler
-	username   string
-	out        chan *messages.Wrapper
-	closed     chan struct{} // Unbuffered channel
+	srv      *server
+	conn     transport
+	username string
+	out      chan *messages.Wrapper
+	closed   chan struct{} // Unbuffered channel
+	outMutex sync.Mutex    // rooms enqueue from many goroutines; held so nobody sends on a closed out
+	started  bool          // writePump is running
+	stopped  bool          // out is closed
+	limiter  *connLimiter  // only touched by the goroutine reading this connection
+	log      *slog.Logger  // tagged with the connection ID and username
+	features []string      // negotiated in the Hello/Welcome exchange
+	home     string        // for a federated user's proxy, the server they're really on
+
+	publicKey []byte // published for end-to-end DMs; guarded by the registry's mutex
+
+	lastTyping time.Time // when we last relayed a Typing from this client; reader goroutine only
 }
 
-func newClient(msgHandler *messages.MessageHandler, username string) *client {
+func (s *server) newClient(conn transport, username string, logger *slog.Logger) *client {
 	c := &client{
-		msgHandler: msgHandler,
-		username:   username,
+		srv:      s,
+		conn:     conn,
+		username: username,
+		log:      logger.With("user", username),
 		// Can hold up to 128 messages in this channel
 		// Bounded queue -> But, we need a default clause otherwise goroutine blocks!!!
-		out:    make(chan *messages.Wrapper, 128),
-		closed: make(chan struct{}),
+		out:     make(chan *messages.Wrapper, 128),
+		closed:  make(chan struct{}),
+		limiter: s.limiter.newConn(),
 	}
-	go c.writePump()
 	return c
 }
 
+// start begins writing c's queue to its connection. The registry does this
+// once c is registered, so a client that never makes it in (a taken nick
+// over IRC, say) has no writer to leak and its connection stays usable.
+func (c *client) start() {
+	c.outMutex.Lock()
+	defer c.outMutex.Unlock()
+	if !c.started && !c.stopped {
+		c.started = true
+		go c.writePump()
+	}
+}
+
 func (c *client) writePump() {
 	defer close(c.closed)
-	defer c.msgHandler.Close()
+	defer c.conn.Close()
 
 	for w := range c.out {
-		if err := c.msgHandler.Send(w); err != nil {
+		if err := c.conn.Send(w); err != nil {
+			c.srv.metrics.sendErrors.Add(1)
+			c.log.Warn("send error", "err", err)
 			return
 		}
 	}
 }
 
 func (c *client) enqueue(w *messages.Wrapper) {
+	c.outMutex.Lock()
+	defer c.outMutex.Unlock()
+	if c.stopped {
+		return // removed: nobody is writing any more
+	}
 	select {
 	case c.out <- w:
 	default:
+		c.srv.metrics.framesDropped.Add(1)
+		c.log.Debug("send queue full, frame dropped", "type", messages.TypeName(w))
 		// If c.out reaches 128 messages, the select default kicks in -> new messages are dropped
 		// We don't want to pile any more messages in the out channel
 		// If no default, this will block if c.out is full!!!
 	}
 }
+
+// disconnect cuts c off. Usually closing the connection is enough, and the
+// read loop cleans up as it fails; a readerless one is removed here.
+func (c *client) disconnect() {
+	if _, ok := c.conn.(readerless); ok {
+		c.srv.users.remove(c.conn)
+		return
+	}
+	c.conn.Close()
+}
+
+// stop closes the queue once whatever is already in it has been sent, then
+// waits for the writer to finish, up to flushTimeout. A client that was never
+// started has no writer, and its connection is left to whoever made it.
+func (c *client) stop() {
+	c.outMutex.Lock()
+	if !c.stopped {
+		c.stopped = true
+		close(c.out) // writePump() sends what's left, then closes the connection
+	}
+	started := c.started
+	c.outMutex.Unlock()
+	if !started {
+		return
+	}
+
+	select {
+	case <-c.closed:
+	case <-time.After(flushTimeout):
+		c.log.Warn("send queue didn't drain, closing the connection")
+		c.conn.Close() // unblocks a writer stuck on a dead peer
+		<-c.closed
+	}
+}
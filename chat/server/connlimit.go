@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// connGate caps how many connections are open in total and per source IP.
+// Zero means no cap.
+type connGate struct {
+	maxTotal int
+	maxPerIP int
+
+	mutex sync.Mutex
+	total int
+	perIP map[string]int
+
+	rejecting chan struct{} // one token per rejected client we're still talking to
+}
+
+func newConnGate(maxTotal, maxPerIP int) *connGate {
+	return &connGate{
+		maxTotal: maxTotal,
+		maxPerIP: maxPerIP,
+		perIP:    make(map[string]int),
+
+		rejecting: make(chan struct{}, maxRejecting),
+	}
+}
+
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// admit reserves a slot for a new connection from addr. The returned func
+// gives the slot back and must be called once the connection is done.
+func (g *connGate) admit(addr net.Addr) (func(), error) {
+	ip := remoteIP(addr)
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.maxTotal > 0 && g.total >= g.maxTotal {
+		return nil, fmt.Errorf("server is full (%d connections)", g.maxTotal)
+	}
+	if g.maxPerIP > 0 && g.perIP[ip] >= g.maxPerIP {
+		return nil, fmt.Errorf("too many connections from %s (limit %d)", ip, g.maxPerIP)
+	}
+	g.total++
+	g.perIP[ip]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			g.mutex.Lock()
+			defer g.mutex.Unlock()
+			g.total--
+			if g.perIP[ip]--; g.perIP[ip] <= 0 {
+				delete(g.perIP, ip)
+			}
+		})
+	}, nil
+}
+
+// rejectTimeout bounds how long we spend telling a rejected client why.
+const rejectTimeout = 2 * time.Second
+
+// maxRejecting is how many rejected clients we explain ourselves to at once.
+// Past that they're just hung up on: a flood of connections shouldn't cost a
+// goroutine each for rejectTimeout.
+const maxRejecting = 64
+
+// explain reserves a slot for telling a rejected client why. If ok is false
+// there are none left and the caller should just close the connection;
+// otherwise it calls done once it has.
+func (g *connGate) explain() (done func(), ok bool) {
+	select {
+	case g.rejecting <- struct{}{}:
+		return func() { <-g.rejecting }, true
+	default:
+		return nil, false
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"chat/messages"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestConnGateCaps(t *testing.T) {
+	g := newConnGate(3, 2)
+	a := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1}
+	b := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1}
+
+	releaseA, err := g.admit(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.admit(a); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.admit(a); err == nil || !strings.Contains(err.Error(), "too many connections from 10.0.0.1") {
+		t.Fatalf("third connection from one IP: %v", err)
+	}
+	if _, err := g.admit(b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.admit(b); err == nil || !strings.Contains(err.Error(), "server is full") {
+		t.Fatalf("connection past the total: %v", err)
+	}
+
+	releaseA()
+	releaseA() // only counts once
+	if _, err := g.admit(b); err != nil {
+		t.Fatalf("after a release: %v", err)
+	}
+	if _, err := g.admit(a); err == nil {
+		t.Fatal("a double release freed two slots")
+	}
+}
+
+func TestRejectsAreCapped(t *testing.T) {
+	g := newConnGate(0, 0)
+	var dones []func()
+	for i := 0; i < maxRejecting; i++ {
+		done, ok := g.explain()
+		if !ok {
+			t.Fatalf("reject %d refused a slot", i+1)
+		}
+		dones = append(dones, done)
+	}
+	if _, ok := g.explain(); ok {
+		t.Fatal("more than maxRejecting rejects at once")
+	}
+	dones[0]()
+	if _, ok := g.explain(); !ok {
+		t.Fatal("a finished reject didn't give its slot back")
+	}
+}
+
+func TestServerFull(t *testing.T) {
+	s := newServer()
+	s.gate = newConnGate(1, 0)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go s.serve(ln)
+
+	first, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	waitFor(t, "the first connection", func() bool {
+		s.gate.mutex.Lock()
+		defer s.gate.mutex.Unlock()
+		return s.gate.total == 1
+	})
+
+	second, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mh := messages.NewMessageHandler(second)
+	defer mh.Close()
+	w, err := mh.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text := w.GetServerNotice().GetText(); !strings.Contains(text, "Connection refused: server is full") {
+		t.Errorf("rejected with %q", text)
+	}
+}
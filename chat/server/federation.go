@@ -0,0 +1,615 @@
+package main
+
+import (
+	"bufio"
+	"chat/messages"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Federation links this server to independently run ones. Their users are
+// addressed as user@server and their rooms as room@server.
+//
+// A frame from one of our users for somewhere else (a room@server, or a DM
+// to user@server) is forwarded over the link. The other server hands it to
+// a proxy client named user@ourname, which it registers like any other, so
+// the proxy joins rooms, posts and is sent broadcasts the usual way; what
+// it's sent comes back over the link to the real user.
+//
+// Each side rewrites names before sending, so a frame always arrives in
+// the receiving server's terms: "bob" becomes "bob@us" and "alice@them"
+// becomes "alice". A peer is only trusted about its own users and rooms,
+// though: what it delivers is checked again on arrival.
+
+type federation struct {
+	srv   *server
+	name  string              // how our peers address us
+	peers map[string]*fedPeer // by name; fixed after loading
+}
+
+type fedPeer struct {
+	name   string
+	addr   string // "" if only they dial us
+	secret []byte
+
+	mutex sync.Mutex
+	link  *fedLink // nil while there isn't one
+}
+
+// loadPeers reads the peers file: one "name address secret" line per
+// server, with "-" as the address of servers we don't dial ourselves.
+func loadPeers(s *server, name, path string) (*federation, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fd := newFederation(s, name)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 3 || strings.Contains(fields[0], "@") || fields[0] == name {
+			return nil, fmt.Errorf("%s:%d: want \"name address secret\" for another server", path, line)
+		}
+		if fields[1] == "-" {
+			fields[1] = ""
+		}
+		fd.addPeer(fields[0], fields[1], fields[2])
+	}
+	return fd, scanner.Err()
+}
+
+func newFederation(s *server, name string) *federation {
+	return &federation{srv: s, name: name, peers: make(map[string]*fedPeer)}
+}
+
+// addPeer federates with server name, dialing it at addr unless that's "".
+// Call it before start.
+func (f *federation) addPeer(name, addr, secret string) {
+	f.peers[name] = &fedPeer{name: name, addr: addr, secret: []byte(secret)}
+}
+
+// start dials every peer we have an address for and, if ln isn't nil,
+// accepts links from the rest.
+func (f *federation) start(ln net.Listener) {
+	for _, p := range f.peers {
+		if p.addr != "" {
+			go f.dialLoop(p)
+		}
+	}
+	if ln == nil {
+		return
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				slog.Warn("federation accept error", "err", err)
+				continue
+			}
+			go f.accept(messages.NewMessageHandler(conn))
+		}
+	}()
+}
+
+// serverName is how peers address us, or "" if we're not federated.
+func (f *federation) serverName() string {
+	if f == nil {
+		return ""
+	}
+	return f.name
+}
+
+// splitAddress splits "name@server" into its parts. server is "" for a
+// plain name.
+func splitAddress(s string) (name, server string) {
+	if i := strings.LastIndexByte(s, '@'); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+// targetServer returns the server a client's frame is addressed to, or ""
+// if it's for this one.
+func targetServer(w *messages.Wrapper) string {
+	var target string
+	switch msg := w.Msg.(type) {
+	case *messages.Wrapper_DirectChat:
+		target = msg.DirectChat.GetTo()
+	case *messages.Wrapper_KeyRequest:
+		target = msg.KeyRequest.GetUsername()
+	case *messages.Wrapper_FileOffer:
+		target = msg.FileOffer.GetTo() + msg.FileOffer.GetRoom() // only one is set
+	case *messages.Wrapper_Typing:
+		target = msg.Typing.GetTo() + msg.Typing.GetRoom()
+	case *messages.Wrapper_RoomJoin:
+		target = msg.RoomJoin.GetRoom()
+	case *messages.Wrapper_RoomLeave:
+		target = msg.RoomLeave.GetRoom()
+	case *messages.Wrapper_RoomChat:
+		target = msg.RoomChat.GetRoom()
+	case *messages.Wrapper_EditMessage:
+		target = msg.EditMessage.GetRoom()
+	case *messages.Wrapper_DeleteMessage:
+		target = msg.DeleteMessage.GetRoom()
+	case *messages.Wrapper_Reaction:
+		target = msg.Reaction.GetRoom()
+	case *messages.Wrapper_ThreadRequest:
+		target = msg.ThreadRequest.GetRoom()
+	case *messages.Wrapper_RoomRetention:
+		target = msg.RoomRetention.GetRoom()
+	case *messages.Wrapper_Search:
+		target = msg.Search.GetRoom()
+	case *messages.Wrapper_Command:
+		target = msg.Command.GetRoom()
+	}
+	_, server := splitAddress(target)
+	return server
+}
+
+// forward sends c's frame to the server it's addressed to, if that's not
+// this one, and reports whether it did (or refused to). Frames from proxies
+// are never forwarded again.
+func (f *federation) forward(c *client, w *messages.Wrapper) bool {
+	if f == nil || c.home != "" {
+		return false
+	}
+	server := targetServer(w)
+	if server == "" {
+		return false
+	}
+	if server == f.name {
+		translate(w.ProtoReflect(), "", f.name) // just our own name spelled out
+		return false
+	}
+	p := f.peers[server]
+	var l *fedLink
+	if p != nil {
+		l = p.current()
+	}
+	switch {
+	case w.GetTyping() != nil && l == nil:
+		// not worth a complaint
+	case p == nil:
+		_ = c.conn.Send(notice(fmt.Sprintf("This server isn't federated with %s", server)))
+	case w.GetFileOffer() != nil:
+		_ = c.conn.Send(notice("Files can't be sent to other servers"))
+	case l == nil:
+		_ = c.conn.Send(notice(fmt.Sprintf("%s is unreachable right now, try again shortly", server)))
+	default:
+		translate(w.ProtoReflect(), f.name, server)
+		l.track(c.username)
+		l.send(&messages.FedFrame{User: c.username, Payload: w, Features: c.features})
+	}
+	return true
+}
+
+// userGone tells every server username used that their session is over,
+// so their proxies there go away.
+func (f *federation) userGone(username string) {
+	if f == nil {
+		return
+	}
+	for _, p := range f.peers {
+		if l := p.current(); l != nil && l.untrack(username) {
+			l.send(&messages.FedFrame{User: username, Bye: true})
+		}
+	}
+}
+
+// nameFields are the string fields, in any message, that hold a user or
+// room name.
+var nameFields = map[protoreflect.Name]bool{"username": true, "room": true, "from": true, "to": true}
+
+// translate rewrites the names in m from the terms of server from to those
+// of server to.
+func translate(m protoreflect.Message, from, to string) {
+	var names []protoreflect.FieldDescriptor
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.IsMap():
+		case fd.Kind() == protoreflect.StringKind && !fd.IsList() && nameFields[fd.Name()]:
+			names = append(names, fd)
+		case fd.Kind() == protoreflect.MessageKind && fd.IsList():
+			for i := 0; i < v.List().Len(); i++ {
+				translate(v.List().Get(i).Message(), from, to)
+			}
+		case fd.Kind() == protoreflect.MessageKind:
+			translate(v.Message(), from, to)
+		}
+		return true
+	})
+	for _, fd := range names {
+		m.Set(fd, protoreflect.ValueOfString(rename(m.Get(fd).String(), from, to)))
+	}
+}
+
+// confine qualifies every name in m, a frame peer sent for our user self,
+// that doesn't already end in @peer, so a peer can't pass a frame off as
+// coming from one of our users or rooms, or from a third server. The peer
+// rewrote the names already, but we don't take its word for it. The only
+// name left alone is self as a user: their proxy there is who they are.
+func confine(m protoreflect.Message, peer, self string) {
+	var names []protoreflect.FieldDescriptor
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.IsMap():
+		case fd.Kind() == protoreflect.StringKind && !fd.IsList() && nameFields[fd.Name()]:
+			names = append(names, fd)
+		case fd.Kind() == protoreflect.MessageKind && fd.IsList():
+			for i := 0; i < v.List().Len(); i++ {
+				confine(v.List().Get(i).Message(), peer, self)
+			}
+		case fd.Kind() == protoreflect.MessageKind:
+			confine(v.Message(), peer, self)
+		}
+		return true
+	})
+	for _, fd := range names {
+		name := m.Get(fd).String()
+		if strings.HasSuffix(name, "@"+peer) || (name == self && fd.Name() != "room") {
+			continue
+		}
+		m.Set(fd, protoreflect.ValueOfString(name+"@"+peer))
+	}
+}
+
+func rename(s, from, to string) string {
+	name, server := splitAddress(s)
+	switch {
+	case s == "":
+		return s
+	case server == to:
+		return name
+	case server == "" && from != "":
+		return s + "@" + from
+	}
+	return s
+}
+
+// fedProof proves knowledge of the shared secret, by server, for one
+// handshake.
+func fedProof(secret []byte, server string, dialerNonce, listenerNonce []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("go-chat federation v1\x00" + server + "\x00"))
+	mac.Write(dialerNonce)
+	mac.Write(listenerNonce)
+	return mac.Sum(nil)
+}
+
+func fedHello(h *messages.FedHello) *messages.Wrapper {
+	return &messages.Wrapper{Msg: &messages.Wrapper_FedHello{FedHello: h}}
+}
+
+func newNonce() []byte {
+	nonce := make([]byte, 16)
+	_, _ = rand.Read(nonce)
+	return nonce
+}
+
+// dialLoop keeps a link to p up for as long as the server runs.
+func (f *federation) dialLoop(p *fedPeer) {
+	delay := time.Second
+	for {
+		if p.current() == nil {
+			err := f.dial(p)
+			if err == nil {
+				delay = time.Second
+			} else {
+				slog.Warn("federation link failed", "peer", p.name, "err", err, "retry_in", delay)
+			}
+		}
+		time.Sleep(delay)
+		delay = min(2*delay, maxRelinkDelay)
+	}
+}
+
+// dial links to p and serves the link until it drops.
+func (f *federation) dial(p *fedPeer) error {
+	conn, err := net.DialTimeout("tcp", p.addr, claimTimeout)
+	if err != nil {
+		return err
+	}
+	mh := messages.NewMessageHandler(conn)
+	defer mh.Close()
+	_ = mh.SetReadDeadline(time.Now().Add(f.srv.registerTimeout))
+
+	ours := newNonce()
+	if err := mh.Send(fedHello(&messages.FedHello{Server: f.name, Nonce: ours})); err != nil {
+		return err
+	}
+	w, err := mh.Receive()
+	if err != nil {
+		return err
+	}
+	theirs := w.GetFedHello()
+	if theirs == nil {
+		return errors.New(w.GetServerNotice().GetText())
+	}
+	if theirs.GetServer() != p.name || !hmac.Equal(theirs.GetProof(), fedProof(p.secret, p.name, ours, theirs.GetNonce())) {
+		return fmt.Errorf("%s failed to prove it knows the secret", p.addr)
+	}
+	if err := mh.Send(fedHello(&messages.FedHello{Server: f.name, Proof: fedProof(p.secret, f.name, ours, theirs.GetNonce())})); err != nil {
+		return err
+	}
+	_ = mh.SetReadDeadline(time.Time{})
+	return f.serve(p, mh)
+}
+
+// accept authenticates a link some other server dialed, then serves it.
+func (f *federation) accept(mh *messages.MessageHandler) {
+	defer mh.Close()
+	logger := connLogger(mh.RemoteAddr(), "federation")
+	_ = mh.SetReadDeadline(time.Now().Add(f.srv.registerTimeout))
+
+	w, err := mh.Receive()
+	if err != nil {
+		logger.Info("federation hello read error", "err", err)
+		return
+	}
+	hello := w.GetFedHello()
+	p := f.peers[hello.GetServer()]
+	if p == nil {
+		logger.Warn("federation link refused: unknown server", "server", hello.GetServer())
+		_ = mh.Send(notice("Federation refused: unknown server"))
+		return
+	}
+	ours := newNonce()
+	if err := mh.Send(fedHello(&messages.FedHello{Server: f.name, Nonce: ours, Proof: fedProof(p.secret, f.name, hello.GetNonce(), ours)})); err != nil {
+		return
+	}
+	if w, err = mh.Receive(); err != nil {
+		logger.Info("federation proof read error", "err", err)
+		return
+	}
+	if !hmac.Equal(w.GetFedHello().GetProof(), fedProof(p.secret, p.name, hello.GetNonce(), ours)) {
+		logger.Warn("federation link refused: bad proof", "server", p.name)
+		return
+	}
+	_ = mh.SetReadDeadline(time.Time{})
+	if err := f.serve(p, mh); err != nil {
+		logger.Warn("federation link ended", "server", p.name, "err", err)
+	}
+}
+
+func (p *fedPeer) current() *fedLink {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.link
+}
+
+// fedLink is an authenticated link to a peer server.
+type fedLink struct {
+	fed  *federation
+	peer *fedPeer
+	mh   *messages.MessageHandler
+	out  chan *messages.Wrapper
+	log  *slog.Logger
+
+	mutex sync.Mutex
+	users map[string]struct{} // our users who've sent frames over it
+
+	proxies map[string]*client // proxies for the peer's users, by name; the reader goroutine's
+}
+
+// serve runs an authenticated link to p until it drops. Only one link per
+// peer is kept: if both sides dial at once, the later one is turned away.
+func (f *federation) serve(p *fedPeer, mh *messages.MessageHandler) error {
+	l := &fedLink{
+		fed:     f,
+		peer:    p,
+		mh:      mh,
+		out:     make(chan *messages.Wrapper, clientQueueSize),
+		log:     slog.Default().With("peer", p.name),
+		users:   make(map[string]struct{}),
+		proxies: make(map[string]*client),
+	}
+	p.mutex.Lock()
+	if p.link != nil {
+		p.mutex.Unlock()
+		return errors.New("already linked")
+	}
+	p.link = l
+	p.mutex.Unlock()
+	mh.SetCompression(true)
+	l.log.Info("federation link up")
+
+	done := make(chan struct{})
+	defer func() {
+		p.mutex.Lock()
+		p.link = nil
+		p.mutex.Unlock()
+		close(done)
+		l.drop()
+	}()
+	go func() {
+		for {
+			select {
+			case w := <-l.out:
+				if err := mh.Send(w); err != nil {
+					mh.Close()
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		w, err := mh.Receive()
+		if err != nil {
+			l.log.Info("federation link down", "err", err)
+			return nil
+		}
+		ff := w.GetFedFrame()
+		if ff == nil {
+			l.log.Warn("unexpected message type on federation link", "type", messages.TypeName(w))
+			continue
+		}
+		if ff.GetDeliver() {
+			l.deliver(ff)
+		} else {
+			l.handle(ff)
+		}
+	}
+}
+
+func (l *fedLink) send(ff *messages.FedFrame) {
+	select {
+	case l.out <- &messages.Wrapper{Msg: &messages.Wrapper_FedFrame{FedFrame: ff}}:
+	default:
+		l.fed.srv.metrics.framesDropped.Add(1)
+		l.log.Debug("federation queue full, frame dropped", "user", ff.GetUser())
+	}
+}
+
+func (l *fedLink) track(username string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.users[username] = struct{}{}
+}
+
+func (l *fedLink) tracked(username string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	_, ok := l.users[username]
+	return ok
+}
+
+func (l *fedLink) untrack(username string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	_, ok := l.users[username]
+	delete(l.users, username)
+	return ok
+}
+
+// deliver passes a frame the peer sent for one of our users on to them, if
+// they've been talking over this link, with its names confined to the peer.
+func (l *fedLink) deliver(ff *messages.FedFrame) {
+	c := l.fed.srv.users.lookup(ff.GetUser())
+	if c == nil || c.home != "" {
+		return
+	}
+	if ff.GetBye() {
+		if l.untrack(c.username) {
+			c.enqueue(notice(fmt.Sprintf("Your session on %s has ended", l.peer.name)))
+		}
+		return
+	}
+	if !l.tracked(c.username) {
+		l.log.Warn("frame for a user with no session there dropped", "user", c.username)
+		return
+	}
+	w := ff.GetPayload()
+	confine(w.ProtoReflect(), l.peer.name, c.username)
+	c.enqueue(w)
+}
+
+// handle acts on a frame from one of the peer's users, through their proxy
+// here, which it registers first if need be.
+func (l *fedLink) handle(ff *messages.FedFrame) {
+	users := l.fed.srv.users
+	if ff.GetUser() == "" || strings.Contains(ff.GetUser(), "@") {
+		l.log.Warn("frame from a bad username dropped", "user", ff.GetUser())
+		return
+	}
+	name := ff.GetUser() + "@" + l.peer.name
+	proxy := l.proxies[name]
+	if proxy != nil && !users.registered(proxy) {
+		delete(l.proxies, name) // kicked: they're told, and start over next time
+		proxy = nil
+	}
+	if ff.GetBye() {
+		if proxy != nil {
+			delete(l.proxies, name)
+			users.remove(proxy.conn)
+		}
+		return
+	}
+	if proxy == nil {
+		t := &fedTransport{link: l, user: ff.GetUser()}
+		proxy = l.fed.srv.newClient(t, name, l.log)
+		proxy.home = l.peer.name
+		proxy.features = ff.GetFeatures()
+		if err := users.add(proxy); err != nil {
+			_ = t.Send(notice(fmt.Sprintf("Cannot act as %s here: %s", name, err)))
+			return
+		}
+		l.proxies[name] = proxy
+	}
+	if ff.GetPayload().GetMsg() != nil {
+		handleMessage(proxy, ff.GetPayload())
+	}
+}
+
+// drop cleans up after the link goes down: the peer's proxies leave, and
+// our users who were talking over it are told.
+func (l *fedLink) drop() {
+	users := l.fed.srv.users
+	l.log.Info("federation link dropped", "proxies", len(l.proxies))
+	for name, proxy := range l.proxies {
+		delete(l.proxies, name)
+		users.remove(proxy.conn)
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for username := range l.users {
+		if c := users.lookup(username); c != nil {
+			c.enqueue(notice(fmt.Sprintf("Lost the link to %s: rooms and users there are unreachable until it's back", l.peer.name)))
+		}
+	}
+}
+
+// fedTransport is a proxy client's connection: frames written to it go back
+// over the link to the real user.
+type fedTransport struct {
+	link *fedLink
+	user string // their name on their own server
+}
+
+func (t *fedTransport) Send(w *messages.Wrapper) error {
+	// w may be on its way to other clients too, so rename a copy
+	w = proto.Clone(w).(*messages.Wrapper)
+	translate(w.ProtoReflect(), t.link.fed.name, t.link.peer.name)
+	t.link.send(&messages.FedFrame{User: t.user, Payload: w, Deliver: true})
+	return nil
+}
+
+// Close tells the real user their session here is over. It's called once,
+// when the proxy's writePump ends.
+func (t *fedTransport) Close() {
+	t.link.send(&messages.FedFrame{User: t.user, Bye: true, Deliver: true})
+}
+
+func (*fedTransport) readerless() {}
+
+func (t *fedTransport) RemoteAddr() net.Addr {
+	return fedAddr(t.link.peer.name)
+}
+
+// fedAddr is where a federated user is connected from: their server.
+type fedAddr string
+
+func (a fedAddr) Network() string { return "federation" }
+func (a fedAddr) String() string  { return "federation:" + string(a) }
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"chat/messages"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+const testFedSecret = "s3cret"
+
+// federatedPair runs two servers in this process, alpha and beta, federated
+// with each other: beta dials alpha.
+func federatedPair(t *testing.T) (alpha, beta *server) {
+	t.Helper()
+	alpha, beta = newServer(), newServer()
+	alpha.fed, beta.fed = newFederation(alpha, "alpha"), newFederation(beta, "beta")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	alpha.fed.addPeer("beta", "", testFedSecret)
+	beta.fed.addPeer("alpha", ln.Addr().String(), testFedSecret)
+	alpha.fed.start(ln)
+	beta.fed.start(nil)
+	waitFor(t, "the link", func() bool {
+		return alpha.fed.peers["beta"].current() != nil && beta.fed.peers["alpha"].current() != nil
+	})
+	return alpha, beta
+}
+
+func TestFederatedRoom(t *testing.T) {
+	alpha, beta := federatedPair(t)
+	alice := connect(t, alpha, "alice")
+	bob := connect(t, beta, "bob")
+	alice.joined("lobby")
+
+	bob.join("lobby@alpha")
+	alice.expectNotice("bob@beta joined")
+	bob.expectNotice("bob@beta joined") // notice text is never rewritten
+
+	bob.say("lobby@alpha", "hello from beta")
+	rc := alice.expectChat("hello from beta")
+	if rc.GetUsername() != "bob@beta" || rc.GetRoom() != "lobby" {
+		t.Errorf("alice saw %s in %s, want bob@beta in lobby", rc.GetUsername(), rc.GetRoom())
+	}
+	rc = bob.expectChat("hello from beta")
+	if rc.GetUsername() != "bob" || rc.GetRoom() != "lobby@alpha" {
+		t.Errorf("bob saw %s in %s, want bob in lobby@alpha", rc.GetUsername(), rc.GetRoom())
+	}
+
+	alice.say("lobby", "hi bob")
+	rc = bob.expectChat("hi bob")
+	if rc.GetUsername() != "alice@alpha" || rc.GetRoom() != "lobby@alpha" {
+		t.Errorf("bob saw %s in %s, want alice@alpha in lobby@alpha", rc.GetUsername(), rc.GetRoom())
+	}
+}
+
+func TestFederatedDirect(t *testing.T) {
+	alpha, beta := federatedPair(t)
+	alice := connect(t, alpha, "alice")
+	bob := connect(t, beta, "bob")
+
+	alice.dm("bob@beta", "psst")
+	dc := bob.expect("DM", func(w *messages.Wrapper) bool { return w.GetDirectChat() != nil }).GetDirectChat()
+	if dc.GetFrom() != "alice@alpha" || dc.GetTo() != "bob" || dc.GetMessageBody() != "psst" {
+		t.Errorf("bob got %v, want psst from alice@alpha", dc)
+	}
+
+	bob.dm("alice@alpha", "hi back")
+	dc = alice.expect("DM", func(w *messages.Wrapper) bool { return w.GetDirectChat() != nil }).GetDirectChat()
+	if dc.GetFrom() != "bob@beta" || dc.GetTo() != "alice" {
+		t.Errorf("alice got %v, want a DM from bob@beta", dc)
+	}
+}
+
+func TestFederatedUnknownServer(t *testing.T) {
+	alpha, _ := federatedPair(t)
+	alice := connect(t, alpha, "alice")
+	alice.join("lobby@zeta")
+	alice.expectNotice("isn't federated with zeta")
+}
+
+func TestFederatedSessionEnds(t *testing.T) {
+	alpha, beta := federatedPair(t)
+	alice := connect(t, alpha, "alice")
+	bob := connect(t, beta, "bob")
+	bob.joined("lobby")
+	alice.join("lobby@beta")
+	bob.expectNotice("alice@alpha joined")
+
+	// alice hanging up takes her proxy on beta with her
+	alice.close()
+	waitFor(t, "alice's proxy to go", func() bool { return beta.users.lookup("alice@alpha") == nil })
+}
+
+// TestFloodingProxyIsKicked has bob flood a room over the link: with no read
+// loop to notice the kick, the proxy has to be removed by whoever kicks it.
+func TestFloodingProxyIsKicked(t *testing.T) {
+	alpha, beta := federatedPair(t)
+	clock := newFakeClock()
+	alpha.limiter = newRateLimiter(testLimits(), clock.now)
+	alice := connect(t, alpha, "alice")
+	alice.joined("lobby")
+	bob := connect(t, beta, "bob")
+
+	bob.join("lobby@alpha") // the first of bob's two
+	alice.expectNotice("bob@beta joined")
+	bob.say("lobby@alpha", "one")
+	alice.expectChat("one")
+	bob.say("lobby@alpha", "two")
+	bob.expectNotice("You are sending too fast")
+	bob.say("lobby@alpha", "three")
+	bob.expectNotice("You are muted for 30s")
+	clock.advance(30 * time.Second)
+	bob.say("lobby@alpha", "four")
+	bob.say("lobby@alpha", "five")
+	bob.say("lobby@alpha", "six")
+	bob.expectNotice("Disconnected for flooding")
+	waitFor(t, "bob's proxy to go", func() bool { return alpha.users.lookup("bob@beta") == nil })
+	if names, _ := alpha.users.members(nil, "lobby"); slices.Contains(names, "bob@beta") {
+		t.Fatalf("bob@beta is still in the lobby: %v", names)
+	}
+
+	// and bob comes back as a new proxy, with a clean slate
+	bob.join("lobby@alpha")
+	alice.expectNotice("bob@beta joined")
+}
+
+// evilPeer links to s as the peer called name, and then does whatever the
+// test says instead of what a server would.
+func evilPeer(t *testing.T, s *server, name string) *messages.MessageHandler {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	s.fed.addPeer(name, "", testFedSecret)
+	s.fed.start(ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mh := messages.NewMessageHandler(conn)
+	t.Cleanup(mh.Close)
+	ours := newNonce()
+	if err := mh.Send(fedHello(&messages.FedHello{Server: name, Nonce: ours})); err != nil {
+		t.Fatal(err)
+	}
+	w, err := mh.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof := fedProof([]byte(testFedSecret), name, ours, w.GetFedHello().GetNonce())
+	if err := mh.Send(fedHello(&messages.FedHello{Server: name, Proof: proof})); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the link", func() bool { return s.fed.peers[name].current() != nil })
+	return mh
+}
+
+func deliverFrame(t *testing.T, mh *messages.MessageHandler, user string, w *messages.Wrapper) {
+	t.Helper()
+	ff := &messages.FedFrame{User: user, Deliver: true, Payload: w}
+	if err := mh.Send(&messages.Wrapper{Msg: &messages.Wrapper_FedFrame{FedFrame: ff}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFederationDeliversOnlyToUsersTalkingOverTheLink(t *testing.T) {
+	alpha := newServer()
+	alpha.fed = newFederation(alpha, "alpha")
+	mallory := evilPeer(t, alpha, "evil")
+	alice := connect(t, alpha, "alice")
+
+	deliverFrame(t, mallory, "alice", &messages.Wrapper{Msg: &messages.Wrapper_DirectChat{
+		DirectChat: &messages.DirectChat{From: "bob", To: "alice", MessageBody: "unasked for"},
+	}})
+	alice.expectNone("DM", 200*time.Millisecond, func(w *messages.Wrapper) bool { return w.GetDirectChat() != nil })
+}
+
+func TestFederationConfinesNamesToThePeer(t *testing.T) {
+	alpha := newServer()
+	alpha.fed = newFederation(alpha, "alpha")
+	mallory := evilPeer(t, alpha, "evil")
+	alice := connect(t, alpha, "alice")
+	bob := connect(t, alpha, "bob")
+	alice.joined("lobby")
+	bob.joined("lobby")
+
+	// Once alice talks to someone there, evil may deliver to her
+	alice.dm("mallory@evil", "hi")
+	waitFor(t, "alice's session on evil", func() bool { return alpha.fed.peers["evil"].current().tracked("alice") })
+
+	deliverFrame(t, mallory, "alice", &messages.Wrapper{Msg: &messages.Wrapper_DirectChat{
+		DirectChat: &messages.DirectChat{From: "bob", To: "alice", MessageBody: "forged DM"},
+	}})
+	dc := alice.expect("DM", func(w *messages.Wrapper) bool { return w.GetDirectChat() != nil }).GetDirectChat()
+	if dc.GetFrom() != "bob@evil" || dc.GetTo() != "alice" {
+		t.Errorf("DM from %q to %q, want from bob@evil to alice", dc.GetFrom(), dc.GetTo())
+	}
+
+	deliverFrame(t, mallory, "alice", &messages.Wrapper{Msg: &messages.Wrapper_RoomChat{
+		RoomChat: &messages.RoomChat{Room: "lobby", Username: "carol@gamma", MessageBody: "forged chat"},
+	}})
+	rc := alice.expectChat("forged chat")
+	if rc.GetRoom() != "lobby@evil" || rc.GetUsername() != "carol@gamma@evil" {
+		t.Errorf("chat by %q in %q, want carol@gamma@evil in lobby@evil", rc.GetUsername(), rc.GetRoom())
+	}
+	bob.expectNone("forged chat", 100*time.Millisecond, func(w *messages.Wrapper) bool {
+		return w.GetRoomChat().GetMessageBody() == "forged chat"
+	})
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"chat/messages"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// fileLimits bounds how much the server keeps in memory for transfers.
+// A zero maxSize turns transfers off.
+type fileLimits struct {
+	maxSize    int64         // largest single file
+	userQuota  int64         // bytes one user may have stored at once
+	totalQuota int64         // bytes stored across all users
+	ttl        time.Duration // how long a file is kept after it's offered
+}
+
+func defaultFileLimits() fileLimits {
+	return fileLimits{
+		maxSize:    16 << 20,
+		userQuota:  64 << 20,
+		totalQuota: 256 << 20,
+		ttl:        15 * time.Minute,
+	}
+}
+
+var (
+	errTransfersOff = errors.New("file transfers are disabled on this server")
+	errNoSuchFile   = errors.New("no such file (it may have expired)")
+	errNoUpload     = errors.New("no upload in progress")
+	errBadChecksum  = errors.New("checksum mismatch")
+)
+
+// storedFile's uploader and readers are connections, not names: whoever
+// registers a name after its owner leaves gets none of their files.
+type storedFile struct {
+	offer    *messages.FileOffer
+	data     []byte
+	complete bool
+	uploader *client
+	readers  map[*client]struct{} // who may download it, set once it's shared
+	expires  time.Time
+}
+
+// fileStore holds uploads in memory until they expire. Uploads are
+// store-and-forward: a file is only offered to anyone once all of it has
+// arrived, so recipients never wait on a slow sender.
+type fileStore struct {
+	limits fileLimits
+	now    func() time.Time // swapped for a fake clock in tests
+
+	mutex   sync.Mutex
+	files   map[uint64]*storedFile
+	uploads map[string]uint64 // uploader -> file they're still sending (one at a time)
+	used    map[string]int64  // bytes held per uploader
+	total   int64
+	nextID  uint64
+}
+
+func newFileStore(limits fileLimits, now func() time.Time) *fileStore {
+	return &fileStore{
+		limits:  limits,
+		now:     now,
+		files:   make(map[uint64]*storedFile),
+		uploads: make(map[string]uint64),
+		used:    make(map[string]int64),
+	}
+}
+
+// offer starts uploader's upload of o and returns the file's ID. Space for
+// the whole file is reserved up front so a transfer can't fail halfway on
+// quota.
+func (s *fileStore) offer(uploader *client, o *messages.FileOffer) (uint64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.prune()
+
+	size := int64(o.GetSize())
+	switch {
+	case s.limits.maxSize <= 0:
+		return 0, errTransfersOff
+	case o.GetSize() == 0:
+		return 0, errors.New("empty file")
+	case size > s.limits.maxSize || size < 0:
+		return 0, fmt.Errorf("file too large: the limit is %d bytes", s.limits.maxSize)
+	case len(o.GetSha256()) != sha256.Size:
+		return 0, errors.New("missing sha256")
+	case o.GetTo() == "" && o.GetRoom() == "":
+		return 0, errors.New("no recipient")
+	}
+	if _, busy := s.uploads[o.GetFrom()]; busy {
+		return 0, errors.New("you already have an upload in progress")
+	}
+	if s.limits.userQuota > 0 && s.used[o.GetFrom()]+size > s.limits.userQuota {
+		return 0, fmt.Errorf("over your quota of %d bytes: wait for older files to expire", s.limits.userQuota)
+	}
+	if s.limits.totalQuota > 0 && s.total+size > s.limits.totalQuota {
+		return 0, errors.New("server storage is full, try again later")
+	}
+
+	name := filepath.Base(o.GetName())
+	if name == "." || name == "/" {
+		name = "file"
+	}
+	s.nextID++
+	offer := &messages.FileOffer{
+		FileId: s.nextID, From: o.GetFrom(), To: o.GetTo(), Room: o.GetRoom(),
+		Name: name, Size: o.GetSize(), Sha256: o.GetSha256(),
+	}
+	s.files[offer.FileId] = &storedFile{
+		offer:    offer,
+		data:     make([]byte, 0, size),
+		uploader: uploader,
+		expires:  s.now().Add(s.limits.ttl),
+	}
+	s.uploads[offer.From] = offer.FileId
+	s.used[offer.From] += size
+	s.total += size
+	return offer.FileId, nil
+}
+
+// write stores the next chunk of from's upload. It returns the offset to
+// ask for next, or the finished offer once the whole file is in. Anything
+// out of order abandons the upload.
+func (s *fileStore) write(from string, ch *messages.FileChunk) (uint64, *messages.FileOffer, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	id, ok := s.uploads[from]
+	if !ok || id != ch.GetFileId() {
+		return 0, nil, errNoUpload
+	}
+	f := s.files[id]
+	if f == nil {
+		// expired halfway through
+		delete(s.uploads, from)
+		return 0, nil, errNoSuchFile
+	}
+	data := ch.GetData()
+	if ch.GetOffset() != uint64(len(f.data)) || len(data) == 0 || len(data) > messages.FileChunkSize ||
+		len(f.data)+len(data) > cap(f.data) {
+		s.drop(id)
+		return 0, nil, errors.New("chunk out of order")
+	}
+	f.data = append(f.data, data...)
+	if len(f.data) < cap(f.data) {
+		return uint64(len(f.data)), nil, nil
+	}
+
+	delete(s.uploads, from)
+	if sum := sha256.Sum256(f.data); !bytes.Equal(sum[:], f.offer.GetSha256()) {
+		s.drop(id)
+		return 0, nil, errBadChecksum
+	}
+	f.complete = true
+	return 0, f.offer, nil
+}
+
+// share lets readers download a finished file.
+func (s *fileStore) share(id uint64, readers []*client) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	f := s.files[id]
+	if f == nil {
+		return
+	}
+	f.readers = make(map[*client]struct{}, len(readers))
+	for _, reader := range readers {
+		f.readers[reader] = struct{}{}
+	}
+}
+
+// read returns the chunk of file id at offset, if c may have it.
+func (s *fileStore) read(c *client, id, offset uint64) ([]byte, *messages.FileOffer, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	f := s.files[id]
+	if f == nil || !f.complete || s.now().After(f.expires) {
+		return nil, nil, errNoSuchFile
+	}
+	if _, ok := f.readers[c]; !ok && f.uploader != c {
+		return nil, nil, errNoSuchFile // don't confirm the ID exists
+	}
+	if offset >= uint64(len(f.data)) {
+		return nil, nil, errors.New("offset past the end of the file")
+	}
+	end := min(offset+messages.FileChunkSize, uint64(len(f.data)))
+	// the stored bytes never change again, so the slice can be shared
+	return f.data[offset:end], f.offer, nil
+}
+
+// remove forgets a file, e.g. because nobody could be offered it.
+func (s *fileStore) remove(id uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.drop(id)
+}
+
+// abandon drops username's unfinished upload, if any. Finished files stay
+// until they expire: the recipients may still want them.
+func (s *fileStore) abandon(username string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if id, ok := s.uploads[username]; ok {
+		s.drop(id)
+	}
+}
+
+// expireLoop frees expired files every so often, so memory doesn't wait
+// for the next transfer to come along.
+func (s *fileStore) expireLoop(every time.Duration) {
+	for range time.Tick(every) {
+		s.mutex.Lock()
+		s.prune()
+		s.mutex.Unlock()
+	}
+}
+
+// prune drops expired files. The caller holds the mutex.
+func (s *fileStore) prune() {
+	now := s.now()
+	for id, f := range s.files {
+		if now.After(f.expires) {
+			s.drop(id)
+		}
+	}
+}
+
+// drop forgets file id and gives its space back. The caller holds the mutex.
+func (s *fileStore) drop(id uint64) {
+	f := s.files[id]
+	if f == nil {
+		return
+	}
+	from := f.offer.GetFrom()
+	if s.uploads[from] == id {
+		delete(s.uploads, from)
+	}
+	size := int64(f.offer.GetSize())
+	s.used[from] -= size
+	if s.used[from] <= 0 {
+		delete(s.used, from)
+	}
+	s.total -= size
+	delete(s.files, id)
+}
+
+func fileComplete(id uint64, sum []byte, err error) *messages.Wrapper {
+	fc := &messages.FileComplete{FileId: id, Sha256: sum}
+	if err != nil {
+		fc.Error = err.Error()
+	}
+	return &messages.Wrapper{Msg: &messages.Wrapper_FileComplete{FileComplete: fc}}
+}
+
+// handleFileOffer starts an upload from c and asks for its first chunk.
+func handleFileOffer(c *client, fo *messages.FileOffer) {
+	fo.From = c.username
+	if fo.GetTo() != "" && c.srv.users.lookup(fo.GetTo()) == nil {
+		c.enqueue(fileComplete(0, nil, fmt.Errorf("no such user %q", fo.GetTo())))
+		return
+	}
+	id, err := c.srv.files.offer(c, fo)
+	if err != nil {
+		c.enqueue(fileComplete(0, nil, err))
+		return
+	}
+	c.log.Info("upload started", "file", id, "name", fo.GetName(), "size", fo.GetSize())
+	c.enqueue(&messages.Wrapper{
+		Msg: &messages.Wrapper_FileAccept{FileAccept: &messages.FileAccept{FileId: id}},
+	})
+}
+
+// handleFileChunk stores a piece of c's upload. When it's the last piece
+// the file is offered to its recipients.
+func handleFileChunk(c *client, ch *messages.FileChunk) {
+	next, done, err := c.srv.files.write(c.username, ch)
+	if err != nil {
+		c.enqueue(fileComplete(ch.GetFileId(), nil, err))
+		return
+	}
+	if done == nil {
+		c.enqueue(&messages.Wrapper{
+			Msg: &messages.Wrapper_FileAccept{FileAccept: &messages.FileAccept{FileId: ch.GetFileId(), Offset: next}},
+		})
+		return
+	}
+	readers, err := c.srv.users.shareFile(c, &messages.Wrapper{Msg: &messages.Wrapper_FileOffer{FileOffer: done}})
+	if err != nil {
+		c.srv.files.remove(done.GetFileId())
+		c.enqueue(fileComplete(done.GetFileId(), nil, err))
+		return
+	}
+	c.srv.files.share(done.GetFileId(), readers)
+	c.log.Info("upload complete", "file", done.GetFileId(), "recipients", len(readers))
+	c.enqueue(fileComplete(done.GetFileId(), done.GetSha256(), nil))
+}
+
+// handleFileAccept sends c one chunk of a file it's downloading, and the
+// checksum after the last one.
+func handleFileAccept(c *client, fa *messages.FileAccept) {
+	data, offer, err := c.srv.files.read(c, fa.GetFileId(), fa.GetOffset())
+	if err != nil {
+		c.enqueue(fileComplete(fa.GetFileId(), nil, err))
+		return
+	}
+	c.enqueue(&messages.Wrapper{
+		Msg: &messages.Wrapper_FileChunk{
+			FileChunk: &messages.FileChunk{FileId: fa.GetFileId(), Offset: fa.GetOffset(), Data: data},
+		},
+	})
+	if fa.GetOffset()+uint64(len(data)) == offer.GetSize() {
+		c.enqueue(fileComplete(fa.GetFileId(), offer.GetSha256(), nil))
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"chat/messages"
+	"crypto/sha256"
+	"errors"
+	"testing"
+	"time"
+)
+
+func testFileLimits() fileLimits {
+	return fileLimits{maxSize: 4 * messages.FileChunkSize, userQuota: 6 * messages.FileChunkSize, totalQuota: 8 * messages.FileChunkSize, ttl: time.Minute}
+}
+
+// fileOffer offers data from from to to, failing the test if it's refused.
+func fileOffer(t *testing.T, s *fileStore, from *client, to string, data []byte) uint64 {
+	t.Helper()
+	sum := sha256.Sum256(data)
+	id, err := s.offer(from, &messages.FileOffer{From: from.username, To: to, Name: "notes.txt", Size: uint64(len(data)), Sha256: sum[:]})
+	if err != nil {
+		t.Fatalf("offer refused: %v", err)
+	}
+	return id
+}
+
+// upload sends all of data for file id, in order, and shares it with readers.
+func upload(t *testing.T, s *fileStore, from *client, id uint64, data []byte, readers ...*client) {
+	t.Helper()
+	for offset := 0; offset < len(data); offset += messages.FileChunkSize {
+		end := min(offset+messages.FileChunkSize, len(data))
+		next, done, err := s.write(from.username, &messages.FileChunk{FileId: id, Offset: uint64(offset), Data: data[offset:end]})
+		if err != nil {
+			t.Fatalf("chunk at %d: %v", offset, err)
+		}
+		if (done != nil) != (end == len(data)) || (done == nil && next != uint64(end)) {
+			t.Fatalf("chunk at %d: asked for %d, finished %v", offset, next, done != nil)
+		}
+	}
+	s.share(id, readers)
+}
+
+// download reads all of file id as c.
+func download(s *fileStore, c *client, id uint64) ([]byte, error) {
+	var got []byte
+	for {
+		data, offer, err := s.read(c, id, uint64(len(got)))
+		if err != nil {
+			return nil, err
+		}
+		got = append(got, data...)
+		if uint64(len(got)) == offer.GetSize() {
+			return got, nil
+		}
+	}
+}
+
+func TestFileTransfer(t *testing.T) {
+	s := newFileStore(testFileLimits(), newFakeClock().now)
+	alice, bob, mallory := &client{username: "alice"}, &client{username: "bob"}, &client{username: "mallory"}
+	data := bytes.Repeat([]byte("0123456789"), messages.FileChunkSize/4) // two and a half chunks
+	id := fileOffer(t, s, alice, "bob", data)
+	upload(t, s, alice, id, data, bob)
+
+	for _, c := range []*client{bob, alice} {
+		if got, err := download(s, c, id); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s downloaded %d bytes (%v), want %d", c.username, len(got), err, len(data))
+		}
+	}
+	if _, err := download(s, mallory, id); !errors.Is(err, errNoSuchFile) {
+		t.Errorf("mallory's download: %v, want %v", err, errNoSuchFile)
+	}
+	// nor does whoever has bob's name once bob has gone
+	if _, err := download(s, &client{username: "bob"}, id); !errors.Is(err, errNoSuchFile) {
+		t.Errorf("the new bob's download: %v, want %v", err, errNoSuchFile)
+	}
+}
+
+func TestFileChunksMustFit(t *testing.T) {
+	s := newFileStore(testFileLimits(), newFakeClock().now)
+	alice := &client{username: "alice"}
+	data := bytes.Repeat([]byte{'x'}, 2*messages.FileChunkSize)
+
+	for _, tc := range []struct {
+		what  string
+		chunk *messages.FileChunk
+	}{
+		{"out of order", &messages.FileChunk{Offset: 10, Data: data[10:20]}},
+		{"oversize", &messages.FileChunk{Data: bytes.Repeat([]byte{'x'}, messages.FileChunkSize+1)}},
+		{"empty", &messages.FileChunk{}},
+	} {
+		id := fileOffer(t, s, alice, "bob", data)
+		tc.chunk.FileId = id
+		if _, _, err := s.write("alice", tc.chunk); err == nil {
+			t.Errorf("%s chunk accepted", tc.what)
+		}
+		// the upload is abandoned, and its space given back
+		if _, _, err := s.write("alice", &messages.FileChunk{FileId: id, Data: data[:10]}); !errors.Is(err, errNoUpload) {
+			t.Errorf("after a %s chunk, the upload carried on: %v", tc.what, err)
+		}
+		if s.used["alice"] != 0 || s.total != 0 {
+			t.Errorf("after a %s chunk, %d bytes still held", tc.what, s.total)
+		}
+	}
+
+	// past the end of the file, even in chunks that would each be fine
+	short := data[:messages.FileChunkSize+10]
+	id := fileOffer(t, s, alice, "bob", short)
+	if _, _, err := s.write("alice", &messages.FileChunk{FileId: id, Data: data[:messages.FileChunkSize]}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.write("alice", &messages.FileChunk{FileId: id, Offset: messages.FileChunkSize, Data: data[:20]}); err == nil {
+		t.Error("chunk past the end of the file accepted")
+	}
+}
+
+func TestFileQuotas(t *testing.T) {
+	s := newFileStore(testFileLimits(), newFakeClock().now)
+	alice, bob := &client{username: "alice"}, &client{username: "bob"}
+	big := bytes.Repeat([]byte{'x'}, 4*messages.FileChunkSize)
+
+	if _, err := s.offer(alice, &messages.FileOffer{From: "alice", To: "bob", Size: uint64(len(big)) + 1, Sha256: make([]byte, sha256.Size)}); err == nil {
+		t.Error("a file over the size limit was accepted")
+	}
+	upload(t, s, alice, fileOffer(t, s, alice, "bob", big), big, bob)
+	if _, err := s.offer(alice, &messages.FileOffer{From: "alice", To: "bob", Size: uint64(len(big)), Sha256: make([]byte, sha256.Size)}); err == nil {
+		t.Error("alice went over her quota")
+	}
+	upload(t, s, bob, fileOffer(t, s, bob, "alice", big), big, alice)
+	if _, err := s.offer(bob, &messages.FileOffer{From: "bob", To: "alice", Size: 1, Sha256: make([]byte, sha256.Size)}); err == nil {
+		t.Error("the store went over its total quota")
+	}
+}
+
+func TestFileChecksumMismatch(t *testing.T) {
+	s := newFileStore(testFileLimits(), newFakeClock().now)
+	alice := &client{username: "alice"}
+	id := fileOffer(t, s, alice, "bob", []byte("what alice meant to send"))
+	if _, _, err := s.write("alice", &messages.FileChunk{FileId: id, Data: []byte("what the wire delivered!")}); !errors.Is(err, errBadChecksum) {
+		t.Fatalf("corrupt upload: %v, want %v", err, errBadChecksum)
+	}
+	if s.files[id] != nil || s.total != 0 {
+		t.Error("the corrupt file was kept")
+	}
+}
+
+func TestFilesExpire(t *testing.T) {
+	clock := newFakeClock()
+	s := newFileStore(testFileLimits(), clock.now)
+	alice, bob := &client{username: "alice"}, &client{username: "bob"}
+	data := []byte("soon gone")
+	id := fileOffer(t, s, alice, "bob", data)
+	upload(t, s, alice, id, data, bob)
+
+	clock.advance(time.Minute + time.Second)
+	if _, err := download(s, bob, id); !errors.Is(err, errNoSuchFile) {
+		t.Errorf("download after the TTL: %v, want %v", err, errNoSuchFile)
+	}
+	s.mutex.Lock()
+	s.prune()
+	s.mutex.Unlock()
+	if s.files[id] != nil || s.used["alice"] != 0 || s.total != 0 {
+		t.Error("the expired file still holds its space")
+	}
+}
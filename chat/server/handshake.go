@@ -0,0 +1,52 @@
+package main
+
+import (
+	"chat/messages"
+	"fmt"
+	"log/slog"
+	"slices"
+)
+
+// serverFeatures lists the optional protocol features this server can enable.
+var serverFeatures = []string{messages.FeatureCompression, messages.FeatureHistory}
+
+func (s *server) serverLimits() *messages.ServerLimits {
+	return &messages.ServerLimits{
+		MaxFrameSize:      messages.MaxFrameSize,
+		MaxUsernameLength: messages.MaxUsernameLength,
+		MaxFileSize:       uint64(max(s.files.limits.maxSize, 0)),
+	}
+}
+
+// negotiate answers a client's Hello with a Welcome, or refuses the client
+// with a notice if it's too old. It returns the features enabled for the
+// connection.
+func (s *server) negotiate(msgHandler *messages.MessageHandler, hello *messages.Hello, logger *slog.Logger) ([]string, bool) {
+	version, ok := messages.NegotiateVersion(hello.GetProtocolVersion())
+	if !ok {
+		logger.Info("refused incompatible client", "version", hello.GetProtocolVersion(), "client", hello.GetClientName())
+		_ = msgHandler.Send(notice(fmt.Sprintf("Unsupported protocol version %d: this server speaks versions %d to %d",
+			hello.GetProtocolVersion(), messages.MinProtocolVersion, messages.ProtocolVersion)))
+		return nil, false
+	}
+	features := messages.NegotiateFeatures(hello.GetFeatures(), serverFeatures)
+	err := msgHandler.Send(&messages.Wrapper{
+		Msg: &messages.Wrapper_Welcome{
+			Welcome: &messages.Welcome{
+				ProtocolVersion: version,
+				Features:        features,
+				Limits:          s.serverLimits(),
+				ServerName:      s.fed.serverName(),
+			},
+		},
+	})
+	if err != nil {
+		return nil, false
+	}
+	logger.Debug("negotiated", "version", version, "features", features, "client", hello.GetClientName())
+	// The Welcome itself goes out uncompressed; everything after may not
+	if slices.Contains(features, messages.FeatureCompression) {
+		msgHandler.SetCompression(true)
+	}
+	return features, true
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"chat/messages"
+	"log/slog"
+	"net"
+	"testing"
+)
+
+// hello says hello to s as version, and returns the reply.
+func hello(t *testing.T, s *server, version uint32) *messages.Wrapper {
+	t.Helper()
+	ours, theirs := net.Pipe()
+	go s.handleClient(messages.NewMessageHandler(theirs), slog.Default())
+	mh := messages.NewMessageHandler(ours)
+	t.Cleanup(mh.Close)
+	if err := mh.Send(&messages.Wrapper{Msg: &messages.Wrapper_Hello{Hello: &messages.Hello{ProtocolVersion: version}}}); err != nil {
+		t.Fatal(err)
+	}
+	w, err := mh.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func TestHelloTooOld(t *testing.T) {
+	w := hello(t, newServer(), messages.MinProtocolVersion-1)
+	if w.GetWelcome() != nil || w.GetServerNotice() == nil {
+		t.Fatalf("a client below version %d got %v", messages.MinProtocolVersion, w)
+	}
+}
+
+func TestHelloTooNew(t *testing.T) {
+	w := hello(t, newServer(), messages.ProtocolVersion+1)
+	if v := w.GetWelcome().GetProtocolVersion(); v != messages.ProtocolVersion {
+		t.Fatalf("a newer client was offered version %d (%v), want %d", v, w, messages.ProtocolVersion)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"chat/messages"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Tests run whole servers in the test process and talk to them the way
+// clients do, over in-memory pipes.
+
+// testTimeout is how long a test waits for something that should happen.
+const testTimeout = 5 * time.Second
+
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// testClient is a native client connected to a server over a net.Pipe.
+type testClient struct {
+	t      testing.TB
+	name   string
+	mh     *messages.MessageHandler
+	frames chan *messages.Wrapper
+}
+
+// dial connects to s, says hello and asks to register as name, without
+// waiting to see whether that worked.
+func dial(t testing.TB, s *server, name string) *testClient {
+	t.Helper()
+	ours, theirs := net.Pipe()
+	go s.handleClient(messages.NewMessageHandler(theirs), slog.Default())
+	tc := &testClient{t: t, name: name, mh: messages.NewMessageHandler(ours), frames: make(chan *messages.Wrapper, 4096)}
+	go func() {
+		defer close(tc.frames)
+		for {
+			w, err := tc.mh.Receive()
+			if err != nil {
+				return
+			}
+			tc.frames <- w
+		}
+	}()
+	t.Cleanup(tc.close)
+	tc.send(&messages.Wrapper{Msg: &messages.Wrapper_Hello{Hello: &messages.Hello{
+		ProtocolVersion: messages.ProtocolVersion, Features: []string{messages.FeatureHistory}, ClientName: "test",
+	}}})
+	tc.send(&messages.Wrapper{Msg: &messages.Wrapper_RegistrationMessage{
+		RegistrationMessage: &messages.Registration{Username: name},
+	}})
+	return tc
+}
+
+// connect registers name with s, failing the test if it can't.
+func connect(t testing.TB, s *server, name string) *testClient {
+	t.Helper()
+	tc := dial(t, s, name)
+	waitFor(t, name+" to register", func() bool { return s.users.lookup(name) != nil })
+	return tc
+}
+
+func (tc *testClient) send(w *messages.Wrapper) {
+	tc.t.Helper()
+	if err := tc.mh.Send(w); err != nil {
+		tc.t.Fatalf("%s: send: %v", tc.name, err)
+	}
+}
+
+func (tc *testClient) close() {
+	tc.mh.Close()
+}
+
+// expect returns the first frame that matches, skipping the rest, and fails
+// the test if none comes.
+func (tc *testClient) expect(what string, match func(*messages.Wrapper) bool) *messages.Wrapper {
+	tc.t.Helper()
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case w, ok := <-tc.frames:
+			if !ok {
+				tc.t.Fatalf("%s: disconnected while waiting for %s", tc.name, what)
+			}
+			if match(w) {
+				return w
+			}
+		case <-timeout:
+			tc.t.Fatalf("%s: no %s after %s", tc.name, what, testTimeout)
+		}
+	}
+}
+
+// expectNone fails the test if a matching frame comes within d.
+func (tc *testClient) expectNone(what string, d time.Duration, match func(*messages.Wrapper) bool) {
+	tc.t.Helper()
+	timeout := time.After(d)
+	for {
+		select {
+		case w, ok := <-tc.frames:
+			if !ok {
+				return
+			}
+			if match(w) {
+				tc.t.Fatalf("%s: unexpected %s: %v", tc.name, what, w)
+			}
+		case <-timeout:
+			return
+		}
+	}
+}
+
+// expectNotice waits for a notice containing text.
+func (tc *testClient) expectNotice(text string) *messages.ServerNotice {
+	tc.t.Helper()
+	return tc.expect("notice "+text, func(w *messages.Wrapper) bool {
+		return strings.Contains(w.GetServerNotice().GetText(), text)
+	}).GetServerNotice()
+}
+
+// expectChat waits for a room message saying text.
+func (tc *testClient) expectChat(text string) *messages.RoomChat {
+	tc.t.Helper()
+	return tc.expect("room message "+text, func(w *messages.Wrapper) bool {
+		return w.GetRoomChat().GetMessageBody() == text
+	}).GetRoomChat()
+}
+
+func (tc *testClient) join(room string) {
+	tc.t.Helper()
+	tc.send(&messages.Wrapper{Msg: &messages.Wrapper_RoomJoin{RoomJoin: &messages.RoomJoin{Room: room}}})
+}
+
+// joined joins room and waits until the server has added tc to it.
+func (tc *testClient) joined(room string) {
+	tc.t.Helper()
+	tc.join(room)
+	tc.expectNotice(tc.name + " joined")
+}
+
+func (tc *testClient) say(room, text string) {
+	tc.t.Helper()
+	tc.send(&messages.Wrapper{Msg: &messages.Wrapper_RoomChat{RoomChat: &messages.RoomChat{Room: room, MessageBody: text}}})
+}
+
+func (tc *testClient) dm(to, text string) {
+	tc.t.Helper()
+	tc.send(&messages.Wrapper{Msg: &messages.Wrapper_DirectChat{DirectChat: &messages.DirectChat{To: to, MessageBody: text}}})
+}
+
+// waitFor polls cond until it holds, failing the test if it doesn't in time.
+func waitFor(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
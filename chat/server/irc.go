@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bufio"
+	"chat/messages"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ircServerName is the prefix the gateway uses for numerics and notices.
+const ircServerName = "go-chat"
+
+// ircConn is the IRC side of a client. It implements transport, so IRC users
+// live in the same registry (and rooms) as native users. Rooms are mapped
+// 1:1 with IRC channels by adding/stripping a leading '#'.
+type ircConn struct {
+	conn      net.Conn
+	nick      string
+	sendMutex sync.Mutex
+}
+
+func newIRCConn(conn net.Conn) *ircConn {
+	return &ircConn{conn: conn}
+}
+
+func (s *server) serveIRC(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			slog.Warn("irc accept error", "err", err)
+			continue
+		}
+		ic := newIRCConn(conn)
+		logger := connLogger(conn.RemoteAddr(), "irc")
+		release, err := s.gate.admit(conn.RemoteAddr())
+		if err != nil {
+			logger.Warn("connection rejected", "err", err)
+			done, ok := s.gate.explain()
+			if !ok {
+				ic.Close()
+				continue
+			}
+			go func() {
+				defer done()
+				defer ic.Close()
+				_ = conn.SetWriteDeadline(time.Now().Add(rejectTimeout))
+				_ = ic.writeLine("ERROR :Connection refused: %s", err)
+			}()
+			continue
+		}
+		go func() {
+			defer release()
+			s.handleIRC(ic, logger)
+		}()
+	}
+}
+
+// ircMessage is one parsed IRC line: [:prefix] COMMAND params... [:trailing]
+type ircMessage struct {
+	prefix  string
+	command string
+	params  []string
+}
+
+func parseIRC(line string) (ircMessage, bool) {
+	var m ircMessage
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, ":") {
+		sp := strings.IndexByte(line, ' ')
+		if sp < 0 {
+			return m, false
+		}
+		m.prefix = line[1:sp]
+		line = line[sp+1:]
+	}
+	for line != "" {
+		line = strings.TrimLeft(line, " ")
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, ":") {
+			m.params = append(m.params, line[1:])
+			break
+		}
+		sp := strings.IndexByte(line, ' ')
+		if sp < 0 {
+			m.params = append(m.params, line)
+			break
+		}
+		m.params = append(m.params, line[:sp])
+		line = line[sp+1:]
+	}
+	if len(m.params) == 0 {
+		return m, false
+	}
+	m.command = strings.ToUpper(m.params[0])
+	m.params = m.params[1:]
+	return m, true
+}
+
+func (m ircMessage) param(i int) string {
+	if i < len(m.params) {
+		return m.params[i]
+	}
+	return ""
+}
+
+func (ic *ircConn) writeLine(format string, args ...any) error {
+	ic.sendMutex.Lock()
+	defer ic.sendMutex.Unlock()
+	_, err := fmt.Fprintf(ic.conn, format+"\r\n", args...)
+	return err
+}
+
+// numeric sends a server reply like ":go-chat 001 nick :Welcome".
+func (ic *ircConn) numeric(code, text string) error {
+	nick := ic.nick
+	if nick == "" {
+		nick = "*"
+	}
+	return ic.writeLine(":%s %s %s %s", ircServerName, code, nick, text)
+}
+
+func ircChannel(room string) string { return "#" + ircWord(room) }
+
+func roomFromChannel(channel string) string { return strings.TrimPrefix(channel, "#") }
+
+func ircSource(username string) string {
+	username = ircWord(username)
+	return fmt.Sprintf("%s!%s@%s", username, username, ircServerName)
+}
+
+// ircWord drops anything from name that would end the word or the line it
+// goes in. The registry refuses such names, but a federated server might
+// not have.
+func ircWord(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\r' || r == '\n' || r == 0 {
+			return -1
+		}
+		return r
+	}, name)
+}
+
+// Send translates a protobuf frame into IRC lines. Frames with no IRC
+// equivalent are silently dropped.
+func (ic *ircConn) Send(w *messages.Wrapper) error {
+	switch m := w.Msg.(type) {
+	case *messages.Wrapper_ServerNotice:
+		target := ic.nick
+		if room := m.ServerNotice.GetRoom(); room != "" {
+			target = ircChannel(room)
+		}
+		return ic.sendLines(":"+ircServerName, "NOTICE", target, m.ServerNotice.GetText())
+
+	case *messages.Wrapper_RoomChat:
+		rc := m.RoomChat
+		if rc.GetUsername() == ic.nick {
+			return nil // IRC clients echo their own messages locally
+		}
+		return ic.sendLines(":"+ircSource(rc.GetUsername()), "PRIVMSG", ircChannel(rc.GetRoom()), rc.GetMessageBody())
+
+	case *messages.Wrapper_DirectChat:
+		dc := m.DirectChat
+		if len(dc.GetCiphertext()) > 0 {
+			return ic.sendLines(":"+ircServerName, "NOTICE", ic.nick,
+				dc.GetFrom()+" sent you an encrypted message: use the native client to read it")
+		}
+		return ic.sendLines(":"+ircSource(dc.GetFrom()), "PRIVMSG", ic.nick, dc.GetMessageBody())
+
+	// IRC has no edits or deletions, so the best we can do is say what happened
+	case *messages.Wrapper_EditMessage:
+		e := m.EditMessage
+		return ic.sendLines(":"+ircServerName, "NOTICE", ircChannel(e.GetRoom()),
+			fmt.Sprintf("%s edited #%d: %s", e.GetUsername(), e.GetMessageId(), e.GetMessageBody()))
+
+	case *messages.Wrapper_DeleteMessage:
+		d := m.DeleteMessage
+		if d.GetUsername() == "" {
+			return ic.sendLines(":"+ircServerName, "NOTICE", ircChannel(d.GetRoom()), fmt.Sprintf("#%d expired", d.GetMessageId()))
+		}
+		return ic.sendLines(":"+ircServerName, "NOTICE", ircChannel(d.GetRoom()),
+			fmt.Sprintf("%s deleted #%d", d.GetUsername(), d.GetMessageId()))
+
+	case *messages.Wrapper_MentionNotice:
+		mn := m.MentionNotice
+		return ic.sendLines(":"+ircServerName, "NOTICE", ic.nick,
+			fmt.Sprintf("%s mentioned you in %s: %s", mn.GetFrom(), ircChannel(mn.GetRoom()), mn.GetMessageBody()))
+
+	case *messages.Wrapper_FileOffer:
+		// there's no way to download over IRC, but at least say it was sent
+		fo := m.FileOffer
+		target := ic.nick
+		if fo.GetRoom() != "" {
+			target = ircChannel(fo.GetRoom())
+		}
+		return ic.sendLines(":"+ircServerName, "NOTICE", target,
+			fmt.Sprintf("%s sent a file, %s (%d bytes): use the native client to download it", fo.GetFrom(), fo.GetName(), fo.GetSize()))
+
+	case *messages.Wrapper_Reaction:
+		r := m.Reaction
+		verb := "reacted"
+		if r.GetRemove() {
+			verb = "took back"
+		}
+		return ic.sendLines(":"+ircServerName, "NOTICE", ircChannel(r.GetRoom()),
+			fmt.Sprintf("%s %s %s on #%d (%d)", r.GetUsername(), verb, r.GetEmoji(), r.GetMessageId(), r.GetCount()))
+	}
+	return nil
+}
+
+// sendLines writes one IRC line per line of text, since IRC can't carry
+// line breaks (any of them) or NULs.
+func (ic *ircConn) sendLines(prefix, command, target, text string) error {
+	lines := strings.FieldsFunc(text, func(r rune) bool { return r == '\r' || r == '\n' || r == 0 })
+	for _, line := range lines {
+		if err := ic.writeLine("%s %s %s :%s", prefix, command, target, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ic *ircConn) Close() {
+	ic.conn.Close()
+}
+
+func (ic *ircConn) RemoteAddr() net.Addr {
+	return ic.conn.RemoteAddr()
+}
+
+func (s *server) handleIRC(ic *ircConn, logger *slog.Logger) {
+	var c *client
+	defer func() {
+		if c != nil {
+			s.users.remove(ic)
+		}
+		ic.Close()
+	}()
+
+	if s.registerTimeout > 0 {
+		_ = ic.conn.SetReadDeadline(time.Now().Add(s.registerTimeout))
+	}
+	scanner := bufio.NewScanner(ic.conn)
+	var nick, user string
+	for scanner.Scan() {
+		msg, ok := parseIRC(scanner.Text())
+		if !ok {
+			continue
+		}
+		logger.Debug("irc line received", "command", msg.command, "size", len(scanner.Bytes()))
+
+		switch msg.command {
+		case "PING":
+			_ = ic.writeLine(":%s PONG %s :%s", ircServerName, ircServerName, msg.param(0))
+			continue
+		case "QUIT":
+			return
+		case "CAP":
+			if strings.ToUpper(msg.param(0)) == "LS" {
+				_ = ic.writeLine(":%s CAP * LS :", ircServerName)
+			}
+			continue
+		}
+
+		// Registration: NICK + USER together map to a Registration
+		if c == nil {
+			switch msg.command {
+			case "NICK":
+				nick = msg.param(0)
+			case "USER":
+				user = msg.param(0)
+			case "PASS":
+			default:
+				_ = ic.numeric("451", ":You have not registered")
+				continue
+			}
+			if nick == "" || user == "" {
+				continue
+			}
+			ic.nick = nick
+			nc := s.newClient(ic, nick, logger)
+			if err := s.users.add(nc); err != nil {
+				logger.Info("registration refused", "user", nick, "err", err)
+				nc.stop()
+				_ = ic.numeric("433", nick+" :Nickname is already in use")
+				nick = ""
+				continue
+			}
+			c = nc
+			logger = c.log
+			_ = ic.conn.SetReadDeadline(time.Time{})
+			_ = ic.numeric("001", ":Welcome to go-chat "+ircSource(nick))
+			if text := s.motd.get(); text != "" {
+				_ = ic.numeric("375", ":- "+ircServerName+" Message of the day -")
+				for _, line := range strings.Split(text, "\n") {
+					_ = ic.numeric("372", ":- "+line)
+				}
+				_ = ic.numeric("376", ":End of /MOTD command")
+			} else {
+				_ = ic.numeric("422", ":MOTD File is missing")
+			}
+			continue
+		}
+
+		handleIRCCommand(c, ic, msg)
+	}
+	if err := scanner.Err(); err != nil {
+		s.metrics.receiveErrors.Add(1)
+		logger.Warn("receive error", "err", err)
+	}
+}
+
+func handleIRCCommand(c *client, ic *ircConn, msg ircMessage) {
+	switch msg.command {
+	case "JOIN":
+		for _, channel := range strings.Split(msg.param(0), ",") {
+			if err := joinRoom(c, roomFromChannel(channel)); err != nil {
+				_ = ic.numeric("403", channel+" :"+err.Error())
+				continue
+			}
+			_ = ic.writeLine(":%s JOIN %s", ircSource(c.username), channel)
+			sendNames(c, ic, channel)
+		}
+
+	case "NAMES":
+		for _, channel := range strings.Split(msg.param(0), ",") {
+			sendNames(c, ic, channel)
+		}
+
+	case "PART":
+		for _, channel := range strings.Split(msg.param(0), ",") {
+			if err := leaveRoom(c, roomFromChannel(channel)); err != nil {
+				_ = ic.numeric("442", channel+" :"+err.Error())
+				continue
+			}
+			_ = ic.writeLine(":%s PART %s", ircSource(c.username), channel)
+		}
+
+	case "PRIVMSG", "NOTICE":
+		target, body := msg.param(0), msg.param(1)
+		if target == "" || body == "" {
+			_ = ic.numeric("412", ":No text to send")
+			return
+		}
+		if strings.HasPrefix(target, "#") {
+			handleMessage(c, &messages.Wrapper{
+				Msg: &messages.Wrapper_RoomChat{
+					RoomChat: &messages.RoomChat{Room: roomFromChannel(target), MessageBody: body},
+				},
+			})
+		} else {
+			handleMessage(c, &messages.Wrapper{
+				Msg: &messages.Wrapper_DirectChat{
+					DirectChat: &messages.DirectChat{To: target, MessageBody: body},
+				},
+			})
+		}
+
+	case "NICK", "USER":
+		_ = ic.numeric("462", ":You may not reregister")
+
+	default:
+		_ = ic.numeric("421", msg.command+" :Unknown command")
+	}
+}
+
+// ircNamesPerLine keeps 353 replies well inside IRC's 512-byte lines.
+const ircNamesPerLine = 10
+
+// sendNames lists who is in channel (353), if c is, then ends the list (366).
+func sendNames(c *client, ic *ircConn, channel string) {
+	names, _ := c.srv.users.members(c, roomFromChannel(channel))
+	for i, name := range names {
+		names[i] = ircWord(name)
+	}
+	for len(names) > 0 {
+		n := min(len(names), ircNamesPerLine)
+		_ = ic.numeric("353", "= "+channel+" :"+strings.Join(names[:n], " "))
+		names = names[n:]
+	}
+	_ = ic.numeric("366", channel+" :End of /NAMES list")
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"chat/messages"
+	"fmt"
+	"log/slog"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ircTestClient scripts raw IRC lines at the gateway over a net.Pipe.
+type ircTestClient struct {
+	t     testing.TB
+	conn  net.Conn
+	lines chan string
+}
+
+func dialIRC(t testing.TB, s *server) *ircTestClient {
+	t.Helper()
+	ours, theirs := net.Pipe()
+	go s.handleIRC(newIRCConn(theirs), slog.Default())
+	ic := &ircTestClient{t: t, conn: ours, lines: make(chan string, 4096)}
+	go func() {
+		defer close(ic.lines)
+		scanner := bufio.NewScanner(ours)
+		for scanner.Scan() {
+			ic.lines <- scanner.Text()
+		}
+	}()
+	t.Cleanup(func() { ours.Close() })
+	return ic
+}
+
+func (ic *ircTestClient) send(format string, args ...any) {
+	ic.t.Helper()
+	if _, err := fmt.Fprintf(ic.conn, format+"\r\n", args...); err != nil {
+		ic.t.Fatalf("irc: send: %v", err)
+	}
+}
+
+// expect returns the first line containing text, skipping the rest.
+func (ic *ircTestClient) expect(text string) string {
+	ic.t.Helper()
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case line, ok := <-ic.lines:
+			if !ok {
+				ic.t.Fatalf("irc: disconnected while waiting for %q", text)
+			}
+			if strings.Contains(line, text) {
+				return line
+			}
+		case <-timeout:
+			ic.t.Fatalf("irc: no %q after %s", text, testTimeout)
+		}
+	}
+}
+
+func (ic *ircTestClient) register(nick string) {
+	ic.t.Helper()
+	ic.send("NICK %s", nick)
+	ic.send("USER %s 0 * :%s", nick, nick)
+	ic.expect(" 001 " + nick + " ")
+}
+
+func TestIRCRegister(t *testing.T) {
+	s := newServer()
+	ic := dialIRC(t, s)
+
+	ic.send("JOIN #lobby")
+	ic.expect(" 451 * :You have not registered")
+	ic.send("PING :hi")
+	ic.expect(":go-chat PONG go-chat :hi")
+
+	ic.register("alice")
+	ic.expect(" 422 alice :MOTD File is missing")
+	waitFor(t, "alice to register", func() bool { return s.users.lookup("alice") != nil })
+
+	ic.send("NICK bob")
+	ic.expect(" 462 alice :You may not reregister")
+	ic.send("FROB")
+	ic.expect(" 421 alice FROB :Unknown command")
+}
+
+func TestIRCNickInUse(t *testing.T) {
+	s := newServer()
+	connect(t, s, "alice")
+	ic := dialIRC(t, s)
+
+	ic.send("USER alice 0 * :alice")
+	ic.send("NICK alice")
+	ic.expect(" 433 alice alice :Nickname is already in use")
+
+	// the connection is still good for another try
+	ic.register("alice2")
+	if s.users.lookup("alice2") == nil {
+		t.Error("alice2 didn't register after the collision")
+	}
+}
+
+func TestIRCNickInUseDoesNotLeak(t *testing.T) {
+	s := newServer()
+	connect(t, s, "alice")
+	ic := dialIRC(t, s)
+	ic.send("USER alice 0 * :alice")
+	ic.send("NICK alice")
+	ic.expect(" 433 ")
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		ic.send("NICK alice")
+		ic.expect(" 433 ")
+	}
+	if after := runtime.NumGoroutine(); after > before+10 {
+		t.Errorf("%d goroutines after 50 refused nicks, %d before", after, before)
+	}
+}
+
+func TestIRCChannels(t *testing.T) {
+	s := newServer()
+	bob := connect(t, s, "bob")
+	bob.joined("lobby")
+	ic := dialIRC(t, s)
+	ic.register("alice")
+
+	ic.send("JOIN #lobby")
+	ic.expect(":alice!alice@go-chat JOIN #lobby")
+	ic.expect(" 353 alice = #lobby :alice bob")
+	ic.expect(" 366 alice #lobby :End of /NAMES list")
+	bob.expectNotice("alice joined")
+
+	ic.send("PRIVMSG #lobby :hello from irc")
+	if rc := bob.expectChat("hello from irc"); rc.GetUsername() != "alice" || rc.GetRoom() != "lobby" {
+		t.Errorf("bob saw %s in %s, want alice in lobby", rc.GetUsername(), rc.GetRoom())
+	}
+
+	bob.say("lobby", "hi alice")
+	ic.expect(":bob!bob@go-chat PRIVMSG #lobby :hi alice")
+
+	bob.say("lobby", "two\nlines")
+	ic.expect(":bob!bob@go-chat PRIVMSG #lobby :two")
+	ic.expect(":bob!bob@go-chat PRIVMSG #lobby :lines")
+
+	// a bare CR ends an IRC line too, so it mustn't get through to start one
+	bob.say("lobby", "hi\r:go-chat 001 alice :spoofed")
+	if line := ic.expect(":bob!bob@go-chat PRIVMSG #lobby :hi"); strings.Contains(line, "\r") {
+		t.Errorf("a CR got through: %q", line)
+	}
+	ic.expect(":bob!bob@go-chat PRIVMSG #lobby ::go-chat 001 alice :spoofed")
+
+	ic.send("PART #lobby")
+	ic.expect(":alice!alice@go-chat PART #lobby")
+	bob.expectNotice("alice left")
+}
+
+func TestIRCDirect(t *testing.T) {
+	s := newServer()
+	bob := connect(t, s, "bob")
+	ic := dialIRC(t, s)
+	ic.register("alice")
+
+	ic.send("PRIVMSG bob :psst")
+	dc := bob.expect("DM", func(w *messages.Wrapper) bool { return w.GetDirectChat() != nil }).GetDirectChat()
+	if dc.GetFrom() != "alice" || dc.GetMessageBody() != "psst" {
+		t.Errorf("bob got %v, want psst from alice", dc)
+	}
+
+	bob.dm("alice", "hi back")
+	ic.expect(":bob!bob@go-chat PRIVMSG alice :hi back")
+
+	ic.send("PRIVMSG bob")
+	ic.expect(" 412 alice :No text to send")
+}
+
+func TestIRCQuit(t *testing.T) {
+	s := newServer()
+	ic := dialIRC(t, s)
+	ic.register("alice")
+	ic.send("QUIT :bye")
+	waitFor(t, "alice to go", func() bool { return s.users.lookup("alice") == nil })
+}
+
+func TestHostileNamesRefused(t *testing.T) {
+	s := newServer()
+	for _, name := range []string{"evil\r\n:go-chat 001 x :spoofed", "two words", "nul\x00"} {
+		dial(t, s, name).expectNotice("Registration failed: " + errBadName.Error())
+	}
+
+	mallory := connect(t, s, "mallory")
+	for _, room := range []string{"lobby\r\nPRIVMSG #lobby :spoofed", "lobby\n", "two words"} {
+		mallory.join(room)
+		mallory.expectNotice("Join failed: " + errBadName.Error())
+	}
+	if n := len(s.users.stats().members); n != 0 {
+		t.Errorf("%d rooms opened with hostile names", n)
+	}
+}
+
+// TestIRCScrubsNames checks the gateway itself keeps names to one word, for
+// those that didn't pass through this registry.
+func TestIRCScrubsNames(t *testing.T) {
+	s := newServer()
+	ic := dialIRC(t, s)
+	ic.register("alice")
+	waitFor(t, "alice to register", func() bool { return s.users.lookup("alice") != nil })
+
+	s.users.direct("alice", &messages.Wrapper{Msg: &messages.Wrapper_DirectChat{DirectChat: &messages.DirectChat{
+		From: "mallory@elsewhere\r\n:go-chat 001 alice :spoofed", To: "alice", MessageBody: "hi",
+	}}})
+	line := ic.expect("PRIVMSG alice :hi")
+	if !strings.HasPrefix(line, ":mallory@elsewhere:go-chat001alice:spoofed!") {
+		t.Errorf("sent %q", line)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+var nextConnID atomic.Uint64
+
+// connLogger returns a logger that tags every line with a fresh connection
+// ID and the peer's address. Add the username with .With once it's known.
+func connLogger(addr net.Addr, front string) *slog.Logger {
+	return slog.Default().With("conn", nextConnID.Add(1), "remote", addr.String(), "front", front)
+}
+
+// setupLogging installs the default logger. format is "text" or "json";
+// level is one of debug, info, warn, error.
+func setupLogging(format, level string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return err
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var h slog.Handler
+	switch strings.ToLower(format) {
+	case "text":
+		h = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// fatal logs at error level and exits, like log.Fatalln.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,34 @@
+package main
+
+import "chat/messages"
+
+func mentionWrapper(mn *messages.MentionNotice) *messages.Wrapper {
+	return &messages.Wrapper{Msg: &messages.Wrapper_MentionNotice{MentionNotice: mn}}
+}
+
+// notifyMentions sends a MentionNotice to everyone rc mentions who is
+// online, whether or not they're in the room. Nothing is kept for names
+// nobody is using: whoever registers one later isn't necessarily who was
+// meant. In a cluster each node notifies its own users. The caller holds
+// rc's room locked.
+func (r *registry) notifyMentions(rc *messages.RoomChat) {
+	names := messages.ParseMentions(rc.GetMessageBody())
+	if len(names) == 0 {
+		return
+	}
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, name := range names {
+		if name == rc.GetUsername() {
+			continue
+		}
+		if c := r.byName[name]; c != nil {
+			c.enqueue(mentionWrapper(&messages.MentionNotice{
+				Room:        rc.GetRoom(),
+				From:        rc.GetUsername(),
+				MessageId:   rc.GetMessageId(),
+				MessageBody: rc.GetMessageBody(),
+			}))
+		}
+	}
+}
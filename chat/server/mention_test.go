@@ -0,0 +1,35 @@
+package main
+
+import (
+	"chat/messages"
+	"testing"
+	"time"
+)
+
+func isMention(w *messages.Wrapper) bool { return w.GetMentionNotice() != nil }
+
+func TestMentionReachesUserOutsideTheRoom(t *testing.T) {
+	s := newServer()
+	alice := connect(t, s, "alice")
+	bob := connect(t, s, "bob")
+	alice.joined("lobby")
+
+	alice.say("lobby", "hey @bob and @alice")
+	mn := bob.expect("mention", isMention).GetMentionNotice()
+	if mn.GetFrom() != "alice" || mn.GetRoom() != "lobby" || mn.GetMessageBody() != "hey @bob and @alice" {
+		t.Errorf("bob got %v", mn)
+	}
+	alice.expectNone("a mention of herself", 100*time.Millisecond, isMention)
+}
+
+func TestMentionsArentKeptForOfflineNames(t *testing.T) {
+	s := newServer()
+	alice := connect(t, s, "alice")
+	alice.joined("lobby")
+	alice.say("lobby", "@carol the password is hunter2")
+	alice.expectChat("@carol the password is hunter2")
+
+	// whoever takes the name next isn't necessarily who alice meant
+	carol := connect(t, s, "carol")
+	carol.expectNone("a mention from before she registered", 200*time.Millisecond, isMention)
+}
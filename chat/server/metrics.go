@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// serverMetrics holds the counters exposed on /metrics. Gauges (clients,
+// rooms, queue depths) are read from the registry at scrape time instead.
+type serverMetrics struct {
+	framesDropped  atomic.Uint64
+	sendErrors     atomic.Uint64
+	receiveErrors  atomic.Uint64
+	clusterDropped atomic.Uint64
+
+	webhooksDelivered atomic.Uint64
+	webhooksFailed    atomic.Uint64
+	webhooksDropped   atomic.Uint64
+
+	relayedMutex sync.Mutex
+	relayed      map[string]uint64 // message type -> count
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{relayed: make(map[string]uint64)}
+}
+
+func (m *serverMetrics) countRelayed(msgType string) {
+	m.relayedMutex.Lock()
+	defer m.relayedMutex.Unlock()
+	m.relayed[msgType]++
+}
+
+// labelEscaper escapes label values per the Prometheus text format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeMetric(w io.Writer, name, help, kind string, samples func(emit func(labels string, v uint64))) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	samples(func(labels string, v uint64) {
+		fmt.Fprintf(w, "%s%s %d\n", name, labels, v)
+	})
+}
+
+func single(v uint64) func(func(string, uint64)) {
+	return func(emit func(string, uint64)) { emit("", v) }
+}
+
+// write renders every metric, with the registry's current stats, in the
+// Prometheus text format.
+func (m *serverMetrics) write(w http.ResponseWriter, stats registryStats) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	writeMetric(w, "gochat_connected_clients", "Registered clients.", "gauge", single(uint64(stats.clients)))
+	writeMetric(w, "gochat_rooms", "Rooms with at least one member.", "gauge", single(uint64(len(stats.members))))
+	writeMetric(w, "gochat_room_members", "Members per room.", "gauge", func(emit func(string, uint64)) {
+		rooms := make([]string, 0, len(stats.members))
+		for room := range stats.members {
+			rooms = append(rooms, room)
+		}
+		slices.Sort(rooms)
+		for _, room := range rooms {
+			emit(fmt.Sprintf(`{room="%s"}`, labelEscaper.Replace(room)), uint64(stats.members[room]))
+		}
+	})
+
+	m.relayedMutex.Lock()
+	relayed := make(map[string]uint64, len(m.relayed))
+	for k, v := range m.relayed {
+		relayed[k] = v
+	}
+	m.relayedMutex.Unlock()
+	writeMetric(w, "gochat_messages_relayed_total", "Messages relayed by the registry, by type.", "counter", func(emit func(string, uint64)) {
+		types := make([]string, 0, len(relayed))
+		for t := range relayed {
+			types = append(types, t)
+		}
+		slices.Sort(types)
+		for _, t := range types {
+			emit(fmt.Sprintf(`{type="%s"}`, t), relayed[t])
+		}
+	})
+
+	writeMetric(w, "gochat_frames_dropped_total", "Frames dropped because a client's send queue was full.", "counter", single(m.framesDropped.Load()))
+	writeMetric(w, "gochat_cluster_events_dropped_total", "Cluster events dropped because a node fell too far behind.", "counter", single(m.clusterDropped.Load()))
+	writeMetric(w, "gochat_webhook_deliveries_total", "Webhook events by outcome: delivered, failed after retries, or dropped on a full queue.", "counter", func(emit func(string, uint64)) {
+		emit(`{result="delivered"}`, m.webhooksDelivered.Load())
+		emit(`{result="failed"}`, m.webhooksFailed.Load())
+		emit(`{result="dropped"}`, m.webhooksDropped.Load())
+	})
+	writeMetric(w, "gochat_send_errors_total", "Errors writing frames to clients.", "counter", single(m.sendErrors.Load()))
+	writeMetric(w, "gochat_receive_errors_total", "Errors reading frames from clients, excluding clean disconnects.", "counter", single(m.receiveErrors.Load()))
+}
+
+// metricsHandler serves /metrics.
+func (s *server) metricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, _ *http.Request) { s.metrics.write(w, s.users.stats()) })
+	return mux
+}
+
+func (s *server) serveMetrics(addr string) error {
+	return http.ListenAndServe(addr, s.metricsHandler())
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// scrape fetches s's metrics over HTTP, as Prometheus would.
+func scrape(t *testing.T, s *server) string {
+	t.Helper()
+	ts := httptest.NewServer(s.metricsHandler())
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("scrape: %s, %q", resp.Status, resp.Header.Get("Content-Type"))
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func expectSamples(t *testing.T, metrics string, samples ...string) {
+	t.Helper()
+	lines := strings.Split(metrics, "\n")
+	for _, sample := range samples {
+		if !slices.Contains(lines, sample) {
+			t.Errorf("no %q in:\n%s", sample, metrics)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	s := quietServer()
+	expectSamples(t, scrape(t, s),
+		"# TYPE gochat_connected_clients gauge",
+		"gochat_connected_clients 0",
+		"gochat_frames_dropped_total 0",
+	)
+
+	alice, bob := addClient(t, s, "alice"), addClient(t, s, "bob")
+	for _, c := range []*client{alice, bob} {
+		if err := s.users.joinRoom(c, "lobby"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if err := s.users.postRoom(alice, chat("lobby", "hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// and a client nobody's writing to yet drops what won't fit its queue
+	stuck := s.newClient(&nullConn{}, "stuck", slog.Default())
+	for i := 0; i < cap(stuck.out)+2; i++ {
+		stuck.enqueue(notice("anyone there?"))
+	}
+
+	expectSamples(t, scrape(t, s),
+		"gochat_connected_clients 2",
+		"gochat_rooms 1",
+		`gochat_room_members{room="lobby"} 2`,
+		`gochat_messages_relayed_total{type="room_chat"} 3`,
+		"gochat_frames_dropped_total 2",
+	)
+}
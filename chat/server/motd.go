@@ -0,0 +1,58 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// motd is the message of the day, read from a file and sent to every client
+// right after it registers. It can be reloaded while the server runs.
+type motd struct {
+	path string
+	text atomic.Pointer[string]
+}
+
+// load re-reads the file. An empty path means no MOTD.
+func (m *motd) load() error {
+	text := ""
+	if m.path != "" {
+		b, err := os.ReadFile(m.path)
+		if err != nil {
+			return err
+		}
+		text = strings.TrimRight(string(b), "\r\n")
+	}
+	m.text.Store(&text)
+	return nil
+}
+
+func (m *motd) get() string {
+	if t := m.text.Load(); t != nil {
+		return *t
+	}
+	return ""
+}
+
+// reloadOnHangup reloads the MOTD whenever the process gets SIGHUP.
+func (m *motd) reloadOnHangup() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := m.load(); err != nil {
+			slog.Error("MOTD reload failed", "path", m.path, "err", err)
+			continue
+		}
+		slog.Info("MOTD reloaded", "path", m.path)
+	}
+}
+
+// sendMOTD greets a freshly registered client.
+func sendMOTD(c *client) {
+	if text := c.srv.motd.get(); text != "" {
+		c.enqueue(notice(text))
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// withMOTD gives s a MOTD file saying text.
+func withMOTD(t *testing.T, s *server, text string) {
+	t.Helper()
+	s.motd.path = filepath.Join(t.TempDir(), "motd")
+	if err := os.WriteFile(s.motd.path, []byte(text+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.motd.load(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMOTDOnRegistration(t *testing.T) {
+	s := newServer()
+	withMOTD(t, s, "Welcome!\nBe nice.")
+
+	alice := connect(t, s, "alice")
+	alice.expectNotice("Welcome!\nBe nice.")
+	ic := dialIRC(t, s)
+	ic.register("bob")
+	ic.expect(" 375 bob :- go-chat Message of the day -")
+	ic.expect(" 372 bob :- Welcome!")
+	ic.expect(" 372 bob :- Be nice.")
+	ic.expect(" 376 bob :End of /MOTD command")
+
+	// a reload is what the next one to register sees
+	if err := os.WriteFile(s.motd.path, []byte("New rules."), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.motd.load(); err != nil {
+		t.Fatal(err)
+	}
+	carol := connect(t, s, "carol")
+	carol.expectNotice("New rules.")
+}
+
+// TestBroadcastAllReachesEveryTransport has a notice go out to clients on
+// the wire, over IRC, on another cluster node and on a federated server.
+func TestBroadcastAllReachesEveryTransport(t *testing.T) {
+	_, nodes := clustered(t, 2)
+	alpha, beta := federatedPair(t)
+	alice := connect(t, alpha, "alice") // in no rooms at all
+	ic := dialIRC(t, alpha)
+	ic.register("bob")
+	waitFor(t, "bob to register", func() bool { return alpha.users.lookup("bob") != nil })
+	dave := connect(t, beta, "dave")
+	dave.dm("alice@alpha", "hi") // which leaves dave a proxy on alpha
+	waitFor(t, "dave's proxy", func() bool { return alpha.users.lookup("dave@beta") != nil })
+
+	alpha.users.broadcastAll(notice("Restarting in 5 minutes"))
+	alice.expectNotice("Restarting in 5 minutes")
+	ic.expect("NOTICE bob :Restarting in 5 minutes")
+	dave.expectNotice("Restarting in 5 minutes")
+
+	carol := connect(t, nodes[0], "carol")
+	erin := connect(t, nodes[1], "erin")
+	nodes[0].users.broadcastAll(notice("Node 1 is going down"))
+	carol.expectNotice("Node 1 is going down")
+	erin.expectNotice("Node 1 is going down")
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"chat/messages"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// claimTimeout is how long registering waits on the hub for a username.
+	claimTimeout = 5 * time.Second
+	// maxRelinkDelay caps the backoff between attempts to reach the hub.
+	maxRelinkDelay = 30 * time.Second
+)
+
+var errHubDown = errors.New("the cluster is unreachable right now, try again shortly")
+
+func clusterWrapper(ev *messages.ClusterEvent) *messages.Wrapper {
+	return &messages.Wrapper{Msg: &messages.Wrapper_ClusterEvent{ClusterEvent: ev}}
+}
+
+// startCluster makes this server a node of a cluster: the hub if listen is
+// set, otherwise linked to the hub at join.
+func (s *server) startCluster(node uint32, listen, join, secret string) error {
+	switch {
+	case node == 0 || node > maxNode:
+		return fmt.Errorf("-node must be between 1 and %d", maxNode)
+	case (listen == "") == (join == ""):
+		return errors.New("give either -cluster-listen (to be the hub) or -cluster-join, not both")
+	case secret == "":
+		return errors.New("a cluster needs -cluster-secret")
+	}
+	if join != "" {
+		slog.Info("joining cluster", "node", node, "hub", join)
+		return s.users.joinCluster(node, newPeerBus(join, node, secret, s.metrics))
+	}
+
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+	hub := newMemBus(s.metrics)
+	if err := s.users.joinCluster(node, hub); err != nil {
+		return err
+	}
+	slog.Info("cluster hub listening", "node", node, "addr", listen)
+	go s.servePeers(ln, hub, node, secret)
+	return nil
+}
+
+// clusterProof is what node sends to show it knows secret, for the link
+// the node's and the hub's nonces were swapped on. The node ID keeps the
+// hub's proof from being replayed as a node's, or one node's as another's.
+func clusterProof(secret string, node uint32, nodeNonce, hubNonce []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(fmt.Sprintf("go-chat cluster v1\x00%d\x00", node)))
+	mac.Write(nodeNonce)
+	mac.Write(hubNonce)
+	return mac.Sum(nil)
+}
+
+func clusterHello(h *messages.ClusterHello) *messages.Wrapper {
+	return &messages.Wrapper{Msg: &messages.Wrapper_ClusterHello{ClusterHello: h}}
+}
+
+// servePeers accepts links from the other nodes, on the hub, until ln is
+// closed.
+func (s *server) servePeers(ln net.Listener, hub *memBus, self uint32, secret string) {
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			slog.Warn("cluster accept error", "err", err)
+			continue
+		}
+		go s.handlePeer(messages.NewMessageHandler(conn), hub, self, secret)
+	}
+}
+
+// handlePeer serves one node's link to the hub: its claims and events go
+// into hub, and everything published by other nodes goes back out.
+func (s *server) handlePeer(mh *messages.MessageHandler, hub *memBus, self uint32, secret string) {
+	defer mh.Close()
+	logger := connLogger(mh.RemoteAddr(), "cluster")
+
+	_ = mh.SetReadDeadline(time.Now().Add(s.registerTimeout))
+	first, err := mh.Receive()
+	if err != nil {
+		logger.Info("cluster hello read error", "err", err)
+		return
+	}
+	hello := first.GetClusterHello()
+	node := hello.GetNode()
+	if hello == nil || node == 0 || node > maxNode || node == self {
+		logger.Warn("cluster link refused: bad node ID", "node", node)
+		_ = mh.Send(notice(fmt.Sprintf("Cluster link refused: node ID %d is invalid or the hub's own", node)))
+		return
+	}
+	logger = logger.With("node", node)
+	ours := newNonce()
+	if err := mh.Send(clusterHello(&messages.ClusterHello{Node: self, Nonce: ours, Proof: clusterProof(secret, self, hello.GetNonce(), ours)})); err != nil {
+		return
+	}
+	if first, err = mh.Receive(); err != nil {
+		logger.Info("cluster proof read error", "err", err)
+		return
+	}
+	if !hmac.Equal(first.GetClusterHello().GetProof(), clusterProof(secret, node, hello.GetNonce(), ours)) {
+		logger.Warn("cluster link refused: bad proof")
+		_ = mh.Send(notice("Cluster link refused: bad secret"))
+		return
+	}
+	_ = mh.SetReadDeadline(time.Time{})
+	mh.SetCompression(true)
+	if err := mh.Send(clusterHello(&messages.ClusterHello{Node: self})); err != nil {
+		return
+	}
+
+	// Writes go through a queue so a slow node never holds up the bus. If
+	// it overflows, the node has missed something: cut it off, so it links
+	// again and starts over from a replay. Only the first overflow says so:
+	// the rest is dropped while the link goes down
+	out := make(chan *messages.Wrapper, clusterQueueSize)
+	done := make(chan struct{})
+	defer close(done)
+	var overflow sync.Once
+	send := func(w *messages.Wrapper) {
+		select {
+		case out <- w:
+		default:
+			s.metrics.clusterDropped.Add(1)
+			overflow.Do(func() {
+				logger.Warn("cluster link can't keep up, relinking")
+				mh.Close()
+			})
+		}
+	}
+	if err := hub.subscribe(node, func(ev *messages.ClusterEvent) { send(clusterWrapper(ev)) }); err != nil {
+		logger.Warn("cluster link refused", "err", err)
+		_ = mh.Send(notice("Cluster link refused: " + err.Error()))
+		return
+	}
+	defer hub.detach(node)
+	go func() {
+		for {
+			select {
+			case w := <-out:
+				if err := mh.Send(w); err != nil {
+					mh.Close() // the read loop fails and detaches
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	logger.Info("node linked")
+
+	for {
+		w, err := mh.Receive()
+		if err != nil {
+			logger.Warn("node unlinked", "err", err)
+			return
+		}
+		switch msg := w.Msg.(type) {
+		case *messages.Wrapper_ClusterClaim:
+			cc := msg.ClusterClaim
+			if cc.GetRelease() {
+				hub.release(node, cc.GetUsername())
+				continue
+			}
+			res := &messages.ClusterClaimResult{Seq: cc.GetSeq()}
+			if err := hub.claim(node, cc.GetUsername()); err != nil {
+				res.Error = err.Error()
+				res.AlreadyYours = errors.Is(err, errClaimedHere)
+			}
+			send(&messages.Wrapper{Msg: &messages.Wrapper_ClusterClaimResult{ClusterClaimResult: res}})
+		case *messages.Wrapper_ClusterEvent:
+			ev := msg.ClusterEvent
+			ev.Node = node // a node only speaks for itself
+			hub.publish(ev)
+		default:
+			logger.Warn("unexpected message type on cluster link", "type", messages.TypeName(w))
+		}
+	}
+}
+
+// peerBus is a node's view of the bus: a link to the hub, remade whenever
+// it drops. While it's down nobody can register here, and events from this
+// node are dropped.
+type peerBus struct {
+	hub     string
+	node    uint32
+	secret  string
+	metrics *serverMetrics
+
+	mutex   sync.Mutex
+	out     chan *messages.Wrapper                       // nil while the link is down
+	conn    *messages.MessageHandler                     // nil while the link is down
+	seq     uint64                                       // last claim sent
+	waiting map[uint64]chan *messages.ClusterClaimResult // seq -> claimer
+}
+
+func newPeerBus(hub string, node uint32, secret string, metrics *serverMetrics) *peerBus {
+	return &peerBus{hub: hub, node: node, secret: secret, metrics: metrics, waiting: make(map[uint64]chan *messages.ClusterClaimResult)}
+}
+
+// send queues w for the hub, reporting whether it could. If the queue is
+// full the link is dropped, as the hub would be wrong about this node from
+// then on; the relink tells it everything again.
+func (b *peerBus) send(w *messages.Wrapper) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.out == nil {
+		return false
+	}
+	select {
+	case b.out <- w:
+		return true
+	default:
+		b.metrics.clusterDropped.Add(1)
+		slog.Warn("cluster link can't keep up, relinking", "hub", b.hub)
+		b.conn.Close()
+		b.out, b.conn = nil, nil
+		return false
+	}
+}
+
+func (b *peerBus) claim(_ uint32, username string) error {
+	b.mutex.Lock()
+	b.seq++
+	seq := b.seq
+	res := make(chan *messages.ClusterClaimResult, 1)
+	b.waiting[seq] = res
+	b.mutex.Unlock()
+	defer func() {
+		b.mutex.Lock()
+		delete(b.waiting, seq)
+		b.mutex.Unlock()
+	}()
+
+	if !b.send(&messages.Wrapper{Msg: &messages.Wrapper_ClusterClaim{ClusterClaim: &messages.ClusterClaim{Seq: seq, Username: username}}}) {
+		return errHubDown
+	}
+	select {
+	case cr := <-res:
+		switch {
+		case cr == nil:
+			return errHubDown // the link dropped while we waited
+		case cr.GetAlreadyYours():
+			return errClaimedHere
+		case cr.GetError() != "":
+			return errors.New(cr.GetError())
+		}
+		return nil
+	case <-time.After(claimTimeout):
+		b.release(0, username) // in case the hub said yes too late
+		return errHubDown
+	}
+}
+
+// release is best effort: if the link is down, the hub has already let go
+// of all this node's names.
+func (b *peerBus) release(_ uint32, username string) {
+	b.send(&messages.Wrapper{Msg: &messages.Wrapper_ClusterClaim{ClusterClaim: &messages.ClusterClaim{Username: username, Release: true}}})
+}
+
+func (b *peerBus) publish(ev *messages.ClusterEvent) {
+	b.send(clusterWrapper(ev))
+}
+
+// subscribe starts linking to the hub, and keeps at it for as long as the
+// server runs. fn sees a RESET every time the link is made, then whatever
+// the hub replays.
+func (b *peerBus) subscribe(_ uint32, fn func(*messages.ClusterEvent)) error {
+	go func() {
+		delay := time.Second
+		for {
+			linked, err := b.link(fn)
+			if linked {
+				delay = time.Second
+			}
+			slog.Warn("cluster link down", "hub", b.hub, "err", err, "retry_in", delay)
+			time.Sleep(delay)
+			delay = min(2*delay, maxRelinkDelay)
+		}
+	}()
+	return nil
+}
+
+// link runs one connection to the hub until it fails. linked reports
+// whether the hub accepted us first.
+func (b *peerBus) link(fn func(*messages.ClusterEvent)) (linked bool, err error) {
+	conn, err := net.DialTimeout("tcp", b.hub, claimTimeout)
+	if err != nil {
+		return false, err
+	}
+	mh := messages.NewMessageHandler(conn)
+	defer mh.Close()
+	mh.SetCompression(true)
+
+	ours := newNonce()
+	if err := mh.Send(clusterHello(&messages.ClusterHello{Node: b.node, Nonce: ours})); err != nil {
+		return false, err
+	}
+	_ = mh.SetReadDeadline(time.Now().Add(claimTimeout))
+	w, err := mh.Receive()
+	if err != nil {
+		return false, err
+	}
+	theirs := w.GetClusterHello()
+	if theirs == nil {
+		return false, errors.New(w.GetServerNotice().GetText())
+	}
+	if !hmac.Equal(theirs.GetProof(), clusterProof(b.secret, theirs.GetNode(), ours, theirs.GetNonce())) {
+		return false, fmt.Errorf("%s failed to prove it knows the cluster secret", b.hub)
+	}
+	if err := mh.Send(clusterHello(&messages.ClusterHello{Node: b.node, Proof: clusterProof(b.secret, b.node, ours, theirs.GetNonce())})); err != nil {
+		return false, err
+	}
+	if w, err = mh.Receive(); err != nil {
+		return false, err
+	}
+	if w.GetClusterHello() == nil {
+		return false, errors.New(w.GetServerNotice().GetText())
+	}
+	_ = mh.SetReadDeadline(time.Time{})
+	slog.Info("linked to cluster hub", "hub", b.hub, "hub_node", w.GetClusterHello().GetNode())
+
+	// Open up for claims, then have the registry forget what it knew about
+	// the rest of the cluster and reclaim its users; the hub's replay
+	// follows the RESET
+	out := make(chan *messages.Wrapper, clusterQueueSize)
+	done := make(chan struct{})
+	b.mutex.Lock()
+	b.out, b.conn = out, mh
+	b.mutex.Unlock()
+	fn(&messages.ClusterEvent{Kind: messages.ClusterEvent_RESET})
+	defer func() {
+		b.mutex.Lock()
+		b.out, b.conn = nil, nil
+		for seq, res := range b.waiting {
+			select {
+			case res <- nil:
+			default: // the answer is already there
+			}
+			delete(b.waiting, seq)
+		}
+		b.mutex.Unlock()
+		close(done)
+	}()
+	go func() {
+		for {
+			select {
+			case w := <-out:
+				if err := mh.Send(w); err != nil {
+					mh.Close() // the read loop fails and relinks
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		w, err := mh.Receive()
+		if err != nil {
+			return true, err
+		}
+		switch msg := w.Msg.(type) {
+		case *messages.Wrapper_ClusterEvent:
+			fn(msg.ClusterEvent)
+		case *messages.Wrapper_ClusterClaimResult:
+			b.mutex.Lock()
+			if res := b.waiting[msg.ClusterClaimResult.GetSeq()]; res != nil {
+				res <- msg.ClusterClaimResult
+			}
+			b.mutex.Unlock()
+		default:
+			slog.Warn("unexpected message type from cluster hub", "type", messages.TypeName(w))
+		}
+	}
+}
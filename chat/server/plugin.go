@@ -0,0 +1,287 @@
+package main
+
+import (
+	"chat/audit"
+	"chat/messages"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// plugin is a bot that runs inside the server. Each one is registered as a
+// user of its own, named after it, and talks through the same paths as any
+// client, so room rate limits, federation and the audit log all apply.
+type plugin interface {
+	// name is the bot's username, and what -plugins calls it.
+	name() string
+	// handle reacts to ev, answering through b. Calls for one bot come one
+	// at a time, from its own goroutine, so a plugin needs no locking.
+	handle(b *bot, ev botEvent)
+}
+
+// Kinds of botEvent.
+const (
+	botJoin   = "join"  // user joined room
+	botLeave  = "leave" // user left room
+	botChat   = "chat"  // user said text in room
+	botDirect = "dm"    // user sent the bot text directly
+)
+
+// botEvent is something a bot can react to. A bot only hears about rooms it
+// is in, never about itself.
+type botEvent struct {
+	kind string // one of the bot* constants
+	user string
+	room string // empty for DMs
+	text string
+	id   uint64 // of the message, for botChat
+
+	run func() // set for timers (see bot.after), which never reach the plugin
+}
+
+// botQueueSize is how many events can wait for a bot before they're dropped.
+const botQueueSize = 256
+
+// plugins are the built-in bots, by name.
+var plugins = map[string]func() plugin{
+	"echo":    func() plugin { return echoBot{} },
+	"dice":    func() plugin { return diceBot{} },
+	"remind":  func() plugin { return newRemindBot() },
+	"greeter": func() plugin { return greeterBot{} },
+}
+
+// bot runs one plugin: a client whose frames turn into events instead of
+// going out over a connection.
+type bot struct {
+	plugin  plugin
+	c       *client
+	events  chan botEvent
+	done    chan struct{} // closed when the bot is removed (kicked, say)
+	stop    sync.Once
+	unwatch func() // removes watch from the registry's sinks
+
+	mutex sync.Mutex
+	rooms map[string]struct{} // rooms the bot is in, kept up to date by watch
+}
+
+// startPlugins registers a bot for each plugin in names and has it join
+// rooms. It fails on a name that isn't a built-in plugin; a bot whose
+// username is taken is only logged.
+func (s *server) startPlugins(names, rooms []string) error {
+	for _, name := range names {
+		if plugins[name] == nil {
+			known := make([]string, 0, len(plugins))
+			for n := range plugins {
+				known = append(known, n)
+			}
+			slices.Sort(known)
+			return fmt.Errorf("no plugin %q (have %s)", name, strings.Join(known, ", "))
+		}
+	}
+	for _, name := range names {
+		b, err := newBot(s, plugins[name]())
+		if err != nil {
+			slog.Warn("plugin not started", "plugin", name, "err", err)
+			continue
+		}
+		for _, room := range rooms {
+			b.join(room)
+		}
+		slog.Info("plugin started", "plugin", name, "rooms", rooms)
+	}
+	return nil
+}
+
+func newBot(s *server, p plugin) (*bot, error) {
+	b := &bot{
+		plugin: p,
+		events: make(chan botEvent, botQueueSize),
+		done:   make(chan struct{}),
+		rooms:  make(map[string]struct{}),
+	}
+	b.c = s.newClient(botTransport{b}, p.name(), slog.Default().With("front", "plugin"))
+	// A bot only talks when spoken to, so the flood limits for connections
+	// would punish it for how busy its rooms are. Room limits still apply.
+	// With no buckets, nothing runs out
+	b.c.limiter = &connLimiter{parent: s.limiter}
+	b.unwatch = s.users.addSink(b.watch) // first, so it's there to remove once the bot can be kicked
+	if err := s.users.add(b.c); err != nil {
+		b.unwatch()
+		b.c.stop()
+		return nil, err
+	}
+	go b.run()
+	return b, nil
+}
+
+func (b *bot) run() {
+	for {
+		select {
+		case ev := <-b.events:
+			if ev.run != nil {
+				ev.run()
+				continue
+			}
+			b.plugin.handle(b, ev)
+		case <-b.done:
+			b.c.log.Info("plugin stopped")
+			return
+		}
+	}
+}
+
+// push queues ev for the bot, dropping it if the bot is behind or gone. It
+// reports whether ev was queued.
+func (b *bot) push(ev botEvent) bool {
+	select {
+	case <-b.done:
+		return false
+	default:
+	}
+	select {
+	case b.events <- ev:
+		return true
+	default:
+		b.c.log.Warn("bot queue full, event dropped", "kind", ev.kind)
+		return false
+	}
+}
+
+func (b *bot) in(room string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	_, ok := b.rooms[room]
+	return ok
+}
+
+// watch is a registry sink passing on joins and leaves in the bot's rooms.
+// The bot's own tell it which rooms those are, even when an operator closes
+// or renames one.
+func (b *bot) watch(ev registryEvent) {
+	if ev.user == b.c.username {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		switch ev.kind {
+		case audit.KindJoin:
+			b.rooms[ev.room] = struct{}{}
+		case audit.KindLeave:
+			delete(b.rooms, ev.room)
+		}
+		return
+	}
+	if !b.in(ev.room) {
+		return
+	}
+	switch ev.kind {
+	case audit.KindJoin:
+		b.push(botEvent{kind: botJoin, user: ev.user, room: ev.room})
+	case audit.KindLeave:
+		b.push(botEvent{kind: botLeave, user: ev.user, room: ev.room})
+	}
+}
+
+// join puts the bot in room.
+func (b *bot) join(room string) {
+	if err := joinRoom(b.c, room); err != nil {
+		b.c.log.Warn("bot cannot join room", "room", room, "err", err)
+	}
+}
+
+// say posts text to room as the bot.
+func (b *bot) say(room, text string) {
+	handleMessage(b.c, &messages.Wrapper{
+		Msg: &messages.Wrapper_RoomChat{RoomChat: &messages.RoomChat{Room: room, MessageBody: text}},
+	})
+}
+
+// direct sends text to user as a DM from the bot.
+func (b *bot) direct(to, text string) {
+	handleMessage(b.c, &messages.Wrapper{
+		Msg: &messages.Wrapper_DirectChat{DirectChat: &messages.DirectChat{To: to, MessageBody: text}},
+	})
+}
+
+// reply answers ev where it happened: in its room, or by DM.
+func (b *bot) reply(ev botEvent, text string) {
+	if ev.room != "" {
+		b.say(ev.room, text)
+	} else {
+		b.direct(ev.user, text)
+	}
+}
+
+// after runs fn on the bot's goroutine once d has passed, unless the bot
+// is gone or too far behind by then, in which case dropped runs instead, on
+// the timer's goroutine.
+func (b *bot) after(d time.Duration, fn, dropped func()) {
+	time.AfterFunc(d, func() {
+		if !b.push(botEvent{run: fn}) {
+			dropped()
+		}
+	})
+}
+
+// botTransport is a bot's connection: frames the registry writes to it
+// become events.
+type botTransport struct {
+	b *bot
+}
+
+func (t botTransport) Send(w *messages.Wrapper) error {
+	self := t.b.c.username
+	switch msg := w.Msg.(type) {
+	case *messages.Wrapper_RoomChat:
+		rc := msg.RoomChat
+		if rc.GetUsername() != self {
+			t.b.push(botEvent{kind: botChat, user: rc.GetUsername(), room: rc.GetRoom(), text: rc.GetMessageBody(), id: rc.GetMessageId()})
+		}
+	case *messages.Wrapper_DirectChat:
+		// Bots publish no key, so DMs to them come in plaintext
+		dc := msg.DirectChat
+		if dc.GetFrom() != self && dc.GetMessageBody() != "" {
+			t.b.push(botEvent{kind: botDirect, user: dc.GetFrom(), text: dc.GetMessageBody()})
+		}
+	}
+	return nil
+}
+
+// Close stops the bot. It's called when the bot's client is removed, and
+// by whoever else wants rid of it: there's no read loop to notice it went
+// and remove it, so that happens here.
+func (t botTransport) Close() {
+	t.b.stop.Do(func() {
+		close(t.b.done)
+		// remove waits for the writer, which may be calling us
+		go func() {
+			t.b.unwatch()
+			t.b.c.srv.users.remove(t)
+		}()
+	})
+}
+
+func (botTransport) readerless() {}
+
+func (t botTransport) RemoteAddr() net.Addr {
+	return pluginAddr(t.b.plugin.name())
+}
+
+// pluginAddr is where a bot is connected from.
+type pluginAddr string
+
+func (a pluginAddr) Network() string { return "plugin" }
+func (a pluginAddr) String() string  { return "plugin:" + string(a) }
+
+// splitList splits a comma-separated flag, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"chat/messages"
+	"strings"
+	"testing"
+)
+
+// startBot runs p on s, in rooms, until the test ends.
+func startBot(t *testing.T, s *server, p plugin, rooms ...string) *bot {
+	t.Helper()
+	b, err := newBot(s, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(b.c.conn.Close)
+	for _, room := range rooms {
+		b.join(room)
+	}
+	return b
+}
+
+func TestEchoBot(t *testing.T) {
+	s := newServer()
+	startBot(t, s, echoBot{}, "lobby")
+	alice := connect(t, s, "alice")
+	alice.joined("lobby")
+
+	alice.say("lobby", "!echo hello")
+	if rc := alice.expectChat("hello"); rc.GetUsername() != "echo" {
+		t.Errorf("%s echoed, not the bot", rc.GetUsername())
+	}
+	alice.dm("echo", "just us")
+	alice.expect("the bot's DM", func(w *messages.Wrapper) bool {
+		dc := w.GetDirectChat()
+		return dc.GetFrom() == "echo" && dc.GetMessageBody() == "just us"
+	})
+}
+
+func TestGreeterBot(t *testing.T) {
+	s := newServer()
+	startBot(t, s, greeterBot{}, "lobby")
+	alice := connect(t, s, "alice")
+	alice.join("lobby")
+	alice.expectChat("Welcome to lobby, alice!")
+}
+
+// TestBotsArentFloodLimited has a crowd keep a bot busy: it answers them
+// all, where a client saying as much would be kicked.
+func TestBotsArentFloodLimited(t *testing.T) {
+	s := newServer()
+	limits := testLimits()
+	limits.roomPerSec = 0
+	s.limiter = newRateLimiter(limits, newFakeClock().now)
+	startBot(t, s, diceBot{}, "casino")
+
+	players := []*testClient{connect(t, s, "alice"), connect(t, s, "bob"), connect(t, s, "carol")}
+	for _, p := range players {
+		p.joined("casino") // the first of each player's two frames
+	}
+	for _, p := range players {
+		p.say("casino", "!roll")
+	}
+	watcher := players[0]
+	for _, p := range players {
+		watcher.expect("the roll for "+p.name, func(w *messages.Wrapper) bool {
+			return strings.HasPrefix(w.GetRoomChat().GetMessageBody(), p.name+" rolled")
+		})
+	}
+	if s.users.lookup("dice") == nil {
+		t.Fatal("the bot was kicked for answering")
+	}
+}
+
+func TestClosedBotLeaves(t *testing.T) {
+	s := newServer()
+	b := startBot(t, s, echoBot{}, "lobby")
+	b.c.conn.Close() // as kicking it for flooding does
+
+	waitFor(t, "the bot to be removed", func() bool { return s.users.lookup("echo") == nil })
+	if names, _ := s.users.members(nil, "lobby"); len(names) != 0 {
+		t.Errorf("%v still in the lobby", names)
+	}
+	<-b.done
+	startBot(t, s, echoBot{}) // its name is free again
+}
+
+func TestStoppedBotStopsWatching(t *testing.T) {
+	s := newServer()
+	sinks := func() int {
+		s.users.sinkMutex.Lock()
+		defer s.users.sinkMutex.Unlock()
+		return len(s.users.sinks)
+	}
+	before := sinks()
+	b := startBot(t, s, greeterBot{}, "lobby")
+	if sinks() != before+1 {
+		t.Fatal("the bot isn't watching the registry")
+	}
+	b.c.conn.Close()
+	waitFor(t, "the bot to stop watching", func() bool { return sinks() == before })
+}
+
+// TestDroppedReminderIsForgotten has a reminder come due while the bot is
+// too busy for it: it still stops counting against its asker.
+func TestDroppedReminderIsForgotten(t *testing.T) {
+	s := newServer()
+	rb := newRemindBot()
+	b := startBot(t, s, rb, "lobby")
+	alice := connect(t, s, "alice")
+	alice.joined("lobby")
+	pending := func() int {
+		rb.mutex.Lock()
+		defer rb.mutex.Unlock()
+		return rb.pending["alice"]
+	}
+
+	unblock := make(chan struct{})
+	defer close(unblock)
+	alice.say("lobby", "!remind 100ms stretch")
+	alice.expectChat("OK alice, I'll remind you in 100ms")
+	if pending() != 1 {
+		t.Fatal("the reminder isn't counted")
+	}
+	b.push(botEvent{run: func() { <-unblock }})
+	for b.push(botEvent{run: func() {}}) {
+	}
+	waitFor(t, "the dropped reminder to be forgotten", func() bool { return pending() == 0 })
+}
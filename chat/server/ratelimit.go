@@ -0,0 +1,186 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucket refills at rate tokens per second up to burst. It is not safe
+// for concurrent use; callers lock around it if they share one.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+// allow takes n tokens if they're available. A bucket with a zero rate never limits.
+func (b *tokenBucket) allow(now time.Time, n float64) bool {
+	if b == nil || b.rate <= 0 {
+		return true
+	}
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// rateLimits configures flood protection. Zero rates disable a limit.
+type rateLimits struct {
+	msgsPerSec  float64 // frames per second per connection
+	msgBurst    int
+	bytesPerSec float64 // payload bytes per second per connection
+	byteBurst   int
+	roomPerSec  float64 // chat messages per second per room, across all senders
+	roomBurst   int
+	// file chunks and chunk requests per second per connection; they're
+	// budgeted apart from chat since a transfer is mostly big frames
+	transfersPerSec float64
+	transferBurst   int
+
+	muteFor      time.Duration // how long the second strike mutes for
+	forgiveAfter time.Duration // strikes reset after this long without one
+}
+
+func defaultRateLimits() rateLimits {
+	return rateLimits{
+		msgsPerSec:  10,
+		msgBurst:    20,
+		bytesPerSec: 64 << 10,
+		byteBurst:   2 << 20, // must be above MaxFrameSize or big frames can never pass
+		roomPerSec:  50,
+		roomBurst:   100,
+		// at 64 KiB a chunk, about 12 MiB/s
+		transfersPerSec: 200,
+		transferBurst:   400,
+		muteFor:         30 * time.Second,
+		forgiveAfter:    time.Minute,
+	}
+}
+
+// maxIdleRooms is how many room buckets we keep before pruning idle ones.
+const maxIdleRooms = 1024
+
+// rateLimiter hands out per-connection limiters and owns the shared per-room buckets.
+type rateLimiter struct {
+	limits rateLimits
+	now    func() time.Time // swapped for a fake clock in tests
+
+	roomMutex sync.Mutex
+	rooms     map[string]*tokenBucket
+}
+
+func newRateLimiter(limits rateLimits, now func() time.Time) *rateLimiter {
+	return &rateLimiter{
+		limits: limits,
+		now:    now,
+		rooms:  make(map[string]*tokenBucket),
+	}
+}
+
+// allowRoom reports whether room can take another chat message right now.
+func (l *rateLimiter) allowRoom(room string) bool {
+	if l.limits.roomPerSec <= 0 {
+		return true
+	}
+	l.roomMutex.Lock()
+	defer l.roomMutex.Unlock()
+	now := l.now()
+	if len(l.rooms) > maxIdleRooms {
+		// Buckets that have refilled completely carry no state worth keeping
+		for name, b := range l.rooms {
+			if b.allow(now, 0) && b.tokens >= b.burst {
+				delete(l.rooms, name)
+			}
+		}
+	}
+	b := l.rooms[room]
+	if b == nil {
+		b = newTokenBucket(l.limits.roomPerSec, l.limits.roomBurst, now)
+		l.rooms[room] = b
+	}
+	return b.allow(now, 1)
+}
+
+// verdict is what to do with a frame after it's been counted.
+type verdict int
+
+const (
+	allowFrame verdict = iota
+	warnFrame          // over the limit: drop it and warn the sender
+	muteFrame          // over the limit again: drop it and mute the sender
+	mutedFrame         // sender is muted: drop it quietly
+	kickFrame          // third strike: disconnect
+)
+
+// connLimiter tracks one connection. Only the goroutine reading that
+// connection uses it, so it needs no locking.
+type connLimiter struct {
+	parent     *rateLimiter
+	msgs       *tokenBucket
+	bytes      *tokenBucket
+	transfers  *tokenBucket
+	strikes    int
+	lastStrike time.Time
+	mutedUntil time.Time
+}
+
+func (l *rateLimiter) newConn() *connLimiter {
+	now := l.now()
+	return &connLimiter{
+		parent:    l,
+		msgs:      newTokenBucket(l.limits.msgsPerSec, l.limits.msgBurst, now),
+		bytes:     newTokenBucket(l.limits.bytesPerSec, l.limits.byteBurst, now),
+		transfers: newTokenBucket(l.limits.transfersPerSec, l.limits.transferBurst, now),
+	}
+}
+
+// check counts a frame of size bytes and escalates on repeat offences:
+// warning, then a temporary mute, then a disconnect.
+func (cl *connLimiter) check(size int) verdict {
+	now := cl.parent.now()
+	if now.Before(cl.mutedUntil) {
+		return mutedFrame
+	}
+	if cl.msgs.allow(now, 1) && cl.bytes.allow(now, float64(size)) {
+		return allowFrame
+	}
+	return cl.strike(now)
+}
+
+// checkTransfer counts a file chunk or chunk request against the transfer
+// budget instead of the chat one. Overdoing it strikes all the same.
+func (cl *connLimiter) checkTransfer() verdict {
+	now := cl.parent.now()
+	if now.Before(cl.mutedUntil) {
+		return mutedFrame
+	}
+	if cl.transfers.allow(now, 1) {
+		return allowFrame
+	}
+	return cl.strike(now)
+}
+
+func (cl *connLimiter) strike(now time.Time) verdict {
+	if cl.strikes > 0 && now.Sub(cl.lastStrike) > cl.parent.limits.forgiveAfter {
+		cl.strikes = 0
+	}
+	cl.strikes++
+	cl.lastStrike = now
+	switch cl.strikes {
+	case 1:
+		return warnFrame
+	case 2:
+		cl.mutedUntil = now.Add(cl.parent.limits.muteFor)
+		return muteFrame
+	default:
+		return kickFrame
+	}
+}
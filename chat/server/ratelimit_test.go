@@ -0,0 +1,205 @@
+package main
+
+import (
+	"chat/messages"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock only moves when the test says so.
+type fakeClock struct {
+	mutex sync.Mutex // a server's reader goroutines read it too
+	t     time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.t = c.t.Add(d)
+}
+
+func newFakeClock() *fakeClock { return &fakeClock{t: time.Unix(1700000000, 0)} }
+
+// testLimits allows two frames at once and one a second after that.
+func testLimits() rateLimits {
+	return rateLimits{
+		msgsPerSec:      1,
+		msgBurst:        2,
+		transfersPerSec: 1,
+		transferBurst:   1,
+		roomPerSec:      1,
+		roomBurst:       2,
+		muteFor:         30 * time.Second,
+		forgiveAfter:    time.Minute,
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	clock := newFakeClock()
+	b := newTokenBucket(2, 3, clock.now())
+	for i := 0; i < 3; i++ {
+		if !b.allow(clock.now(), 1) {
+			t.Fatalf("token %d of the burst refused", i+1)
+		}
+	}
+	if b.allow(clock.now(), 1) {
+		t.Fatal("allowed past the burst")
+	}
+	clock.advance(500 * time.Millisecond)
+	if !b.allow(clock.now(), 1) {
+		t.Fatal("no token after refilling for half a second at 2/s")
+	}
+	clock.advance(time.Hour)
+	if !b.allow(clock.now(), 3) || b.allow(clock.now(), 1) {
+		t.Fatal("refilled past the burst")
+	}
+}
+
+func TestZeroRateNeverLimits(t *testing.T) {
+	clock := newFakeClock()
+	l := newRateLimiter(rateLimits{}, clock.now)
+	cl := l.newConn()
+	for i := 0; i < 1000; i++ {
+		if v := cl.check(1 << 20); v != allowFrame {
+			t.Fatalf("frame %d: verdict %d with limits off", i, v)
+		}
+		if !l.allowRoom("lobby") {
+			t.Fatalf("room message %d refused with limits off", i)
+		}
+	}
+}
+
+func TestEscalation(t *testing.T) {
+	clock := newFakeClock()
+	cl := newRateLimiter(testLimits(), clock.now).newConn()
+
+	want := func(v verdict, what string) {
+		t.Helper()
+		if got := cl.check(10); got != v {
+			t.Fatalf("%s: verdict %d, want %d", what, got, v)
+		}
+	}
+	want(allowFrame, "first of the burst")
+	want(allowFrame, "second of the burst")
+	want(warnFrame, "first strike")
+	want(muteFrame, "second strike")
+	want(mutedFrame, "while muted")
+
+	clock.advance(29 * time.Second)
+	want(mutedFrame, "just before the mute ends")
+
+	clock.advance(time.Second)
+	want(allowFrame, "after the mute")
+	want(allowFrame, "the refilled burst")
+	want(kickFrame, "third strike")
+}
+
+func TestStrikesForgiven(t *testing.T) {
+	clock := newFakeClock()
+	cl := newRateLimiter(testLimits(), clock.now).newConn()
+	cl.check(10)
+	cl.check(10)
+	if v := cl.check(10); v != warnFrame {
+		t.Fatalf("verdict %d, want a warning", v)
+	}
+
+	// a minute of good behaviour wipes the slate
+	clock.advance(time.Minute + time.Second)
+	cl.check(10)
+	cl.check(10)
+	if v := cl.check(10); v != warnFrame {
+		t.Fatalf("verdict %d after the strike was forgiven, want another warning", v)
+	}
+}
+
+func TestByteLimit(t *testing.T) {
+	clock := newFakeClock()
+	limits := testLimits()
+	limits.msgsPerSec, limits.bytesPerSec, limits.byteBurst = 0, 100, 1000
+	cl := newRateLimiter(limits, clock.now).newConn()
+	if v := cl.check(1000); v != allowFrame {
+		t.Fatalf("verdict %d for a frame the size of the burst", v)
+	}
+	if v := cl.check(1); v != warnFrame {
+		t.Fatalf("verdict %d with the byte budget spent, want a warning", v)
+	}
+	clock.advance(time.Second)
+	if v := cl.check(100); v != allowFrame {
+		t.Fatalf("verdict %d after a second's refill", v)
+	}
+}
+
+func TestTransfersBudgetedApart(t *testing.T) {
+	clock := newFakeClock()
+	cl := newRateLimiter(testLimits(), clock.now).newConn()
+	cl.check(10)
+	cl.check(10)
+	if v := cl.checkTransfer(); v != allowFrame {
+		t.Fatalf("transfer verdict %d with only the chat budget spent", v)
+	}
+	if v := cl.checkTransfer(); v != warnFrame {
+		t.Fatalf("transfer verdict %d past its budget, want a warning", v)
+	}
+	// strikes are shared, so chat now picks up where transfers left off
+	if v := cl.check(10); v != muteFrame {
+		t.Fatalf("chat verdict %d after a transfer strike, want a mute", v)
+	}
+	if v := cl.checkTransfer(); v != mutedFrame {
+		t.Fatalf("transfer verdict %d while muted", v)
+	}
+}
+
+func TestRoomLimit(t *testing.T) {
+	clock := newFakeClock()
+	l := newRateLimiter(testLimits(), clock.now)
+	if !l.allowRoom("lobby") || !l.allowRoom("lobby") {
+		t.Fatal("room burst refused")
+	}
+	if l.allowRoom("lobby") {
+		t.Fatal("room allowed past its burst")
+	}
+	if !l.allowRoom("other") {
+		t.Fatal("one busy room held up another")
+	}
+	clock.advance(time.Second)
+	if !l.allowRoom("lobby") {
+		t.Fatal("room didn't refill")
+	}
+}
+
+func TestFloodingEscalates(t *testing.T) {
+	clock := newFakeClock()
+	s := newServer()
+	s.limiter = newRateLimiter(testLimits(), clock.now)
+	bob := connect(t, s, "bob")
+	bob.joined("lobby")
+	alice := connect(t, s, "alice")
+	alice.joined("lobby") // the first of alice's two
+
+	alice.say("lobby", "one")
+	bob.expectChat("one")
+	alice.say("lobby", "two")
+	alice.expectNotice("You are sending too fast")
+	alice.say("lobby", "three")
+	alice.expectNotice("You are muted for 30s")
+	alice.say("lobby", "four")
+	bob.expectNone("a muted message", 100*time.Millisecond, func(w *messages.Wrapper) bool {
+		return w.GetRoomChat().GetMessageBody() == "four"
+	})
+
+	clock.advance(30 * time.Second)
+	alice.say("lobby", "five")
+	bob.expectChat("five")
+	alice.say("lobby", "six")
+	bob.expectChat("six")
+	alice.say("lobby", "seven")
+	alice.expectNotice("Disconnected for flooding")
+	waitFor(t, "alice to be kicked", func() bool { return s.users.lookup("alice") == nil })
+}
@@ -1,134 +1,750 @@
 package main
 
 import (
+	"chat/audit"
 	"chat/messages"
+	"errors"
 	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// The registry is sharded so that rooms don't wait on each other: who is
+// registered sits behind one lock, and every room behind its own. A big
+// room's fan-out only holds up that room.
+//
+// Locks are taken in this order, never the other way round:
+//
+//	a room's mutex (only one room at a time)
+//	registry.mutex
+//	registry.roomsMutex, sinkMutex (held only briefly, nothing inside)
+//
+// None of them is ever held while waiting on a client: enqueue doesn't block.
 type registry struct {
-	byConn map[*messages.MessageHandler]*client
-	byName map[string]*client
-	rooms  map[string]map[*client]struct{} // room -> set of members
-
-	addChan           chan addRequest
-	removeChan        chan removeRequest
-	roomJoinChan      chan roomJoinRequest
-	roomLeaveChan     chan roomLeaveRequest
-	roomBroadcastChan chan roomBroadcastRequest
-	directChan        chan directRequest
-}
-
-func newRegistry() *registry {
-	r := &registry{
-		byConn:            make(map[*messages.MessageHandler]*client),
-		byName:            make(map[string]*client),
-		rooms:             make(map[string]map[*client]struct{}),
-		addChan:           make(chan addRequest),
-		removeChan:        make(chan removeRequest),
-		roomJoinChan:      make(chan roomJoinRequest),
-		roomLeaveChan:     make(chan roomLeaveRequest),
-		roomBroadcastChan: make(chan roomBroadcastRequest, 1024),
-		directChan:        make(chan directRequest, 1024),
-	}
-	go r.loop()
-	return r
-}
-
-func (r *registry) loop() {
-	for {
-		select {
-		case addReq := <-r.addChan:
-			if addReq.c.username == "" || r.byName[addReq.c.username] != nil {
-				addReq.response <- fmt.Errorf("username is empty or already exists")
-				continue
-			}
-			r.byName[addReq.c.username] = addReq.c
-			r.byConn[addReq.c.msgHandler] = addReq.c
-			addReq.response <- nil
-
-		case removeReq := <-r.removeChan:
-			var removed *client
-			if c, ok := r.byConn[removeReq.msgHandler]; ok {
-				delete(r.byConn, removeReq.msgHandler)
-				delete(r.byName, c.username)
-				// purge from all rooms
-				for _, set := range r.rooms {
-					delete(set, c)
-				}
-				close(c.out) // This is necessary!! writePump() goroutine is waiting a new message infinitely. We need to signal that there is no more new messages.
-				<-c.closed   // We need this!! Because there might be leftover buffered messages in writePump()
-				// <-c.closed(): receive operation. Normally, if nothing has been sent, it would block
-				// But, if the channel is closed, <-channel immediately return zero value
-				// In this program, it blocks until the closed channel is closed
-				removed = c
-			}
-			removeReq.response <- removed
+	mutex       sync.RWMutex // guards byConn, byName, remoteUsers and clients' public keys
+	byConn      map[transport]*client
+	byName      map[string]*client
+	remoteUsers map[string]*remoteUser // username -> on another node
 
-		case j := <-r.roomJoinChan:
-			if j.room == "" {
-				j.result <- fmt.Errorf("room name cannot be empty")
-				continue
-			}
-			set := r.rooms[j.room]
-			if set == nil {
-				set = make(map[*client]struct{})
-				r.rooms[j.room] = set
-			}
-			set[j.c] = struct{}{}
-			j.result <- nil
-
-		case l := <-r.roomLeaveChan:
-			if set, ok := r.rooms[l.room]; ok {
-				delete(set, l.c)
-				if len(set) == 0 {
-					delete(r.rooms, l.room)
-				}
-			}
-			l.result <- nil
+	roomsMutex sync.Mutex // guards the map only; each room has its own lock
+	rooms      map[string]*room
 
-		case rb := <-r.roomBroadcastChan:
-			if set, ok := r.rooms[rb.room]; ok {
-				for c := range set {
-					c.enqueue(rb.w)
-				}
-			}
+	nextID atomic.Uint64 // last message ID handed out
 
-		case dm := <-r.directChan:
-			if c := r.byName[dm.to]; c != nil {
-				c.enqueue(dm.w)
-			}
+	// defaultRetention applies to rooms that haven't set their own. main
+	// sets it from flags before any client connects.
+	defaultRetention retentionPolicy
+	metrics          *serverMetrics
+
+	sinkMutex sync.Mutex             // sinks see one event at a time
+	sinks     []*func(registryEvent) // pointers, so one can be told apart to remove it
+
+	// set by joinCluster when this server is one node of several
+	cluster bus
+	node    uint32
+}
+
+// registryEvent is something that happened in the registry, handed to every
+// sink. Events about one room arrive in the order they happened there.
+type registryEvent struct {
+	kind   string // one of the audit.Kind* constants
+	user   string
+	room   string
+	to     string
+	detail string
+
+	operator string // on joins, the room's operator, for the rest of a cluster
+}
+
+type registryStats struct {
+	clients int
+	members map[string]int // room -> member count
+}
+
+// clientInfo is a snapshot of one connection for the admin console.
+type clientInfo struct {
+	username   string
+	addr       string
+	queueDepth int
+	rooms      []string
+}
+
+func newRegistry(metrics *serverMetrics) *registry {
+	return &registry{
+		byConn:      make(map[transport]*client),
+		byName:      make(map[string]*client),
+		rooms:       make(map[string]*room),
+		remoteUsers: make(map[string]*remoteUser),
+
+		defaultRetention: retentionPolicy{keep: historyLimit},
+		metrics:          metrics,
+	}
+}
+
+var (
+	// errNotMember is returned when a client posts to a room it hasn't joined.
+	errNotMember = errors.New("not a member of that room")
+	// errNotRegistered is returned when a client that has just been removed
+	// (kicked, say) still tries to do something.
+	errNotRegistered = errors.New("not registered")
+	// errRoomBusy is returned when a room's rate limit drops a message.
+	errRoomBusy = errors.New("room is too busy")
+	// errTooManyExpiring is returned for a self-destructing message when the
+	// room is already tracking maxExpiring of them.
+	errTooManyExpiring = fmt.Errorf("the room already has %d self-destructing messages pending: try again without /ttl", maxExpiring)
+	// errTooManyRooms is returned when joining would open a room past maxRooms.
+	errTooManyRooms = fmt.Errorf("the server already has %d rooms: join one of those", maxRooms)
+	// errBadName is returned for a username or room name with a space, a
+	// line break or a NUL in it.
+	errBadName = errors.New("names can't contain spaces, line breaks or NULs")
+)
+
+// lockRoom returns the room called name with its mutex held, or nil if
+// there's no such room.
+func (r *registry) lockRoom(name string) *room {
+	for {
+		r.roomsMutex.Lock()
+		rm := r.rooms[name]
+		r.roomsMutex.Unlock()
+		if rm == nil {
+			return nil
+		}
+		rm.mutex.Lock()
+		if rm.live(name) {
+			return rm
+		}
+		rm.mutex.Unlock() // dropped or renamed while we waited: look again
+	}
+}
+
+// openRoom is lockRoom, but makes the room first if it doesn't exist, with
+// operator as its operator.
+func (r *registry) openRoom(name, operator string) *room {
+	for {
+		r.roomsMutex.Lock()
+		rm := r.rooms[name]
+		if rm == nil {
+			rm = newRoom(name, operator, r.defaultRetention)
+			r.rooms[name] = rm
 		}
+		r.roomsMutex.Unlock()
+		rm.mutex.Lock()
+		if rm.live(name) {
+			return rm
+		}
+		rm.mutex.Unlock()
+	}
+}
+
+// dropRoom forgets rm, which the caller has locked.
+func (r *registry) dropRoom(rm *room) {
+	r.roomsMutex.Lock()
+	if r.rooms[rm.name] == rm {
+		delete(r.rooms, rm.name)
+	}
+	r.roomsMutex.Unlock()
+	rm.gone = true
+}
+
+// dropIfIdle forgets rm, which the caller has locked, if nothing would be
+// lost by doing so.
+func (r *registry) dropIfIdle(rm *room) {
+	if rm.idle() {
+		r.dropRoom(rm)
+	}
+}
+
+// roomsFull reports whether there's no space left for a new room called
+// name. Racing joins can overshoot maxRooms a little, which is fine.
+func (r *registry) roomsFull(name string) bool {
+	r.roomsMutex.Lock()
+	defer r.roomsMutex.Unlock()
+	return r.rooms[name] == nil && len(r.rooms) >= maxRooms
+}
+
+// allRooms snapshots the rooms, unlocked. Any of them may be gone by the
+// time the caller locks it, so check rm.gone.
+func (r *registry) allRooms() []*room {
+	r.roomsMutex.Lock()
+	defer r.roomsMutex.Unlock()
+	rooms := make([]*room, 0, len(r.rooms))
+	for _, rm := range r.rooms {
+		rooms = append(rooms, rm)
+	}
+	return rooms
+}
+
+// registered reports whether c is still the client registered under its name.
+func (r *registry) registered(c *client) bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.byName[c.username] == c
+}
+
+// ownMessage finds message id in rm, which the caller has locked, and checks
+// that c may change it: only its sender or the room's operator can.
+func ownMessage(rm *room, c *client, id uint64) (*messages.RoomChat, error) {
+	if !rm.has(c) {
+		return nil, errNotMember
+	}
+	stored := rm.history.get(id)
+	if stored == nil {
+		return nil, fmt.Errorf("no message #%d in %s", id, rm.name)
+	}
+	if stored.GetUsername() != c.username && rm.operator != c.username {
+		return nil, fmt.Errorf("message #%d isn't yours", id)
+	}
+	return stored, nil
+}
+
+func (r *registry) emit(ev registryEvent) {
+	r.sinkMutex.Lock()
+	defer r.sinkMutex.Unlock()
+	for _, sink := range r.sinks {
+		(*sink)(ev)
+	}
+}
+
+// addSink registers fn to see every registry event, until the returned
+// func is called. fn may run with a room locked, so it must hand off
+// anything slow and never call back into the registry.
+func (r *registry) addSink(fn func(registryEvent)) (remove func()) {
+	r.sinkMutex.Lock()
+	defer r.sinkMutex.Unlock()
+	sink := &fn
+	r.sinks = append(r.sinks, sink)
+	return func() {
+		r.sinkMutex.Lock()
+		defer r.sinkMutex.Unlock()
+		r.sinks = slices.DeleteFunc(r.sinks, func(s *func(registryEvent)) bool { return s == sink })
 	}
 }
 
+// add registers c. In a cluster its name is claimed cluster-wide first.
 func (r *registry) add(c *client) error {
-	res := make(chan error, 1)
-	r.addChan <- addRequest{c: c, response: res}
-	return <-res
+	if r.cluster != nil {
+		if err := r.cluster.claim(r.node, c.username); errors.Is(err, errClaimedHere) {
+			return errNameTaken // someone on this node has it
+		} else if err != nil {
+			return err
+		}
+	}
+	err := r.register(c)
+	if err != nil && r.cluster != nil {
+		r.cluster.release(r.node, c.username)
+	}
+	return err
 }
 
-func (r *registry) remove(mh *messages.MessageHandler) *client {
-	res := make(chan *client, 1)
-	r.removeChan <- removeRequest{msgHandler: mh, response: res}
-	return <-res
+func (r *registry) register(c *client) error {
+	if c.home == "" && strings.Contains(c.username, "@") {
+		return fmt.Errorf("username can't contain @, which addresses users on other servers")
+	}
+	if len(c.username) > messages.MaxUsernameLength {
+		return fmt.Errorf("username is longer than %d bytes", messages.MaxUsernameLength)
+	}
+	if !messages.ValidName(c.username) {
+		return errBadName
+	}
+	r.mutex.Lock()
+	if c.username == "" || r.byName[c.username] != nil {
+		r.mutex.Unlock()
+		return errNameTaken
+	}
+	r.byName[c.username] = c
+	r.byConn[c.conn] = c
+	r.mutex.Unlock()
+	c.start()
+
+	c.log.Info("registered")
+	r.emit(registryEvent{kind: audit.KindRegister, user: c.username, detail: "from " + c.conn.RemoteAddr().String()})
+	return nil
+}
+
+// remove unregisters whoever is on conn, takes them out of every room and
+// waits (a while) for their queue to be sent. It returns who that was, or
+// nil if nobody was.
+func (r *registry) remove(conn transport) *client {
+	r.mutex.Lock()
+	c := r.byConn[conn]
+	if c != nil {
+		delete(r.byConn, conn)
+		delete(r.byName, c.username)
+	}
+	r.mutex.Unlock()
+	if c == nil {
+		return nil
+	}
+
+	// purge from all rooms; joinRoom won't put them back now they're unregistered
+	for _, rm := range r.allRooms() {
+		rm.mutex.Lock()
+		delete(rm.members, c)
+		rm.mutex.Unlock()
+	}
+	c.log.Info("removed")
+	r.emit(registryEvent{kind: audit.KindDisconnect, user: c.username})
+	c.stop() // no locks held: a slow writer only holds up this caller
+
+	if r.cluster != nil {
+		r.cluster.release(r.node, c.username)
+	}
+	if c.home == "" {
+		c.srv.fed.userGone(c.username)
+	}
+	return c
 }
 
 func (r *registry) joinRoom(c *client, room string) error {
-	res := make(chan error, 1)
-	r.roomJoinChan <- roomJoinRequest{c: c, room: room, result: res}
-	return <-res
+	if room == "" {
+		return fmt.Errorf("room name cannot be empty")
+	}
+	if !messages.ValidName(room) {
+		return errBadName
+	}
+	if r.roomsFull(room) {
+		return errTooManyRooms
+	}
+	rm := r.openRoom(room, c.username)
+	defer rm.mutex.Unlock()
+	if !r.registered(c) {
+		r.dropIfIdle(rm)
+		return errNotRegistered
+	}
+	rm.emptySince = time.Time{}
+	if !rm.has(c) && slices.Contains(c.features, messages.FeatureHistory) {
+		for _, m := range rm.history.recent(replayOnJoin) {
+			c.enqueue(roomChatWrapper(m))
+		}
+	}
+	rm.members[c] = struct{}{}
+	c.log.Info("joined room", "room", room)
+	r.emit(registryEvent{kind: audit.KindJoin, user: c.username, room: room, operator: rm.operator})
+	return nil
 }
 
 func (r *registry) leaveRoom(c *client, room string) error {
-	res := make(chan error, 1)
-	r.roomLeaveChan <- roomLeaveRequest{c: c, room: room, result: res}
-	return <-res
+	rm := r.lockRoom(room)
+	if rm == nil {
+		return nil
+	}
+	defer rm.mutex.Unlock()
+	delete(rm.members, c)
+	c.log.Info("left room", "room", room)
+	r.emit(registryEvent{kind: audit.KindLeave, user: c.username, room: room})
+	r.dropIfIdle(rm)
+	return nil
 }
 
 func (r *registry) broadcastRoom(room string, w *messages.Wrapper) {
-	r.roomBroadcastChan <- roomBroadcastRequest{room: room, w: w}
+	r.metrics.countRelayed(messages.TypeName(w))
+	rm := r.lockRoom(room)
+	if rm == nil {
+		return
+	}
+	defer rm.mutex.Unlock()
+	rm.broadcast(w)
+	r.publishRoom(room, w)
+}
+
+// broadcastAll sends w to every registered client, in or out of rooms.
+func (r *registry) broadcastAll(w *messages.Wrapper) {
+	r.metrics.countRelayed(messages.TypeName(w))
+	r.mutex.RLock()
+	for _, c := range r.byName {
+		c.enqueue(w)
+	}
+	r.mutex.RUnlock()
+	if r.cluster != nil {
+		r.cluster.publish(&messages.ClusterEvent{Kind: messages.ClusterEvent_ALL, Node: r.node, Payload: w})
+	}
 }
 
 func (r *registry) direct(to string, w *messages.Wrapper) {
-	r.directChan <- directRequest{to: to, w: w}
+	r.metrics.countRelayed(messages.TypeName(w))
+	if c := r.lookup(to); c != nil {
+		c.enqueue(w)
+	} else if !r.publishDirect(to, w) {
+		slog.Debug("direct message to unknown user dropped", "to", to)
+		return
+	}
+	dc := w.GetDirectChat()
+	detail := fmt.Sprintf("%d bytes", len(dc.GetMessageBody()))
+	if n := len(dc.GetCiphertext()); n > 0 {
+		detail = fmt.Sprintf("%d bytes, encrypted", n)
+	}
+	r.emit(registryEvent{kind: audit.KindDirect, user: dc.GetFrom(), to: to, detail: detail})
+}
+
+func (r *registry) stats() registryStats {
+	r.mutex.RLock()
+	stats := registryStats{clients: len(r.byName), members: make(map[string]int)}
+	r.mutex.RUnlock()
+	for _, rm := range r.allRooms() {
+		rm.mutex.Lock()
+		if !rm.gone && len(rm.members) > 0 {
+			stats.members[rm.name] = len(rm.members)
+		}
+		rm.mutex.Unlock()
+	}
+	return stats
+}
+
+// roomsOf maps every local client in a room to the names of its rooms, sorted.
+func (r *registry) roomsOf() map[*client][]string {
+	in := make(map[*client][]string)
+	for _, rm := range r.allRooms() {
+		rm.mutex.Lock()
+		if !rm.gone {
+			for c := range rm.members {
+				in[c] = append(in[c], rm.name)
+			}
+		}
+		rm.mutex.Unlock()
+	}
+	for _, rooms := range in {
+		slices.Sort(rooms)
+	}
+	return in
+}
+
+// list snapshots every registered client, sorted by name.
+func (r *registry) list() []clientInfo {
+	in := r.roomsOf()
+	r.mutex.RLock()
+	infos := make([]clientInfo, 0, len(r.byName))
+	for _, c := range r.byName {
+		infos = append(infos, clientInfo{username: c.username, addr: c.conn.RemoteAddr().String(), queueDepth: len(c.out), rooms: in[c]})
+	}
+	r.mutex.RUnlock()
+	slices.SortFunc(infos, func(a, b clientInfo) int { return strings.Compare(a.username, b.username) })
+	return infos
+}
+
+func (r *registry) lookup(username string) *client {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.byName[username]
+}
+
+// whereIs finds username: connected here, or on another node of the
+// cluster (node is 0 if neither).
+func (r *registry) whereIs(username string) (c *client, node uint32) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if c = r.byName[username]; c == nil && r.remoteUsers[username] != nil {
+		node = r.remoteUsers[username].node
+	}
+	return c, node
+}
+
+// members names everyone in room, here or on other nodes, sorted. c is nil
+// for admin requests; otherwise c must be in the room, so nobody can list
+// a room they haven't joined.
+func (r *registry) members(c *client, room string) ([]string, error) {
+	rm := r.lockRoom(room)
+	if rm == nil && c != nil {
+		return nil, errNotMember // whether or not it exists
+	}
+	if rm == nil {
+		return nil, fmt.Errorf("no such room %q", room)
+	}
+	defer rm.mutex.Unlock()
+	if c != nil && !rm.has(c) {
+		return nil, errNotMember
+	}
+	names := make([]string, 0, len(rm.members)+len(rm.remote))
+	for c := range rm.members {
+		names = append(names, c.username)
+	}
+	for name := range rm.remote {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// closeRoom drops every member from room.
+func (r *registry) closeRoom(room string) error {
+	rm := r.lockRoom(room)
+	if rm == nil {
+		return fmt.Errorf("no such room %q", room)
+	}
+	defer rm.mutex.Unlock()
+	for c := range rm.members {
+		c.enqueue(roomNotice(room, "This room was closed by an operator"))
+		r.emit(registryEvent{kind: audit.KindLeave, user: c.username, room: room, detail: "room closed"})
+	}
+	r.dropRoom(rm)
+	return nil
+}
+
+// renameRoom moves every member of from into the new room to.
+func (r *registry) renameRoom(from, to string) error {
+	rm := r.lockRoom(from)
+	if rm == nil {
+		return fmt.Errorf("no such room %q", from)
+	}
+	defer rm.mutex.Unlock()
+	r.roomsMutex.Lock()
+	if to == "" || !messages.ValidName(to) || r.rooms[to] != nil {
+		r.roomsMutex.Unlock()
+		return fmt.Errorf("room %q already exists, is empty or has spaces or line breaks in it", to)
+	}
+	delete(r.rooms, from)
+	r.rooms[to] = rm
+	r.roomsMutex.Unlock()
+	rm.rename(to)
+	for c := range rm.members {
+		c.enqueue(roomNotice(to, fmt.Sprintf("Room %s was renamed to %s: use /join %s", from, to, to)))
+		r.emit(registryEvent{kind: audit.KindLeave, user: c.username, room: from, detail: "room renamed"})
+		r.emit(registryEvent{kind: audit.KindJoin, user: c.username, room: to, detail: "room renamed", operator: rm.operator})
+	}
+	return nil
+}
+
+// postRoom assigns w (a RoomChat) an ID, stores it and sends it to the room.
+// It fails if c isn't a member.
+func (r *registry) postRoom(c *client, w *messages.Wrapper) error {
+	rc := w.GetRoomChat()
+	rm := r.lockRoom(rc.GetRoom())
+	if rm == nil {
+		return errNotMember
+	}
+	defer rm.mutex.Unlock()
+	if !rm.has(c) {
+		return errNotMember
+	}
+	// only members count against the room's limit, or outsiders could drown it
+	if !c.srv.limiter.allowRoom(rc.GetRoom()) {
+		return errRoomBusy
+	}
+	if rc.GetExpiresAt() != 0 && len(rm.expiring) >= maxExpiring {
+		return errTooManyExpiring
+	}
+	if rc.GetReplyTo() != 0 {
+		if err := rm.attachReply(rc); err != nil {
+			return err
+		}
+	}
+	rc.MessageId = r.messageID()
+	rm.store(rc)
+	r.metrics.countRelayed(messages.TypeName(w))
+	rm.broadcast(w)
+	r.publishRoom(rc.GetRoom(), w)
+	r.notifyMentions(rc)
+	c.srv.hooks.roomChat(rc, rm.policy().ephemeral)
+	return nil
+}
+
+// editMessage applies an EditMessage to stored history and relays it.
+func (r *registry) editMessage(c *client, w *messages.Wrapper) error {
+	edit := w.GetEditMessage()
+	rm := r.lockRoom(edit.GetRoom())
+	if rm == nil {
+		return errNotMember
+	}
+	defer rm.mutex.Unlock()
+	stored, err := ownMessage(rm, c, edit.GetMessageId())
+	if err != nil {
+		return err
+	}
+	rm.edit(stored, edit.GetMessageBody())
+	r.metrics.countRelayed(messages.TypeName(w))
+	rm.broadcast(w)
+	r.publishRoom(edit.GetRoom(), w)
+	return nil
+}
+
+// deleteMessage removes a message from stored history and relays the DeleteMessage.
+func (r *registry) deleteMessage(c *client, w *messages.Wrapper) error {
+	del := w.GetDeleteMessage()
+	rm := r.lockRoom(del.GetRoom())
+	if rm == nil {
+		return errNotMember
+	}
+	defer rm.mutex.Unlock()
+	stored, err := ownMessage(rm, c, del.GetMessageId())
+	if err != nil {
+		return err
+	}
+	rm.detachReply(stored)
+	rm.unstore(del.GetMessageId())
+	r.metrics.countRelayed(messages.TypeName(w))
+	rm.broadcast(w)
+	r.publishRoom(del.GetRoom(), w)
+	return nil
+}
+
+// thread returns the messages of thread id in room, if c is a member.
+func (r *registry) thread(c *client, room string, id uint64) ([]*messages.RoomChat, error) {
+	rm := r.lockRoom(room)
+	if rm == nil {
+		return nil, errNotMember
+	}
+	defer rm.mutex.Unlock()
+	if !rm.has(c) {
+		return nil, errNotMember
+	}
+	msgs := rm.thread(id)
+	if len(msgs) == 0 {
+		return nil, fmt.Errorf("no thread #%d in %s", id, room)
+	}
+	return msgs, nil
+}
+
+// shareFile offers a finished upload (a FileOffer) to the user or room it's
+// for and returns who got it. c must be a member of the room.
+func (r *registry) shareFile(c *client, w *messages.Wrapper) ([]*client, error) {
+	fo := w.GetFileOffer()
+	var readers []*client
+	if fo.GetRoom() != "" {
+		rm := r.lockRoom(fo.GetRoom())
+		if rm == nil {
+			return nil, errNotMember
+		}
+		defer rm.mutex.Unlock()
+		if !rm.has(c) {
+			return nil, errNotMember
+		}
+		for member := range rm.members {
+			if member != c {
+				readers = append(readers, member)
+			}
+		}
+	} else if to := r.lookup(fo.GetTo()); to != nil {
+		readers = append(readers, to)
+	} else {
+		return nil, fmt.Errorf("%s is no longer online", fo.GetTo())
+	}
+	for _, reader := range readers {
+		reader.enqueue(w)
+	}
+	r.metrics.countRelayed(messages.TypeName(w))
+	r.emit(registryEvent{kind: audit.KindFile, user: c.username, room: fo.GetRoom(), to: fo.GetTo(),
+		detail: fmt.Sprintf("%s (%d bytes)", fo.GetName(), fo.GetSize())})
+	return readers, nil
+}
+
+// retention returns room's effective retention policy, first changing it
+// to set if that isn't nil. c is nil for admin requests; otherwise c must
+// be in the room, and be its operator to change anything.
+func (r *registry) retention(c *client, room string, set *retentionPolicy) (retentionPolicy, error) {
+	rm := r.lockRoom(room)
+	if rm == nil && c == nil {
+		return retentionPolicy{}, fmt.Errorf("no room %q", room)
+	}
+	if rm == nil {
+		return retentionPolicy{}, errNotMember
+	}
+	defer rm.mutex.Unlock()
+	if c != nil && !rm.has(c) {
+		return retentionPolicy{}, errNotMember
+	}
+	if set != nil {
+		if c != nil && c.username != rm.operator {
+			return retentionPolicy{}, fmt.Errorf("only the room's operator (%s) can change that", rm.operator)
+		}
+		rm.setRetention(*set)
+		by := "an operator"
+		if c != nil {
+			by = c.username
+		}
+		announce := roomNotice(room, fmt.Sprintf("%s changed retention: this room now %s", by, rm.policy()))
+		rm.broadcast(announce)
+		r.publishRoom(room, &messages.Wrapper{Msg: &messages.Wrapper_RoomRetention{RoomRetention: set.proto(room)}})
+		r.publishRoom(room, announce)
+	}
+	return rm.policy(), nil
+}
+
+// publishKey records c's public key in the key directory.
+func (r *registry) publishKey(c *client, key []byte) {
+	r.mutex.Lock()
+	c.publicKey = key
+	r.mutex.Unlock()
+	if r.cluster != nil {
+		r.cluster.publish(&messages.ClusterEvent{Kind: messages.ClusterEvent_KEY, Node: r.node, Username: c.username, PublicKey: key})
+	}
+}
+
+// publicKey returns the key username published, or nil if they're not
+// online or never published one.
+func (r *registry) publicKey(username string) []byte {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if c := r.byName[username]; c != nil {
+		return c.publicKey
+	}
+	if ru := r.remoteUsers[username]; ru != nil {
+		return ru.key
+	}
+	return nil
+}
+
+// relayTyping passes a Typing indicator on to the room or user it names.
+// Indicators are only ever relayed: no history, no audit event.
+func (r *registry) relayTyping(c *client, w *messages.Wrapper) {
+	t := w.GetTyping()
+	if t.GetTo() != "" {
+		if to := r.lookup(t.GetTo()); to != nil && to != c {
+			to.enqueue(w)
+		} else if to == nil {
+			r.publishDirect(t.GetTo(), w)
+		}
+		return
+	}
+	rm := r.lockRoom(t.GetRoom())
+	if rm == nil {
+		return
+	}
+	defer rm.mutex.Unlock()
+	if !rm.has(c) {
+		return
+	}
+	for member := range rm.members {
+		if member != c {
+			member.enqueue(w)
+		}
+	}
+	r.publishRoom(t.GetRoom(), w)
+}
+
+// react adds or removes c's reaction to a message and relays the change.
+func (r *registry) react(c *client, w *messages.Wrapper) error {
+	reaction := w.GetReaction()
+	rm := r.lockRoom(reaction.GetRoom())
+	if rm == nil {
+		return errNotMember
+	}
+	defer rm.mutex.Unlock()
+	if !rm.has(c) {
+		return errNotMember
+	}
+	changed, count, err := rm.react(c.username, reaction)
+	if err != nil {
+		return err
+	}
+	if changed {
+		reaction.Count = count
+		r.metrics.countRelayed(messages.TypeName(w))
+		rm.broadcast(w) // a delta: one emoji's new count, not the whole set
+		r.publishRoom(reaction.GetRoom(), w)
+	}
+	return nil
+}
+
+// compact enforces retention in every room as of now.
+func (r *registry) compact(now time.Time) {
+	for _, rm := range r.allRooms() {
+		rm.mutex.Lock()
+		if !rm.gone {
+			r.compactRoom(rm, now)
+		}
+		rm.mutex.Unlock()
+	}
 }
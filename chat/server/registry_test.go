@@ -0,0 +1,292 @@
+package main
+
+import (
+	"chat/messages"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// manyClients is how many clients the registry is tested and benchmarked with.
+const manyClients = 10000
+
+// nullConn is a connection that counts frames and throws them away. (It
+// can't be zero-sized: the registry tells connections apart by pointer.)
+type nullConn struct {
+	sent atomic.Int64
+}
+
+func (n *nullConn) Send(*messages.Wrapper) error { n.sent.Add(1); return nil }
+func (n *nullConn) Close()                       {}
+func (n *nullConn) RemoteAddr() net.Addr         { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+
+// quietServer is a server with rate limits off, so load tests measure the
+// registry rather than get themselves muted.
+func quietServer() *server {
+	s := newServer()
+	s.limiter = newRateLimiter(rateLimits{}, time.Now)
+	return s
+}
+
+// addClient registers name on s over a nullConn, without a reader of its own.
+func addClient(tb testing.TB, s *server, name string) *client {
+	tb.Helper()
+	c := s.newClient(&nullConn{}, name, slog.Default())
+	if err := s.users.add(c); err != nil {
+		tb.Fatalf("adding %s: %v", name, err)
+	}
+	tb.Cleanup(func() { s.users.remove(c.conn) })
+	return c
+}
+
+func addClients(tb testing.TB, s *server, n int) []*client {
+	tb.Helper()
+	clients := make([]*client, n)
+	for i := range clients {
+		clients[i] = addClient(tb, s, fmt.Sprintf("user%d", i))
+	}
+	return clients
+}
+
+func chat(room, text string) *messages.Wrapper {
+	return &messages.Wrapper{Msg: &messages.Wrapper_RoomChat{RoomChat: &messages.RoomChat{Room: room, MessageBody: text}}}
+}
+
+func TestUsernamesStayUnique(t *testing.T) {
+	s := quietServer()
+	const names, tries = 100, 20
+	var won [names]atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < names*tries; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			name := i % names
+			c := s.newClient(&nullConn{}, fmt.Sprintf("user%d", name), slog.Default())
+			if s.users.add(c) == nil {
+				won[name].Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	for i := range won {
+		if n := won[i].Load(); n != 1 {
+			t.Errorf("user%d was registered %d times", i, n)
+		}
+	}
+}
+
+// TestRegistryUnderLoad has manyClients joining, leaving, talking,
+// reconnecting and having their rooms renamed all at once. Run it with
+// -race; afterwards every room member must still be registered.
+func TestRegistryUnderLoad(t *testing.T) {
+	n := manyClients
+	if testing.Short() {
+		n = 1000
+	}
+	s := quietServer()
+	clients := addClients(t, s, n)
+	names := make([]string, n)
+	for i, c := range clients {
+		names[i] = c.username
+	}
+	const rooms = 1000
+	room := func(i int) string { return fmt.Sprintf("room%d", i%rooms) }
+
+	var wg sync.WaitGroup
+	for i := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := clients[i]
+			for step := 0; step < 10; step++ {
+				switch rand.IntN(8) {
+				case 0, 1:
+					_ = joinRoom(c, room(rand.IntN(rooms)))
+				case 2:
+					_ = leaveRoom(c, room(rand.IntN(rooms)))
+				case 3:
+					_ = s.users.postRoom(c, chat(room(i), "hi"))
+				case 4:
+					s.users.broadcastRoom(room(i), chat(room(i), "hello"))
+				case 5:
+					s.users.direct(names[rand.IntN(n)], &messages.Wrapper{Msg: &messages.Wrapper_DirectChat{
+						DirectChat: &messages.DirectChat{From: c.username, MessageBody: "psst"},
+					}})
+				case 6:
+					// reconnect under the same name
+					s.users.remove(c.conn)
+					c = s.newClient(&nullConn{}, c.username, slog.Default())
+					if err := s.users.add(c); err != nil {
+						t.Errorf("%s couldn't reconnect: %v", c.username, err)
+						return
+					}
+					clients[i] = c
+				case 7:
+					from := room(rand.IntN(rooms))
+					_ = s.users.renameRoom(from, from+"-renamed")
+					_ = s.users.renameRoom(from+"-renamed", from)
+				}
+			}
+		}()
+	}
+	// and the admin console reads it all the while
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				s.users.stats()
+				s.users.list()
+			}
+		}
+	}()
+	wg.Wait()
+	close(done)
+
+	for _, rm := range s.users.allRooms() {
+		rm.mutex.Lock()
+		for c := range rm.members {
+			if !s.users.registered(c) {
+				t.Errorf("%s is in %s but not registered", c.username, rm.name)
+			}
+		}
+		rm.mutex.Unlock()
+	}
+	if got := s.users.stats().clients; got != n {
+		t.Errorf("%d clients registered, want %d", got, n)
+	}
+}
+
+// TestBigRoomDoesntHoldUpOthers checks a room's fan-out to manyClients
+// doesn't stop others registering meanwhile.
+func TestBigRoomDoesntHoldUpOthers(t *testing.T) {
+	s := quietServer()
+	clients := addClients(t, s, manyClients)
+	for _, c := range clients {
+		if err := s.users.joinRoom(c, "stadium"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				s.users.broadcastRoom("stadium", chat("stadium", "goal"))
+			}
+		}
+	}()
+	defer close(stop)
+
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		addClient(t, s, fmt.Sprintf("late%d", i))
+	}
+	if d := time.Since(start); d > testTimeout {
+		t.Fatalf("registering 100 clients took %s during the fan-out", d)
+	}
+}
+
+func BenchmarkBroadcastRoom(b *testing.B) {
+	s := quietServer()
+	for _, c := range addClients(b, s, manyClients) {
+		if err := s.users.joinRoom(c, "stadium"); err != nil {
+			b.Fatal(err)
+		}
+	}
+	w := chat("stadium", "goal")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.users.broadcastRoom("stadium", w)
+	}
+}
+
+// BenchmarkBroadcastRooms is every client talking in its own small room at
+// once, which sharding should let run in parallel.
+func BenchmarkBroadcastRooms(b *testing.B) {
+	s := quietServer()
+	clients := addClients(b, s, manyClients)
+	for i, c := range clients {
+		if err := s.users.joinRoom(c, fmt.Sprintf("room%d", i/10)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	var next atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(next.Add(1)) % len(clients)
+		c, room := clients[i], fmt.Sprintf("room%d", i/10)
+		for pb.Next() {
+			if err := s.users.postRoom(c, chat(room, "hi")); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkJoinLeave(b *testing.B) {
+	s := quietServer()
+	clients := addClients(b, s, manyClients)
+	var next atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		c := clients[int(next.Add(1))%len(clients)]
+		room := "room-" + c.username
+		for pb.Next() {
+			if err := s.users.joinRoom(c, room); err != nil {
+				b.Error(err)
+				return
+			}
+			if err := s.users.leaveRoom(c, room); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkDirect(b *testing.B) {
+	s := quietServer()
+	clients := addClients(b, s, manyClients)
+	var next atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(next.Add(1))
+		from := clients[i%len(clients)].username
+		for pb.Next() {
+			i++
+			to := clients[i%len(clients)].username
+			s.users.direct(to, &messages.Wrapper{Msg: &messages.Wrapper_DirectChat{
+				DirectChat: &messages.DirectChat{From: from, To: to, MessageBody: "psst"},
+			}})
+		}
+	})
+}
+
+func BenchmarkRegister(b *testing.B) {
+	s := quietServer()
+	addClients(b, s, manyClients)
+	var next atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			c := s.newClient(&nullConn{}, fmt.Sprintf("new%d", next.Add(1)), slog.Default())
+			if err := s.users.add(c); err != nil {
+				b.Error(err)
+				return
+			}
+			s.users.remove(c.conn)
+		}
+	})
+}
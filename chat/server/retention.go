@@ -0,0 +1,146 @@
+package main
+
+import (
+	"chat/messages"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// retentionPolicy says how much of a room's history the server keeps.
+// Zero fields fall back to the server's default.
+type retentionPolicy struct {
+	keep      int           // newest messages kept
+	maxAge    time.Duration // older messages are dropped
+	ephemeral bool          // store nothing at all
+}
+
+const (
+	// maxTTL bounds a message's self-destruct timer.
+	maxTTL = 7 * 24 * time.Hour
+	// maxExpiring bounds how many pending self-destructs a room tracks.
+	// Past it, self-destructing messages are refused until some expire.
+	maxExpiring = 10 * historyLimit
+	// compactInterval is how often the compactor sweeps: the resolution of
+	// TTLs and age limits.
+	compactInterval = time.Second
+)
+
+// effective fills in p's unset fields from def, the server default.
+func (p retentionPolicy) effective(def retentionPolicy) retentionPolicy {
+	if p.keep <= 0 || p.keep > historyLimit {
+		p.keep = historyLimit
+		if def.keep > 0 {
+			p.keep = min(def.keep, historyLimit)
+		}
+	}
+	if p.maxAge <= 0 {
+		p.maxAge = def.maxAge
+	}
+	return p
+}
+
+// policy is the retention rm actually has.
+func (rm *room) policy() retentionPolicy {
+	return rm.retention.effective(rm.defaults)
+}
+
+func (p retentionPolicy) String() string {
+	if p.ephemeral {
+		return "stores nothing (ephemeral)"
+	}
+	s := fmt.Sprintf("keeps the newest %d messages", p.keep)
+	if p.maxAge > 0 {
+		s += " for up to " + messages.FormatDays(p.maxAge)
+	}
+	return s
+}
+
+func retentionFromProto(rr *messages.RoomRetention) retentionPolicy {
+	return retentionPolicy{
+		keep:      int(rr.GetKeep()),
+		maxAge:    time.Duration(rr.GetMaxAgeSeconds()) * time.Second,
+		ephemeral: rr.GetEphemeral(),
+	}
+}
+
+func (p retentionPolicy) proto(room string) *messages.RoomRetention {
+	return &messages.RoomRetention{
+		Room:          room,
+		Keep:          uint32(p.keep),
+		MaxAgeSeconds: int64(p.maxAge / time.Second),
+		Ephemeral:     p.ephemeral,
+		Update:        true,
+	}
+}
+
+// setRetention changes the room's policy and applies it to what's already
+// stored. Messages dropped this way just disappear from history; clients
+// that already showed them aren't told.
+func (rm *room) setRetention(p retentionPolicy) {
+	rm.retention = p
+	keep := p.effective(rm.defaults).keep
+	if p.ephemeral {
+		keep = 0
+	}
+	for len(rm.history.msgs) > keep {
+		rm.evictOldest()
+	}
+}
+
+// compact enforces the room's age limit and returns the IDs of messages
+// whose own TTL ran out, which the caller announces as deleted.
+func (rm *room) compact(now time.Time) []uint64 {
+	if maxAge := rm.policy().maxAge; maxAge > 0 {
+		cutoff := now.Add(-maxAge).Unix()
+		for len(rm.history.msgs) > 0 && rm.history.msgs[0].GetSentAt() < cutoff {
+			rm.evictOldest()
+		}
+	}
+	var expired []uint64
+	for id, at := range rm.expiring {
+		if at > now.Unix() {
+			continue
+		}
+		if m := rm.history.get(id); m != nil {
+			rm.detachReply(m)
+		}
+		rm.unstore(id)
+		expired = append(expired, id)
+	}
+	slices.Sort(expired)
+	return expired
+}
+
+// compactRoom runs compact over rm, which the caller has locked, announces
+// what expired and drops the room if that left it idle, or if nobody has
+// been in it for roomIdleTimeout. A room with self-destructs to come is
+// kept until they're done, so whoever comes back still hears of them.
+func (r *registry) compactRoom(rm *room, now time.Time) {
+	switch {
+	case len(rm.members) > 0 || len(rm.remote) > 0:
+		rm.emptySince = time.Time{}
+	case rm.emptySince.IsZero():
+		rm.emptySince = now
+	case now.Sub(rm.emptySince) >= roomIdleTimeout && len(rm.expiring) == 0:
+		r.dropRoom(rm)
+		return
+	}
+	for _, id := range rm.compact(now) {
+		// no username: nobody deleted it, it expired
+		rm.broadcast(&messages.Wrapper{
+			Msg: &messages.Wrapper_DeleteMessage{
+				DeleteMessage: &messages.DeleteMessage{Room: rm.name, MessageId: id},
+			},
+		})
+	}
+	r.dropIfIdle(rm)
+}
+
+// runCompactor compacts every interval. A sweep that runs long delays the
+// next one, which then catches up.
+func (r *registry) runCompactor(every time.Duration) {
+	for now := range time.Tick(every) {
+		r.compact(now)
+	}
+}
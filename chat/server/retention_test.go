@@ -0,0 +1,104 @@
+package main
+
+import (
+	"chat/messages"
+	"testing"
+	"time"
+)
+
+func TestTTLMessageExpires(t *testing.T) {
+	s := newServer()
+	alice := connect(t, s, "alice")
+	alice.joined("lobby")
+	alice.send(&messages.Wrapper{Msg: &messages.Wrapper_RoomChat{RoomChat: &messages.RoomChat{
+		Room: "lobby", MessageBody: "gone soon", TtlSeconds: 60,
+	}}})
+	rc := alice.expectChat("gone soon")
+	if rc.GetExpiresAt() != rc.GetSentAt()+60 {
+		t.Fatalf("expires at %d, sent at %d", rc.GetExpiresAt(), rc.GetSentAt())
+	}
+
+	s.users.compact(time.Unix(rc.GetExpiresAt(), 0))
+	d := alice.expect("the expiry", func(w *messages.Wrapper) bool { return w.GetDeleteMessage() != nil }).GetDeleteMessage()
+	if d.GetMessageId() != rc.GetMessageId() || d.GetUsername() != "" {
+		t.Errorf("got %v, want #%d expired", d, rc.GetMessageId())
+	}
+	rm := s.users.lockRoom("lobby")
+	defer rm.mutex.Unlock()
+	if rm.history.get(rc.GetMessageId()) != nil {
+		t.Error("an expired message is still in history")
+	}
+}
+
+func TestTTLMessagesRefusedWhenTheRoomCantExpireThem(t *testing.T) {
+	s := newServer()
+	alice := connect(t, s, "alice")
+	alice.joined("lobby")
+	rm := s.users.lockRoom("lobby")
+	for i := uint64(1); i <= maxExpiring; i++ {
+		rm.expiring[1<<40+i] = time.Now().Add(time.Hour).Unix()
+	}
+	rm.mutex.Unlock()
+
+	alice.send(&messages.Wrapper{Msg: &messages.Wrapper_RoomChat{RoomChat: &messages.RoomChat{
+		Room: "lobby", MessageBody: "self-destruct", TtlSeconds: 60,
+	}}})
+	alice.expectNotice("Message not sent: the room already has")
+
+	// messages that don't self-destruct are fine
+	alice.say("lobby", "still here")
+	alice.expectChat("still here")
+
+	// and one accepted elsewhere in a cluster isn't kept if it can't expire here
+	rm = s.users.lockRoom("lobby")
+	defer rm.mutex.Unlock()
+	rm.store(&messages.RoomChat{Room: "lobby", MessageId: 99, MessageBody: "x", ExpiresAt: time.Now().Unix() + 60})
+	if rm.history.get(99) != nil {
+		t.Error("stored a self-destructing message the room can't expire")
+	}
+}
+
+func TestDMTTLCappedBySendersRetention(t *testing.T) {
+	s := newServer()
+	alice := connect(t, s, "alice")
+	bob := connect(t, s, "bob")
+	alice.send(&messages.Wrapper{Msg: &messages.Wrapper_DirectChat{DirectChat: &messages.DirectChat{
+		To: "bob", MessageBody: "hi", Retention: &messages.DMRetention{MaxAgeSeconds: 3600},
+	}}})
+	dc := bob.expect("DM", func(w *messages.Wrapper) bool { return w.GetDirectChat() != nil }).GetDirectChat()
+	if dc.GetTtlSeconds() != 3600 || dc.GetRetention().GetMaxAgeSeconds() != 3600 {
+		t.Errorf("got TTL %d and retention %v, want both an hour", dc.GetTtlSeconds(), dc.GetRetention())
+	}
+}
+
+// TestIdleRoomWaitsForExpiries has a room empty for longer than
+// roomIdleTimeout while a message in it has yet to self-destruct: the room
+// stays until it has, so someone coming back still hears.
+func TestIdleRoomWaitsForExpiries(t *testing.T) {
+	s := newServer()
+	alice := connect(t, s, "alice")
+	alice.joined("lobby")
+	alice.send(&messages.Wrapper{Msg: &messages.Wrapper_RoomChat{RoomChat: &messages.RoomChat{
+		Room: "lobby", MessageBody: "gone the day after tomorrow", TtlSeconds: 2 * 24 * 60 * 60,
+	}}})
+	rc := alice.expectChat("gone the day after tomorrow")
+	if err := s.users.leaveRoom(s.users.lookup("alice"), "lobby"); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(rc.GetSentAt(), 0)
+	s.users.compact(now)
+	s.users.compact(now.Add(roomIdleTimeout + time.Hour))
+	if rm := s.users.lockRoom("lobby"); rm == nil {
+		t.Fatal("an idle room was dropped with a message still to expire")
+	} else {
+		rm.mutex.Unlock()
+	}
+
+	alice.joined("lobby")
+	s.users.compact(time.Unix(rc.GetExpiresAt(), 0))
+	d := alice.expect("the expiry", func(w *messages.Wrapper) bool { return w.GetDeleteMessage() != nil }).GetDeleteMessage()
+	if d.GetMessageId() != rc.GetMessageId() {
+		t.Errorf("got %v, want #%d expired", d, rc.GetMessageId())
+	}
+}
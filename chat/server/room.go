@@ -0,0 +1,294 @@
+package main
+
+import (
+	"chat/messages"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// historyLimit is how many messages a room remembers.
+const historyLimit = 1000
+
+// maxRooms bounds how many rooms clients can open on this server.
+const maxRooms = 10000
+
+// roomIdleTimeout is how long a room nobody is in keeps its history before
+// the server forgets it altogether.
+const roomIdleTimeout = 24 * time.Hour
+
+// replayOnJoin is how much history a client that negotiated FeatureHistory
+// gets when it joins.
+const replayOnJoin = 20
+
+// room is a chat room: its members plus the recent history the server keeps
+// for it. Everything in it is guarded by mutex.
+type room struct {
+	mutex    sync.Mutex
+	gone     bool // dropped from the registry; whoever was waiting to lock it must look again
+	name     string
+	members  map[*client]struct{}
+	remote   map[string]uint32 // members on other nodes of a cluster: username -> node
+	operator string            // whoever created the room may edit or delete anything in it
+	history  roomHistory
+	threads  map[uint64]uint32 // thread root ID -> reply count
+	index    searchIndex       // words in history -> message IDs
+
+	retention retentionPolicy
+	defaults  retentionPolicy // the server's, for what retention leaves unset
+	// message ID -> when its TTL runs out (unix seconds). Tracked apart from
+	// history, since clients must hear about the expiry even of messages
+	// the room never stored or has already dropped.
+	expiring map[uint64]int64
+	// when the compactor first found nobody in the room; zero while anyone is
+	emptySince time.Time
+
+	reactions map[uint64]map[string]map[string]struct{} // message ID -> emoji -> usernames
+}
+
+func newRoom(name, operator string, defaults retentionPolicy) *room {
+	return &room{
+		name:     name,
+		defaults: defaults,
+		members:  make(map[*client]struct{}),
+		remote:   make(map[string]uint32),
+		operator: operator,
+		history:  roomHistory{byID: make(map[uint64]*messages.RoomChat)},
+		threads:  make(map[uint64]uint32),
+		index:    make(searchIndex),
+		expiring: make(map[uint64]int64),
+
+		reactions: make(map[uint64]map[string]map[string]struct{}),
+	}
+}
+
+// live reports whether rm is still the registry's room called name.
+func (rm *room) live(name string) bool {
+	return !rm.gone && rm.name == name
+}
+
+func (rm *room) has(c *client) bool {
+	_, ok := rm.members[c]
+	return ok
+}
+
+// store adds rc to history, as far as the room's retention policy allows,
+// forgetting whatever falls off the end. A self-destructing message is only
+// stored if the room can track its expiry.
+func (rm *room) store(rc *messages.RoomChat) {
+	if at := rc.GetExpiresAt(); at != 0 {
+		if len(rm.expiring) >= maxExpiring {
+			return // postRoom refuses these; one relayed from elsewhere just isn't kept
+		}
+		rm.expiring[rc.GetMessageId()] = at
+	}
+	policy := rm.policy()
+	if policy.ephemeral {
+		return
+	}
+	rm.index.add(rc.GetMessageId(), rc.GetMessageBody())
+	if evicted := rm.history.add(rc); evicted != nil {
+		rm.forget(evicted)
+	}
+	for len(rm.history.msgs) > policy.keep {
+		rm.evictOldest()
+	}
+}
+
+// evictOldest drops the oldest stored message.
+func (rm *room) evictOldest() {
+	oldest := rm.history.msgs[0]
+	rm.history.remove(oldest.GetMessageId())
+	rm.forget(oldest)
+}
+
+// unstore removes message id and everything hanging off it, since it's
+// been deleted.
+func (rm *room) unstore(id uint64) {
+	if m := rm.history.get(id); m != nil {
+		rm.history.remove(id)
+		rm.forget(m)
+	}
+	delete(rm.expiring, id)
+}
+
+// forget drops what the room keeps about m besides history itself.
+func (rm *room) forget(m *messages.RoomChat) {
+	rm.index.remove(m.GetMessageId(), m.GetMessageBody())
+	delete(rm.reactions, m.GetMessageId())
+	delete(rm.threads, m.GetMessageId()) // if it was a thread's root
+}
+
+// edit replaces the body of stored message m.
+func (rm *room) edit(m *messages.RoomChat, body string) {
+	rm.index.remove(m.GetMessageId(), m.GetMessageBody())
+	m.MessageBody = body
+	m.Edited = true
+	rm.index.add(m.GetMessageId(), body)
+}
+
+// maxEmojiLength bounds a reaction, which is meant to be one emoji (or a short :code:).
+const maxEmojiLength = 32
+
+// react applies r on behalf of username. It reports whether anything
+// changed and the emoji's new count.
+func (rm *room) react(username string, r *messages.Reaction) (bool, uint32, error) {
+	emoji := r.GetEmoji()
+	if emoji == "" || len(emoji) > maxEmojiLength || strings.ContainsAny(emoji, " \t\r\n") {
+		return false, 0, fmt.Errorf("%q is not a reaction", emoji)
+	}
+	stored := rm.history.get(r.GetMessageId())
+	if stored == nil {
+		return false, 0, fmt.Errorf("no message #%d in %s", r.GetMessageId(), rm.name)
+	}
+
+	byEmoji := rm.reactions[r.GetMessageId()]
+	if byEmoji == nil {
+		byEmoji = make(map[string]map[string]struct{})
+		rm.reactions[r.GetMessageId()] = byEmoji
+	}
+	who := byEmoji[emoji]
+	_, had := who[username]
+	switch {
+	case r.GetRemove() && !had, !r.GetRemove() && had:
+		return false, uint32(len(who)), nil // nothing to remove, or already there
+	case r.GetRemove():
+		delete(who, username)
+	default:
+		if who == nil {
+			who = make(map[string]struct{})
+			byEmoji[emoji] = who
+		}
+		who[username] = struct{}{}
+	}
+
+	count := uint32(len(who))
+	if count == 0 {
+		delete(byEmoji, emoji)
+		delete(stored.Reactions, emoji)
+	} else {
+		if stored.Reactions == nil {
+			stored.Reactions = make(map[string]uint32)
+		}
+		stored.Reactions[emoji] = count
+	}
+	return true, count, nil
+}
+
+// attachReply checks that rc's parent is in this room and files rc under
+// the parent's thread.
+func (rm *room) attachReply(rc *messages.RoomChat) error {
+	parent := rm.history.get(rc.GetReplyTo())
+	if parent == nil {
+		return fmt.Errorf("no message #%d in %s to reply to", rc.GetReplyTo(), rm.name)
+	}
+	rc.ThreadId = parent.GetThreadId()
+	if rc.ThreadId == 0 {
+		rc.ThreadId = parent.GetMessageId() // parent starts a new thread
+	}
+	// Replies are only counted while their root is around to show the count
+	if root := rm.history.get(rc.ThreadId); root != nil {
+		rm.threads[rc.ThreadId]++
+		root.ReplyCount = rm.threads[rc.ThreadId]
+	}
+	return nil
+}
+
+// detachReply undoes attachReply when a reply is deleted.
+func (rm *room) detachReply(rc *messages.RoomChat) {
+	id := rc.GetThreadId()
+	if id == 0 || rm.threads[id] == 0 {
+		return
+	}
+	rm.threads[id]--
+	if root := rm.history.get(id); root != nil {
+		root.ReplyCount = rm.threads[id]
+	}
+	if rm.threads[id] == 0 {
+		delete(rm.threads, id)
+	}
+}
+
+// thread returns copies of a thread's messages still in history: the root
+// first, then the replies oldest first.
+func (rm *room) thread(id uint64) []*messages.RoomChat {
+	var out []*messages.RoomChat
+	for _, m := range rm.history.msgs {
+		if m.GetMessageId() == id || m.GetThreadId() == id {
+			out = append(out, proto.Clone(m).(*messages.RoomChat))
+		}
+	}
+	return out
+}
+
+func (rm *room) broadcast(w *messages.Wrapper) {
+	for c := range rm.members {
+		c.enqueue(w)
+	}
+}
+
+// idle reports whether nothing would be lost by forgetting the room.
+func (rm *room) idle() bool {
+	return len(rm.members) == 0 && len(rm.remote) == 0 && len(rm.history.msgs) == 0 && len(rm.expiring) == 0
+}
+
+// rename moves the room (and its stored messages) to a new name.
+func (rm *room) rename(name string) {
+	rm.name = name
+	for _, m := range rm.history.msgs {
+		m.Room = name
+	}
+}
+
+// roomHistory keeps the last historyLimit messages of a room, oldest first.
+// Stored messages are private copies, so editing them never races with a
+// writePump serializing the copy that went out.
+type roomHistory struct {
+	msgs []*messages.RoomChat
+	byID map[uint64]*messages.RoomChat
+}
+
+// add stores a copy of rc and returns the message that fell out of
+// history to make room, if any.
+func (h *roomHistory) add(rc *messages.RoomChat) *messages.RoomChat {
+	rc = proto.Clone(rc).(*messages.RoomChat)
+	h.msgs = append(h.msgs, rc)
+	h.byID[rc.GetMessageId()] = rc
+	if len(h.msgs) > historyLimit {
+		evicted := h.msgs[0]
+		delete(h.byID, evicted.GetMessageId())
+		h.msgs = h.msgs[1:]
+		return evicted
+	}
+	return nil
+}
+
+func (h *roomHistory) get(id uint64) *messages.RoomChat {
+	return h.byID[id]
+}
+
+func (h *roomHistory) remove(id uint64) {
+	if _, ok := h.byID[id]; !ok {
+		return
+	}
+	delete(h.byID, id)
+	h.msgs = slices.DeleteFunc(h.msgs, func(m *messages.RoomChat) bool { return m.GetMessageId() == id })
+}
+
+// recent returns copies of the last n messages, oldest first.
+func (h *roomHistory) recent(n int) []*messages.RoomChat {
+	start := max(0, len(h.msgs)-n)
+	out := make([]*messages.RoomChat, 0, len(h.msgs)-start)
+	for _, m := range h.msgs[start:] {
+		out = append(out, proto.Clone(m).(*messages.RoomChat))
+	}
+	return out
+}
+
+func roomChatWrapper(rc *messages.RoomChat) *messages.Wrapper {
+	return &messages.Wrapper{Msg: &messages.Wrapper_RoomChat{RoomChat: rc}}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"chat/messages"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestOutsidersDontSpendTheRoomLimit(t *testing.T) {
+	clock := newFakeClock()
+	s := newServer()
+	limits := testLimits()
+	limits.msgsPerSec = 0 // only the room limit matters here
+	s.limiter = newRateLimiter(limits, clock.now)
+	alice := connect(t, s, "alice")
+	alice.joined("lobby")
+	mallory := connect(t, s, "mallory")
+
+	for i := 0; i < 5; i++ {
+		mallory.say("lobby", "let me in")
+		mallory.expectNotice("Join the room first")
+	}
+	alice.say("lobby", "one")
+	alice.expectChat("one")
+	alice.say("lobby", "two")
+	alice.expectChat("two")
+	alice.say("lobby", "three")
+	alice.expectNotice("Room is too busy")
+}
+
+func TestEmptyRoomsExpire(t *testing.T) {
+	s := newServer()
+	alice := connect(t, s, "alice")
+	alice.joined("lobby")
+	alice.say("lobby", "remember me")
+	alice.expectChat("remember me")
+	c := s.users.lookup("alice")
+	if err := s.users.leaveRoom(c, "lobby"); err != nil {
+		t.Fatal(err)
+	}
+
+	exists := func() bool {
+		rm := s.users.lockRoom("lobby")
+		if rm != nil {
+			rm.mutex.Unlock()
+		}
+		return rm != nil
+	}
+	now := time.Now()
+	s.users.compact(now)
+	if !exists() {
+		t.Fatal("a room with history was dropped as soon as it emptied")
+	}
+
+	// somebody dropping in and out starts the clock again
+	if err := s.users.joinRoom(c, "lobby"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.users.leaveRoom(c, "lobby"); err != nil {
+		t.Fatal(err)
+	}
+	s.users.compact(now.Add(roomIdleTimeout))
+	if !exists() {
+		t.Fatal("a room was dropped a day after it first emptied, though someone came back since")
+	}
+
+	s.users.compact(now.Add(2 * roomIdleTimeout))
+	if exists() {
+		t.Fatalf("a room nobody was in for %s is still there", roomIdleTimeout)
+	}
+}
+
+func TestRoomCap(t *testing.T) {
+	s := newServer()
+	connect(t, s, "alice")
+	c := s.users.lookup("alice")
+	for i := 0; i < maxRooms; i++ {
+		if err := s.users.joinRoom(c, fmt.Sprintf("room%d", i)); err != nil {
+			t.Fatalf("room %d: %v", i, err)
+		}
+	}
+	if err := s.users.joinRoom(c, "one-too-many"); err != errTooManyRooms {
+		t.Fatalf("opening a room past maxRooms: %v", err)
+	}
+	if err := s.users.joinRoom(c, "room0"); err != nil {
+		t.Fatalf("joining a room that already exists at the cap: %v", err)
+	}
+}
+
+func TestThreadsForgottenWithTheirRoot(t *testing.T) {
+	rm := newRoom("lobby", "alice", retentionPolicy{})
+	post := func(id, replyTo uint64) {
+		t.Helper()
+		rc := &messages.RoomChat{Room: "lobby", Username: "alice", MessageId: id, ReplyTo: replyTo, MessageBody: "hi"}
+		if replyTo != 0 {
+			if err := rm.attachReply(rc); err != nil {
+				t.Fatal(err)
+			}
+		}
+		rm.store(rc)
+	}
+	post(1, 0)
+	post(2, 1)
+	post(3, 2)
+	if got := rm.history.get(1).GetReplyCount(); got != 2 {
+		t.Fatalf("root has %d replies, want 2", got)
+	}
+
+	// deleting the root forgets its thread, and later replies don't bring it back
+	rm.unstore(1)
+	post(4, 3)
+	if len(rm.threads) != 0 {
+		t.Fatalf("threads %v after their root was deleted", rm.threads)
+	}
+
+	// a root falling out of history takes its thread with it too
+	post(5, 0)
+	post(6, 5)
+	rm.setRetention(retentionPolicy{keep: 1})
+	if len(rm.threads) != 0 {
+		t.Fatalf("threads %v after their root was evicted", rm.threads)
+	}
+
+	// and a thread whose replies are all deleted is gone too
+	rm.setRetention(retentionPolicy{})
+	post(7, 0)
+	post(8, 7)
+	rm.detachReply(rm.history.get(8))
+	rm.unstore(8)
+	if len(rm.threads) != 0 || rm.history.get(7).GetReplyCount() != 0 {
+		t.Fatalf("threads %v after the only reply was deleted", rm.threads)
+	}
+}
+
+func editMsg(room string, id uint64, body string) *messages.Wrapper {
+	return &messages.Wrapper{Msg: &messages.Wrapper_EditMessage{EditMessage: &messages.EditMessage{Room: room, MessageId: id, MessageBody: body}}}
+}
+
+func deleteMsg(room string, id uint64) *messages.Wrapper {
+	return &messages.Wrapper{Msg: &messages.Wrapper_DeleteMessage{DeleteMessage: &messages.DeleteMessage{Room: room, MessageId: id}}}
+}
+
+// TestOnlyAuthorOrOperatorChangesMessages has alice run the lobby, bob post
+// in it and carol try to change what bob said.
+func TestOnlyAuthorOrOperatorChangesMessages(t *testing.T) {
+	s := newServer()
+	alice := connect(t, s, "alice")
+	alice.joined("lobby")
+	bob := connect(t, s, "bob")
+	bob.joined("lobby")
+	carol := connect(t, s, "carol")
+	carol.joined("lobby")
+	mallory := connect(t, s, "mallory")
+
+	bob.say("lobby", "teh plan")
+	id := carol.expectChat("teh plan").GetMessageId()
+
+	carol.send(editMsg("lobby", id, "carol's plan"))
+	carol.expectNotice("Edit failed")
+	carol.send(deleteMsg("lobby", id))
+	carol.expectNotice("Delete failed")
+	mallory.send(editMsg("lobby", id, "mallory's plan"))
+	mallory.expectNotice("Edit failed")
+
+	// bob's own edit reaches everyone, marked as bob's
+	bob.send(editMsg("lobby", id, "the plan"))
+	for _, tc := range []*testClient{alice, carol} {
+		e := tc.expect("the edit", func(w *messages.Wrapper) bool { return w.GetEditMessage() != nil }).GetEditMessage()
+		if e.GetMessageId() != id || e.GetMessageBody() != "the plan" || e.GetUsername() != "bob" {
+			t.Errorf("%s saw %v, want bob's edit of #%d", tc.name, e, id)
+		}
+	}
+	rm := s.users.lockRoom("lobby")
+	if m := rm.history.get(id); m.GetMessageBody() != "the plan" || !m.GetEdited() {
+		t.Errorf("history has %v, want it edited", m)
+	}
+	rm.mutex.Unlock()
+
+	// and alice runs the room, so can delete it anyway
+	alice.send(deleteMsg("lobby", id))
+	for _, tc := range []*testClient{bob, carol} {
+		d := tc.expect("the delete", func(w *messages.Wrapper) bool { return w.GetDeleteMessage() != nil }).GetDeleteMessage()
+		if d.GetMessageId() != id || d.GetUsername() != "alice" {
+			t.Errorf("%s saw %v, want alice deleting #%d", tc.name, d, id)
+		}
+	}
+	rm = s.users.lockRoom("lobby")
+	defer rm.mutex.Unlock()
+	if rm.history.get(id) != nil {
+		t.Error("a deleted message is still in history")
+	}
+}
+
+func TestReactions(t *testing.T) {
+	rm := newRoom("lobby", "alice", retentionPolicy{})
+	rm.store(&messages.RoomChat{MessageId: 1, Room: "lobby", Username: "alice", MessageBody: "ship it?"})
+	react := func(who, emoji string, remove bool) (bool, uint32) {
+		t.Helper()
+		changed, count, err := rm.react(who, &messages.Reaction{Room: "lobby", MessageId: 1, Emoji: emoji, Remove: remove})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return changed, count
+	}
+	counted := func() uint32 { return rm.history.get(1).GetReactions()["+1"] }
+
+	for _, step := range []struct {
+		what    string
+		who     string
+		remove  bool
+		changed bool
+		count   uint32
+	}{
+		{"bob's +1", "bob", false, true, 1},
+		{"carol's +1", "carol", false, true, 2},
+		{"bob's +1 again", "bob", false, false, 2},
+		{"bob taking it back", "bob", true, true, 1},
+		{"bob taking it back again", "bob", true, false, 1},
+		{"carol taking it back", "carol", true, true, 0},
+		{"dave taking back one never given", "dave", true, false, 0},
+	} {
+		if changed, count := react(step.who, "+1", step.remove); changed != step.changed || count != step.count {
+			t.Errorf("%s: changed %v, count %d; want %v, %d", step.what, changed, count, step.changed, step.count)
+		}
+		if got := counted(); got != step.count {
+			t.Errorf("after %s the message says %d, want %d", step.what, got, step.count)
+		}
+	}
+	if _, ok := rm.history.get(1).GetReactions()["+1"]; ok {
+		t.Error("a reaction nobody's left on is still counted")
+	}
+	if len(rm.reactions[1]) != 0 {
+		t.Errorf("reactions nobody's left on are still tracked: %v", rm.reactions[1])
+	}
+
+	if _, _, err := rm.react("bob", &messages.Reaction{MessageId: 1, Emoji: "two words"}); err == nil {
+		t.Error("a reaction with a space in it was accepted")
+	}
+	if _, _, err := rm.react("bob", &messages.Reaction{MessageId: 2, Emoji: "+1"}); err == nil {
+		t.Error("a reaction to no message was accepted")
+	}
+}
+
+func typing(room, to string) *messages.Wrapper {
+	return &messages.Wrapper{Msg: &messages.Wrapper_Typing{Typing: &messages.Typing{Room: room, To: to}}}
+}
+
+func isTyping(w *messages.Wrapper) bool { return w.GetTyping() != nil }
+
+func TestTypingReachesOnlyMembers(t *testing.T) {
+	s := newServer()
+	alice := connect(t, s, "alice")
+	alice.joined("lobby")
+	bob := connect(t, s, "bob")
+	bob.joined("lobby")
+	alice.expectNotice("bob joined")
+	carol := connect(t, s, "carol")
+	mallory := connect(t, s, "mallory")
+
+	alice.send(typing("lobby", ""))
+	if ty := bob.expect("alice typing", isTyping).GetTyping(); ty.GetUsername() != "alice" || ty.GetRoom() != "lobby" {
+		t.Errorf("bob saw %v, want alice typing in lobby", ty)
+	}
+	carol.expectNone("typing outside the room", 100*time.Millisecond, isTyping)
+	alice.expectNone("alice's own typing", 0, isTyping)
+
+	// nor can an outsider tell the room they're typing
+	mallory.send(typing("lobby", ""))
+	bob.expectNone("mallory typing", 100*time.Millisecond, isTyping)
+
+	// and a DM's indicator goes to whoever it's to, and nobody else
+	carol.send(typing("", "alice"))
+	if ty := alice.expect("carol typing", isTyping).GetTyping(); ty.GetUsername() != "carol" || ty.GetTo() != "alice" {
+		t.Errorf("alice saw %v, want carol typing to alice", ty)
+	}
+	bob.expectNone("someone else's DM typing", 100*time.Millisecond, isTyping)
+}
+
+func TestTypingIsThrottled(t *testing.T) {
+	s := newServer()
+	alice := connect(t, s, "alice")
+	alice.joined("lobby")
+	bob := connect(t, s, "bob")
+	bob.joined("lobby")
+
+	for i := 0; i < 5; i++ {
+		alice.send(typing("lobby", ""))
+	}
+	bob.expect("alice typing", isTyping)
+	bob.expectNone("more than one indicator a second", minTypingInterval/2, isTyping)
+
+	time.Sleep(minTypingInterval)
+	alice.send(typing("lobby", ""))
+	bob.expect("alice typing once the interval's up", isTyping)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"chat/messages"
+	"cmp"
+	"errors"
+	"slices"
+	"strings"
+	"unicode"
+
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// searchDefaultLimit and searchMaxLimit bound how many results one Search returns.
+	searchDefaultLimit = 20
+	searchMaxLimit     = 100
+	// maxTermLength keeps pasted blobs (hashes, base64) from bloating the index.
+	maxTermLength = 64
+)
+
+// searchIndex is an inverted index over a room's stored messages: each word
+// maps to the IDs of the messages containing it. It follows the room's
+// history exactly, so it's bounded by historyLimit too.
+type searchIndex map[string]map[uint64]struct{}
+
+// terms splits text into lowercase words, each once.
+func terms(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	words = slices.DeleteFunc(words, func(w string) bool { return len(w) > maxTermLength })
+	slices.Sort(words)
+	return slices.Compact(words)
+}
+
+func (ix searchIndex) add(id uint64, text string) {
+	for _, t := range terms(text) {
+		ids := ix[t]
+		if ids == nil {
+			ids = make(map[uint64]struct{})
+			ix[t] = ids
+		}
+		ids[id] = struct{}{}
+	}
+}
+
+func (ix searchIndex) remove(id uint64, text string) {
+	for _, t := range terms(text) {
+		delete(ix[t], id)
+		if len(ix[t]) == 0 {
+			delete(ix, t)
+		}
+	}
+}
+
+// lookup returns the IDs of messages containing every one of words.
+func (ix searchIndex) lookup(words []string) []uint64 {
+	if len(words) == 0 {
+		return nil
+	}
+	// Walk the rarest word's postings and check the rest against them
+	slices.SortFunc(words, func(a, b string) int { return len(ix[a]) - len(ix[b]) })
+	var ids []uint64
+	for id := range ix[words[0]] {
+		all := true
+		for _, w := range words[1:] {
+			if _, ok := ix[w][id]; !ok {
+				all = false
+				break
+			}
+		}
+		if all {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// searchMatches applies a Search's sender and time filters.
+func searchMatches(q *messages.Search, rc *messages.RoomChat) bool {
+	if q.GetFrom() != "" && rc.GetUsername() != q.GetFrom() {
+		return false
+	}
+	if q.GetSince() != 0 && rc.GetSentAt() < q.GetSince() {
+		return false
+	}
+	if q.GetUntil() != 0 && rc.GetSentAt() >= q.GetUntil() {
+		return false
+	}
+	return true
+}
+
+// search finds stored messages matching q in the rooms c is in (or just q's
+// room, which c must be in). Results are copies, newest first.
+func (r *registry) search(c *client, q *messages.Search) ([]*messages.RoomChat, bool, error) {
+	words := terms(q.GetQuery())
+	if len(words) == 0 && q.GetFrom() == "" {
+		return nil, false, errors.New("nothing to search for")
+	}
+	limit := int(q.GetLimit())
+	if limit <= 0 {
+		limit = searchDefaultLimit
+	}
+	limit = min(limit, searchMaxLimit)
+
+	var found []*messages.RoomChat
+	total := 0
+	if q.GetRoom() != "" {
+		rm := r.lockRoom(q.GetRoom())
+		if rm == nil {
+			return nil, false, errNotMember
+		}
+		if !rm.has(c) {
+			rm.mutex.Unlock()
+			return nil, false, errNotMember
+		}
+		found, total = rm.search(q, words, limit)
+		rm.mutex.Unlock()
+	} else {
+		for _, rm := range r.allRooms() {
+			rm.mutex.Lock()
+			if !rm.gone && rm.has(c) {
+				msgs, n := rm.search(q, words, limit)
+				found = append(found, msgs...)
+				total += n
+			}
+			rm.mutex.Unlock()
+		}
+	}
+	sortNewestFirst(found)
+	return found[:min(limit, len(found))], total > limit, nil
+}
+
+// search returns copies of the newest limit messages in rm matching q, and
+// how many matched in all. The caller holds rm locked.
+func (rm *room) search(q *messages.Search, words []string, limit int) ([]*messages.RoomChat, int) {
+	var found []*messages.RoomChat
+	if len(words) == 0 {
+		// sender filter only: nothing to look up, so scan
+		for _, m := range rm.history.msgs {
+			if searchMatches(q, m) {
+				found = append(found, m)
+			}
+		}
+	} else {
+		for _, id := range rm.index.lookup(words) {
+			if m := rm.history.get(id); m != nil && searchMatches(q, m) {
+				found = append(found, m)
+			}
+		}
+	}
+	sortNewestFirst(found)
+	out := make([]*messages.RoomChat, 0, min(limit, len(found)))
+	for _, m := range found[:min(limit, len(found))] {
+		out = append(out, proto.Clone(m).(*messages.RoomChat))
+	}
+	return out, len(found)
+}
+
+// sortNewestFirst orders msgs by when they were sent, then by ID, which at
+// least one node hands out in order.
+func sortNewestFirst(msgs []*messages.RoomChat) {
+	slices.SortFunc(msgs, func(a, b *messages.RoomChat) int {
+		return cmp.Or(cmp.Compare(b.GetSentAt(), a.GetSentAt()), cmp.Compare(b.GetMessageId(), a.GetMessageId()))
+	})
+}
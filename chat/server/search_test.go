@@ -0,0 +1,147 @@
+package main
+
+import (
+	"chat/messages"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestTerms(t *testing.T) {
+	long := strings.Repeat("x", maxTermLength+1)
+	got := terms("Deploy, deploy! Rollback at 5pm? " + long)
+	if want := []string{"5pm", "at", "deploy", "rollback"}; !slices.Equal(got, want) {
+		t.Errorf("terms = %v, want %v", got, want)
+	}
+}
+
+func TestSearchIndex(t *testing.T) {
+	ix := make(searchIndex)
+	ix.add(1, "the deploy is done")
+	ix.add(2, "deploy failed, rolling back")
+	ix.add(3, "lunch?")
+
+	lookup := func(query string) []uint64 {
+		ids := ix.lookup(terms(query))
+		slices.Sort(ids)
+		return ids
+	}
+	if got := lookup("deploy"); !slices.Equal(got, []uint64{1, 2}) {
+		t.Errorf("deploy is in %v, want 1 and 2", got)
+	}
+	if got := lookup("DEPLOY failed"); !slices.Equal(got, []uint64{2}) {
+		t.Errorf("deploy and failed are in %v, want only 2", got)
+	}
+	if got := lookup("deploy lunch"); len(got) != 0 {
+		t.Errorf("deploy and lunch are in %v, want none", got)
+	}
+
+	ix.remove(2, "deploy failed, rolling back")
+	if got := lookup("deploy"); !slices.Equal(got, []uint64{1}) {
+		t.Errorf("after removing 2, deploy is in %v", got)
+	}
+	if _, ok := ix["failed"]; ok {
+		t.Error("a word in no message is still indexed")
+	}
+}
+
+// TestSearchRarestFirst checks a lookup walks the rarest word's postings
+// and only checks the others, whatever order they're asked for in.
+func TestSearchRarestFirst(t *testing.T) {
+	ix := make(searchIndex)
+	for id := uint64(1); id <= 100; id++ {
+		ix.add(id, "hello everyone")
+	}
+	ix.add(50, "hello everyone, ship it")
+	words := []string{"hello", "everyone", "ship"}
+	if got := ix.lookup(words); !slices.Equal(got, []uint64{50}) {
+		t.Fatalf("got %v, want 50", got)
+	}
+	if words[0] != "ship" {
+		t.Errorf("walked %q's postings first, not the rarest word's", words[0])
+	}
+}
+
+// searchServer has alice in lobby and ops and bob in lobby only, each room
+// with n messages saying "deploy" and one saying something else.
+func searchServer(t *testing.T, n int) (s *server, alice, bob *client) {
+	t.Helper()
+	s = quietServer()
+	alice, bob = addClient(t, s, "alice"), addClient(t, s, "bob")
+	for _, join := range []struct {
+		c    *client
+		room string
+	}{{alice, "lobby"}, {alice, "ops"}, {bob, "lobby"}} {
+		if err := s.users.joinRoom(join.c, join.room); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, room := range []string{"lobby", "ops"} {
+		for i := 0; i < n; i++ {
+			if err := s.users.postRoom(alice, chat(room, fmt.Sprintf("deploy %d in %s", i, room))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.users.postRoom(alice, chat(room, "lunch?")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s, alice, bob
+}
+
+func TestSearchOnlyMembersRooms(t *testing.T) {
+	s, alice, bob := searchServer(t, 3)
+
+	found, _, err := s.users.search(bob, &messages.Search{Query: "deploy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 3 || slices.ContainsFunc(found, func(rc *messages.RoomChat) bool { return rc.GetRoom() != "lobby" }) {
+		t.Errorf("bob found %d, not just lobby's 3", len(found))
+	}
+	if _, _, err := s.users.search(bob, &messages.Search{Query: "deploy", Room: "ops"}); !errors.Is(err, errNotMember) {
+		t.Errorf("bob searching ops: %v, want %v", err, errNotMember)
+	}
+
+	found, _, err = s.users.search(alice, &messages.Search{Query: "deploy"})
+	if err != nil || len(found) != 6 {
+		t.Errorf("alice found %d (%v), want both rooms' 6", len(found), err)
+	}
+	found, _, err = s.users.search(alice, &messages.Search{Query: "deploy", Room: "ops"})
+	if err != nil || len(found) != 3 {
+		t.Errorf("alice found %d in ops (%v), want 3", len(found), err)
+	}
+
+	// and results are copies, not what the room keeps
+	found[0].MessageBody = "tampered"
+	if found, _, _ := s.users.search(alice, &messages.Search{Query: "tampered"}); len(found) != 0 {
+		t.Error("changing a result changed history")
+	}
+}
+
+func TestSearchLimit(t *testing.T) {
+	s, alice, _ := searchServer(t, searchMaxLimit)
+
+	found, truncated, err := s.users.search(alice, &messages.Search{Query: "deploy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != searchDefaultLimit || !truncated {
+		t.Errorf("got %d, truncated %v; want the default %d, truncated", len(found), truncated, searchDefaultLimit)
+	}
+	if !slices.IsSortedFunc(found, func(a, b *messages.RoomChat) int { return int(b.GetMessageId()) - int(a.GetMessageId()) }) {
+		t.Error("results aren't newest first")
+	}
+
+	found, truncated, _ = s.users.search(alice, &messages.Search{Query: "deploy", Limit: 10 * searchMaxLimit})
+	if len(found) != searchMaxLimit || !truncated {
+		t.Errorf("asked for %d, got %d, truncated %v; want at most %d", 10*searchMaxLimit, len(found), truncated, searchMaxLimit)
+	}
+
+	found, truncated, _ = s.users.search(alice, &messages.Search{Query: "deploy", Room: "ops", Limit: searchMaxLimit})
+	if len(found) != searchMaxLimit || truncated {
+		t.Errorf("all %d of ops' fit, got %d, truncated %v", searchMaxLimit, len(found), truncated)
+	}
+}
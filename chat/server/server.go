@@ -2,13 +2,49 @@ package main
 
 import (
 	"chat/messages"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"math"
 	"net"
 	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/proto"
 )
 
-var users = newRegistry()
+// server is one chat server: its registry and everything else a client's
+// frames can reach. main runs one; tests run several in one process.
+type server struct {
+	users   *registry
+	fed     *federation // nil unless federated
+	hooks   *webhooks   // nil unless there are any
+	limiter *rateLimiter
+	gate    *connGate
+	files   *fileStore
+	motd    *motd
+	metrics *serverMetrics
+
+	// registerTimeout is how long a new connection gets to register.
+	registerTimeout time.Duration
+}
+
+func newServer() *server {
+	metrics := newServerMetrics()
+	return &server{
+		users:   newRegistry(metrics),
+		limiter: newRateLimiter(defaultRateLimits(), time.Now),
+		gate:    newConnGate(1000, 16),
+		files:   newFileStore(defaultFileLimits(), time.Now),
+		motd:    &motd{},
+		metrics: metrics,
+
+		registerTimeout: 10 * time.Second,
+	}
+}
 
 func notice(text string) *messages.Wrapper {
 	return &messages.Wrapper{
@@ -26,19 +62,42 @@ func roomNotice(room, text string) *messages.Wrapper {
 	}
 }
 
-func handleClient(msgHandler *messages.MessageHandler) {
+func (s *server) handleClient(msgHandler *messages.MessageHandler, logger *slog.Logger) {
 	defer func() {
-		if c := users.remove(msgHandler); c != nil && c.username != "" {
+		if c := s.users.remove(msgHandler); c != nil && c.username != "" {
 			// announce to all rooms they were in is optional; here we skip, since membership purged
+			s.files.abandon(c.username)
 		}
 		msgHandler.Close()
 	}()
 
+	// Idle sockets that never register don't get to hold a goroutine forever
+	if s.registerTimeout > 0 {
+		_ = msgHandler.SetReadDeadline(time.Now().Add(s.registerTimeout))
+	}
 	first, err := msgHandler.Receive()
 	if err != nil {
-		log.Println("registration read error:", err)
+		logger.Info("registration read error", "err", err)
 		return
 	}
+
+	// Version negotiation. Version 1 clients skip the Hello and register straight away.
+	var features []string
+	if hello := first.GetHello(); hello != nil {
+		var ok bool
+		if features, ok = s.negotiate(msgHandler, hello, logger); !ok {
+			return
+		}
+		if first, err = msgHandler.Receive(); err != nil {
+			logger.Info("registration read error", "err", err)
+			return
+		}
+	} else if messages.MinProtocolVersion > 1 {
+		_ = msgHandler.Send(notice(fmt.Sprintf("Protocol version 1 is no longer supported: send a Hello for version %d or later",
+			messages.MinProtocolVersion)))
+		return
+	}
+
 	reg := first.GetRegistrationMessage()
 	if reg == nil || reg.GetUsername() == "" {
 		_ = msgHandler.Send(notice("You must register with a non-empty username"))
@@ -47,92 +106,424 @@ func handleClient(msgHandler *messages.MessageHandler) {
 	username := reg.GetUsername()
 
 	// Create running client up-front and add
-	c := newClient(msgHandler, username)
-	if err := users.add(c); err != nil {
+	c := s.newClient(msgHandler, username, logger)
+	c.features = features
+	if err := s.users.add(c); err != nil {
+		logger.Info("registration refused", "user", username, "err", err)
 		_ = msgHandler.Send(notice("Registration failed: " + err.Error()))
 		return
 	}
+	msgHandler.SetLogger(c.log)
+	sendMOTD(c)
+	_ = msgHandler.SetReadDeadline(time.Time{})
 
 	// Main loop (room-only + DM)
 	for {
 		wrapper, err := msgHandler.Receive()
 		if err != nil {
-			log.Println("receive error:", err)
+			if err != io.EOF {
+				s.metrics.receiveErrors.Add(1)
+				c.log.Warn("receive error", "err", err)
+			} else {
+				c.log.Info("client hung up")
+			}
 			return
 		}
+		handleMessage(c, wrapper)
+	}
+}
 
-		switch msg := wrapper.Msg.(type) {
-		case *messages.Wrapper_ServerNotice:
-			// ignore client-crafted notices
+// joinRoom adds c to room and tells the room about it.
+func joinRoom(c *client, room string) error {
+	if err := c.srv.users.joinRoom(c, room); err != nil {
+		return err
+	}
+	c.srv.users.broadcastRoom(room, roomNotice(room, fmt.Sprintf("%s joined", c.username)))
+	return nil
+}
 
-		case *messages.Wrapper_RoomJoin:
-			room := msg.RoomJoin.GetRoom()
-			if err := users.joinRoom(c, room); err != nil {
-				_ = msgHandler.Send(notice("Join failed: " + err.Error()))
-				continue
-			}
-			users.broadcastRoom(room, roomNotice(room, fmt.Sprintf("%s joined", username)))
+// leaveRoom removes c from room and tells the remaining members.
+func leaveRoom(c *client, room string) error {
+	if err := c.srv.users.leaveRoom(c, room); err != nil {
+		return err
+	}
+	c.srv.users.broadcastRoom(room, roomNotice(room, fmt.Sprintf("%s left", c.username)))
+	return nil
+}
 
-		case *messages.Wrapper_RoomLeave:
-			room := msg.RoomLeave.GetRoom()
-			if err := users.leaveRoom(c, room); err != nil {
-				_ = msgHandler.Send(notice("Leave failed: " + err.Error()))
-				continue
-			}
-			users.broadcastRoom(room, roomNotice(room, fmt.Sprintf("%s left", username)))
-
-		case *messages.Wrapper_RoomChat:
-			rc := msg.RoomChat
-			room := rc.GetRoom()
-			// overwrite sender
-			rc.Username = username
-
-			// optional membership guard: if not in room, bounce
-			if set, ok := users.rooms[room]; !ok || set[c] == (struct{}{}) == false {
-				_ = msgHandler.Send(&messages.Wrapper{
-					Msg: &messages.Wrapper_ServerNotice{ServerNotice: &messages.ServerNotice{
-						Text: fmt.Sprintf("Join the room first: /join %s", room),
-						Room: room,
-					}},
-				})
-				continue
-			}
+// handleMessage routes one frame from a registered client. It is shared by
+// every front end (native protobuf clients and the IRC gateway).
+func handleMessage(c *client, wrapper *messages.Wrapper) {
+	username := c.username
+	users := c.srv.users
 
-			users.broadcastRoom(room, wrapper)
+	var v verdict
+	switch wrapper.Msg.(type) {
+	case *messages.Wrapper_FileChunk, *messages.Wrapper_FileAccept:
+		v = c.limiter.checkTransfer()
+	default:
+		v = c.limiter.check(proto.Size(wrapper))
+	}
+	switch v {
+	case warnFrame:
+		_ = c.conn.Send(notice("You are sending too fast: slow down or you will be muted"))
+		return
+	case muteFrame:
+		_ = c.conn.Send(notice(fmt.Sprintf("You are muted for %s for flooding", c.srv.limiter.limits.muteFor)))
+		return
+	case mutedFrame:
+		return
+	case kickFrame:
+		_ = c.conn.Send(notice("Disconnected for flooding"))
+		c.disconnect()
+		return
+	}
+
+	// Anything for user@server or room@server goes to that server
+	if c.srv.fed.forward(c, wrapper) {
+		return
+	}
+
+	switch msg := wrapper.Msg.(type) {
+	case *messages.Wrapper_ServerNotice:
+		// ignore client-crafted notices
+
+	case *messages.Wrapper_RoomJoin:
+		if err := joinRoom(c, msg.RoomJoin.GetRoom()); err != nil {
+			_ = c.conn.Send(notice("Join failed: " + err.Error()))
+		}
+
+	case *messages.Wrapper_RoomLeave:
+		if err := leaveRoom(c, msg.RoomLeave.GetRoom()); err != nil {
+			_ = c.conn.Send(notice("Leave failed: " + err.Error()))
+		}
+
+	case *messages.Wrapper_RoomChat:
+		rc := msg.RoomChat
+		room := rc.GetRoom()
+		// overwrite sender and anything else only the server may set
+		rc.Username = username
+		rc.MessageId = 0
+		rc.Edited = false
+		rc.ThreadId = 0
+		rc.ReplyCount = 0
+		rc.Reactions = nil
+		rc.SentAt = time.Now().Unix()
+		rc.ExpiresAt = 0
+		if ttl := time.Duration(rc.GetTtlSeconds()) * time.Second; ttl > 0 {
+			rc.TtlSeconds = uint32(min(ttl, maxTTL) / time.Second)
+			rc.ExpiresAt = rc.SentAt + int64(rc.TtlSeconds)
+		}
+
+		// membership guard: if not in room, bounce
+		if err := users.postRoom(c, wrapper); errors.Is(err, errNotMember) {
+			_ = c.conn.Send(roomNotice(room, fmt.Sprintf("Join the room first: /join %s", room)))
+		} else if errors.Is(err, errRoomBusy) {
+			_ = c.conn.Send(roomNotice(room, "Room is too busy right now: message dropped"))
+		} else if err != nil {
+			_ = c.conn.Send(roomNotice(room, "Message not sent: "+err.Error()))
+		}
+
+	case *messages.Wrapper_Reaction:
+		msg.Reaction.Username = username
+		msg.Reaction.Count = 0
+		if err := users.react(c, wrapper); err != nil {
+			_ = c.conn.Send(roomNotice(msg.Reaction.GetRoom(), "Reaction failed: "+err.Error()))
+		}
+
+	case *messages.Wrapper_Typing:
+		// Well-behaved clients send one every few seconds; anything faster is noise
+		now := time.Now()
+		if now.Sub(c.lastTyping) < minTypingInterval {
+			return
+		}
+		c.lastTyping = now
+		msg.Typing.Username = username
+		users.relayTyping(c, wrapper)
 
-		case *messages.Wrapper_DirectChat:
-			dc := msg.DirectChat
-			// overwrite sender
-			dc.From = username
-			users.direct(dc.GetTo(), wrapper)
+	case *messages.Wrapper_FileOffer:
+		handleFileOffer(c, msg.FileOffer)
 
-		case *messages.Wrapper_RegistrationMessage:
-			_ = msgHandler.Send(notice("Already registered as " + username))
+	case *messages.Wrapper_FileChunk:
+		handleFileChunk(c, msg.FileChunk)
 
-		default:
-			log.Printf("unexpected message type: %T", msg)
+	case *messages.Wrapper_FileAccept:
+		handleFileAccept(c, msg.FileAccept)
+
+	case *messages.Wrapper_RoomRetention:
+		rr := msg.RoomRetention
+		var set *retentionPolicy
+		if rr.GetUpdate() {
+			p := retentionFromProto(rr)
+			set = &p
+		}
+		policy, err := users.retention(c, rr.GetRoom(), set)
+		if err != nil {
+			_ = c.conn.Send(roomNotice(rr.GetRoom(), "Retention: "+err.Error()))
+			return
+		}
+		if set == nil {
+			_ = c.conn.Send(roomNotice(rr.GetRoom(), "This room "+policy.String()))
+		}
+
+	case *messages.Wrapper_Search:
+		q := msg.Search
+		found, truncated, err := users.search(c, q)
+		if err != nil {
+			_ = c.conn.Send(roomNotice(q.GetRoom(), "Search failed: "+err.Error()))
+			return
 		}
+		c.enqueue(&messages.Wrapper{
+			Msg: &messages.Wrapper_SearchResults{
+				SearchResults: &messages.SearchResults{Query: q.GetQuery(), Messages: found, Truncated: truncated},
+			},
+		})
+
+	case *messages.Wrapper_ThreadRequest:
+		tr := msg.ThreadRequest
+		msgs, err := users.thread(c, tr.GetRoom(), tr.GetThreadId())
+		if err != nil {
+			_ = c.conn.Send(roomNotice(tr.GetRoom(), "Thread unavailable: "+err.Error()))
+			return
+		}
+		c.enqueue(&messages.Wrapper{
+			Msg: &messages.Wrapper_ThreadView{
+				ThreadView: &messages.ThreadView{Room: tr.GetRoom(), ThreadId: tr.GetThreadId(), Messages: msgs},
+			},
+		})
+
+	case *messages.Wrapper_EditMessage:
+		msg.EditMessage.Username = username
+		if err := users.editMessage(c, wrapper); err != nil {
+			_ = c.conn.Send(roomNotice(msg.EditMessage.GetRoom(), "Edit failed: "+err.Error()))
+		}
+
+	case *messages.Wrapper_DeleteMessage:
+		msg.DeleteMessage.Username = username
+		if err := users.deleteMessage(c, wrapper); err != nil {
+			_ = c.conn.Send(roomNotice(msg.DeleteMessage.GetRoom(), "Delete failed: "+err.Error()))
+		}
+
+	case *messages.Wrapper_DirectChat:
+		dc := msg.DirectChat
+		// overwrite sender
+		dc.From = username
+		// however the client set it, the TTL is no longer than the sender
+		// says they keep the conversation
+		if age := dc.GetRetention().GetMaxAgeSeconds(); age > 0 && (dc.TtlSeconds == 0 || int64(dc.TtlSeconds) > age) {
+			dc.TtlSeconds = uint32(min(age, math.MaxUint32))
+		}
+		users.direct(dc.GetTo(), wrapper)
+
+	case *messages.Wrapper_PublishKey:
+		// Only X25519 keys, which are always 32 bytes
+		if key := msg.PublishKey.GetPublicKey(); len(key) != 32 {
+			_ = c.conn.Send(notice("Key not published: expected a 32-byte X25519 public key"))
+			return
+		}
+		users.publishKey(c, msg.PublishKey.GetPublicKey())
+		c.log.Debug("public key published")
+
+	case *messages.Wrapper_KeyRequest:
+		name := msg.KeyRequest.GetUsername()
+		c.enqueue(&messages.Wrapper{
+			Msg: &messages.Wrapper_PublishKey{
+				PublishKey: &messages.PublishKey{Username: name, PublicKey: users.publicKey(name)},
+			},
+		})
+
+	case *messages.Wrapper_Command:
+		runCommand(c, msg.Command)
+
+	case *messages.Wrapper_RegistrationMessage:
+		_ = c.conn.Send(notice("Already registered as " + username))
+
+	default:
+		c.log.Warn("unexpected message type", "type", fmt.Sprintf("%T", msg))
 	}
 }
 
+// reject tells a client why it's being turned away, then hangs up.
+func reject(msgHandler *messages.MessageHandler, reason error) {
+	defer msgHandler.Close()
+	deadline := time.Now().Add(rejectTimeout)
+	_ = msgHandler.SetWriteDeadline(deadline)
+	_ = msgHandler.Send(notice("Connection refused: " + reason.Error()))
+	// Swallow the client's first frame: closing with unread data resets the
+	// connection and the client may never see the notice
+	_ = msgHandler.SetReadDeadline(deadline)
+	_, _ = msgHandler.Receive()
+}
+
 func main() {
-	if len(os.Args) < 2 {
-		log.Fatalln("usage: server <port>")
+	srv := newServer()
+	ircAddr := flag.String("irc", "", "also accept IRC clients on this address (e.g. :6667)")
+	flag.StringVar(&srv.motd.path, "motd", "", "send this file to clients after they register (reloaded on SIGHUP)")
+	adminSocket := flag.String("admin", "", "serve the operator console on this Unix socket path")
+	auditPath := flag.String("audit", "", "append a hash-chained audit log of membership events to this file")
+	metricsAddr := flag.String("metrics", "", "serve Prometheus metrics over HTTP at /metrics on this address (e.g. :9100)")
+	flag.Float64Var(&srv.limiter.limits.msgsPerSec, "rate-msgs", srv.limiter.limits.msgsPerSec, "frames per second per connection (0 = unlimited)")
+	flag.IntVar(&srv.limiter.limits.msgBurst, "rate-msg-burst", srv.limiter.limits.msgBurst, "frame burst per connection")
+	flag.Float64Var(&srv.limiter.limits.bytesPerSec, "rate-bytes", srv.limiter.limits.bytesPerSec, "bytes per second per connection (0 = unlimited)")
+	flag.IntVar(&srv.limiter.limits.byteBurst, "rate-byte-burst", srv.limiter.limits.byteBurst, "byte burst per connection")
+	flag.Float64Var(&srv.limiter.limits.roomPerSec, "rate-room", srv.limiter.limits.roomPerSec, "chat messages per second per room (0 = unlimited)")
+	flag.IntVar(&srv.limiter.limits.roomBurst, "rate-room-burst", srv.limiter.limits.roomBurst, "chat message burst per room")
+	flag.DurationVar(&srv.limiter.limits.muteFor, "mute", srv.limiter.limits.muteFor, "how long flooders are muted for")
+	flag.Float64Var(&srv.limiter.limits.transfersPerSec, "rate-transfers", srv.limiter.limits.transfersPerSec, "file chunks per second per connection (0 = unlimited)")
+	flag.Int64Var(&srv.files.limits.maxSize, "file-max", srv.files.limits.maxSize, "largest file upload in bytes (0 = no transfers)")
+	flag.Int64Var(&srv.files.limits.userQuota, "file-quota", srv.files.limits.userQuota, "bytes of uploads one user may have stored (0 = unlimited)")
+	flag.Int64Var(&srv.files.limits.totalQuota, "file-total", srv.files.limits.totalQuota, "bytes of uploads stored across all users (0 = unlimited)")
+	flag.DurationVar(&srv.files.limits.ttl, "file-ttl", srv.files.limits.ttl, "how long uploaded files are kept")
+	flag.IntVar(&srv.users.defaultRetention.keep, "retention-keep", srv.users.defaultRetention.keep, fmt.Sprintf("messages each room keeps by default (at most %d)", historyLimit))
+	flag.DurationVar(&srv.users.defaultRetention.maxAge, "retention-age", srv.users.defaultRetention.maxAge, "drop room messages older than this by default (0 = keep until pushed out)")
+	flag.IntVar(&srv.gate.maxTotal, "max-conns", srv.gate.maxTotal, "maximum open connections (0 = unlimited)")
+	flag.IntVar(&srv.gate.maxPerIP, "max-conns-per-ip", srv.gate.maxPerIP, "maximum open connections per source IP (0 = unlimited)")
+	flag.DurationVar(&srv.registerTimeout, "register-timeout", srv.registerTimeout, "how long a new connection has to register (0 = forever)")
+	node := flag.Uint("node", 0, "this server's ID in a cluster, 1-255")
+	clusterListen := flag.String("cluster-listen", "", "be the cluster's hub, accepting the other nodes on this address")
+	clusterJoin := flag.String("cluster-join", "", "join the cluster whose hub is at this address")
+	clusterSecret := flag.String("cluster-secret", "", "shared secret the nodes of a cluster prove they know to the hub")
+	serverName := flag.String("server-name", "", "how federated servers address this one (user@name, room@name)")
+	peersPath := flag.String("federation", "", "federate with the servers listed in this file, one \"name address secret\" per line")
+	fedListen := flag.String("federation-listen", "", "accept links from federated servers on this address")
+	pluginNames := flag.String("plugins", "", "run these built-in bots, comma-separated: echo, dice, remind, greeter")
+	pluginRooms := flag.String("plugin-rooms", "lobby", "rooms the bots join, comma-separated")
+	webhooksPath := flag.String("webhooks", "", "POST room chat to the webhooks listed in this JSON file")
+	logFormat := flag.String("log-format", "text", "log output format: text or json")
+	logLevel := flag.String("log-level", "info", "log level: debug, info, warn or error (debug traces every frame)")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: server [flags] <port>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := setupLogging(*logFormat, *logLevel); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if *auditPath != "" {
+		sink, err := newAuditSink(*auditPath)
+		if err != nil {
+			fatal("cannot open audit log", "path", *auditPath, "err", err)
+		}
+		srv.users.addSink(sink.record)
+		slog.Info("audit log enabled", "path", *auditPath)
+	}
+
+	if *clusterListen != "" || *clusterJoin != "" {
+		if err := srv.startCluster(uint32(*node), *clusterListen, *clusterJoin, *clusterSecret); err != nil {
+			fatal("cannot start clustering", "err", err)
+		}
+	}
+
+	if *peersPath != "" {
+		if *serverName == "" || strings.Contains(*serverName, "@") {
+			fatal("federation needs a -server-name without @")
+		}
+		var err error
+		if srv.fed, err = loadPeers(srv, *serverName, *peersPath); err != nil {
+			fatal("cannot read federation peers", "path", *peersPath, "err", err)
+		}
+		var ln net.Listener
+		if *fedListen != "" {
+			if ln, err = net.Listen("tcp", *fedListen); err != nil {
+				fatal("listen failed", "addr", *fedListen, "err", err)
+			}
+			slog.Info("federation listening", "addr", *fedListen, "server_name", *serverName)
+		}
+		srv.fed.start(ln)
+	}
+
+	if *webhooksPath != "" {
+		var err error
+		if srv.hooks, err = loadWebhooks(*webhooksPath, srv.fed.serverName(), srv.metrics); err != nil {
+			fatal("cannot read webhooks", "path", *webhooksPath, "err", err)
+		}
+		slog.Info("webhooks enabled", "path", *webhooksPath, "hooks", len(srv.hooks.list))
+	}
+
+	if err := srv.motd.load(); err != nil {
+		fatal("cannot read MOTD", "path", srv.motd.path, "err", err)
 	}
-	addr := ":" + os.Args[1]
+	go srv.motd.reloadOnHangup()
+	go srv.files.expireLoop(time.Minute)
+	go srv.users.runCompactor(compactInterval)
+
+	if *adminSocket != "" {
+		if err := srv.serveAdmin(*adminSocket); err != nil {
+			fatal("cannot start admin console", "path", *adminSocket, "err", err)
+		}
+		slog.Info("admin console listening", "path", *adminSocket)
+	}
+
+	// Bots register before anyone can connect, so nobody takes their names
+	if *pluginNames != "" {
+		if err := srv.startPlugins(splitList(*pluginNames), splitList(*pluginRooms)); err != nil {
+			fatal("cannot start plugins", "err", err)
+		}
+	}
+
+	addr := ":" + flag.Arg(0)
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
-		log.Fatalln(err)
+		fatal("listen failed", "addr", addr, "err", err)
 	}
-	log.Println("listening on", addr)
+	slog.Info("listening", "addr", addr)
 
+	if *ircAddr != "" {
+		ircListener, err := net.Listen("tcp", *ircAddr)
+		if err != nil {
+			fatal("listen failed", "addr", *ircAddr, "err", err)
+		}
+		slog.Info("IRC gateway listening", "addr", *ircAddr)
+		go srv.serveIRC(ircListener)
+	}
+
+	if *metricsAddr != "" {
+		slog.Info("metrics listening", "addr", *metricsAddr)
+		go func() {
+			fatal("metrics server failed", "err", srv.serveMetrics(*metricsAddr))
+		}()
+	}
+
+	srv.serve(listener)
+}
+
+// serve accepts native clients on listener until it's closed.
+func (s *server) serve(listener net.Listener) {
 	for {
 		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
-			log.Println("accept error:", err)
+			slog.Warn("accept error", "err", err)
 			continue
 		}
 		msgHandler := messages.NewMessageHandler(conn)
-		go handleClient(msgHandler)
+		logger := connLogger(conn.RemoteAddr(), "native")
+		release, err := s.gate.admit(conn.RemoteAddr())
+		if err != nil {
+			logger.Warn("connection rejected", "err", err)
+			done, ok := s.gate.explain()
+			if !ok {
+				msgHandler.Close()
+				continue
+			}
+			go func() {
+				defer done()
+				reject(msgHandler, err)
+			}()
+			continue
+		}
+		logger.Debug("connection accepted")
+		msgHandler.SetLogger(logger)
+		go func() {
+			defer release()
+			s.handleClient(msgHandler, logger)
+		}()
 	}
 }
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"chat/messages"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// webhookQueueSize is how many events can wait for one hook before
+	// they're dropped.
+	webhookQueueSize = 256
+	// webhookAttempts is how many times an event is tried before giving up,
+	// waiting webhookFirstRetry and then twice as long each time between.
+	webhookAttempts   = 5
+	webhookFirstRetry = time.Second
+	webhookTimeout    = 10 * time.Second
+	// webhookSignatureHeader carries "sha256=" and the hex HMAC-SHA256,
+	// keyed with the hook's secret, of the timestamp, the delivery ID and
+	// the body, joined with dots.
+	webhookSignatureHeader = "X-Gochat-Signature"
+	// webhookTimestampHeader is when the request was sent, in unix seconds.
+	webhookTimestampHeader = "X-Gochat-Timestamp"
+	// webhookDeliveryHeader identifies the event, and stays the same when
+	// it's retried.
+	webhookDeliveryHeader = "X-Gochat-Delivery"
+)
+
+// webhooks are the server's outgoing webhooks. A nil *webhooks has none.
+type webhooks struct {
+	server  string // our federation name, if any, for webhookEvent.Server
+	list    []*webhook
+	client  *http.Client
+	metrics *serverMetrics
+
+	// swapped out in tests
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// webhook is one entry of the -webhooks file: chat in its rooms that
+// contains one of its keywords is POSTed to URL as a webhookEvent.
+type webhook struct {
+	URL      string   `json:"url"`
+	Secret   string   `json:"secret"`
+	Rooms    []string `json:"rooms,omitempty"`    // none means every room
+	Keywords []string `json:"keywords,omitempty"` // none means every message; case doesn't matter
+
+	queue chan []byte // JSON bodies waiting to be sent
+}
+
+// webhookEvent is the body of a webhook request.
+type webhookEvent struct {
+	Event     string `json:"event"` // "room_chat"
+	Server    string `json:"server,omitempty"`
+	Room      string `json:"room"`
+	User      string `json:"user"`
+	MessageID uint64 `json:"message_id"`
+	ReplyTo   uint64 `json:"reply_to,omitempty"`
+	Text      string `json:"text"`
+	SentAt    int64  `json:"sent_at"` // unix seconds
+}
+
+// loadWebhooks reads a JSON array of webhooks from path and starts sending.
+// server is how federated servers address this one, if they do.
+func loadWebhooks(path, server string, metrics *serverMetrics) (*webhooks, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var list []*webhook
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&list); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for i, h := range list {
+		if u, err := url.Parse(h.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("%s: hook %d: url must be http(s)://host/...", path, i+1)
+		}
+		if h.Secret == "" {
+			return nil, fmt.Errorf("%s: hook %d: needs a secret to sign with", path, i+1)
+		}
+		for k, kw := range h.Keywords {
+			h.Keywords[k] = strings.ToLower(kw)
+		}
+	}
+
+	return newWebhooks(server, list, metrics), nil
+}
+
+// newWebhooks starts sending to the hooks in list.
+func newWebhooks(server string, list []*webhook, metrics *serverMetrics) *webhooks {
+	client := &http.Client{Timeout: webhookTimeout, CheckRedirect: noRedirects}
+	wh := &webhooks{server: server, list: list, client: client, metrics: metrics, now: time.Now, sleep: time.Sleep}
+	for _, h := range list {
+		h.queue = make(chan []byte, webhookQueueSize)
+		go h.run(wh)
+	}
+	return wh
+}
+
+func (h *webhook) matches(rc *messages.RoomChat) bool {
+	if len(h.Rooms) > 0 && !slices.Contains(h.Rooms, rc.GetRoom()) {
+		return false
+	}
+	if len(h.Keywords) == 0 {
+		return true
+	}
+	body := strings.ToLower(rc.GetMessageBody())
+	return slices.ContainsFunc(h.Keywords, func(kw string) bool { return strings.Contains(body, kw) })
+}
+
+// roomChat queues rc, just posted on this server, for every hook it
+// matches. It never blocks: the caller holds the room locked. Nothing
+// meant to vanish is sent, whether it self-destructs or its room is
+// ephemeral, as a receiver can't be made to forget it.
+func (wh *webhooks) roomChat(rc *messages.RoomChat, ephemeral bool) {
+	if wh == nil || ephemeral || rc.GetExpiresAt() != 0 {
+		return
+	}
+	var body []byte
+	for _, h := range wh.list {
+		if !h.matches(rc) {
+			continue
+		}
+		if body == nil {
+			body, _ = json.Marshal(webhookEvent{
+				Event:     "room_chat",
+				Server:    wh.server,
+				Room:      rc.GetRoom(),
+				User:      rc.GetUsername(),
+				MessageID: rc.GetMessageId(),
+				ReplyTo:   rc.GetReplyTo(),
+				Text:      rc.GetMessageBody(),
+				SentAt:    rc.GetSentAt(),
+			})
+		}
+		select {
+		case h.queue <- body:
+		default:
+			wh.metrics.webhooksDropped.Add(1)
+			slog.Warn("webhook queue full, event dropped", "url", h.URL, "room", rc.GetRoom())
+		}
+	}
+}
+
+// run sends the hook's events one at a time, so they arrive in order.
+func (h *webhook) run(wh *webhooks) {
+	for body := range h.queue {
+		h.deliver(wh, body)
+	}
+}
+
+// deliver sends body, retrying with backoff while the receiver is
+// unreachable or failing. It reports whether body got there.
+func (h *webhook) deliver(wh *webhooks, body []byte) bool {
+	// The same ID on every attempt, so a receiver can drop an event it has
+	// already handled, retried or replayed
+	raw := make([]byte, 16)
+	_, _ = rand.Read(raw)
+	id := hex.EncodeToString(raw)
+	delay := webhookFirstRetry
+	for attempt := 1; ; attempt++ {
+		err := h.post(wh, id, body)
+		if err == nil {
+			wh.metrics.webhooksDelivered.Add(1)
+			return true
+		}
+		var perm permanentError
+		if errors.As(err, &perm) || attempt == webhookAttempts {
+			wh.metrics.webhooksFailed.Add(1)
+			slog.Warn("webhook delivery failed", "url", h.URL, "attempts", attempt, "err", err)
+			return false
+		}
+		slog.Debug("webhook delivery failed, retrying", "url", h.URL, "attempt", attempt, "retry_in", delay, "err", err)
+		wh.sleep(delay)
+		delay *= 2
+	}
+}
+
+// noRedirects stops a hook being redirected: the signed event would go
+// somewhere its secret was never meant for. A 3xx is a permanent failure.
+func noRedirects(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+
+// permanentError is a response that trying again won't change.
+type permanentError struct{ status string }
+
+func (e permanentError) Error() string { return e.status }
+
+func (h *webhook) post(wh *webhooks, id string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err.Error()}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go-chat-webhook")
+	ts := strconv.FormatInt(wh.now().Unix(), 10)
+	req.Header.Set(webhookTimestampHeader, ts)
+	req.Header.Set(webhookDeliveryHeader, id)
+	req.Header.Set(webhookSignatureHeader, signWebhook(h.Secret, ts, id, body))
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10)) // so the connection can be reused
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return errors.New(resp.Status)
+	default:
+		return permanentError{resp.Status}
+	}
+}
+
+// signWebhook returns the signature header for body, sent at timestamp as
+// delivery id. Receivers should compute the same and compare in constant
+// time, then turn away timestamps that are too old and IDs they've seen.
+func signWebhook(secret, timestamp, id string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + id + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
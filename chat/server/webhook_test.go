@@ -0,0 +1,234 @@
+package main
+
+import (
+	"chat/messages"
+	"crypto/hmac"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testHookSecret = "s3cret"
+
+// hookRequest is what a test receiver was sent.
+type hookRequest struct {
+	header http.Header
+	body   []byte
+}
+
+// hookReceiver answers the nth request (from 0) with status(n), and
+// records them all.
+type hookReceiver struct {
+	mutex    sync.Mutex
+	requests []hookRequest
+}
+
+func (hr *hookReceiver) got() []hookRequest {
+	hr.mutex.Lock()
+	defer hr.mutex.Unlock()
+	return slices.Clone(hr.requests)
+}
+
+// testHook makes a hook posting to a new test receiver, with a fake clock
+// that sleeping moves on. sleeps records how long each retry waited.
+func testHook(t *testing.T, status func(n int) int) (h *webhook, wh *webhooks, hr *hookReceiver, sleeps *[]time.Duration) {
+	t.Helper()
+	hr = &hookReceiver{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		hr.mutex.Lock()
+		n := len(hr.requests)
+		hr.requests = append(hr.requests, hookRequest{header: r.Header.Clone(), body: body})
+		hr.mutex.Unlock()
+		w.WriteHeader(status(n))
+	}))
+	t.Cleanup(srv.Close)
+
+	clock := newFakeClock()
+	sleeps = new([]time.Duration)
+	client := srv.Client()
+	client.CheckRedirect = noRedirects
+	wh = &webhooks{client: client, metrics: newServerMetrics(), now: clock.now, sleep: func(d time.Duration) {
+		*sleeps = append(*sleeps, d)
+		clock.advance(d)
+	}}
+	return &webhook{URL: srv.URL, Secret: testHookSecret}, wh, hr, sleeps
+}
+
+func TestWebhookSignature(t *testing.T) {
+	h, wh, hr, _ := testHook(t, func(int) int { return http.StatusNoContent })
+	body := []byte(`{"event":"room_chat"}`)
+	if !h.deliver(wh, body) {
+		t.Fatal("not delivered")
+	}
+	req := hr.got()[0]
+	ts, id := req.header.Get(webhookTimestampHeader), req.header.Get(webhookDeliveryHeader)
+	if ts != strconv.FormatInt(wh.now().Unix(), 10) {
+		t.Errorf("timestamp %q, want now", ts)
+	}
+	if len(id) != 32 {
+		t.Errorf("delivery ID %q", id)
+	}
+	sig := req.header.Get(webhookSignatureHeader)
+	if !hmac.Equal([]byte(sig), []byte(signWebhook(testHookSecret, ts, id, req.body))) {
+		t.Errorf("signature %q doesn't check out", sig)
+	}
+
+	// none of the three can be changed without the signature breaking
+	for _, other := range []string{
+		signWebhook(testHookSecret, "1", id, req.body),
+		signWebhook(testHookSecret, ts, "replayed", req.body),
+		signWebhook(testHookSecret, ts, id, []byte(`{"event":"forged"}`)),
+		signWebhook("wrong", ts, id, req.body),
+	} {
+		if other == sig {
+			t.Errorf("signature %q also signs something else", sig)
+		}
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	statuses := []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusOK}
+	h, wh, hr, sleeps := testHook(t, func(n int) int { return statuses[n] })
+	if !h.deliver(wh, []byte(`{}`)) {
+		t.Fatal("not delivered in the end")
+	}
+	if want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}; !slices.Equal(*sleeps, want) {
+		t.Errorf("waited %v between attempts, want %v", *sleeps, want)
+	}
+	reqs := hr.got()
+	if len(reqs) != len(statuses) {
+		t.Fatalf("%d attempts, want %d", len(reqs), len(statuses))
+	}
+	first := reqs[0].header
+	for i, req := range reqs[1:] {
+		if req.header.Get(webhookDeliveryHeader) != first.Get(webhookDeliveryHeader) {
+			t.Errorf("retry %d has a new delivery ID", i+1)
+		}
+		if req.header.Get(webhookTimestampHeader) == first.Get(webhookTimestampHeader) {
+			t.Errorf("retry %d is stamped with when the first attempt was sent", i+1)
+		}
+	}
+}
+
+func TestWebhookGivesUp(t *testing.T) {
+	h, wh, hr, sleeps := testHook(t, func(int) int { return http.StatusBadGateway })
+	if h.deliver(wh, []byte(`{}`)) {
+		t.Fatal("delivered to a receiver that always fails")
+	}
+	if n := len(hr.got()); n != webhookAttempts {
+		t.Errorf("%d attempts, want %d", n, webhookAttempts)
+	}
+	if want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second}; !slices.Equal(*sleeps, want) {
+		t.Errorf("waited %v between attempts, want %v", *sleeps, want)
+	}
+}
+
+func TestWebhookPermanentFailures(t *testing.T) {
+	for _, status := range []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusNotFound} {
+		h, wh, hr, sleeps := testHook(t, func(int) int { return status })
+		if h.deliver(wh, []byte(`{}`)) {
+			t.Fatalf("%d counted as delivered", status)
+		}
+		if n := len(hr.got()); n != 1 || len(*sleeps) != 0 {
+			t.Errorf("%d: %d attempts, %d waits; a 4xx isn't worth retrying", status, n, len(*sleeps))
+		}
+	}
+}
+
+func TestWebhookRedirectsArentFollowed(t *testing.T) {
+	h, wh, hr, sleeps := testHook(t, func(int) int { return http.StatusOK })
+	elsewhere := h.URL
+	redirector := httptest.NewServer(http.RedirectHandler(elsewhere, http.StatusTemporaryRedirect))
+	t.Cleanup(redirector.Close)
+	h.URL = redirector.URL
+	if h.deliver(wh, []byte(`{}`)) {
+		t.Fatal("a redirect counted as delivered")
+	}
+	if n := len(hr.got()); n != 0 {
+		t.Errorf("the redirect was followed %d times", n)
+	}
+	if len(*sleeps) != 0 {
+		t.Errorf("waited %v to retry a redirect", *sleeps)
+	}
+}
+
+// hookServer has s post chat in ops to a new test receiver, whose events
+// come out of the channel returned.
+func hookServer(t *testing.T, s *server) <-chan webhookEvent {
+	t.Helper()
+	received := make(chan webhookEvent, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev webhookEvent
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			t.Error(err)
+		}
+		received <- ev
+	}))
+	t.Cleanup(srv.Close)
+	s.hooks = newWebhooks("", []*webhook{{URL: srv.URL, Secret: testHookSecret, Rooms: []string{"ops"}, Keywords: []string{"deploy"}}}, s.metrics)
+	return received
+}
+
+func TestWebhookFromRoomChat(t *testing.T) {
+	s := newServer()
+	received := hookServer(t, s)
+	alice := connect(t, s, "alice")
+	alice.joined("lobby")
+	alice.joined("ops")
+	alice.say("lobby", "deploy in the wrong room")
+	alice.say("ops", "no keyword")
+	alice.say("ops", "Deploy done")
+	alice.expectChat("Deploy done")
+
+	select {
+	case ev := <-received:
+		if ev.Event != "room_chat" || ev.Room != "ops" || ev.User != "alice" || ev.Text != "Deploy done" {
+			t.Errorf("hook got %+v", ev)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("the hook heard nothing")
+	}
+	select {
+	case ev := <-received:
+		t.Errorf("hook also got %+v", ev)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebhookSkipsWhatWontLast(t *testing.T) {
+	s := newServer()
+	received := hookServer(t, s)
+	alice := connect(t, s, "alice")
+	alice.joined("ops")
+
+	alice.send(&messages.Wrapper{Msg: &messages.Wrapper_RoomChat{RoomChat: &messages.RoomChat{
+		Room: "ops", MessageBody: "deploy key is hunter2", TtlSeconds: 60,
+	}}})
+	alice.expectChat("deploy key is hunter2")
+	if _, err := s.users.retention(nil, "ops", &retentionPolicy{ephemeral: true}); err != nil {
+		t.Fatal(err)
+	}
+	alice.say("ops", "deploy off the record")
+	alice.expectChat("deploy off the record")
+	if _, err := s.users.retention(nil, "ops", &retentionPolicy{}); err != nil {
+		t.Fatal(err)
+	}
+	alice.say("ops", "deploy done")
+	alice.expectChat("deploy done")
+
+	select {
+	case ev := <-received:
+		if ev.Text != "deploy done" {
+			t.Errorf("hook got %q, which wasn't meant to last", ev.Text)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("the hook heard nothing")
+	}
+}